@@ -0,0 +1,58 @@
+package koyori
+
+import "time"
+
+// OldestItemAge returns how long ago the first item of the queue was enqueued, counting
+// reserved items and items held back by MinAge. Items whose enqueue time wasn't recorded (see
+// RecordEnqueueTime) are passed over, and it is zero if none of the items it looked at has one.
+func (q *Queue[T]) OldestItemAge() time.Duration {
+	q.lock()
+	defer q.unlock()
+
+	t := q.firstSegment.enqueuedAt(true)
+	if t.IsZero() && q.lastSegment != q.firstSegment && q.middleCount == 0 {
+		t = q.lastSegment.enqueuedAt(true)
+	}
+	return ageSince(t, q.options.now())
+}
+
+// NewestItemAge returns how long ago the last item of the queue was enqueued. Like
+// OldestItemAge, it is zero if the enqueue time isn't known.
+func (q *Queue[T]) NewestItemAge() time.Duration {
+	q.lock()
+	defer q.unlock()
+
+	t := q.lastSegment.enqueuedAt(false)
+	if t.IsZero() && q.lastSegment != q.firstSegment && q.middleCount == 0 {
+		t = q.firstSegment.enqueuedAt(false)
+	}
+	return ageSince(t, q.options.now())
+}
+
+func ageSince(t, now time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	if age := now.Sub(t); age > 0 {
+		return age
+	}
+	return 0
+}
+
+// enqueuedAt returns the enqueue time of the first item of the segment that has one, or of the
+// last one if first isn't set.
+func (s *segment[T]) enqueuedAt(first bool) time.Time {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	for i := range s.entries {
+		pos := i
+		if !first {
+			pos = len(s.entries) - 1 - i
+		}
+		if t := s.entries[pos].enqueuedAt; !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
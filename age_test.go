@@ -0,0 +1,54 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueItemAge(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		RecordEnqueueTime:    true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), queue.OldestItemAge())
+	assert.Equal(t, time.Duration(0), queue.NewestItemAge())
+
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"b", "c", "d", "e"})))
+	assert.GreaterOrEqual(t, queue.OldestItemAge(), 50*time.Millisecond)
+	assert.Less(t, queue.NewestItemAge(), 50*time.Millisecond)
+	assert.Nil(t, queue.Close())
+
+	// Enqueue times are kept across restarts.
+	segments, err := koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.False(t, segments[0].OldestEnqueuedAt.IsZero())
+	assert.True(t, segments[0].OldestEnqueuedAt.Before(segments[0].NewestEnqueuedAt))
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, queue.OldestItemAge(), 50*time.Millisecond)
+	assertDequeue(t, queue, "a")
+	assert.Less(t, queue.OldestItemAge(), 50*time.Millisecond)
+	assert.Greater(t, queue.OldestItemAge(), time.Duration(0))
+	assert.Nil(t, queue.Close())
+
+	// Items enqueued without recording the time have no age.
+	opts.RecordEnqueueTime = false
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 4, []string{"b", "c", "d", "e"})
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assert.Equal(t, time.Duration(0), queue.OldestItemAge())
+	assert.Nil(t, queue.Close())
+}
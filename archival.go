@@ -0,0 +1,221 @@
+package koyori
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveFolder is the subfolder of the queue folder holding the segment files moved there
+// under ArchivePolicy.
+const archiveFolder = "archive"
+
+// archiveCheckInterval is how often archived files are checked against MaxAge.
+const archiveCheckInterval = time.Minute
+
+// ArchivePolicy keeps the segment files the queue is done with, as a record of the items it
+// handled.
+type ArchivePolicy struct {
+	// Enabled moves segment files to the archive subfolder of the queue folder once all of
+	// their items were removed, instead of deleting them. Claimed segments are archived when
+	// they are committed. Segments deleted by Clear aren't archived.
+	//
+	// Archived files are named after the creation time of the segment in unix nanos followed by
+	// the name of the segment file, so they sort in the order they were created. They may be
+	// read with OpenSegment, once decompressed under Gzip. Under HeadFile, the items removed from
+	// the head of a segment aren't recorded in its file, so they still show up there.
+	Enabled bool
+	// Gzip compresses archived files in the background, adding .gz to their names.
+	Gzip bool
+	// MaxAge, if positive, deletes archived files once they were archived longer ago than this.
+	MaxAge time.Duration
+	// MaxBytes, if positive, deletes the oldest archived files while all of them take up more
+	// than this.
+	MaxBytes int64
+}
+
+// archiveFirstSegmentLocked closes the first segment and moves its file to the archive folder.
+func (q *Queue[T]) archiveFirstSegmentLocked() error {
+	seg := q.firstSegment
+	seg.fileLock.Lock()
+	err := seg.closeFilesLocked()
+	seg.fileLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return q.archiveFileLocked(seg.filePath(), seg.segmentNumber, seg.header.createdAt)
+}
+
+// archiveFileLocked moves the file of a segment the queue is done with to the archive folder.
+func (q *Queue[T]) archiveFileLocked(filePath string, number int, createdAt time.Time) error {
+	folderPath := filepath.Join(q.options.FolderPath, archiveFolder)
+	if err := os.MkdirAll(folderPath, q.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create archive folder")
+	}
+	// Segment numbers start over, so the creation time keeps names apart. Segments written by
+	// earlier versions have none, and are named after the time they are archived.
+	if createdAt.IsZero() {
+		createdAt = q.options.now()
+	}
+	archivePath := filepath.Join(folderPath, fmt.Sprintf("%d-%s", createdAt.UnixNano(), q.options.SegmentNaming.filename(number)))
+	if err := os.Rename(filePath, archivePath); err != nil {
+		return errors.Wrap(err, "failed to move segment file to archive folder")
+	}
+	// MaxAge counts from the time the file was archived.
+	now := q.options.now()
+	if err := os.Chtimes(archivePath, now, now); err != nil {
+		return errors.Wrap(err, "failed to set time of archived file")
+	}
+	if err := syncDir(folderPath); err != nil {
+		return errors.Wrap(err, "failed to sync archive folder")
+	}
+	q.archived.notify()
+	return nil
+}
+
+// runArchival compresses and expires archived files whenever segments are archived, and every
+// archiveCheckInterval, until the queue is closed.
+func (q *Queue[T]) runArchival() {
+	defer q.background.Done()
+	ticker := time.NewTicker(archiveCheckInterval)
+	defer ticker.Stop()
+	for {
+		archived := q.archived.wait()
+		// Errors leave the files as they were; the next run tries again.
+		if err := maintainArchive(filepath.Join(q.options.FolderPath, archiveFolder), q.options.ArchivePolicy, q.options.FileMode, q.options.now(), q.closed); err != nil {
+			q.options.logger().Warn("failed to maintain archived segments", "folder", q.options.FolderPath, "err", err)
+		}
+		select {
+		case <-q.closed:
+			return
+		case <-archived:
+		case <-ticker.C:
+		}
+	}
+}
+
+// maintainArchive compresses the files in the archive folder under Gzip, and then deletes those
+// that are too old or don't fit in MaxBytes. It stops early once stop is closed.
+func maintainArchive(folderPath string, policy ArchivePolicy, mode os.FileMode, now time.Time, stop <-chan struct{}) error {
+	entries, err := os.ReadDir(folderPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read archive folder")
+	}
+	type archivedFile struct {
+		path       string
+		size       int64
+		archivedAt time.Time
+	}
+	files := []archivedFile{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		filePath := filepath.Join(folderPath, name)
+		if policy.Gzip && !strings.HasSuffix(name, ".gz") {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if filePath, err = gzipArchivedFile(filePath, mode); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return errors.Wrap(err, "failed to stat archived file")
+		}
+		files = append(files, archivedFile{path: filePath, size: info.Size(), archivedAt: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i].path) < filepath.Base(files[j].path) })
+
+	total := int64(0)
+	for _, file := range files {
+		total += file.size
+	}
+	cutoff := now.Add(-policy.MaxAge)
+	removed := false
+	for _, file := range files {
+		tooOld := policy.MaxAge > 0 && file.archivedAt.Before(cutoff)
+		tooLarge := policy.MaxBytes > 0 && total > policy.MaxBytes
+		if !tooOld && !tooLarge {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			return errors.Wrap(err, "failed to delete archived file")
+		}
+		total -= file.size
+		removed = true
+	}
+	if removed {
+		return errors.Wrap(syncDir(folderPath), "failed to sync archive folder")
+	}
+	return nil
+}
+
+// gzipArchivedFile replaces an archived file with a compressed copy, keeping its time, and
+// returns the path of the copy.
+func gzipArchivedFile(filePath string, mode os.FileMode) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stat archived file")
+	}
+	gzPath := filePath + ".gz"
+	tmpPath := gzPath + ".tmp"
+	if err := writeGzipFile(filePath, tmpPath, mode); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return "", errors.Wrap(err, "failed to set time of compressed file")
+	}
+	if err := os.Rename(tmpPath, gzPath); err != nil {
+		return "", errors.Wrap(err, "failed to replace compressed file")
+	}
+	// The copy must be in place before the original is gone.
+	if err := syncDir(filepath.Dir(filePath)); err != nil {
+		return "", errors.Wrap(err, "failed to sync archive folder")
+	}
+	if err := os.Remove(filePath); err != nil {
+		return "", errors.Wrap(err, "failed to delete uncompressed file")
+	}
+	return gzPath, nil
+}
+
+// writeGzipFile writes a compressed copy of the file at srcPath to dstPath, synced.
+func writeGzipFile(srcPath, dstPath string, mode os.FileMode) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open archived file")
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to create compressed file")
+	}
+	defer dst.Close()
+
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(srcPath)
+	if _, err := io.Copy(zw, src); err != nil {
+		return errors.Wrap(err, "failed to compress archived file")
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "failed to compress archived file")
+	}
+	if err := dst.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync compressed file")
+	}
+	return errors.Wrap(dst.Close(), "failed to close compressed file")
+}
@@ -0,0 +1,120 @@
+package koyori_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func archivedFiles(t *testing.T, folderPath string) []string {
+	files, err := filepath.Glob(filepath.Join(folderPath, "archive", "*"))
+	assert.Nil(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func readArchivedItems(t *testing.T, filePath string) []string {
+	reader, err := koyori.OpenSegment[string](filePath, StringConverter{})
+	assert.Nil(t, err)
+	defer reader.Close()
+	items := []string{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return items
+		}
+		assert.Nil(t, err)
+		if record.Type == koyori.RecordItem {
+			items = append(items, record.Item)
+		}
+	}
+}
+
+func TestQueueArchivePolicy(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		ArchivePolicy:        koyori.ArchivePolicy{Enabled: true},
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeueMany(t, queue, 4, []string{"a", "b", "c", "d"})
+
+	// Drained segments are kept, in the order they were created.
+	files := archivedFiles(t, opts.FolderPath)
+	assert.Len(t, files, 2)
+	assert.Len(t, segmentFiles(t, opts.FolderPath), 1)
+	assert.Equal(t, []string{"a", "b"}, readArchivedItems(t, files[0]))
+	assert.Equal(t, []string{"c", "d"}, readArchivedItems(t, files[1]))
+
+	// Committed claims are archived as well.
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"f", "g"})))
+	claim, err := queue.ClaimSegment()
+	assert.Nil(t, err)
+	assert.Nil(t, claim.Commit())
+	assert.Len(t, archivedFiles(t, opts.FolderPath), 3)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueArchivePolicyRetention(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		ArchivePolicy:        koyori.ArchivePolicy{Enabled: true, Gzip: true},
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assertDequeueMany(t, queue, 6, []string{"a", "b", "c", "d", "e", "f"})
+	assert.Eventually(t, func() bool {
+		files := archivedFiles(t, opts.FolderPath)
+		return len(files) == 3 && filepath.Ext(files[0]) == ".gz" && filepath.Ext(files[2]) == ".gz"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, queue.Close())
+
+	files := archivedFiles(t, opts.FolderPath)
+	compressed, err := os.Open(files[0])
+	assert.Nil(t, err)
+	zr, err := gzip.NewReader(compressed)
+	assert.Nil(t, err)
+	plain := filepath.Join(os.TempDir(), fmt.Sprintf("%d.queue", time.Now().UnixNano()))
+	out, err := os.Create(plain)
+	assert.Nil(t, err)
+	_, err = io.Copy(out, zr)
+	assert.Nil(t, err)
+	assert.Nil(t, out.Close())
+	assert.Nil(t, compressed.Close())
+	assert.Equal(t, []string{"a", "b"}, readArchivedItems(t, plain))
+
+	// Oldest files are deleted first to fit in MaxBytes.
+	info, err := os.Stat(files[2])
+	assert.Nil(t, err)
+	opts.ArchivePolicy.MaxBytes = info.Size()
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		files := archivedFiles(t, opts.FolderPath)
+		return len(files) == 1 && filepath.Base(files[0]) == filepath.Base(info.Name())
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, queue.Close())
+
+	// As are files archived longer ago than MaxAge.
+	opts.ArchivePolicy.MaxAge = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(archivedFiles(t, opts.FolderPath)) == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,280 @@
+package koyori
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// archiveMagic starts every stream written by Export.
+var archiveMagic = []byte("KOYORIA1")
+
+// An archive is archiveMagic, the uvarint-length-prefixed ConverterName of the queue, then a
+// sequence of records, each starting with its kind.
+const (
+	// archiveEnd is followed by the uvarint number of items in the archive.
+	archiveEnd byte = iota
+	// archiveItem is followed by the uvarint length of an envelope record body holding the
+	// item as encoded by the converter, the body and the CRC32-C of the body.
+	archiveItem
+)
+
+// importBatchSize is how many items Import adds at once.
+const importBatchSize = 256
+
+// Export writes every item of the queue, in order, to w as a self-describing archive, which
+// Import reads back into another queue. Items are written as encoded by the converter, along
+// with their headers and enqueue time. Items that are reserved are exported, while those
+// added by EnqueueAt that aren't due yet are not.
+//
+// The queue is locked while the archive is written, so it holds the items of a single point in
+// time.
+func (q *Queue[T]) Export(w io.Writer) error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	aw := archiveWriter{w: bufio.NewWriter(w)}
+	aw.writeHeader(q.options.ConverterName)
+	for _, number := range q.segments {
+		var err error
+		switch number {
+		case q.firstSegment.segmentNumber:
+			err = q.firstSegment.export(&aw)
+		case q.lastSegment.segmentNumber:
+			err = q.lastSegment.export(&aw)
+		default:
+			err = q.exportSegmentLocked(number, &aw)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to export segment (#%d)", number)
+		}
+	}
+	return aw.close()
+}
+
+// exportSegmentLocked exports a segment between the first and the last one, which isn't
+// loaded.
+func (q *Queue[T]) exportSegmentLocked(number int, aw *archiveWriter) error {
+	seg := &segment[T]{
+		folderPath:    q.options.FolderPath,
+		segmentNumber: number,
+		converter:     q.options.Converter,
+		options:       &q.options,
+		readOnly:      true,
+	}
+	if q.isColdLocked(number) {
+		dir, err := q.fetchColdTemp(number)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		seg.folderPath = dir
+	}
+	if err := seg.load(); err != nil {
+		return err
+	}
+	err := seg.export(aw)
+	if closeErr := seg.closeReaderLocked(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// export writes the items of the segment to aw, skipping those lost while loading it.
+func (s *segment[T]) export(aw *archiveWriter) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	lost := map[int]bool{}
+	for _, index := range s.lostIndexes {
+		lost[index] = true
+	}
+	for i := range s.entries {
+		e := &s.entries[i]
+		if lost[e.index] {
+			continue
+		}
+		var data []byte
+		var version byte
+		var err error
+		if data, err = s.readItemLocked(e, true); err == nil {
+			data, err = decompress(s.header.compression, data)
+		}
+		if err == nil {
+			version, data, err = splitSchemaVersion(s.header.flags, data)
+		}
+		if err != nil {
+			return err
+		}
+		env := envelope{enqueuedAt: e.enqueuedAt, attempts: e.attempts, schemaVersion: version}
+		if e.meta != nil {
+			env.headers, env.priority = e.meta.headers, e.meta.priority
+		}
+		if err := aw.writeItem(env, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type archiveWriter struct {
+	w     *bufio.Writer
+	count int
+	err   error
+}
+
+func (aw *archiveWriter) writeHeader(converterName string) {
+	buf := bytes.Buffer{}
+	buf.Write(archiveMagic)
+	writeUvarint(&buf, uint64(len(converterName)))
+	buf.WriteString(converterName)
+	aw.write(buf.Bytes())
+}
+
+func (aw *archiveWriter) writeItem(env envelope, data []byte) error {
+	body := encodeEnvelopeRecord(env, data)
+	buf := bytes.Buffer{}
+	buf.WriteByte(archiveItem)
+	writeUvarint(&buf, uint64(len(body)))
+	aw.write(buf.Bytes())
+	aw.write(body)
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(body, crcTable))
+	aw.write(checksum)
+	aw.count++
+	return aw.err
+}
+
+func (aw *archiveWriter) write(b []byte) {
+	if aw.err == nil {
+		_, aw.err = aw.w.Write(b)
+	}
+}
+
+func (aw *archiveWriter) close() error {
+	buf := bytes.Buffer{}
+	buf.WriteByte(archiveEnd)
+	writeUvarint(&buf, uint64(aw.count))
+	aw.write(buf.Bytes())
+	if aw.err != nil {
+		return errors.Wrap(aw.err, "failed to write archive")
+	}
+	return errors.Wrap(aw.w.Flush(), "failed to write archive")
+}
+
+// Import adds the items of an archive written by Export to the end of the queue, keeping their
+// order, headers and enqueue time. It fails if the archive was exported from a queue with
+// another ConverterName.
+//
+// Items are added as they are read. If the archive turns out to be cut short or corrupt, the
+// items read before that stay in the queue.
+func (q *Queue[T]) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, archiveMagic) {
+		return errors.New("not a koyori archive")
+	}
+	converterName, err := readArchiveBytes(br)
+	if err != nil {
+		return errors.Wrap(err, "failed to read archive header")
+	}
+	if string(converterName) != q.options.ConverterName {
+		return errors.Errorf("archive was exported with converter %q, but the queue uses %q", converterName, q.options.ConverterName)
+	}
+
+	batch := []T{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := q.EnqueueMany(batch)
+		batch = batch[:0]
+		return err
+	}
+	imported := 0
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return errors.Wrap(noEOF(err), "failed to read archive")
+		}
+		if kind == archiveEnd {
+			count, err := binary.ReadUvarint(br)
+			if err != nil {
+				return errors.Wrap(noEOF(err), "failed to read archive")
+			}
+			if count != uint64(imported) {
+				return errors.Errorf("archive holds %d items, but %d were read", count, imported)
+			}
+			return flush()
+		}
+		if kind != archiveItem {
+			return errors.Errorf("unknown archive record %d after %d items", kind, imported)
+		}
+		body, err := readArchiveBytes(br)
+		if err != nil {
+			return errors.Wrap(err, "failed to read archive")
+		}
+		checksum := make([]byte, 4)
+		if _, err := io.ReadFull(br, checksum); err != nil {
+			return errors.Wrap(noEOF(err), "failed to read archive")
+		}
+		if binary.LittleEndian.Uint32(checksum) != crc32.Checksum(body, crcTable) {
+			return errors.Wrapf(ErrCorrupt, "checksum mismatch in archive item %d", imported)
+		}
+		env, data, err := decodeEnvelopeRecord(body)
+		if err != nil {
+			return errors.Wrapf(ErrCorrupt, "archive item %d: %v", imported, err)
+		}
+		var item T
+		if err := unmarshalVersion(q.options.Converter, env.schemaVersion, data, &item); err != nil {
+			return errors.Wrapf(err, "failed to decode archive item %d", imported)
+		}
+		imported++
+		// Imported items are numbered by the queue they are added to.
+		env.sequence = 0
+
+		if env.headers == nil && env.priority == 0 && env.attempts == 0 && env.enqueuedAt.IsZero() {
+			batch = append(batch, item)
+			if len(batch) == importBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if _, err := q.enqueueEnvelope(item, env); err != nil {
+			return err
+		}
+	}
+}
+
+func readArchiveBytes(br *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	if length > maxRecordLength {
+		return nil, errors.Errorf("invalid length %d", length)
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(br, buf)
+	return buf, noEOF(err)
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, as an archive only ends after its end record.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package koyori_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueExportImport(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+		Compression:          koyori.CompressionSnappy,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g", "h"})))
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("i", map[string]string{"k": "v"})))
+	assertDequeue(t, queue, "a")
+	// The item stays in the queue while it is reserved.
+	_, err = queue.Reserve()
+	assert.Nil(t, err)
+
+	archive := bytes.Buffer{}
+	assert.Nil(t, queue.Export(&archive))
+	assert.Nil(t, queue.Close())
+
+	importOpts := opts
+	importOpts.FolderPath = filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	importOpts.Compression = koyori.CompressionNone
+	imported, err := koyori.NewQueue(importOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, imported.Import(bytes.NewReader(archive.Bytes())))
+	assert.Equal(t, 8, imported.Len())
+	assertDequeueMany(t, imported, 7, []string{"b", "c", "d", "e", "f", "g", "h"})
+	msg, err := imported.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "i", msg.Item)
+	assert.Equal(t, map[string]string{"k": "v"}, msg.Headers)
+	assert.False(t, msg.EnqueuedAt.IsZero())
+
+	// A cut archive is detected.
+	err = imported.Import(bytes.NewReader(archive.Bytes()[:archive.Len()-2]))
+	assert.NotNil(t, err)
+	corrupted := append([]byte(nil), archive.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.NotNil(t, imported.Import(bytes.NewReader(corrupted)))
+	assert.NotNil(t, imported.Import(bytes.NewReader([]byte("not an archive"))))
+	assert.Nil(t, imported.Close())
+
+	// The converter names must match.
+	otherOpts := importOpts
+	otherOpts.FolderPath = filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	otherOpts.ConverterName = "other"
+	other, err := koyori.NewQueue(otherOpts)
+	assert.Nil(t, err)
+	assert.NotNil(t, other.Import(bytes.NewReader(archive.Bytes())))
+	assert.Equal(t, 0, other.Len())
+	assert.Nil(t, other.Close())
+}
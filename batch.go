@@ -0,0 +1,111 @@
+package koyori
+
+import "github.com/pkg/errors"
+
+// Batch is a group of items handed out by BeginDequeue. The items stay in the queue, invisible
+// to other consumers, until the batch is committed. Uncommitted items are delivered again after
+// the queue is reopened.
+type Batch[T any] struct {
+	Items []T
+
+	queue         *Queue[T]
+	segmentNumber int
+	indexes       []int
+	reservations  []uint64
+	// attempts counts the deliveries of each item, including this one.
+	attempts []int
+}
+
+// BeginDequeue hands out up to count items from the head of the queue without removing them,
+// like Reserve does for a single item. Commit removes all of them for good, while Rollback puts
+// them back in their places.
+//
+// Items are reserved from the oldest segment only, so fewer than count items may be returned
+// even if the queue holds more. It returns ErrEmpty if no item is available.
+func (q *Queue[T]) BeginDequeue(count int) (Batch[T], error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return Batch[T]{}, err
+	}
+	if err := q.beforeDequeueLocked(); err != nil {
+		return Batch[T]{}, err
+	}
+	batch := Batch[T]{queue: q}
+	for len(batch.Items) < count {
+		var item T
+		var reserved entry[T]
+		err := q.skipPoisonLocked(func() error {
+			var err error
+			reserved, err = q.firstSegment.reserve(&item, "")
+			return err
+		})
+		if err == errEmptySegment {
+			break
+		} else if err != nil {
+			// Release what was reserved so far, as the caller never sees the batch
+			_ = q.firstSegment.nackMany(batch.indexes, batch.reservations)
+			return Batch[T]{}, errors.Wrap(err, "failed to reserve from segment")
+		}
+		batch.Items = append(batch.Items, item)
+		batch.indexes = append(batch.indexes, reserved.index)
+		batch.reservations = append(batch.reservations, reserved.reservation)
+		batch.attempts = append(batch.attempts, reserved.attempts)
+	}
+	if len(batch.Items) == 0 {
+		return Batch[T]{}, ErrEmpty
+	}
+	// Dropping items that failed to decode may have moved on to the next segment before the
+	// first item was reserved, but not since.
+	batch.segmentNumber = q.firstSegment.segmentNumber
+	return batch, nil
+}
+
+// Commit removes the items of the batch from the queue. The deletion of all of them is written
+// at once. If the reservation of any item expired, nothing is removed and ErrDeliveryDone is
+// returned.
+func (b Batch[T]) Commit() error {
+	q := b.queue
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != b.segmentNumber {
+		return ErrDeliveryDone
+	}
+	if err := q.firstSegment.ackMany(b.indexes, b.reservations); err != nil {
+		if err == errNotReserved {
+			return ErrDeliveryDone
+		}
+		return errors.Wrap(err, "failed to commit batch")
+	}
+	q.emit(Event{Type: EventDequeue, Count: len(b.indexes)})
+	// Items after the committed ones may only be reachable now.
+	defer q.notifyAdded()
+	return q.closeDrainedSegmentsLocked()
+}
+
+// Rollback returns the items of the batch to the queue at their original positions.
+func (b Batch[T]) Rollback() error {
+	q := b.queue
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != b.segmentNumber {
+		return ErrDeliveryDone
+	}
+	if err := q.firstSegment.nackMany(b.indexes, b.reservations); err != nil {
+		if err == errNotReserved {
+			return ErrDeliveryDone
+		}
+		return errors.Wrap(err, "failed to roll back batch")
+	}
+	q.notifyAdded()
+	return nil
+}
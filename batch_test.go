@@ -0,0 +1,61 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueBeginDequeue(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+
+	batch, err := queue.BeginDequeue(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, batch.Items)
+	assertDequeue(t, queue, "c")
+	assert.Nil(t, batch.Rollback())
+	assert.Equal(t, koyori.ErrDeliveryDone, batch.Commit())
+
+	// Only the items of the oldest segment are handed out
+	batch, err = queue.BeginDequeue(5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, batch.Items)
+	assert.Nil(t, queue.Close())
+
+	// The batch was never committed, so it is delivered again.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, queue.Len())
+	batch, err = queue.BeginDequeue(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, batch.Items)
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, koyori.ErrDeliveryDone, batch.Rollback())
+	assert.Equal(t, 2, queue.Len())
+
+	batch, err = queue.BeginDequeue(5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d", "e"}, batch.Items)
+	_, err = queue.BeginDequeue(1)
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+}
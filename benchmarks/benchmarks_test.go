@@ -0,0 +1,230 @@
+package benchmarks_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"testing"
+	"time"
+)
+
+// itemSizes are the sizes of the items the benchmarks run with: small ones, where the cost per
+// item dominates, and large ones, where the cost per byte does.
+var itemSizes = []struct {
+	name string
+	size int
+}{
+	{"small", 64},
+	{"large", 64 << 10},
+}
+
+// batchSize is the number of items enqueued or dequeued at once by the batch workloads.
+const batchSize = 100
+
+// syncPolicies are the ways of flushing writes to disk the enqueue benchmarks run with.
+var syncPolicies = []struct {
+	name string
+	opts []koyori.Option
+}{
+	{"manual", nil},
+	{"buffered", []koyori.Option{koyori.WithWriteBufferSize(64 << 10)}},
+	{"every-100", []koyori.Option{koyori.WithSyncPolicy(koyori.SyncPolicy{Mode: koyori.SyncEveryN, Writes: 100})}},
+	{"interval", []koyori.Option{koyori.WithSyncPolicy(koyori.SyncPolicy{Mode: koyori.SyncInterval, Interval: 10 * time.Millisecond})}},
+	{"every-write", []koyori.Option{koyori.WithSyncPolicy(koyori.SyncPolicy{Mode: koyori.SyncEveryWrite})}},
+}
+
+func openQueue(b *testing.B, folder string, opts ...koyori.Option) *koyori.Queue[[]byte] {
+	b.Helper()
+	queue, err := koyori.NewBytesQueue(folder, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return queue
+}
+
+func closeQueue(b *testing.B, queue *koyori.Queue[[]byte]) {
+	b.Helper()
+	if err := queue.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func makeItem(size int) []byte {
+	item := make([]byte, size)
+	for i := range item {
+		item[i] = byte(i)
+	}
+	return item
+}
+
+func makeBatch(size int) [][]byte {
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = makeItem(size)
+	}
+	return batch
+}
+
+// fill enqueues count items of the given size in batches.
+func fill(b *testing.B, queue *koyori.Queue[[]byte], count, size int) {
+	b.Helper()
+	batch := makeBatch(size)
+	for count > 0 {
+		n := batchSize
+		if n > count {
+			n = count
+		}
+		if _, err := queue.EnqueueMany(batch[:n]); err != nil {
+			b.Fatal(err)
+		}
+		count -= n
+	}
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	for _, size := range itemSizes {
+		b.Run(size.name+"/single", func(b *testing.B) {
+			queue := openQueue(b, b.TempDir())
+			defer closeQueue(b, queue)
+			item := makeItem(size.size)
+			b.SetBytes(int64(size.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := queue.Enqueue(item); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(size.name+"/batch", func(b *testing.B) {
+			queue := openQueue(b, b.TempDir())
+			defer closeQueue(b, queue)
+			batch := makeBatch(size.size)
+			b.SetBytes(int64(size.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i += batchSize {
+				n := batchSize
+				if n > b.N-i {
+					n = b.N - i
+				}
+				if _, err := queue.EnqueueMany(batch[:n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEnqueueSync(b *testing.B) {
+	for _, policy := range syncPolicies {
+		b.Run(policy.name, func(b *testing.B) {
+			queue := openQueue(b, b.TempDir(), policy.opts...)
+			defer closeQueue(b, queue)
+			item := makeItem(itemSizes[0].size)
+			b.SetBytes(int64(len(item)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := queue.Enqueue(item); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDequeue dequeues items read back from disk after the queue was reopened, as a
+// consumer catching up on a backlog does.
+func BenchmarkDequeue(b *testing.B) {
+	for _, size := range itemSizes {
+		for _, batch := range []bool{false, true} {
+			name := size.name + "/single"
+			if batch {
+				name = size.name + "/batch"
+			}
+			b.Run(name, func(b *testing.B) {
+				folder := b.TempDir()
+				queue := openQueue(b, folder)
+				fill(b, queue, b.N, size.size)
+				closeQueue(b, queue)
+				queue = openQueue(b, folder)
+				defer closeQueue(b, queue)
+				b.SetBytes(int64(size.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; {
+					if !batch {
+						if _, err := queue.Dequeue(); err != nil {
+							b.Fatal(err)
+						}
+						i++
+						continue
+					}
+					items, err := queue.DequeueMany(batchSize)
+					if err != nil {
+						b.Fatal(err)
+					}
+					i += len(items)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRawDequeue is BenchmarkDequeue/small/single with pooled buffers.
+func BenchmarkRawDequeue(b *testing.B) {
+	folder := b.TempDir()
+	queue := openQueue(b, folder)
+	fill(b, queue, b.N, itemSizes[0].size)
+	closeQueue(b, queue)
+	raw, err := koyori.NewRawQueue(folder)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer closeQueue(b, raw.Queue)
+	b.SetBytes(int64(itemSizes[0].size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := raw.DequeueBuffer()
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Release()
+	}
+}
+
+// BenchmarkRoundTrip enqueues and dequeues items one at a time on a queue that stays short, as
+// a producer and consumer keeping up with each other do.
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, size := range itemSizes {
+		b.Run(size.name, func(b *testing.B) {
+			queue := openQueue(b, b.TempDir())
+			defer closeQueue(b, queue)
+			item := makeItem(size.size)
+			b.SetBytes(int64(size.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := queue.Enqueue(item); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := queue.Dequeue(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRestart reopens a queue holding a deep backlog, whose segments are all read when it
+// is loaded.
+func BenchmarkRestart(b *testing.B) {
+	for _, backlog := range []int{10000, 100000} {
+		b.Run(fmt.Sprintf("%d", backlog), func(b *testing.B) {
+			folder := b.TempDir()
+			queue := openQueue(b, folder)
+			fill(b, queue, backlog, itemSizes[0].size)
+			closeQueue(b, queue)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				closeQueue(b, openQueue(b, folder))
+			}
+		})
+	}
+}
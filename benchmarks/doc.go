@@ -0,0 +1,45 @@
+// Package benchmarks measures the throughput of koyori queues under realistic workloads. It
+// holds no code of its own; the benchmarks run with
+//
+//	go test -run '^$' -bench . -benchmem ./benchmarks/
+//
+// Every workload runs with small (64 byte) and large (64KiB) items where the size matters:
+//
+//	BenchmarkEnqueue      single items and batches of 100, without syncing
+//	BenchmarkEnqueueSync  small items under each way of flushing writes to disk
+//	BenchmarkDequeue      single items and batches read back from disk after a restart
+//	BenchmarkRawDequeue   small items dequeued into pooled buffers by a RawQueue
+//	BenchmarkRoundTrip    an item enqueued and dequeued at a time on a short queue
+//	BenchmarkRestart      reopening a queue with a backlog of 10000 or 100000 small items
+//
+// To check a change for regressions, run the benchmarks a few times before and after it and
+// compare the results with benchstat (golang.org/x/perf/cmd/benchstat):
+//
+//	go test -run '^$' -bench . -count 6 ./benchmarks/ > old.txt
+//	go test -run '^$' -bench . -count 6 ./benchmarks/ > new.txt
+//	benchstat old.txt new.txt
+//
+// # Baseline
+//
+// Measured on a single-CPU Linux VM (Intel Xeon) with an ext4 disk. Absolute numbers depend on
+// the machine and above all on the disk, so compare runs made on the same one.
+//
+//	BenchmarkEnqueue/small/single        1584 ns/op    40 MB/s
+//	BenchmarkEnqueue/small/batch          632 ns/op   101 MB/s
+//	BenchmarkEnqueue/large/single       66416 ns/op   987 MB/s
+//	BenchmarkEnqueue/large/batch        87321 ns/op   751 MB/s
+//	BenchmarkEnqueueSync/manual          1771 ns/op    36 MB/s
+//	BenchmarkEnqueueSync/buffered        1127 ns/op    57 MB/s
+//	BenchmarkEnqueueSync/every-100       2967 ns/op    22 MB/s
+//	BenchmarkEnqueueSync/interval        2300 ns/op    28 MB/s
+//	BenchmarkEnqueueSync/every-write    59594 ns/op     1 MB/s
+//	BenchmarkDequeue/small/single        1643 ns/op    39 MB/s
+//	BenchmarkDequeue/small/batch          797 ns/op    80 MB/s
+//	BenchmarkDequeue/large/single       43378 ns/op  1511 MB/s
+//	BenchmarkDequeue/large/batch        36536 ns/op  1794 MB/s
+//	BenchmarkRawDequeue                  1963 ns/op    33 MB/s  0 allocs/op
+//	BenchmarkRoundTrip/small             3062 ns/op    21 MB/s
+//	BenchmarkRoundTrip/large            46720 ns/op  1403 MB/s
+//	BenchmarkRestart/10000            1752351 ns/op
+//	BenchmarkRestart/100000          10720246 ns/op
+package benchmarks
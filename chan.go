@@ -0,0 +1,118 @@
+package koyori
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// waitPollInterval is how often a consumer waiting for items checks the queue on its own, for
+// items that become visible without being added, such as through MinAge or EnqueueAt.
+const waitPollInterval = 100 * time.Millisecond
+
+// signal wakes up the goroutines waiting for something to happen to the queue.
+type signal struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+// wait returns a channel closed by the next notify. It must be taken before checking the queue,
+// so changes made in between aren't missed.
+func (s *signal) wait() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+func (s *signal) notify() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// notifyAdded wakes up the consumers waiting for items.
+func (q *Queue[T]) notifyAdded() {
+	q.added.notify()
+}
+
+// DequeueChan returns a channel that receives the items of the queue, waiting for new ones while
+// the queue is empty. The channel is closed once ctx is done, the queue is closed, or reading
+// an item fails, which is reported to QueueOptions.Logger.
+//
+// Items are reserved while they are handed over, and only removed from the queue once they
+// were received from the channel, so items aren't lost when ctx is cancelled.
+func (q *Queue[T]) DequeueChan(ctx context.Context) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for {
+			added := q.added.wait()
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.closed:
+				return
+			default:
+			}
+			delivery, err := q.Reserve()
+			if errors.Is(err, ErrEmpty) {
+				timer := time.NewTimer(waitPollInterval)
+				select {
+				case <-added:
+				case <-timer.C:
+				case <-ctx.Done():
+				case <-q.closed:
+				}
+				timer.Stop()
+				continue
+			}
+			if err != nil {
+				q.options.logger().Warn("dequeue channel stopped", "folder", q.options.FolderPath, "err", err)
+				return
+			}
+			select {
+			case out <- delivery.Item:
+				err = delivery.Ack()
+			case <-ctx.Done():
+				err = delivery.Nack()
+			case <-q.closed:
+				// The reservation goes away with the queue.
+				return
+			}
+			if err != nil {
+				q.options.logger().Warn("dequeue channel stopped", "folder", q.options.FolderPath, "err", err)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// EnqueueFrom enqueues the items received from src until src is closed, which returns nil, or
+// ctx is done, which returns ctx.Err().
+func (q *Queue[T]) EnqueueFrom(ctx context.Context, src <-chan T) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.closed:
+			return ErrClosed
+		case item, ok := <-src:
+			if !ok {
+				return nil
+			}
+			if _, err := q.Enqueue(item); err != nil {
+				return errors.Wrap(err, "failed to enqueue received item")
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package koyori_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueDequeueChan(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	items := queue.DequeueChan(ctx)
+	assert.Equal(t, "a", <-items)
+	assert.Equal(t, "b", <-items)
+	assert.Equal(t, "c", <-items)
+
+	// Waits for items enqueued later on.
+	src := make(chan string)
+	enqueued := make(chan error)
+	go func() { enqueued <- queue.EnqueueFrom(context.Background(), src) }()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		src <- "d"
+		src <- "e"
+		close(src)
+	}()
+	assert.Equal(t, "d", <-items)
+	assert.Equal(t, "e", <-items)
+	assert.Nil(t, <-enqueued)
+
+	// An item not received when ctx is cancelled stays in the queue.
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	for range items {
+	}
+	assert.Equal(t, 1, queue.Len())
+
+	items = queue.DequeueChan(context.Background())
+	assert.Equal(t, "f", <-items)
+	assert.Nil(t, queue.Close())
+	_, ok := <-items
+	assert.False(t, ok)
+}
+
+func TestQueueEnqueueFromCancel(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	src := make(chan string, 1)
+	src <- "a"
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, queue.EnqueueFrom(ctx, src), context.DeadlineExceeded)
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+}
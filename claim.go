@@ -0,0 +1,197 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrClaimDone is returned when using a SegmentClaim that was already committed or released.
+var ErrClaimDone = errors.New("segment claim was already committed or released")
+
+// SegmentClaim is a segment taken out of the queue by ClaimSegment. Its items are read with
+// Next, and the segment is then either deleted with Commit or put back with Release. A
+// SegmentClaim is meant for a single goroutine.
+type SegmentClaim[T any] struct {
+	queue  *Queue[T]
+	seg    *segment[T]
+	number int
+	pos    int
+	done   bool
+}
+
+// ClaimSegment takes the oldest segment out of the queue as a whole, so that a consumer can read
+// all of its items and then delete its file at once, rather than recording the removal of every
+// item. Consumers claiming segments concurrently each get a different one, and Dequeue goes on
+// with the next segment.
+//
+// Only segments no more items are added to are claimed: if the oldest segment is the one items
+// are enqueued to, ClaimSegment starts a new segment if it is full, and returns ErrEmpty if not.
+// It fails while items of the oldest segment are reserved or belong to a pending transaction,
+// and while consumer groups are registered.
+//
+// The file of a claimed segment is left in place until Commit, so if the process dies before,
+// its items are back at their place in the queue when it is opened again.
+func (q *Queue[T]) ClaimSegment() (*SegmentClaim[T], error) {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return nil, err
+	}
+	if len(q.groups) > 0 {
+		return nil, errors.New("can't claim segments while consumer groups are registered")
+	}
+	seg := q.firstSegment
+	if seg.reservedCount > 0 || len(seg.txns) > 0 {
+		return nil, errors.New("can't claim a segment while items of it are reserved or in a transaction")
+	}
+	if seg.count() == 0 || !q.firstSegmentSealedLocked() {
+		return nil, ErrEmpty
+	}
+	if seg == q.lastSegment {
+		if err := q.addSegmentLocked(); err != nil {
+			return nil, errors.Wrap(err, "failed to add new segment")
+		}
+	}
+	number := q.segments[0]
+	q.segments = q.segments[1:]
+	if err := q.advanceFirstSegmentLocked(); err != nil {
+		return nil, err
+	}
+	// The file is read again without the head file if the claim is released.
+	seg.fileLock.Lock()
+	err := seg.recordHeadInFileLocked()
+	seg.fileLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := seg.close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close segment file")
+	}
+	if q.claimed == nil {
+		q.claimed = map[int]bool{}
+	}
+	q.claimed[number] = true
+	q.emit(Event{Type: EventDequeue, Count: seg.count()})
+	return &SegmentClaim[T]{queue: q, seg: seg, number: number}, nil
+}
+
+// Segment returns the number of the claimed segment.
+func (c *SegmentClaim[T]) Segment() int {
+	return c.number
+}
+
+// Len returns the number of items of the claimed segment.
+func (c *SegmentClaim[T]) Len() int {
+	return c.seg.count()
+}
+
+// Next returns the next item of the claimed segment, or io.EOF after the last one.
+func (c *SegmentClaim[T]) Next() (T, error) {
+	var item T
+	if c.done {
+		return item, ErrClaimDone
+	}
+	s := c.seg
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if c.pos == len(s.entries) {
+		return item, io.EOF
+	}
+	if err := s.decodeLocked(&s.entries[c.pos], &item); err != nil {
+		return item, err
+	}
+	c.pos++
+	return item, nil
+}
+
+// Commit deletes the claimed segment, removing its items for good, or archives it under
+// ArchivePolicy.
+func (c *SegmentClaim[T]) Commit() error {
+	q := c.queue
+	q.lock()
+	defer q.unlock()
+
+	if c.done {
+		return ErrClaimDone
+	}
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	c.seg.fileLock.Lock()
+	err := c.seg.closeReaderLocked()
+	c.seg.fileLock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	if q.options.ArchivePolicy.Enabled {
+		if err := q.archiveFileLocked(c.seg.filePath(), c.number, c.seg.header.createdAt); err != nil {
+			return errors.Wrap(err, "failed to archive segment")
+		}
+	} else if err := os.Remove(c.seg.filePath()); err != nil {
+		return errors.Wrap(err, "failed to delete file")
+	}
+	c.done = true
+	delete(q.claimed, c.number)
+	q.emit(Event{Type: EventSegmentDelete, Segment: c.number})
+	return q.folderChangedLocked()
+}
+
+// Release puts the claimed segment back in the queue, ahead of the segments that were enqueued
+// after it, with all of its items.
+func (c *SegmentClaim[T]) Release() error {
+	q := c.queue
+	q.lock()
+	defer q.unlock()
+
+	if c.done {
+		return ErrClaimDone
+	}
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	c.seg.fileLock.Lock()
+	err := c.seg.closeReaderLocked()
+	c.seg.fileLock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+
+	pos := sort.SearchInts(q.segments, c.number)
+	if pos > 0 {
+		q.middleCount += c.seg.count()
+		q.middleBytes += c.seg.fileSize()
+	} else {
+		// The head file only holds the position of the first segment.
+		q.firstSegment.fileLock.Lock()
+		err := q.firstSegment.recordHeadInFileLocked()
+		q.firstSegment.fileLock.Unlock()
+		if err != nil {
+			return err
+		}
+		seg, err := readSegment(c.number, &q.options)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read segment (#%d)", c.number)
+		}
+		if q.firstSegment != q.lastSegment {
+			if err := q.firstSegment.close(); err != nil {
+				seg.close()
+				return errors.Wrap(err, "failed to close segment file")
+			}
+			q.middleCount += q.firstSegment.count()
+			q.middleBytes += q.firstSegment.fileSize()
+		}
+		q.firstSegment = seg
+	}
+	q.segments = append(q.segments, 0)
+	copy(q.segments[pos+1:], q.segments[pos:])
+	q.segments[pos] = c.number
+	c.done = true
+	delete(q.claimed, c.number)
+	q.emit(Event{Type: EventEnqueue, Count: c.seg.count()})
+	q.notifyAdded()
+	return nil
+}
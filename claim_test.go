@@ -0,0 +1,74 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readClaim(t *testing.T, claim *koyori.SegmentClaim[string]) []string {
+	items := []string{}
+	for {
+		item, err := claim.Next()
+		if err == io.EOF {
+			return items
+		}
+		assert.Nil(t, err)
+		items = append(items, item)
+	}
+}
+
+func TestQueueClaimSegment(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+
+	first, err := queue.ClaimSegment()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, first.Segment())
+	second, err := queue.ClaimSegment()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, second.Segment())
+	assert.Equal(t, []string{"a", "b"}, readClaim(t, first))
+	assert.Equal(t, []string{"c", "d"}, readClaim(t, second))
+	assert.Equal(t, 3, queue.Len())
+	assertDequeue(t, queue, "e")
+
+	assert.Nil(t, first.Commit())
+	assert.Equal(t, koyori.ErrClaimDone, first.Commit())
+	_, err = os.Stat(filepath.Join(opts.FolderPath, "00001.queue"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, second.Release())
+	assert.Equal(t, 4, queue.Len())
+	assertDequeueMany(t, queue, 4, []string{"c", "d", "f", "g"})
+
+	// The segment items are added to is only claimed once full.
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"h", "i"})))
+	claim, err := queue.ClaimSegment()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, claim.Len())
+	_, err = queue.ClaimSegment()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("j")))
+	claim, err = queue.ClaimSegment()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, claim.Len())
+	assert.Nil(t, queue.Close())
+
+	// Items of a claim that wasn't committed are back once the queue is reopened.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"h", "i", "j"})
+	assert.Nil(t, queue.Close())
+}
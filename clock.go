@@ -0,0 +1,55 @@
+package koyori
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the features of a queue that depend on it (see QueueOptions.Clock).
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock is a Clock that only moves when told to, so tests can pass time without waiting
+// for it. It is safe for concurrent use.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock returns a ManualClock that is stopped at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time the clock is stopped at.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = t
+}
+
+// now returns the time of Clock, or the current time if it isn't set.
+func (o *QueueOptions[T]) now() time.Time {
+	if o.Clock == nil {
+		return time.Now()
+	}
+	return o.Clock.Now()
+}
@@ -0,0 +1,60 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueManualClock(t *testing.T) {
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		MinAge:               time.Minute,
+		ItemTTL:              time.Hour,
+		VisibilityTimeout:    10 * time.Minute,
+		Clock:                clock,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+
+	// Items are held back until MinAge passed on the clock.
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Minute, queue.OldestItemAge())
+
+	// Reservations expire once VisibilityTimeout passed.
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	clock.Advance(10 * time.Minute)
+	assert.ErrorIs(t, delivery.Ack(), koyori.ErrDeliveryDone)
+	delivery, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Nil(t, delivery.Ack())
+
+	// Items expire after ItemTTL, and scheduled items come due.
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("b", 2*time.Hour)))
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	clock.Advance(time.Hour + time.Minute)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, 1, queue.ScheduledLen())
+	clock.Advance(time.Hour)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Equal(t, 0, queue.ScheduledLen())
+	clock.Advance(time.Minute)
+	assertDequeue(t, queue, "b")
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State files hold the next sequence number to produce and to consume. They live next to the
+// segment files and are replaced atomically.
+const (
+	producedStateFile = "soak-produced"
+	consumedStateFile = "soak-consumed"
+)
+
+// runWorker opens the queue and produces and consumes concurrently for runFor. With drain,
+// it then stops producing and consumes until the queue is empty, checking that every produced
+// item was seen.
+func runWorker(cfg config, runFor time.Duration, drain, tolerateGap bool) error {
+	options := []koyori.Option{koyori.WithMaxObjectsPerSegment(cfg.segmentSize)}
+	if cfg.alwaysFlush {
+		options = append(options, koyori.WithAlwaysFlush())
+	}
+	// A killed worker (the only kind that leaves a gap) can leave a record torn at the end of
+	// the open segment, which is cut off as the queue opens. Otherwise, any unreadable record
+	// is a bug.
+	recovery := koyori.RecoveryStrict
+	if tolerateGap {
+		recovery = koyori.RecoveryTruncate
+	}
+	options = append(options, koyori.WithRecoveryMode(recovery), koyori.WithOnRecovery(func(event koyori.RecoveryEvent) {
+		fmt.Printf("segment %d: cut off %d bytes at offset %d: %v\n", event.Segment, event.Dropped, event.Offset, event.Err)
+	}))
+	queue, err := koyori.NewJSONQueue[uint64](cfg.dir, options...)
+	if err != nil {
+		return err
+	}
+	// The segment files are only scanned once the queue cut off torn records.
+	produced, err := recoverProducedSeq(cfg.dir)
+	if err != nil {
+		queue.Close()
+		return err
+	}
+	consumed, err := readState(cfg.dir, consumedStateFile)
+	if err != nil {
+		queue.Close()
+		return err
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs <- produce(cfg, queue, &produced, stop)
+	}()
+	consumer := &consumer{cfg: cfg, queue: queue, next: consumed, tolerateGap: tolerateGap}
+	go func() {
+		defer wg.Done()
+		errs <- consumer.run(stop)
+	}()
+	time.Sleep(runFor)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			queue.Close()
+			return err
+		}
+	}
+
+	if drain {
+		if err := consumer.drain(); err != nil {
+			queue.Close()
+			return err
+		}
+		if consumer.next != produced {
+			queue.Close()
+			return fmt.Errorf("lost items %d..%d", consumer.next, produced-1)
+		}
+		fmt.Printf("drained: %d items produced and consumed\n", produced)
+	}
+	return queue.Close()
+}
+
+func produce(cfg config, queue *koyori.Queue[uint64], next *uint64, stop chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		items := make([]uint64, rand.Intn(cfg.batch)+1)
+		for i := range items {
+			items[i] = *next + uint64(i)
+		}
+		if _, err := queue.EnqueueMany(items); err != nil {
+			return fmt.Errorf("enqueue: %v", err)
+		}
+		*next += uint64(len(items))
+		if err := writeState(cfg.dir, producedStateFile, *next); err != nil {
+			return err
+		}
+	}
+}
+
+type consumer struct {
+	cfg         config
+	queue       *koyori.Queue[uint64]
+	next        uint64
+	seenAny     bool
+	tolerateGap bool
+}
+
+func (c *consumer) run(stop chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, err := c.consumeBatch()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (c *consumer) drain() error {
+	for {
+		n, err := c.consumeBatch()
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+func (c *consumer) consumeBatch() (int, error) {
+	items, err := c.queue.DequeueUpTo(rand.Intn(c.cfg.batch) + 1)
+	if err != nil {
+		return 0, fmt.Errorf("dequeue: %v", err)
+	}
+	for _, item := range items {
+		switch {
+		case item < c.next:
+			return 0, fmt.Errorf("item %d was duplicated or reordered (expected %d)", item, c.next)
+		case item > c.next && !c.seenAny && c.tolerateGap:
+			fmt.Printf("items %d..%d were dequeued by a killed worker\n", c.next, item-1)
+		case item > c.next:
+			return 0, fmt.Errorf("lost items %d..%d", c.next, item-1)
+		}
+		c.next = item + 1
+		c.seenAny = true
+	}
+	if len(items) > 0 {
+		if err := writeState(c.cfg.dir, consumedStateFile, c.next); err != nil {
+			return 0, err
+		}
+	}
+	return len(items), nil
+}
+
+// recoverProducedSeq returns the next sequence number to produce. A killed producer may have
+// enqueued items without recording them, so the segment files are scanned as well.
+func recoverProducedSeq(dir string) (uint64, error) {
+	next, err := readState(dir, producedStateFile)
+	if err != nil {
+		return 0, err
+	}
+	if consumed, err := readState(dir, consumedStateFile); err != nil {
+		return 0, err
+	} else if consumed > next {
+		next = consumed
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.queue"))
+	if err != nil {
+		return 0, err
+	}
+	open, err := filepath.Glob(filepath.Join(dir, "*.queue.open"))
+	if err != nil {
+		return 0, err
+	}
+	files = append(files, open...)
+	for _, file := range files {
+		reader, err := koyori.OpenSegment[uint64](file, nil)
+		if err != nil {
+			return 0, err
+		}
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				reader.Close()
+				return 0, fmt.Errorf("%s: %v", file, err)
+			}
+			var seq uint64
+			if record.Type != koyori.RecordItem || json.Unmarshal(record.Data, &seq) != nil {
+				continue
+			}
+			if seq+1 > next {
+				next = seq + 1
+			}
+		}
+		reader.Close()
+	}
+	return next, nil
+}
+
+func readState(dir, name string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeState(dir, name string, value uint64) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(strconv.FormatUint(value, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, name))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+)
+
+func runDiff(args []string) error {
+	flags := newFlagSet("diff")
+	verbose := flags.Bool("v", false, "list every item instead of only the counts")
+	showData := flags.Bool("data", false, "print item data (implies -v)")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected two queue directories")
+	}
+
+	diff, err := koyori.DiffSnapshotsWithNaming(flags.Arg(0), flags.Arg(1), *naming)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added:    %d\n", len(diff.Added))
+	fmt.Printf("consumed: %d\n", len(diff.Consumed))
+	fmt.Printf("pending:  %d\n", len(diff.Pending))
+	if !*verbose && !*showData {
+		return nil
+	}
+	printDiffItems("added", diff.Added, *showData)
+	printDiffItems("consumed", diff.Consumed, *showData)
+	printDiffItems("pending", diff.Pending, *showData)
+	return nil
+}
+
+func printDiffItems(state string, items []koyori.DiffItem, showData bool) {
+	for _, item := range items {
+		sequence := ""
+		if item.Sequence != 0 {
+			sequence = fmt.Sprintf(" seq=%d", item.Sequence)
+		}
+		if showData {
+			fmt.Printf("%-8s %05d:%d%s %q\n", state, item.Segment, item.Index, sequence, item.Data)
+		} else {
+			fmt.Printf("%-8s %05d:%d%s (%d bytes)\n", state, item.Segment, item.Index, sequence, len(item.Data))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decoders render the data of an item for dump. More can be registered here, or items can be
+// piped through any command with -exec.
+var decoders = map[string]func(data []byte) (string, error){
+	"hex":    func(data []byte) (string, error) { return hex.EncodeToString(data), nil },
+	"base64": func(data []byte) (string, error) { return base64.StdEncoding.EncodeToString(data), nil },
+	"string": func(data []byte) (string, error) { return strconv.Quote(string(data)), nil },
+	"json": func(data []byte) (string, error) {
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	},
+	"none": func(data []byte) (string, error) { return fmt.Sprintf("(%d bytes)", len(data)), nil },
+}
+
+var recordTypeNames = map[koyori.RecordType]string{
+	koyori.RecordItem:      "item",
+	koyori.RecordTombstone: "tombstone",
+	koyori.RecordTxnCommit: "commit",
+	koyori.RecordTxnAbort:  "abort",
+	koyori.RecordAck:       "ack",
+	koyori.RecordReserve:   "reserve",
+	koyori.RecordTxnAck:    "txn-ack",
+	koyori.RecordDrop:      "drop",
+}
+
+func runDump(args []string) error {
+	flags := newFlagSet("dump")
+	decoderName := flags.String("decoder", "hex", "how to print item data: "+strings.Join(decoderNames(), ", "))
+	command := flags.String("exec", "", "print item data through this command, which reads an item on stdin")
+	itemsOnly := flags.Bool("items", false, "only print items")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory or segment file")
+	}
+	decode, ok := decoders[*decoderName]
+	if !ok {
+		return fmt.Errorf("unknown decoder %q", *decoderName)
+	}
+	if *command != "" {
+		decode = execDecoder(strings.Fields(*command))
+	}
+
+	files, err := segmentFiles(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := dumpSegment(file, decode, *itemsOnly); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+func dumpSegment(filePath string, decode func([]byte) (string, error), itemsOnly bool) error {
+	reader, err := koyori.OpenSegment[[]byte](filePath, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header := reader.Header()
+	fmt.Printf("# %s: v%d, capacity %d, codec %q, compression %s\n", filePath, header.Version, header.Capacity, header.Codec, header.Compression)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if itemsOnly && record.Type != koyori.RecordItem {
+			continue
+		}
+		line := fmt.Sprintf("%10d %-9s", record.Offset, recordTypeNames[record.Type])
+		switch record.Type {
+		case koyori.RecordItem:
+			rendered, err := decode(record.Data)
+			if err != nil {
+				rendered = fmt.Sprintf("(failed to decode: %v)", err)
+			}
+			if record.Sequence != 0 {
+				line += fmt.Sprintf(" seq=%d", record.Sequence)
+			}
+			if record.TxnID != 0 {
+				line += fmt.Sprintf(" txn=%016x", record.TxnID)
+			}
+			if !record.EnqueuedAt.IsZero() {
+				line += " enqueued=" + record.EnqueuedAt.Format(time.RFC3339Nano)
+			}
+			if len(record.Headers) > 0 {
+				line += fmt.Sprintf(" headers=%v", record.Headers)
+			}
+			line += " " + rendered
+		case koyori.RecordTxnCommit, koyori.RecordTxnAbort:
+			line += fmt.Sprintf(" txn=%016x", record.TxnID)
+		case koyori.RecordAck:
+			line += fmt.Sprintf(" index=%d", record.ItemIndex)
+		case koyori.RecordReserve:
+			line += fmt.Sprintf(" index=%d", record.ItemIndex)
+			if !record.ReservedUntil.IsZero() {
+				line += " until=" + record.ReservedUntil.Format(time.RFC3339Nano)
+			}
+			if record.Consumer != "" {
+				line += " consumer=" + record.Consumer
+			}
+		case koyori.RecordTxnAck:
+			line += fmt.Sprintf(" txn=%016x index=%d", record.TxnID, record.ItemIndex)
+		case koyori.RecordDrop:
+			line += fmt.Sprintf(" count=%d", record.Count)
+		}
+		fmt.Println(line)
+	}
+}
+
+// execDecoder runs command for every item, with the item on its stdin, and prints its output.
+func execDecoder(command []string) func([]byte) (string, error) {
+	return func(data []byte) (string, error) {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return strings.TrimRight(string(out), "\n"), err
+	}
+}
+
+func decoderNames() []string {
+	names := []string{}
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// segmentFiles returns filePath if it is a file, or the segment files named by naming in it,
+// oldest first, if it is a directory.
+func segmentFiles(filePath string, naming koyori.SegmentNaming) ([]string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{filePath}, nil
+	}
+	entries, err := os.ReadDir(filePath)
+	if err != nil {
+		return nil, err
+	}
+	ext := naming.Extension
+	if ext == "" {
+		ext = ".queue"
+	}
+	names := []string{}
+	numbers := map[string]int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".open")
+		if !entry.Type().IsRegular() || !strings.HasPrefix(base, naming.Prefix) || !strings.HasSuffix(base, ext) {
+			continue
+		}
+		digits := strings.TrimSuffix(strings.TrimPrefix(base, naming.Prefix), ext)
+		number, err := strconv.ParseUint(digits, 10, 63)
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+		numbers[name] = int(number)
+	}
+	sort.Slice(names, func(i, j int) bool { return numbers[names[i]] < numbers[names[j]] })
+	files := make([]string, len(names))
+	for i, name := range names {
+		files[i] = filepath.Join(filePath, name)
+	}
+	return files, nil
+}
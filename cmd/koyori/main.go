@@ -0,0 +1,78 @@
+// Command koyori inspects koyori queue directories.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "segments", usage: "segments [naming flags] <dir>", run: runSegments},
+		{name: "count", usage: "count [naming flags] <dir>", run: runCount},
+		{name: "dump", usage: "dump [-decoder name] [-exec command] [-items] [naming flags] <dir or segment file>", run: runDump},
+		{name: "verify", usage: "verify [-repair] [naming flags] <dir>", run: runVerify},
+		{name: "compact", usage: "compact [naming flags] <dir>", run: runCompact},
+		{name: "purge", usage: "purge [-y] [naming flags] <dir>", run: runPurge},
+		{name: "diff", usage: "diff [-v] [-data] [naming flags] <before> <after>", run: runDiff},
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+		if err := cmd.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "koyori %s: %v\n", cmd.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  koyori %s\n", cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "naming flags: -prefix, -width and -ext, for queues with a custom SegmentNaming")
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(os.Stderr, "usage: koyori %s\n", cmd.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// namingFlags adds the flags for the segment file naming of the queue to flags.
+func namingFlags(flags *flag.FlagSet) *koyori.SegmentNaming {
+	naming := &koyori.SegmentNaming{}
+	flags.StringVar(&naming.Prefix, "prefix", "", "prefix of the segment file names")
+	flags.IntVar(&naming.Width, "width", 0, "least number of digits of the segment numbers (default 5)")
+	flags.StringVar(&naming.Extension, "ext", "", "extension of the segment file names (default .queue)")
+	return naming
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"io"
+)
+
+func runCompact(args []string) error {
+	flags := newFlagSet("compact")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory")
+	}
+
+	before, err := queueSize(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	queue, err := openQueue(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	if err := queue.Compact(); err != nil {
+		queue.Close()
+		return err
+	}
+	if err := queue.Close(); err != nil {
+		return err
+	}
+	after, err := queueSize(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("compacted: %d -> %d bytes\n", before, after)
+	return nil
+}
+
+func runPurge(args []string) error {
+	flags := newFlagSet("purge")
+	confirm := flags.Bool("y", false, "remove the items without asking for confirmation")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory")
+	}
+
+	queue, err := openQueue(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	count := queue.Len()
+	if !*confirm {
+		queue.Close()
+		return fmt.Errorf("would remove %d items; run again with -y to do so", count)
+	}
+	if err := queue.Clear(); err != nil {
+		queue.Close()
+		return err
+	}
+	fmt.Printf("removed %d items\n", count)
+	return queue.Close()
+}
+
+// openQueue opens the queue for compact and purge. Unlike the queue's default, RecoveryStrict
+// reports a corrupt segment rather than cutting it off as a side effect; verify -repair is there
+// to repair it.
+func openQueue(folderPath string, naming koyori.SegmentNaming) (*koyori.Queue[[]byte], error) {
+	queue, err := koyori.NewBytesQueue(folderPath, koyori.WithSegmentNaming(naming), koyori.WithRecoveryMode(koyori.RecoveryStrict))
+	if errors.Is(err, koyori.ErrCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%v (see koyori verify)", err)
+	}
+	return queue, err
+}
+
+func queueSize(folderPath string, naming koyori.SegmentNaming) (int64, error) {
+	segments, err := koyori.InspectSegmentsWithNaming(folderPath, naming)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, seg := range segments {
+		size += seg.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runSegments(args []string) error {
+	flags := newFlagSet("segments")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory")
+	}
+
+	segments, err := koyori.InspectSegmentsWithNaming(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tITEMS\tCAPACITY\tSIZE\tVERSION\tCODEC\tCOMPRESSION\tCREATED\tOLDEST ITEM")
+	for _, seg := range segments {
+		created := "-"
+		if !seg.Header.CreatedAt.IsZero() {
+			created = seg.Header.CreatedAt.Format(time.RFC3339)
+		}
+		codec := seg.Header.Codec
+		if codec == "" {
+			codec = "-"
+		}
+		oldest := "-"
+		if !seg.OldestEnqueuedAt.IsZero() {
+			oldest = time.Since(seg.OldestEnqueuedAt).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%05d\t%d\t%d\t%d\tv%d\t%s\t%s\t%s\t%s\n", seg.Number, seg.Items, seg.Header.Capacity,
+			seg.Size, seg.Header.Version, codec, seg.Header.Compression, created, oldest)
+	}
+	return w.Flush()
+}
+
+func runCount(args []string) error {
+	flags := newFlagSet("count")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory")
+	}
+
+	segments, err := koyori.InspectSegmentsWithNaming(flags.Arg(0), *naming)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, seg := range segments {
+		count += seg.Items
+	}
+	fmt.Println(count)
+	return nil
+}
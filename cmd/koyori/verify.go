@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+)
+
+func runVerify(args []string) error {
+	flags := newFlagSet("verify")
+	repair := flags.Bool("repair", false, "cut off records left partially written by a crash, with the queue folder locked")
+	naming := namingFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a queue directory")
+	}
+
+	options := koyori.QueueOptions[[]byte]{FolderPath: flags.Arg(0), SegmentNaming: *naming}
+	verify := koyori.Verify[[]byte]
+	if *repair {
+		verify = koyori.Repair[[]byte]
+	}
+	report, err := verify(options)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, p := range report.Problems {
+		status := "FAIL"
+		if p.Repaired {
+			status = "FIXED"
+		} else if p.Torn {
+			status = "TORN"
+		}
+		if !p.Repaired {
+			failed++
+		}
+		fmt.Printf("%-5s %s at offset %d: %v\n", status, p.Path, p.Offset, p.Err)
+	}
+	fmt.Printf("checked %d segments: %d records, %d items\n", report.Segments, report.Records, report.Items)
+	if failed > 0 {
+		return fmt.Errorf("%d problems found", failed)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package koyori
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// compactFileSuffix is appended to the name of a segment file while its compacted copy is written.
+const compactFileSuffix = ".compact"
+
+// Compact rewrites the first segment of the queue without the items already removed from it,
+// reclaiming their space. Segments are otherwise only deleted once fully drained, which can
+// take long for a slow consumer.
+//
+// The segment is left as it is while any of its items are reserved or belong to a pending
+// EnqueueFanout transaction, and while consumer groups are registered.
+//
+// With a VersionedConverter, the items of the segment encoded with an earlier schema version
+// are rewritten in the current one, even if none were removed.
+//
+// Under RenumberSegments, the segment files are then renamed to 1, 2, and so on once the
+// number of the first segment exceeds the number of segments.
+func (q *Queue[T]) Compact() error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	return q.compactLocked(0)
+}
+
+// compactLocked, called with both locks held, compacts the first segment if it has removed items and at least minRemoved
+// of them per live item. With minRemoved 0, a segment whose converter is versioned is compacted
+// regardless, to rewrite its items of earlier schema versions. Segments are then renumbered
+// under RenumberSegments.
+func (q *Queue[T]) compactLocked(minRemoved int) error {
+	if err := q.compactFirstSegmentLocked(minRemoved); err != nil {
+		return err
+	}
+	return q.renumberLocked()
+}
+
+func (q *Queue[T]) compactFirstSegmentLocked(minRemoved int) error {
+	seg := q.firstSegment
+	_, upgrade := seg.converter.(VersionedConverter[T])
+	upgrade = upgrade && minRemoved == 0 && len(seg.entries) > 0
+	if !upgrade && (seg.removeCount == 0 || seg.removeCount < minRemoved*len(seg.entries)) {
+		return nil
+	}
+	if seg.reservedCount > 0 || len(seg.txns) > 0 {
+		return nil
+	}
+	// Compacting renumbers the items, which the cursors of consumer groups refer to.
+	if len(q.groups) > 0 {
+		return nil
+	}
+	return q.rewriteFirstSegmentLocked(nil)
+}
+
+// rewriteFirstSegmentLocked, called with both locks held, replaces the first segment by one
+// holding front followed by its live items.
+//
+// The new file is written next to the segment file and renamed over it, so a crash leaves either
+// file in place. The segment is closed before, as Windows can't replace a file that is open.
+func (q *Queue[T]) rewriteFirstSegmentLocked(front []T) error {
+	seg := q.firstSegment
+	// The items of the new file are indexed anew, so the head position must not apply to it,
+	// whichever of the files the segment is left with.
+	seg.fileLock.Lock()
+	err := seg.recordHeadInFileLocked()
+	seg.fileLock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath, err := seg.writeCompacted(front)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rewrite segment (#%d)", seg.segmentNumber)
+	}
+	defer os.Remove(tmpPath)
+	if err := seg.close(); err != nil {
+		return errors.Wrap(err, "failed to close segment file")
+	}
+	renameErr := os.Rename(tmpPath, seg.filePath())
+	if renameErr == nil {
+		renameErr = syncDir(seg.folderPath)
+	}
+	// The segment is reopened either way, from the old file if it wasn't replaced.
+	compacted, err := readSegment(seg.segmentNumber, &q.options)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read compacted segment (#%d)", seg.segmentNumber)
+	}
+	if q.lastSegment == q.firstSegment {
+		q.lastSegment = compacted
+	}
+	q.firstSegment = compacted
+	return errors.Wrap(renameErr, "failed to replace segment file")
+}
+
+// writeCompacted writes a segment file holding only front followed by the live items of the
+// segment, raising its capacity if they wouldn't fit, and returns its path. The file is synced
+// and placed next to the segment file, for the caller to rename over it.
+func (s *segment[T]) writeCompacted(front []T) (_ string, err error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	header := s.header
+	if count := len(front) + len(s.entries); count > header.capacity {
+		header.capacity = count
+	}
+	header.flags = header.flags&^segmentFlagSchemaVersion | schemaFlags(s.converter)
+	headerBytes, err := header.marshal()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode header")
+	}
+	tmpPath := s.filePath() + compactFileSuffix
+	file, err := createSegmentFileDirect(tmpPath, s.options.FileMode, headerBytes)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create segment file")
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	w := bufio.NewWriter(file)
+	// sequence is the sequence number the next item record is read with; control records
+	// number the item records whose sequence number differs.
+	sequence := header.sequence
+	number := func(buf *bytes.Buffer, itemSequence uint64) {
+		if itemSequence != sequence {
+			appendRecord(buf, currentSegmentFormat, recordKindControl, encodeSequenceControl(itemSequence))
+		}
+		sequence = nthSequence(itemSequence, 1)
+	}
+	for _, object := range front {
+		data, err := s.marshalWithFlags(object, header.flags)
+		if err != nil {
+			return "", err
+		}
+		buf := bytes.Buffer{}
+		number(&buf, 0)
+		appendRecord(&buf, currentSegmentFormat, recordKindItem, data)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return "", errors.Wrap(err, "failed to write object")
+		}
+	}
+	enqueuedAt := time.Time{}
+	for i := range s.entries {
+		e := &s.entries[i]
+		data, err := s.readItemLocked(e, true)
+		if err == nil {
+			data, err = s.upgradeItemLocked(data, header.flags)
+		}
+		if err != nil {
+			return "", err
+		}
+		buf := bytes.Buffer{}
+		if !e.enqueuedAt.IsZero() && !e.enqueuedAt.Equal(enqueuedAt) {
+			enqueuedAt = e.enqueuedAt
+			appendRecord(&buf, currentSegmentFormat, recordKindControl, encodeTimestampControl(enqueuedAt))
+		}
+		if e.meta != nil || e.attempts > 0 {
+			env := envelope{attempts: e.attempts, sequence: e.sequence}
+			if e.meta != nil {
+				env.headers, env.priority = e.meta.headers, e.meta.priority
+			}
+			appendRecord(&buf, currentSegmentFormat, recordKindEnvelope, encodeEnvelopeRecord(env, data))
+		} else {
+			number(&buf, e.sequence)
+			appendRecord(&buf, currentSegmentFormat, recordKindItem, data)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return "", errors.Wrap(err, "failed to write object")
+		}
+	}
+	// The sequence numbers of removed items stay taken, so they aren't given out again once the
+	// queue is reloaded.
+	if sequence != s.sequenceEnd {
+		buf := bytes.Buffer{}
+		appendRecord(&buf, currentSegmentFormat, recordKindControl, encodeSequenceControl(s.sequenceEnd))
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return "", errors.Wrap(err, "failed to write sequence number")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return "", errors.Wrap(err, "failed to write objects")
+	}
+	if err := file.Sync(); err != nil {
+		return "", errors.Wrap(err, "failed to sync file")
+	}
+	return tmpPath, nil
+}
+
+// runCompaction compacts the first segment every CompactInterval until the queue is closed, if at
+// least half of the items it held were removed.
+func (q *Queue[T]) runCompaction() {
+	defer q.background.Done()
+	ticker := time.NewTicker(q.options.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-ticker.C:
+			q.lock()
+			// Errors leave the segment as it was; the next run tries again.
+			if err := q.compactLocked(1); err != nil {
+				q.options.logger().Warn("background compaction failed", "folder", q.options.FolderPath, "err", err)
+			}
+			q.unlock()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileSize(t *testing.T, filePath string) int64 {
+	info, err := os.Stat(filePath)
+	assert.Nil(t, err)
+	return info.Size()
+}
+
+func TestQueueCompact(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 20,
+		MinAge:               time.Nanosecond,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	items := []string{}
+	for i := 0; i < 10; i++ {
+		items = append(items, strings.Repeat(fmt.Sprintf("%d", i), 100))
+	}
+	assert.Nil(t, enqueueErr(queue.EnqueueMany(items)))
+	assertDequeueMany(t, queue, 6, items[:6])
+	segmentPath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	before := fileSize(t, segmentPath)
+
+	assert.Nil(t, queue.Compact())
+	assert.Less(t, fileSize(t, segmentPath), before-500)
+	assert.Equal(t, 4, queue.Len())
+	assertDequeue(t, queue, items[6])
+	assert.Nil(t, enqueueErr(queue.Enqueue("new")))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 4, append(items[7:], "new"))
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueBackgroundCompaction(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		CompactInterval:      10 * time.Millisecond,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	segmentPath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	before := fileSize(t, segmentPath)
+	assertDequeue(t, queue, "a")
+	time.Sleep(50 * time.Millisecond)
+	// One of four items removed isn't worth compacting
+	assert.Equal(t, before+4, fileSize(t, segmentPath))
+
+	assertDequeueMany(t, queue, 2, []string{"b", "c"})
+	time.Sleep(50 * time.Millisecond)
+	assert.Less(t, fileSize(t, segmentPath), before)
+	assertDequeue(t, queue, "d")
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,97 @@
+package koyori
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm items are compressed with before being written to a segment.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+func (c Compression) valid() bool {
+	return c >= CompressionNone && c <= CompressionZstd
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the zstd encoder and decoder shared by all queues. Both are safe for
+// concurrent use through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func compress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return s2.EncodeSnappy(nil, data), nil
+	case CompressionZstd:
+		encoder, _ := zstdCodec()
+		return encoder.EncodeAll(data, nil), nil
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case CompressionSnappy:
+		return s2.Decode(nil, data)
+	case CompressionZstd:
+		_, decoder := zstdCodec()
+		return decoder.DecodeAll(data, nil)
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
@@ -0,0 +1,96 @@
+package koyori
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// gobConverterName is the ConverterName of queues opened without a Converter.
+const gobConverterName = "gob"
+
+// jsonConverter stores items as JSON.
+type jsonConverter[T any] struct{}
+
+func (jsonConverter[T]) Marshal(obj T) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (jsonConverter[T]) Unmarshal(data []byte) (T, error) {
+	var obj T
+	err := json.Unmarshal(data, &obj)
+	return obj, err
+}
+
+// AcceptsViews reports that decoded values never share memory with data.
+func (jsonConverter[T]) AcceptsViews() bool {
+	return true
+}
+
+// rawConverter passes item bytes through unchanged.
+type rawConverter struct{}
+
+func (rawConverter) Marshal(obj []byte) ([]byte, error) {
+	return obj, nil
+}
+
+func (rawConverter) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// UnmarshalInto copies data into the slice dst holds, reusing its capacity.
+func (rawConverter) UnmarshalInto(data []byte, dst *[]byte) error {
+	*dst = append((*dst)[:0], data...)
+	return nil
+}
+
+// AcceptsViews reports that UnmarshalInto, which dequeues use over Unmarshal, copies data.
+func (rawConverter) AcceptsViews() bool {
+	return true
+}
+
+// gobConverter stores items with encoding/gob, for queues opened without a Converter. If T is
+// an interface type, the concrete type of every item is registered with gob.Register as it is
+// enqueued. A process that dequeues items of types it hasn't enqueued itself must register
+// them before, as gob can't decode a type it doesn't know by name.
+type gobConverter[T any] struct{}
+
+// gobRegistered holds the types gobConverter registered.
+var gobRegistered sync.Map
+
+func (gobConverter[T]) Marshal(obj T) ([]byte, error) {
+	if reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Interface {
+		registerGobType(obj)
+	}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(&obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobConverter[T]) Unmarshal(data []byte) (T, error) {
+	var obj T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&obj)
+	return obj, err
+}
+
+// AcceptsViews reports that decoded values never share memory with data.
+func (gobConverter[T]) AcceptsViews() bool {
+	return true
+}
+
+func registerGobType(value any) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		return
+	}
+	if _, done := gobRegistered.LoadOrStore(t, true); done {
+		return
+	}
+	// Register panics if the type was registered under another name, which Decode then uses.
+	defer func() { recover() }()
+	gob.Register(value)
+}
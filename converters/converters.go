@@ -0,0 +1,84 @@
+// Package converters provides ready-made koyori.Converter implementations for common item types.
+package converters
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// JSONConverter stores items as JSON.
+type JSONConverter[T any] struct{}
+
+func (JSONConverter[T]) Marshal(obj T) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (JSONConverter[T]) Unmarshal(data []byte) (T, error) {
+	var obj T
+	err := json.Unmarshal(data, &obj)
+	return obj, err
+}
+
+func (JSONConverter[T]) UnmarshalInto(data []byte, dst *T) error {
+	return json.Unmarshal(data, dst)
+}
+
+// AcceptsViews implements koyori.ViewUnmarshaler: decoded values never share memory with data.
+func (JSONConverter[T]) AcceptsViews() bool {
+	return true
+}
+
+// GobConverter stores items with encoding/gob. Every item carries its own type information,
+// so items stay readable on their own at the cost of a few bytes each.
+type GobConverter[T any] struct{}
+
+func (GobConverter[T]) Marshal(obj T) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobConverter[T]) Unmarshal(data []byte) (T, error) {
+	var obj T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&obj)
+	return obj, err
+}
+
+func (GobConverter[T]) UnmarshalInto(data []byte, dst *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dst)
+}
+
+// AcceptsViews implements koyori.ViewUnmarshaler: decoded values never share memory with data.
+func (GobConverter[T]) AcceptsViews() bool {
+	return true
+}
+
+// StringConverter stores strings as their bytes.
+type StringConverter struct{}
+
+func (StringConverter) Marshal(obj string) ([]byte, error) {
+	return []byte(obj), nil
+}
+
+func (StringConverter) Unmarshal(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// AcceptsViews implements koyori.ViewUnmarshaler: the string is a copy of data.
+func (StringConverter) AcceptsViews() bool {
+	return true
+}
+
+// BytesConverter stores byte slices unchanged.
+type BytesConverter struct{}
+
+func (BytesConverter) Marshal(obj []byte) ([]byte, error) {
+	return obj, nil
+}
+
+func (BytesConverter) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
+}
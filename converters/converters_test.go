@@ -0,0 +1,68 @@
+package converters_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/jungnoh/koyori/converters"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type event struct {
+	ID   int
+	Name string
+}
+
+func roundTrip[T any](t *testing.T, converter koyori.Converter[T], items []T) []T {
+	opts := koyori.QueueOptions[T]{
+		Converter:            converter,
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = queue.EnqueueMany(items)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	defer queue.Close()
+	result, err := queue.DequeueMany(len(items))
+	assert.Nil(t, err)
+	return result
+}
+
+func TestJSONConverter(t *testing.T) {
+	items := []event{{1, "a"}, {2, "b"}}
+	assert.Equal(t, items, roundTrip[event](t, converters.JSONConverter[event]{}, items))
+}
+
+func TestGobConverter(t *testing.T) {
+	items := []event{{1, "a"}, {2, "b"}}
+	assert.Equal(t, items, roundTrip[event](t, converters.GobConverter[event]{}, items))
+}
+
+func TestStringConverter(t *testing.T) {
+	items := []string{"a", "b"}
+	assert.Equal(t, items, roundTrip[string](t, converters.StringConverter{}, items))
+}
+
+func TestBytesConverter(t *testing.T) {
+	items := [][]byte{[]byte("a"), []byte("b")}
+	assert.Equal(t, items, roundTrip[[]byte](t, converters.BytesConverter{}, items))
+}
+
+func TestProtoConverter(t *testing.T) {
+	items := []*wrapperspb.StringValue{wrapperspb.String("a"), wrapperspb.String("b")}
+	result := roundTrip[*wrapperspb.StringValue](t, converters.ProtoConverter[*wrapperspb.StringValue]{}, items)
+	assert.Equal(t, 2, len(result))
+	for i := range items {
+		assert.Equal(t, items[i].GetValue(), result[i].GetValue())
+	}
+}
@@ -0,0 +1,32 @@
+package converters
+
+import "google.golang.org/protobuf/proto"
+
+// ProtoConverter stores protobuf messages in their wire format. T is the pointer type of a
+// generated message, such as *pb.Event.
+type ProtoConverter[T proto.Message] struct{}
+
+func (ProtoConverter[T]) Marshal(obj T) ([]byte, error) {
+	return proto.Marshal(obj)
+}
+
+func (ProtoConverter[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	obj := zero.ProtoReflect().New().Interface().(T)
+	if err := proto.Unmarshal(data, obj); err != nil {
+		return zero, err
+	}
+	return obj, nil
+}
+
+func (c ProtoConverter[T]) UnmarshalInto(data []byte, dst *T) error {
+	if (*dst).ProtoReflect().IsValid() {
+		return proto.Unmarshal(data, *dst)
+	}
+	obj, err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	*dst = obj
+	return nil
+}
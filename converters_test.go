@@ -0,0 +1,57 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type gobPoint struct {
+	X, Y int
+}
+
+type gobLabel struct {
+	Text string
+}
+
+func TestQueueGobFallback(t *testing.T) {
+	opts := koyori.QueueOptions[gobPoint]{
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]gobPoint{{1, 2}, {3, 4}, {5, 6}})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []gobPoint{{1, 2}, {3, 4}, {5, 6}})
+	assert.Nil(t, queue.Close())
+
+	segments, err := koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "gob", segments[0].Header.Codec)
+}
+
+func TestQueueGobFallbackInterface(t *testing.T) {
+	opts := koyori.QueueOptions[any]{
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 4,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]any{gobPoint{1, 2}, gobLabel{"a"}, "b"})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []any{gobPoint{1, 2}, gobLabel{"a"}, "b"})
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,169 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+var ErrDeliveryDone = errors.New("delivery was already acked or nacked")
+
+// Delivery is an item handed out by Reserve. The item stays in the queue, invisible to other
+// consumers, until it is acked. Unacked items are delivered again after the queue is reopened.
+type Delivery[T any] struct {
+	Item T
+	// Attempts counts the deliveries of the item, including this one (see Message.Attempts).
+	Attempts int
+	// Sequence is the sequence number of the item (see Message.Sequence).
+	Sequence uint64
+	// Consumer is the ID given to ReserveAs, or empty.
+	Consumer string
+
+	queue         *Queue[T]
+	segmentNumber int
+	index         int
+	reservation   uint64
+	// headers are kept for Txn.Move.
+	headers map[string]string
+}
+
+// Reserve hands out the first item of the queue without removing it. Ack removes the item for
+// good, while Nack puts it back in its place.
+//
+// With QueueOptions.VisibilityTimeout set, an item that is neither acked nor nacked in time is
+// handed out again, and acking or nacking the expired Delivery returns ErrDeliveryDone.
+//
+// Items are reserved from the oldest segment only: while items of that segment are reserved,
+// neither Reserve nor Dequeue moves on to later segments.
+func (q *Queue[T]) Reserve() (Delivery[T], error) {
+	return q.ReserveAs("")
+}
+
+// ReserveAs is Reserve on behalf of the consumer with the given ID. With VisibilityTimeout set,
+// the ID is stored with the reservation, so that after a crash InFlight tells which consumer
+// held each item that is to be delivered again.
+func (q *Queue[T]) ReserveAs(consumer string) (Delivery[T], error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return Delivery[T]{}, err
+	}
+	if err := q.beforeDequeueLocked(); err != nil {
+		return Delivery[T]{}, err
+	}
+	delivery := Delivery[T]{queue: q}
+	var reserved entry[T]
+	err := q.skipPoisonLocked(func() error {
+		var err error
+		reserved, err = q.firstSegment.reserve(&delivery.Item, consumer)
+		return err
+	})
+	if err != nil {
+		if err == errEmptySegment {
+			return Delivery[T]{}, ErrEmpty
+		}
+		return Delivery[T]{}, errors.Wrap(err, "failed to reserve from segment")
+	}
+	delivery.segmentNumber = q.firstSegment.segmentNumber
+	delivery.index = reserved.index
+	delivery.reservation = reserved.reservation
+	delivery.Attempts = reserved.attempts
+	delivery.Sequence = reserved.sequence
+	delivery.Consumer = consumer
+	if reserved.meta != nil {
+		delivery.headers = reserved.meta.headers
+	}
+	return delivery, nil
+}
+
+// Ack removes the item from the queue.
+func (d Delivery[T]) Ack() error {
+	q := d.queue
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != d.segmentNumber {
+		return ErrDeliveryDone
+	}
+	if err := q.firstSegment.ack(d.index, d.reservation); err != nil {
+		if err == errNotReserved {
+			return ErrDeliveryDone
+		}
+		return errors.Wrap(err, "failed to ack item")
+	}
+	q.emit(Event{Type: EventDequeue, Count: 1})
+	// Items after the acked one may only be reachable now.
+	defer q.notifyAdded()
+	return q.closeDrainedSegmentsLocked()
+}
+
+// Nack returns the item to the queue at its original position.
+func (d Delivery[T]) Nack() error {
+	q := d.queue
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != d.segmentNumber {
+		return ErrDeliveryDone
+	}
+	if err := q.firstSegment.nack(d.index, d.reservation); err != nil {
+		if err == errNotReserved {
+			return ErrDeliveryDone
+		}
+		return errors.Wrap(err, "failed to nack item")
+	}
+	q.notifyAdded()
+	return nil
+}
+
+// Reservation describes an item handed out by Reserve that was neither acked nor nacked.
+type Reservation struct {
+	// Sequence is the sequence number of the item (see Message.Sequence).
+	Sequence uint64
+	// Consumer is the ID given to ReserveAs, or empty.
+	Consumer string
+	// ReservedUntil is when the item is handed out again, or zero without VisibilityTimeout.
+	ReservedUntil time.Time
+	// Attempts counts the deliveries of the item, including the one holding it.
+	Attempts int
+}
+
+// InFlight returns the items that are reserved, in queue order. With VisibilityTimeout set,
+// reservations are kept across restarts: after a crash, it returns the items the consumers were
+// working on, which are delivered again once their reservations expire.
+func (q *Queue[T]) InFlight() ([]Reservation, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return nil, err
+	}
+	return q.firstSegment.reservations(), nil
+}
+
+// reservations returns the items reserved now, releasing those whose reservation expired.
+func (s *segment[T]) reservations() []Reservation {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	now := s.options.now()
+	reservations := []Reservation{}
+	for i := range s.entries {
+		e := &s.entries[i]
+		if s.reservedLocked(e, now) {
+			reservations = append(reservations, Reservation{
+				Sequence:      e.sequence,
+				Consumer:      e.consumer,
+				ReservedUntil: e.reservedUntil,
+				Attempts:      e.attempts,
+			})
+		}
+	}
+	return reservations
+}
@@ -0,0 +1,164 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueReserve(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+
+	a, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	b, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "b", b.Item)
+	assertDequeue(t, queue, "c")
+	assert.Nil(t, b.Ack())
+	assert.Equal(t, koyori.ErrDeliveryDone, b.Ack())
+	assert.Equal(t, 2, queue.Len())
+	assert.Nil(t, queue.Close())
+
+	// a was never acked, so it is delivered again.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queue.Len())
+	a, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	assert.Nil(t, a.Nack())
+	a, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	assert.Nil(t, a.Ack())
+
+	d, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "d", d.Item)
+	_, err = queue.Reserve()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, d.Ack())
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueVisibilityTimeout(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+		VisibilityTimeout:    100 * time.Millisecond,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+
+	expired, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", expired.Item)
+	time.Sleep(150 * time.Millisecond)
+	a, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	assert.Equal(t, koyori.ErrDeliveryDone, expired.Ack())
+	assert.Nil(t, queue.Close())
+
+	// The reservation of a survives reopening the queue.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	b, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "b", b.Item)
+	assert.Nil(t, b.Ack())
+	_, err = queue.Reserve()
+	assert.Equal(t, koyori.ErrEmpty, err)
+
+	time.Sleep(150 * time.Millisecond)
+	a, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	assert.Nil(t, a.Ack())
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueInFlight(t *testing.T) {
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		VisibilityTimeout:    time.Minute,
+		Clock:                clock,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	a, err := queue.ReserveAs("worker-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "worker-1", a.Consumer)
+	b, err := queue.ReserveAs("worker-2")
+	assert.Nil(t, err)
+	assert.Nil(t, b.Ack())
+	c, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "", c.Consumer)
+	assert.Nil(t, queue.Close())
+
+	reader, err := koyori.OpenSegment[string](filepath.Join(opts.FolderPath, "00001.queue.open"), nil)
+	assert.Nil(t, err)
+	consumers := []string{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if record.Type == koyori.RecordReserve {
+			consumers = append(consumers, record.Consumer)
+		}
+	}
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, []string{"worker-1", "worker-2", ""}, consumers)
+
+	// The consumers holding the items are known after reopening the queue.
+	deadline := clock.Now().Add(time.Minute)
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	inFlight, err := queue.InFlight()
+	assert.Nil(t, err)
+	assert.Len(t, inFlight, 2)
+	assert.Equal(t, uint64(1), inFlight[0].Sequence)
+	assert.Equal(t, "worker-1", inFlight[0].Consumer)
+	assert.True(t, deadline.Equal(inFlight[0].ReservedUntil))
+	assert.Equal(t, 1, inFlight[0].Attempts)
+	assert.Equal(t, uint64(3), inFlight[1].Sequence)
+	assert.Equal(t, "", inFlight[1].Consumer)
+
+	clock.Advance(time.Minute)
+	inFlight, err = queue.InFlight()
+	assert.Nil(t, err)
+	assert.Empty(t, inFlight)
+	a, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", a.Item)
+	assert.Equal(t, 2, a.Attempts)
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,128 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// DiffItem is an item found while comparing two queue directories. Items are identified by
+// their sequence number (see Queue.Enqueue), which compaction keeps. Unnumbered items, such as
+// those added by PushFront or written before sequence numbers were introduced, are identified
+// by the segment they are in and their index among the items written to that segment instead.
+type DiffItem struct {
+	Segment  int
+	Index    int
+	Sequence uint64
+	Data     []byte
+}
+
+// SnapshotDiff describes how a queue changed between two copies of its directory.
+type SnapshotDiff struct {
+	// Added holds items that are live in the later directory but not in the earlier one.
+	Added []DiffItem
+	// Consumed holds items that are live in the earlier directory but gone from the later one.
+	Consumed []DiffItem
+	// Pending holds items that are live in both directories.
+	Pending []DiffItem
+}
+
+// DiffSnapshots compares two copies of a queue directory, for example a backup and the live
+// queue, and reports which items were added, consumed or are still pending in between.
+// Item data is reported as stored on disk. Neither directory is modified.
+func DiffSnapshots(before, after string) (SnapshotDiff, error) {
+	return DiffSnapshotsWithNaming(before, after, SegmentNaming{})
+}
+
+// DiffSnapshotsWithNaming is DiffSnapshots for a queue whose segment files are named by naming
+// (see QueueOptions.SegmentNaming).
+func DiffSnapshotsWithNaming(before, after string, naming SegmentNaming) (SnapshotDiff, error) {
+	if err := naming.validate(); err != nil {
+		return SnapshotDiff{}, errors.Wrap(err, "invalid segment naming")
+	}
+	beforeItems, err := readLiveItems(before, naming)
+	if err != nil {
+		return SnapshotDiff{}, errors.Wrapf(err, "failed to read %s", before)
+	}
+	afterItems, err := readLiveItems(after, naming)
+	if err != nil {
+		return SnapshotDiff{}, errors.Wrapf(err, "failed to read %s", after)
+	}
+
+	diff := SnapshotDiff{}
+	for key, item := range beforeItems {
+		if _, ok := afterItems[key]; ok {
+			diff.Pending = append(diff.Pending, item)
+		} else {
+			diff.Consumed = append(diff.Consumed, item)
+		}
+	}
+	for key, item := range afterItems {
+		if _, ok := beforeItems[key]; !ok {
+			diff.Added = append(diff.Added, item)
+		}
+	}
+	sortDiffItems(diff.Added)
+	sortDiffItems(diff.Consumed)
+	sortDiffItems(diff.Pending)
+	return diff, nil
+}
+
+// itemKey identifies an item in both directories, by its sequence number or, for unnumbered
+// items, its position.
+type itemKey struct {
+	sequence uint64
+	segment  int
+	index    int
+}
+
+// readLiveItems reads every segment in the folder without opening it for writing.
+func readLiveItems(folderPath string, naming SegmentNaming) (map[itemKey]DiffItem, error) {
+	segments, err := listSegments(folderPath, naming, nopLogger{})
+	if err != nil {
+		return nil, err
+	}
+	// Under HeadFile, the items removed from the head of a segment are only recorded there. A
+	// head file that can't be read is passed over, as the queue does outside RecoveryStrict.
+	head, err := loadHeadFile(folderPath, defaultFileMode, RecoveryTruncate, nopLogger{})
+	if err != nil {
+		return nil, err
+	}
+	options := &QueueOptions[[]byte]{FolderPath: folderPath, Converter: rawConverter{}, SegmentNaming: naming, headFile: head}
+	items := map[itemKey]DiffItem{}
+	for _, number := range segments {
+		seg := &segment[[]byte]{
+			folderPath:    folderPath,
+			segmentNumber: number,
+			converter:     options.Converter,
+			options:       options,
+			readOnly:      true,
+		}
+		if err := seg.load(); err != nil {
+			return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+		}
+		for i := range seg.entries {
+			var data []byte
+			if err := seg.decodeLocked(&seg.entries[i], &data); err != nil {
+				seg.closeReaderLocked()
+				return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+			}
+			e := &seg.entries[i]
+			key := itemKey{sequence: e.sequence}
+			if e.sequence == 0 {
+				key.segment, key.index = number, e.index
+			}
+			items[key] = DiffItem{Segment: number, Index: e.index, Sequence: e.sequence, Data: data}
+		}
+		seg.closeReaderLocked()
+	}
+	return items, nil
+}
+
+func sortDiffItems(items []DiffItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Segment != items[j].Segment {
+			return items[i].Segment < items[j].Segment
+		}
+		return items[i].Index < items[j].Index
+	})
+}
@@ -0,0 +1,146 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func copyDir(t *testing.T, from, to string) {
+	assert.Nil(t, os.MkdirAll(to, os.ModePerm))
+	entries, err := os.ReadDir(from)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(from, entry.Name()))
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(to, entry.Name()), data, os.ModePerm))
+	}
+}
+
+func diffData(items []koyori.DiffItem) []string {
+	result := []string{}
+	for _, item := range items {
+		result = append(result, string(item.Data))
+	}
+	return result
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "live"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeue(t, queue, "a")
+	copyDir(t, opts.FolderPath, filepath.Join(root, "snapshot"))
+
+	assertDequeueMany(t, queue, 2, []string{"b", "c"})
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"f", "g"})))
+	assert.Nil(t, queue.Close())
+
+	diff, err := koyori.DiffSnapshots(filepath.Join(root, "snapshot"), opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"f", "g"}, diffData(diff.Added))
+	assert.Equal(t, []string{"b", "c"}, diffData(diff.Consumed))
+	assert.Equal(t, []string{"d", "e"}, diffData(diff.Pending))
+	assert.Equal(t, koyori.DiffItem{Segment: 3, Index: 1, Sequence: 6, Data: []byte("f")}, diff.Added[0])
+}
+
+func TestDiffSnapshotsHeadFile(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "live"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		HeadFile:             true,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, queue.Close())
+	copyDir(t, opts.FolderPath, filepath.Join(root, "snapshot"))
+
+	// The removals are only recorded in the head file.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	assert.Nil(t, queue.Close())
+
+	diff, err := koyori.DiffSnapshots(filepath.Join(root, "snapshot"), opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Equal(t, []string{"a", "b"}, diffData(diff.Consumed))
+	assert.Equal(t, []string{"c"}, diffData(diff.Pending))
+}
+
+func TestDiffSnapshotsCompact(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "live"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	assert.Nil(t, queue.Flush())
+	copyDir(t, opts.FolderPath, filepath.Join(root, "snapshot"))
+
+	// Compacting indexes the items left anew, but keeps their sequence numbers.
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	assert.Nil(t, queue.Compact())
+	assert.Nil(t, queue.Close())
+
+	diff, err := koyori.DiffSnapshots(filepath.Join(root, "snapshot"), opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Equal(t, []string{"a", "b"}, diffData(diff.Consumed))
+	assert.Equal(t, []string{"c", "d"}, diffData(diff.Pending))
+}
+
+func TestDiffSnapshotsWithNaming(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	naming := koyori.SegmentNaming{Prefix: "seg-", Width: 8, Extension: ".log"}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "live"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		SegmentNaming:        naming,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, queue.Flush())
+	copyDir(t, opts.FolderPath, filepath.Join(root, "snapshot"))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	assert.Nil(t, queue.Close())
+
+	diff, err := koyori.DiffSnapshotsWithNaming(filepath.Join(root, "snapshot"), opts.FolderPath, naming)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d"}, diffData(diff.Added))
+	assert.Equal(t, []string{"a"}, diffData(diff.Consumed))
+	assert.Equal(t, []string{"b", "c"}, diffData(diff.Pending))
+
+	// The default naming sees no segments at all.
+	diff, err = koyori.DiffSnapshots(filepath.Join(root, "snapshot"), opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Pending)
+}
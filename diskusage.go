@@ -0,0 +1,52 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DiskUsage returns the disk space taken by the queue folder, along with the space taken by each
+// of its segment files by segment number, as du counts it. Segment files take the space of all
+// the items they held until they are deleted, removed items included, as well as the space
+// reserved up front under Preallocate. The total also counts the other files of the queue, such
+// as scheduled items, consumer group cursors, quarantined items and archived segments, but not
+// segments offloaded to ColdStorage.
+func (q *Queue[T]) DiskUsage() (int64, map[int]int64, error) {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return 0, nil, err
+	}
+	total := int64(0)
+	perSegment := map[int]int64{}
+	err := filepath.WalkDir(q.options.FolderPath, func(path string, d fs.DirEntry, err error) error {
+		// Files may be deleted by background work, such as offloading to ColdStorage.
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := diskSize(info)
+		total += size
+		if d.IsDir() || filepath.Dir(path) != filepath.Clean(q.options.FolderPath) {
+			return nil
+		}
+		if number, ok := q.options.SegmentNaming.parse(d.Name()); ok {
+			perSegment[number] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to read queue folder")
+	}
+	return total, perSegment, nil
+}
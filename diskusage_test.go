@@ -0,0 +1,55 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueDiskUsage(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("later", time.Hour)))
+	assert.Nil(t, queue.Flush())
+
+	total, perSegment, err := queue.DiskUsage()
+	assert.Nil(t, err)
+	assert.Len(t, perSegment, 3)
+	sum := int64(0)
+	for _, file := range segmentFiles(t, opts.FolderPath) {
+		info, err := os.Stat(file)
+		assert.Nil(t, err)
+		number := 0
+		fmt.Sscanf(filepath.Base(file), "%d", &number)
+		assert.GreaterOrEqual(t, perSegment[number], info.Size())
+		sum += perSegment[number]
+	}
+	// Scheduled items are counted in the total only.
+	assert.Greater(t, total, sum)
+
+	// Removed items keep taking space until their segment is deleted.
+	assertDequeue(t, queue, "a")
+	_, after, err := queue.DiskUsage()
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, after[1], perSegment[1])
+	assertDequeueMany(t, queue, 2, []string{"b", "c"})
+	_, after, err = queue.DiskUsage()
+	assert.Nil(t, err)
+	assert.NotContains(t, after, 1)
+	assert.Len(t, after, 2)
+
+	assert.Nil(t, queue.Close())
+	_, _, err = queue.DiskUsage()
+	assert.ErrorIs(t, err, koyori.ErrClosed)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package koyori
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskSize returns the space a file takes on disk, counting the blocks allocated to it.
+func diskSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,9 @@
+package koyori
+
+import "os"
+
+// The blocks allocated to a file aren't available from os.FileInfo on Windows, so its size is
+// used instead.
+func diskSize(info os.FileInfo) int64 {
+	return info.Size()
+}
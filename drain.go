@@ -0,0 +1,40 @@
+package koyori
+
+import (
+	"context"
+	"time"
+)
+
+// Drain stops the queue from accepting items, waits until all of its items were consumed or
+// ctx is done, and then closes the queue. Meanwhile, adding items returns ErrDraining, while
+// consumers carry on as usual, including putting items back with Nack or PushFront. Scheduled
+// items count as well, so Drain waits for them to come due and be consumed.
+//
+// If ctx is done first, the queue is closed with the remaining items in place and ctx.Err() is
+// returned. If the queue is closed by someone else while Drain waits, it returns ErrClosed.
+func (q *Queue[T]) Drain(ctx context.Context) error {
+	q.drainOnce.Do(func() { close(q.draining) })
+	for {
+		removed := q.removed.wait()
+		if q.Len() == 0 && q.ScheduledLen() == 0 {
+			return q.Close()
+		}
+		// Expiring items and scheduled items coming due don't wake Drain up, so check now
+		// and then.
+		timer := time.NewTimer(waitPollInterval)
+		select {
+		case <-removed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if err := q.Close(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-q.closed:
+			timer.Stop()
+			return ErrClosed
+		}
+		timer.Stop()
+	}
+}
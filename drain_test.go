@@ -0,0 +1,59 @@
+package koyori_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueDrain(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+
+	drained := make(chan error)
+	go func() { drained <- queue.Drain(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		return errors.Is(enqueueErr(queue.Enqueue("d")), koyori.ErrDraining)
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, enqueueErr(queue.EnqueueAfter("d", time.Second)), koyori.ErrDraining)
+
+	// Consumers carry on until the queue is empty.
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Nil(t, delivery.Nack())
+	select {
+	case <-drained:
+		t.Fatal("Drain returned before the queue was empty")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assertDequeue(t, queue, "c")
+	assert.Nil(t, <-drained)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrClosed)
+
+	// Running out of time closes the queue with the items left.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, queue.Drain(ctx), context.DeadlineExceeded)
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeue(t, queue, "e")
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,74 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// The errors below, together with ErrEmpty and ErrQueueFull, are the conditions callers are
+// expected to handle. Errors returned by the queue may wrap them with more context, so compare
+// with errors.Is rather than ==. Anything else is a failure of the file system or of the
+// Converter, wrapping the error it came from.
+var (
+	// ErrClosed is returned when the queue was closed.
+	ErrClosed = errors.New("queue is closed")
+	// ErrDraining is returned when adding items to a queue that Drain was called on.
+	ErrDraining = errors.New("queue is draining")
+	// ErrCorrupt is returned when a segment file can't be read back, including a
+	// *CorruptRecordError. It is the same error as ErrCorruptRecord.
+	ErrCorrupt = ErrCorruptRecord
+	// ErrLocked is returned when another process holds the queue folder. It is the same error
+	// as ErrQueueLocked.
+	ErrLocked = ErrQueueLocked
+)
+
+// MarshalError is returned by Enqueue and EnqueueMany when the Converter fails to encode an
+// item, or encodes it to more than a record can hold. The items before it were added to the
+// queue, and none after it.
+type MarshalError struct {
+	// Index is the position of the item among those passed to EnqueueMany.
+	Index int
+	Err   error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("failed to encode item %d: %v", e.Index, e.Err)
+}
+
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalError is returned when the Converter fails to decode an item read from a segment.
+type UnmarshalError struct {
+	// Segment is the segment number.
+	Segment int
+	// Offset is the position of the encoded item in the segment file.
+	Offset int64
+	Err    error
+}
+
+func (e *UnmarshalError) Error() string {
+	return fmt.Sprintf("failed to decode item at offset %d of segment %d: %v", e.Offset, e.Segment, e.Err)
+}
+
+func (e *UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// OpenCanceledError is returned by NewQueueContext when its context is done before the queue
+// was opened.
+type OpenCanceledError struct {
+	// SegmentsLoaded is how many of the Segments segment files were read or counted by then.
+	SegmentsLoaded int
+	Segments       int
+	Err            error
+}
+
+func (e *OpenCanceledError) Error() string {
+	return fmt.Sprintf("gave up opening queue after loading %d of %d segments: %v", e.SegmentsLoaded, e.Segments, e.Err)
+}
+
+func (e *OpenCanceledError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,116 @@
+package koyori_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueErrors(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+		MaxItems:             1,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrLocked)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.ErrorIs(t, enqueueErr(queue.Enqueue("b")), koyori.ErrQueueFull)
+
+	closed := make(chan struct{})
+	go func(queue *koyori.Queue[string]) {
+		defer close(closed)
+		time.Sleep(20 * time.Millisecond)
+		queue.Close()
+	}(queue)
+	assert.ErrorIs(t, queue.EnqueueWait(context.Background(), "b"), koyori.ErrClosed)
+	// EnqueueWait may return before Close released the folder.
+	<-closed
+
+	// A deletion marker for an item the segment doesn't hold
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+	file, err := os.OpenFile(filepath.Join(opts.FolderPath, "00001.queue.open"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(make([]byte, 4))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrCorrupt)
+	var corrupt *koyori.CorruptRecordError
+	assert.ErrorAs(t, err, &corrupt)
+}
+
+// pickyConverter fails to encode and decode the item "bad".
+type pickyConverter struct{}
+
+func (pickyConverter) Marshal(v string) ([]byte, error) {
+	if v == "bad" {
+		return nil, errors.New("bad item")
+	}
+	return []byte(v), nil
+}
+
+func (pickyConverter) Unmarshal(v []byte) (string, error) {
+	if string(v) == "bad" {
+		return "", errors.New("bad item")
+	}
+	return string(v), nil
+}
+
+func TestQueueConverterErrors(t *testing.T) {
+	for _, blockSize := range []int{0, 64} {
+		opts := koyori.QueueOptions[string]{
+			Converter:            pickyConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 2,
+			BlockSize:            blockSize,
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		_, err = queue.EnqueueMany([]string{"a", "b", "c", "bad", "d"})
+		var marshalErr *koyori.MarshalError
+		assert.ErrorAs(t, err, &marshalErr)
+		assert.Equal(t, 3, marshalErr.Index)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"d"})))
+		assertDequeueMany(t, queue, 4, []string{"a", "b", "c", "d"})
+		assert.Nil(t, queue.Close())
+	}
+
+	// An item encoded by another converter
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "bad"})))
+	assert.Nil(t, queue.Close())
+	opts.Converter = pickyConverter{}
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	_, err = queue.Dequeue()
+	var unmarshalErr *koyori.UnmarshalError
+	assert.ErrorAs(t, err, &unmarshalErr)
+	assert.Equal(t, 2, unmarshalErr.Segment)
+	assert.True(t, unmarshalErr.Offset > 0)
+	assert.Nil(t, queue.Close())
+}
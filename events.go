@@ -0,0 +1,74 @@
+package koyori
+
+import "time"
+
+// EventType is the kind of an Event passed to QueueOptions.OnEvent.
+type EventType int
+
+const (
+	// EventEnqueue is sent when Count items were added to the end of the queue, including
+	// scheduled items once they are due.
+	EventEnqueue EventType = iota + 1
+	// EventDequeue is sent when Count items were removed from the queue by one of the Dequeue
+	// methods or by acking a Delivery.
+	EventDequeue
+	// EventSegmentCreate is sent when a new segment file was created.
+	EventSegmentCreate
+	// EventSegmentDelete is sent when a segment file was deleted.
+	EventSegmentDelete
+	// EventFlush is sent after Flush synced the open segments, which took Duration.
+	EventFlush
+	// EventRecovery is sent for every record given up on under RecoveryMode, described by
+	// Recovery.
+	EventRecovery
+	// EventDrop is sent when Count items were dropped by OverflowPolicy or PoisonPolicy.
+	EventDrop
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventEnqueue:
+		return "enqueue"
+	case EventDequeue:
+		return "dequeue"
+	case EventSegmentCreate:
+		return "segment create"
+	case EventSegmentDelete:
+		return "segment delete"
+	case EventFlush:
+		return "flush"
+	case EventRecovery:
+		return "recovery"
+	case EventDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to a queue. Only the fields relevant to Type are set.
+type Event struct {
+	Type EventType
+	// Segment is the number of the segment created or deleted.
+	Segment  int
+	Count    int
+	Duration time.Duration
+	Recovery RecoveryEvent
+}
+
+// emit reports an event to the logger and OnEvent, and wakes up the producers waiting for room
+// once items or segments were removed.
+func (q *Queue[T]) emit(event Event) {
+	switch event.Type {
+	case EventDequeue:
+		q.dequeueRate.observe(event.Count)
+		q.removed.notify()
+	case EventSegmentCreate:
+		q.options.logger().Debug("created segment", "folder", q.options.FolderPath, "segment", event.Segment)
+	case EventSegmentDelete:
+		q.removed.notify()
+		q.options.logger().Debug("deleted segment", "folder", q.options.FolderPath, "segment", event.Segment)
+	}
+	if q.options.OnEvent != nil {
+		q.options.OnEvent(event)
+	}
+}
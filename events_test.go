@@ -0,0 +1,51 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueOnEvent(t *testing.T) {
+	events := []koyori.Event{}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		OnEvent:              func(event koyori.Event) { events = append(events, event) },
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"b", "c"})))
+	assert.Nil(t, queue.Flush())
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+
+	types := []koyori.EventType{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []koyori.EventType{
+		koyori.EventSegmentCreate,
+		koyori.EventEnqueue,
+		koyori.EventEnqueue,
+		koyori.EventSegmentCreate,
+		koyori.EventEnqueue,
+		koyori.EventFlush,
+		koyori.EventDequeue,
+		koyori.EventSegmentDelete,
+		koyori.EventDequeue,
+	}, types)
+	assert.Equal(t, 1, events[0].Segment)
+	assert.Equal(t, 1, events[2].Count)
+	assert.Equal(t, 2, events[3].Segment)
+	assert.Equal(t, 2, events[6].Count)
+	assert.Equal(t, 1, events[7].Segment)
+	assert.Equal(t, 1, events[8].Count)
+}
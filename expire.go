@@ -0,0 +1,92 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// beforeDequeueLocked brings the head of the queue up to date before items are taken from it.
+func (q *Queue[T]) beforeDequeueLocked() error {
+	if err := q.promoteDueLocked(); err != nil {
+		return err
+	}
+	return q.expireLocked()
+}
+
+// expireLocked removes the items at the head of the queue that are older than ItemTTL, moving
+// them to DeadLetterQueue if set. Items further back expire once they reach the head.
+func (q *Queue[T]) expireLocked() error {
+	if q.options.ItemTTL <= 0 {
+		return nil
+	}
+	cutoff := q.options.now().Add(-q.options.ItemTTL)
+	dlq := q.options.DeadLetterQueue
+	for {
+		items, indexes, err := q.firstSegment.expired(cutoff, dlq != nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to read expired items")
+		}
+		if len(indexes) == 0 {
+			return nil
+		}
+		if dlq != nil {
+			if _, err := dlq.EnqueueMany(items); err != nil {
+				return errors.Wrap(err, "failed to move expired items to the dead letter queue")
+			}
+		}
+		if err := q.firstSegment.dropIndexes(indexes); err != nil {
+			return errors.Wrap(err, "failed to remove expired items")
+		}
+		if err := q.closeDrainedSegmentsLocked(); err != nil {
+			return errors.Wrap(err, "failed to close segment")
+		}
+	}
+}
+
+// expired returns the indexes of the items at the head of the segment enqueued before cutoff,
+// skipping reserved ones and those without an enqueue time. With decode set, the items are returned as well.
+func (s *segment[T]) expired(cutoff time.Time, decode bool) ([]T, []int, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	legacy := s.header.version < segmentFormatV1
+	now := s.options.now()
+	items := []T{}
+	indexes := []int{}
+	for i := range s.entries {
+		e := &s.entries[i]
+		if e.enqueuedAt.IsZero() {
+			// The item was added without an enqueue time, such as by a queue opened without
+			// ItemTTL, and never expires. Items behind it still do.
+			if legacy {
+				break
+			}
+			continue
+		}
+		if !e.enqueuedAt.Before(cutoff) {
+			break
+		}
+		if s.reservedLocked(e, now) {
+			if legacy {
+				break
+			}
+			continue
+		}
+		if decode {
+			var item T
+			if err := s.decodeLocked(e, &item); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		indexes = append(indexes, e.index)
+	}
+	return items, indexes, nil
+}
+
+func (s *segment[T]) dropIndexes(indexes []int) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.dropIndexesLocked(indexes)
+}
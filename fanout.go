@@ -0,0 +1,249 @@
+package koyori
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnqueueFanout durably enqueues item to every given queue as one atomic unit: even across
+// crashes, the item ends up either in all of the queues or in none of them.
+//
+// The item is first written to each queue as a pending transaction record. A commit marker in
+// the first queue's folder then decides the outcome, so a crash before the marker is synced
+// aborts the item everywhere and a crash after it commits the item everywhere on the next load.
+// A marker left behind is removed when the first queue is opened after every queue recorded
+// the outcome.
+func EnqueueFanout[T any](item T, queues ...*Queue[T]) error {
+	if len(queues) == 0 {
+		return nil
+	}
+	coordinator := queues[0].options.FolderPath
+
+	// Lock in folder order so concurrent fan-outs over the same queues can't deadlock
+	ordered := make([]*Queue[T], len(queues))
+	copy(ordered, queues)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].options.FolderPath < ordered[j].options.FolderPath
+	})
+	for i, q := range ordered {
+		if i > 0 && ordered[i-1].options.FolderPath == q.options.FolderPath {
+			return errors.Errorf("queue %s given more than once", q.options.FolderPath)
+		}
+		q.tailMutex.Lock()
+		defer q.tailMutex.Unlock()
+		if err := q.checkAcceptingLocked(); err != nil {
+			return err
+		}
+	}
+
+	txnID, err := newTxnID()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate transaction ID")
+	}
+	env := envelope{txnID: txnID, txnCoordinator: coordinator}
+	written := []*segment[T]{}
+	abort := func(cause error) error {
+		// Best effort: pending items without a marker are aborted on the next load anyway
+		for _, seg := range written {
+			_ = seg.resolveTxn(txnID, false)
+		}
+		return cause
+	}
+
+	for _, q := range queues {
+		if err := q.checkCapacityLocked(1); err != nil {
+			return abort(errors.Wrapf(err, "failed to write pending item to %s", q.options.FolderPath))
+		}
+		if q.lastSegment.full() || q.lastSegment.header.version < segmentFormatV1 {
+			if err := q.addSegmentLocked(); err != nil {
+				return abort(errors.Wrap(err, "failed to add new segment"))
+			}
+		}
+		env.sequence = q.nextSequence
+		env.enqueuedAt = time.Time{}
+		if q.options.recordsEnqueueTime() {
+			env.enqueuedAt = q.options.now()
+		}
+		if err := q.lastSegment.addTxn(item, env); err != nil {
+			return abort(errors.Wrapf(err, "failed to write pending item to %s", q.options.FolderPath))
+		}
+		written = append(written, q.lastSegment)
+	}
+
+	markerPath := fanoutMarkerPath(coordinator, txnID)
+	if err := writeFanoutMarker(markerPath, queues[0].options.FileMode, segmentPaths(written)); err != nil {
+		return abort(errors.Wrap(err, "failed to write commit marker"))
+	}
+	// The item is committed from here on, even if writing the outcome below fails
+	for _, q := range queues {
+		q.nextSequence++
+	}
+	for _, seg := range written {
+		if err := seg.resolveTxn(txnID, true); err != nil {
+			// The marker stays in place, so the item is committed when the queue is reloaded
+			return errors.Wrap(err, "failed to commit pending item")
+		}
+	}
+	for _, q := range queues {
+		q.notifyAdded()
+	}
+	return errors.Wrap(os.Remove(markerPath), "failed to remove commit marker")
+}
+
+func fanoutMarkerPath(coordinator string, txnID uint64) string {
+	return filepath.Join(coordinator, fmt.Sprintf("fanout-%016x.commit", txnID))
+}
+
+// writeFanoutMarker durably creates the commit marker of a transaction, listing the segment
+// files that hold its pending records one per line.
+func writeFanoutMarker(markerPath string, mode os.FileMode, segments []string) error {
+	file, err := os.OpenFile(markerPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, segment := range segments {
+		buf.WriteString(segment)
+		buf.WriteByte('\n')
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(markerPath))
+}
+
+func segmentPaths[T any](segments []*segment[T]) []string {
+	paths := make([]string, len(segments))
+	for i, seg := range segments {
+		paths[i] = seg.filePath()
+	}
+	return paths
+}
+
+// removeResolvedMarkers deletes the commit markers left in folderPath by transactions that
+// failed after committing, or by a crash, once every segment file they list recorded the
+// outcome. Markers still needed to resolve a pending record stay in place, as do those that
+// can't be checked, such as the ones written by older versions without the list.
+func removeResolvedMarkers(folderPath string, logger Logger) {
+	entries, err := os.ReadDir(folderPath)
+	if err != nil {
+		logger.Warn("failed to list commit markers", "folder", folderPath, "err", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "fanout-") || !strings.HasSuffix(name, ".commit") {
+			continue
+		}
+		txnID, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "fanout-"), ".commit"), 16, 64)
+		if err != nil {
+			continue
+		}
+		markerPath := filepath.Join(folderPath, name)
+		resolved, err := fanoutMarkerResolved(markerPath, txnID)
+		if err != nil {
+			logger.Warn("failed to check commit marker", "folder", folderPath, "marker", name, "err", err)
+			continue
+		}
+		if !resolved {
+			logger.Debug("kept commit marker of pending transaction", "folder", folderPath, "marker", name)
+			continue
+		}
+		if err := os.Remove(markerPath); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove commit marker", "folder", folderPath, "marker", name, "err", err)
+		}
+	}
+}
+
+// fanoutMarkerResolved reports whether none of the segment files listed by the marker of
+// transaction txnID still holds a record of it without an outcome.
+func fanoutMarkerResolved(markerPath string, txnID uint64) (bool, error) {
+	data, err := os.ReadFile(markerPath)
+	if err != nil {
+		return false, err
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		pending, err := txnPendingIn(segment, txnID)
+		if err != nil || pending {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// txnPendingIn reports whether the segment file at filePath holds a record of transaction
+// txnID but not its outcome. A removed segment holds no records, unless it was moved to cold
+// storage, where it can't be checked.
+func txnPendingIn(filePath string, txnID uint64) (bool, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		_, err := os.Stat(filepath.Join(filepath.Dir(filePath), coldManifestFilename))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return true, err
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner, err := newRecordScanner(bufio.NewReader(file), 0)
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for {
+		record, err := scanner.next()
+		if err == io.EOF {
+			return pending, nil
+		} else if err != nil {
+			return false, err
+		}
+		switch {
+		case record.kind == scannedItem && record.env.txnID == txnID:
+			pending = true
+		case record.kind == scannedControl && record.control == controlTxnAck:
+			if id, _, _, ok := decodeTxnAckControl(record.data); ok && id == txnID {
+				pending = true
+			}
+		case record.kind == scannedControl && (record.control == controlTxnCommit || record.control == controlTxnAbort):
+			if len(record.data) == 8 && binary.LittleEndian.Uint64(record.data) == txnID {
+				return false, nil
+			}
+		}
+	}
+}
+
+func newTxnID() (uint64, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, err
+		}
+		if id := binary.LittleEndian.Uint64(buf); id != 0 {
+			return id, nil
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package koyori
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// footerMagic ends the body of a footer record, after the 4-byte length of the body, so that
+// a footer can be found from the end of the file.
+const footerMagic = "KYRF"
+
+// segmentFooter is what loading a segment learns from its records, written as a footer record
+// when the segment stops being the last one. A segment whose last record is a footer is loaded
+// from it without reading the records before it, which are only read as items are removed.
+type segmentFooter struct {
+	nextIndex   int
+	removeCount int
+	// recordBytes is the bytes taken by the records in front of the footer, except tombstones.
+	recordBytes int64
+	entries     []footerEntry
+	// nextSequence and sequenceEnd are those of the segment (see segment.nextSequence). They
+	// follow the entries, and are missing from footers written before items were numbered.
+	nextSequence uint64
+	sequenceEnd  uint64
+	// bodyLength is the length of the body of the footer record, once read.
+	bodyLength int64
+}
+
+type footerEntry struct {
+	index  int
+	offset int64
+	length int
+	env    envelope
+}
+
+// writeFooter appends a footer describing the items left in the segment. Nothing is written
+// for segments whose state isn't all on disk in a form the footer holds: segments with pending
+// transactions, and reserved or lost items.
+func (s *segment[T]) writeFooter() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.readOnly || s.header.version < segmentFormatV2 {
+		return nil
+	}
+	if len(s.txns) > 0 || s.reservedCount > 0 || len(s.lostIndexes) > 0 {
+		return nil
+	}
+	// The footer must be the last record.
+	if err := s.recordDropsLocked(); err != nil {
+		return err
+	}
+	footer := segmentFooter{nextIndex: s.nextIndex, removeCount: s.removeCount, recordBytes: s.recordBytes,
+		nextSequence: s.nextSequence, sequenceEnd: s.sequenceEnd}
+	footer.entries = make([]footerEntry, len(s.entries))
+	for i, e := range s.entries {
+		if !e.dueAt.IsZero() {
+			return nil
+		}
+		env := envelope{enqueuedAt: e.enqueuedAt, attempts: e.attempts, sequence: e.sequence}
+		if e.meta != nil {
+			env.headers, env.priority = e.meta.headers, e.meta.priority
+		}
+		footer.entries[i] = footerEntry{index: e.index, offset: e.offset, length: e.length, env: env}
+	}
+	body := footer.marshal()
+	if len(body) > maxRecordLength {
+		return nil
+	}
+	return s.writeRecordLocked(recordKindControl, body)
+}
+
+// loadFooterLocked loads the segment from its footer, if its last record is one. Size is the
+// size of the file, and headerSize the size of its header.
+func (s *segment[T]) loadFooterLocked(r io.ReaderAt, size, headerSize int64) bool {
+	footer, ok := readFooter(r, s.header.version, size, headerSize)
+	if !ok {
+		return false
+	}
+	s.nextIndex = footer.nextIndex
+	s.removeCount = footer.removeCount
+	s.recordBytes = footer.recordBytes + int64(recordOverhead(s.header.version)) + footer.bodyLength
+	s.entries = make([]entry[T], len(footer.entries))
+	for i, fe := range footer.entries {
+		e := entry[T]{onDisk: true, offset: fe.offset, length: fe.length, index: fe.index, enqueuedAt: fe.env.enqueuedAt, attempts: fe.env.attempts, sequence: fe.env.sequence}
+		if fe.env.headers != nil || fe.env.priority != 0 {
+			e.meta = &itemMeta{headers: fe.env.headers, priority: fe.env.priority}
+		}
+		s.entries[i] = e
+	}
+	s.nextSequence, s.sequenceEnd = s.header.sequence, s.header.sequence
+	if footer.sequenceEnd != 0 {
+		s.nextSequence, s.sequenceEnd = footer.nextSequence, footer.sequenceEnd
+	}
+	s.size = size
+	return true
+}
+
+func (f *segmentFooter) marshal() []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(controlFooter))
+	writeUvarint(&buf, uint64(f.nextIndex))
+	writeUvarint(&buf, uint64(f.removeCount))
+	writeUvarint(&buf, uint64(f.recordBytes))
+	writeUvarint(&buf, uint64(len(f.entries)))
+	for _, e := range f.entries {
+		writeUvarint(&buf, uint64(e.index))
+		writeUvarint(&buf, uint64(e.offset))
+		writeUvarint(&buf, uint64(e.length))
+		env := e.env.marshal()
+		writeUvarint(&buf, uint64(len(env)))
+		buf.Write(env)
+	}
+	if f.sequenceEnd != 0 {
+		writeUvarint(&buf, f.nextSequence)
+		writeUvarint(&buf, f.sequenceEnd)
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(buf.Len()+4+len(footerMagic)))
+	buf.Write(length)
+	buf.WriteString(footerMagic)
+	return buf.Bytes()
+}
+
+// readFooter reads the footer record the file ends with. It reports false if the file doesn't
+// end with one, or the footer doesn't pass its checksum, in which case the segment has to be
+// loaded by reading its records.
+func readFooter(r io.ReaderAt, version int, size, headerSize int64) (segmentFooter, bool) {
+	if version < segmentFormatV2 {
+		return segmentFooter{}, false
+	}
+	trailer := make([]byte, 4+len(footerMagic))
+	if size-int64(len(trailer)) < headerSize {
+		return segmentFooter{}, false
+	}
+	if _, err := r.ReadAt(trailer, size-int64(len(trailer))); err != nil || string(trailer[4:]) != footerMagic {
+		return segmentFooter{}, false
+	}
+	bodyLength := int64(binary.LittleEndian.Uint32(trailer))
+	start := size - bodyLength - int64(recordOverhead(version))
+	if bodyLength > maxRecordLength || start < headerSize {
+		return segmentFooter{}, false
+	}
+	record := make([]byte, size-start)
+	if _, err := r.ReadAt(record, start); err != nil {
+		return segmentFooter{}, false
+	}
+	kind, length := splitRecordWord(binary.LittleEndian.Uint32(record))
+	body := record[8:]
+	if kind != recordKindControl || int64(length) != bodyLength || crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(record[4:]) {
+		return segmentFooter{}, false
+	}
+	footer, ok := decodeFooter(body[:len(body)-len(trailer)])
+	if !ok {
+		return segmentFooter{}, false
+	}
+	for i, e := range footer.entries {
+		if e.offset < headerSize || e.offset+int64(e.length) > start || (i > 0 && e.index <= footer.entries[i-1].index) {
+			return segmentFooter{}, false
+		}
+	}
+	footer.bodyLength = bodyLength
+	return footer, true
+}
+
+func decodeFooter(body []byte) (segmentFooter, bool) {
+	if len(body) == 0 || controlType(body[0]) != controlFooter {
+		return segmentFooter{}, false
+	}
+	body = body[1:]
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(body)
+		if n <= 0 {
+			return 0, false
+		}
+		body = body[n:]
+		return v, true
+	}
+	fields := [4]uint64{}
+	for i := range fields {
+		v, ok := next()
+		if !ok || v > math.MaxInt64 {
+			return segmentFooter{}, false
+		}
+		fields[i] = v
+	}
+	nextIndex, removeCount, recordBytes, count := fields[0], fields[1], fields[2], fields[3]
+	if nextIndex > math.MaxInt32 || removeCount > math.MaxInt32 || count > nextIndex {
+		return segmentFooter{}, false
+	}
+	footer := segmentFooter{nextIndex: int(nextIndex), removeCount: int(removeCount), recordBytes: int64(recordBytes)}
+	footer.entries = make([]footerEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		index, ok1 := next()
+		offset, ok2 := next()
+		length, ok3 := next()
+		envLength, ok4 := next()
+		if !ok1 || !ok2 || !ok3 || !ok4 || index >= nextIndex || offset > math.MaxInt64 || length > maxRecordLength || envLength > uint64(len(body)) {
+			return segmentFooter{}, false
+		}
+		env, err := decodeEnvelope(body[:envLength])
+		if err != nil {
+			return segmentFooter{}, false
+		}
+		body = body[envLength:]
+		footer.entries = append(footer.entries, footerEntry{index: int(index), offset: int64(offset), length: int(length), env: env})
+	}
+	if len(body) > 0 {
+		nextSequence, ok1 := next()
+		sequenceEnd, ok2 := next()
+		if !ok1 || !ok2 || nextSequence > sequenceEnd {
+			return segmentFooter{}, false
+		}
+		footer.nextSequence, footer.sequenceEnd = nextSequence, sequenceEnd
+	}
+	return footer, len(body) == 0
+}
@@ -0,0 +1,75 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueSegmentFooter(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	headers := map[string]string{"tenant": "a"}
+	enqueue := func(queue *koyori.Queue[string]) {
+		for _, item := range []string{"a", "b", "c", "d"} {
+			assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+		}
+		assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("e", headers)))
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"f", "g"})))
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	enqueue(queue)
+	assert.Nil(t, queue.Close())
+
+	// Segment 2 was sealed with a footer while segment 3 is written to.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, queue.Len())
+	assertDequeueMany(t, queue, 4, []string{"a", "b", "c", "d"})
+	assert.Nil(t, queue.Close())
+
+	// Removals follow the footer now, so the segment is loaded from its records.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, queue.Len())
+	msg, err := queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "e", msg.Item)
+	assert.Equal(t, headers, msg.Headers)
+	assertDequeueMany(t, queue, 2, []string{"f", "g"})
+	assert.Nil(t, queue.Close())
+
+	// The records in front of a footer aren't read when loading, so a bad checksum in one of
+	// them goes unnoticed.
+	opts.FolderPath = filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	enqueue(queue)
+	assert.Nil(t, queue.Close())
+	segmentPath := filepath.Join(opts.FolderPath, "00002.queue")
+	reader, err := koyori.OpenSegment[string](segmentPath, nil)
+	assert.Nil(t, err)
+	record, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	data, err := os.ReadFile(segmentPath)
+	assert.Nil(t, err)
+	data[record.Offset+4] ^= 0xff
+	assert.Nil(t, os.WriteFile(segmentPath, data, os.ModePerm))
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, queue.Len())
+	assertDequeueMany(t, queue, 7, []string{"a", "b", "c", "d", "e", "f", "g"})
+	assert.Nil(t, queue.Close())
+}
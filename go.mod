@@ -3,8 +3,11 @@ module github.com/jungnoh/koyori
 go 1.19
 
 require (
+	github.com/klauspost/compress v1.17.4
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.1
+	golang.org/x/sys v0.29.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
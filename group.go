@@ -0,0 +1,396 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// groupsFolder is the folder in the queue folder holding the cursors of consumer groups.
+const groupsFolder = "groups"
+
+const groupCursorExtension = ".cursor"
+
+// ErrGroupRemoved is returned by a ConsumerGroup after RemoveGroup removed it.
+var ErrGroupRemoved = errors.New("consumer group was removed")
+
+// ConsumerGroup reads every item of a queue independently of Dequeue and of other groups,
+// through a cursor that is persisted in the queue folder, so that several consumers can each
+// read the whole stream. It is safe for concurrent use, with the items split between the
+// goroutines reading from it.
+//
+// Once a group is registered, segments are only deleted after every registered group has
+// passed them, and are deleted then even if Dequeue didn't drain them, dropping the items left
+// in them. A group sees the items that are in the queue when it reaches them, so items removed
+// by Dequeue before that are skipped.
+type ConsumerGroup[T any] struct {
+	queue *Queue[T]
+	name  string
+	mutex sync.Mutex
+	// cursor is where the group reads next. It is changed with both the group's mutex and the
+	// queue's headMutex held.
+	cursor  groupCursor
+	removed bool
+	// seg is the segment at the cursor, loaded read-only, and pos the position of the next
+	// entry to look at. sealed is set if no more items were to be added to seg when it was
+	// loaded, so that it holds all of them.
+	seg    *segment[T]
+	pos    int
+	lost   map[int]bool
+	sealed bool
+}
+
+// groupCursor locates the next item a group reads: the item with index (see entry.index) or
+// the first one after it in segment.
+type groupCursor struct {
+	segment int
+	index   int
+}
+
+// Group returns the consumer group called name, registering it if it doesn't exist yet. A new
+// group starts at the first item of the queue. Names are made of letters, digits, '-', '_'
+// and '.', and don't start with '.'.
+func (q *Queue[T]) Group(name string) (*ConsumerGroup[T], error) {
+	if !validGroupName(name) {
+		return nil, errors.Errorf("invalid consumer group name %q", name)
+	}
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return nil, err
+	}
+	if g, ok := q.groups[name]; ok {
+		return g, nil
+	}
+	g := &ConsumerGroup[T]{queue: q, name: name, cursor: groupCursor{segment: q.segments[0]}}
+	if err := os.MkdirAll(filepath.Join(q.options.FolderPath, groupsFolder), q.options.dirMode()); err != nil {
+		return nil, errors.Wrap(err, "failed to create folder")
+	}
+	if err := g.saveLocked(); err != nil {
+		return nil, err
+	}
+	q.groups[name] = g
+	return g, nil
+}
+
+// Groups returns the names of the registered consumer groups, sorted.
+func (q *Queue[T]) Groups() []string {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	names := make([]string, 0, len(q.groups))
+	for name := range q.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RemoveGroup unregisters a consumer group and deletes its cursor, so segments no longer wait
+// for it to be deleted. Removing a group that doesn't exist does nothing.
+func (q *Queue[T]) RemoveGroup(name string) error {
+	q.headMutex.Lock()
+	g, ok := q.groups[name]
+	q.headMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if g.removed {
+		return nil
+	}
+	if err := os.Remove(g.cursorPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove consumer group cursor")
+	}
+	g.removed = true
+	delete(q.groups, name)
+	if err := g.closeSegmentLocked(); err != nil {
+		return err
+	}
+	return errors.Wrap(q.closeDrainedSegmentsBothLocked(), "failed to close segment")
+}
+
+// Name returns the name of the group.
+func (g *ConsumerGroup[T]) Name() string {
+	return g.name
+}
+
+// Dequeue returns the next item for the group and moves its cursor past it, or returns
+// ErrEmpty if the group has read every item of the queue. The item stays in the queue for
+// other groups and for Dequeue.
+func (g *ConsumerGroup[T]) Dequeue() (T, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var zero T
+	if g.removed {
+		return zero, ErrGroupRemoved
+	}
+	for {
+		for g.seg != nil && g.pos < len(g.seg.entries) {
+			e := &g.seg.entries[g.pos]
+			g.pos++
+			if e.index < g.cursor.index || g.lost[e.index] {
+				continue
+			}
+			var item T
+			if err := g.seg.decodeLocked(e, &item); err != nil {
+				return zero, errors.Wrapf(err, "failed to read item of segment (#%d)", g.seg.segmentNumber)
+			}
+			if err := g.moveTo(groupCursor{segment: g.cursor.segment, index: e.index + 1}); err != nil {
+				return zero, err
+			}
+			return item, nil
+		}
+		found, err := g.advance()
+		if errors.Is(err, ErrClosed) {
+			g.closeSegmentLocked()
+			return zero, err
+		} else if err != nil {
+			return zero, err
+		}
+		if !found {
+			return zero, ErrEmpty
+		}
+	}
+}
+
+// Close releases the file of the segment the group is reading. The group stays registered, and
+// reopens the file if Dequeue is called again.
+func (g *ConsumerGroup[T]) Close() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.closeSegmentLocked()
+}
+
+// moveTo persists a new cursor.
+func (g *ConsumerGroup[T]) moveTo(cursor groupCursor) error {
+	q := g.queue
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		g.closeSegmentLocked()
+		return err
+	}
+	g.cursor = cursor
+	return g.saveLocked()
+}
+
+// advance loads the segment holding the items after the cursor, moving the cursor to the next
+// segment once the current one was read and no more items will be added to it. It returns
+// false if there are no items to read yet.
+func (g *ConsumerGroup[T]) advance() (bool, error) {
+	q := g.queue
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return false, err
+	}
+	cursor := g.cursor
+	if g.seg != nil && g.seg.segmentNumber == cursor.segment && g.sealed {
+		// The segment was read to the end.
+		cursor = groupCursor{segment: cursor.segment + 1}
+	}
+	// Segments before the cursor may be gone, as Clear and OverflowPolicy delete segments.
+	next := 0
+	for _, number := range q.segments {
+		if number >= cursor.segment {
+			next = number
+			break
+		}
+	}
+	if next == 0 {
+		return false, nil
+	}
+	if next != cursor.segment {
+		cursor = groupCursor{segment: next}
+	}
+	if cursor.segment == q.lastSegment.segmentNumber && cursor.index > q.lastSegment.lastIndex() {
+		return false, g.updateCursorLocked(cursor)
+	}
+	if err := g.updateCursorLocked(cursor); err != nil {
+		return false, err
+	}
+	if err := g.closeSegmentLocked(); err != nil {
+		return false, err
+	}
+	if err := g.loadSegmentLocked(next); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// updateCursorLocked persists cursor if it moved to another segment, deleting the segments
+// every group has passed since. The caller holds both locks of the queue.
+func (g *ConsumerGroup[T]) updateCursorLocked(cursor groupCursor) error {
+	if cursor == g.cursor {
+		return nil
+	}
+	g.cursor = cursor
+	if err := g.saveLocked(); err != nil {
+		return err
+	}
+	return errors.Wrap(g.queue.closeDrainedSegmentsBothLocked(), "failed to close segment")
+}
+
+func (g *ConsumerGroup[T]) loadSegmentLocked(number int) error {
+	q := g.queue
+	// Buffered writes must be in the file read below.
+	if err := q.firstSegment.writePending(); err != nil {
+		return err
+	}
+	if err := q.lastSegment.writePending(); err != nil {
+		return err
+	}
+	seg := &segment[T]{
+		folderPath:    q.options.FolderPath,
+		segmentNumber: number,
+		converter:     q.options.Converter,
+		options:       &q.options,
+		readOnly:      true,
+	}
+	if q.isColdLocked(number) {
+		dir, err := q.fetchColdTemp(number)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		seg.folderPath = dir
+	}
+	if err := seg.load(); err != nil {
+		return errors.Wrapf(err, "failed to read segment (#%d)", number)
+	}
+	// Open the file now, as it may be deleted once the queue is unlocked.
+	reader, err := os.Open(seg.filePath())
+	if err != nil {
+		return errors.Wrapf(err, "failed to open segment (#%d)", number)
+	}
+	seg.reader = reader
+	g.lost = map[int]bool{}
+	for _, index := range seg.lostIndexes {
+		g.lost[index] = true
+	}
+	g.seg, g.pos = seg, 0
+	g.sealed = number != q.lastSegment.segmentNumber
+	return nil
+}
+
+func (g *ConsumerGroup[T]) closeSegmentLocked() error {
+	if g.seg == nil {
+		return nil
+	}
+	err := g.seg.closeReaderLocked()
+	g.seg = nil
+	return errors.Wrap(err, "failed to close segment file")
+}
+
+func (g *ConsumerGroup[T]) cursorPath() string {
+	return filepath.Join(g.queue.options.FolderPath, groupsFolder, g.name+groupCursorExtension)
+}
+
+// saveLocked writes the cursor to a temporary file that is renamed over the previous one. It is
+// synced under SyncEveryWrite, and otherwise by Flush.
+func (g *ConsumerGroup[T]) saveLocked() error {
+	q := g.queue
+	cursorPath := g.cursorPath()
+	tmpPath := cursorPath + ".tmp"
+	data := fmt.Sprintf("%d %d\n", g.cursor.segment, g.cursor.index)
+	if err := os.WriteFile(tmpPath, []byte(data), q.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to write consumer group cursor")
+	}
+	if q.options.syncPolicy().Mode == SyncEveryWrite {
+		if err := syncFile(tmpPath, q.options.FileMode); err != nil {
+			return errors.Wrap(err, "failed to sync consumer group cursor")
+		}
+	}
+	return errors.Wrap(os.Rename(tmpPath, cursorPath), "failed to replace consumer group cursor")
+}
+
+// loadGroups reads the cursors of the registered consumer groups.
+func (q *Queue[T]) loadGroups() error {
+	q.groups = map[string]*ConsumerGroup[T]{}
+	names, err := listFolder(filepath.Join(q.options.FolderPath, groupsFolder))
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, filename := range names {
+		name := strings.TrimSuffix(filename, groupCursorExtension)
+		if name == filename || !validGroupName(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.options.FolderPath, groupsFolder, filename))
+		if err != nil {
+			return errors.Wrap(err, "failed to read consumer group cursor")
+		}
+		g := &ConsumerGroup[T]{queue: q, name: name}
+		if _, err := fmt.Sscanf(string(data), "%d %d", &g.cursor.segment, &g.cursor.index); err != nil {
+			return errors.Wrapf(ErrCorrupt, "invalid cursor of consumer group %q", name)
+		}
+		q.groups[name] = g
+	}
+	return nil
+}
+
+// syncGroupsLocked syncs the cursors of the consumer groups, for Flush.
+func (q *Queue[T]) syncGroupsLocked() error {
+	if len(q.groups) == 0 {
+		return nil
+	}
+	for _, g := range q.groups {
+		if err := syncFile(g.cursorPath(), q.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to sync cursor of consumer group %q", g.name)
+		}
+	}
+	return errors.Wrap(syncDir(filepath.Join(q.options.FolderPath, groupsFolder)), "failed to sync folder")
+}
+
+// groupsPassedLocked reports whether every registered consumer group has moved past the first
+// segment. The caller holds headMutex.
+func (q *Queue[T]) groupsPassedLocked() bool {
+	for _, g := range q.groups {
+		if g.cursor.segment <= q.firstSegment.segmentNumber {
+			return false
+		}
+	}
+	return true
+}
+
+// lastIndex returns the index of the last item of the segment, or -1 if it holds none.
+func (s *segment[T]) lastIndex() int {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if len(s.entries) == 0 {
+		return -1
+	}
+	return s.entries[len(s.entries)-1].index
+}
+
+func validGroupName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
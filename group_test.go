@@ -0,0 +1,82 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func assertGroupDequeue(t *testing.T, group *koyori.ConsumerGroup[string], expected ...string) {
+	for _, item := range expected {
+		actual, err := group.Dequeue()
+		assert.Nil(t, err)
+		assert.Equal(t, item, actual)
+	}
+}
+
+func TestQueueConsumerGroups(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = queue.Group("../x")
+	assert.NotNil(t, err)
+	a, err := queue.Group("a")
+	assert.Nil(t, err)
+	b, err := queue.Group("b")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, queue.Groups())
+
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assertGroupDequeue(t, a, "a", "b", "c")
+	_, err = a.Dequeue()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"d", "e"})))
+	assertGroupDequeue(t, a, "d", "e")
+
+	// Segments wait for the slowest group, then are deleted with the items Dequeue left.
+	infos, err := koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(infos))
+	assertGroupDequeue(t, b, "a", "b", "c")
+	infos, err = koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, 3, queue.Len())
+	assert.Nil(t, a.Close())
+	assert.Nil(t, b.Close())
+	assert.Nil(t, queue.Close())
+
+	// Cursors survive reopening the queue.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, queue.Groups())
+	a, err = queue.Group("a")
+	assert.Nil(t, err)
+	b, err = queue.Group("b")
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assertGroupDequeue(t, a, "f")
+	assertGroupDequeue(t, b, "d", "e", "f")
+
+	assert.Nil(t, enqueueErr(queue.Enqueue("g")))
+	assertGroupDequeue(t, a, "g")
+	assertGroupDequeue(t, b, "g")
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "g")
+
+	assert.Nil(t, queue.RemoveGroup("a"))
+	_, err = a.Dequeue()
+	assert.Equal(t, koyori.ErrGroupRemoved, err)
+	assert.Equal(t, []string{"b"}, queue.Groups())
+	assert.Nil(t, b.Close())
+	assert.Nil(t, queue.Close())
+}
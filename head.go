@@ -0,0 +1,293 @@
+package koyori
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// headFilename is the file in the queue folder holding the head position of the first segment
+// under QueueOptions.HeadFile. The line after the version holds the number of the segment, its
+// creation time in unix nanos, the index of its first item left and the number of removals from
+// its head that its file doesn't record.
+const headFilename = "head"
+
+const headFileVersion = "koyori-head 1"
+
+// headPosition is where the items left in a segment start. Items with a lower index were
+// removed, count of them without a record in the segment file.
+type headPosition struct {
+	segment   int
+	createdAt int64
+	index     int
+	count     int
+}
+
+// matches reports whether the position is about the segment with the given number and header.
+// Segment numbers start over, so the creation time tells apart segments that had the same one.
+func (p headPosition) matches(number int, header segmentHeader) bool {
+	return p.createdAt != 0 && p.segment == number && !header.createdAt.IsZero() && header.createdAt.UnixNano() == p.createdAt
+}
+
+// headFile keeps the head position of a queue in a file that is replaced as a whole on every
+// change, so it is never read half written. Its methods may be called on a nil headFile, which
+// holds no position.
+type headFile struct {
+	lock       sync.Mutex
+	folderPath string
+	mode       os.FileMode
+	position   headPosition
+	unsynced   bool
+}
+
+// readHeadFile reads the head file of the queue in folderPath, which holds no position if there
+// is none.
+func readHeadFile(folderPath string, mode os.FileMode) (*headFile, error) {
+	h := &headFile{folderPath: folderPath, mode: mode}
+	file, err := os.Open(h.path())
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open head file")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != headFileVersion || !scanner.Scan() {
+		return nil, errors.Wrap(ErrCorrupt, "invalid head file")
+	}
+	p := &h.position
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d %d", &p.segment, &p.createdAt, &p.index, &p.count); err != nil {
+		return nil, errors.Wrapf(ErrCorrupt, "invalid head file line %q", scanner.Text())
+	}
+	return h, errors.Wrap(scanner.Err(), "failed to read head file")
+}
+
+// loadHeadFile reads the head file of a queue being opened. One that can't be read is given up
+// on unless mode is RecoveryStrict, and the items removed since it was last written are then
+// delivered again.
+func loadHeadFile(folderPath string, mode os.FileMode, recovery RecoveryMode, logger Logger) (*headFile, error) {
+	h, err := readHeadFile(folderPath, mode)
+	if err == nil || recovery == RecoveryStrict || !errors.Is(err, ErrCorrupt) {
+		return h, err
+	}
+	logger.Warn("gave up on unreadable head file", "folder", folderPath, "err", err)
+	return &headFile{folderPath: folderPath, mode: mode}, nil
+}
+
+func (h *headFile) path() string {
+	return filepath.Join(h.folderPath, headFilename)
+}
+
+func (h *headFile) get() headPosition {
+	if h == nil {
+		return headPosition{}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.position
+}
+
+// set replaces the position, leaving the file to be synced by sync.
+func (h *headFile) set(position headPosition) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := writeHeadFile(h.folderPath, h.mode, position, false); err != nil {
+		return err
+	}
+	h.position = position
+	h.unsynced = true
+	return nil
+}
+
+// clear removes the position and its file.
+func (h *headFile) clear() error {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := os.Remove(h.path()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove head file")
+	}
+	h.position = headPosition{}
+	h.unsynced = false
+	return errors.Wrap(syncDir(h.folderPath), "failed to sync folder")
+}
+
+// dirty reports whether the file was replaced since it was last synced.
+func (h *headFile) dirty() bool {
+	if h == nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.unsynced
+}
+
+// sync makes the last position set durable.
+func (h *headFile) sync() error {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.unsynced {
+		return nil
+	}
+	if err := syncFile(h.path(), h.mode); err != nil {
+		return errors.Wrap(err, "failed to sync head file")
+	}
+	if err := syncDir(h.folderPath); err != nil {
+		return errors.Wrap(err, "failed to sync folder")
+	}
+	h.unsynced = false
+	return nil
+}
+
+// copyTo writes the position to a head file in folderPath, synced, if there is one.
+func (h *headFile) copyTo(folderPath string) error {
+	position := h.get()
+	if position.createdAt == 0 {
+		return nil
+	}
+	return writeHeadFile(folderPath, h.mode, position, true)
+}
+
+// setFolder points the head file at the copy of the queue in folderPath.
+func (h *headFile) setFolder(folderPath string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.folderPath = folderPath
+}
+
+// writeHeadFile replaces the head file in folderPath with one holding position. With sync set,
+// the file is synced before it replaces the old one.
+func writeHeadFile(folderPath string, mode os.FileMode, position headPosition, sync bool) error {
+	filePath := filepath.Join(folderPath, headFilename)
+	tmpPath := filePath + ".tmp"
+	content := fmt.Sprintf("%s\n%d %d %d %d\n", headFileVersion, position.segment, position.createdAt, position.index, position.count)
+	if err := os.WriteFile(tmpPath, []byte(content), mode); err != nil {
+		return errors.Wrap(err, "failed to write head file")
+	}
+	if sync {
+		if err := syncFile(tmpPath, mode); err != nil {
+			return errors.Wrap(err, "failed to sync head file")
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return errors.Wrap(err, "failed to replace head file")
+	}
+	if sync {
+		return errors.Wrap(syncDir(folderPath), "failed to sync folder")
+	}
+	return nil
+}
+
+// usesHeadFileLocked reports whether removals from the head of the segment are recorded in the
+// head file rather than in the segment file. Segments without a creation time, written by
+// earlier versions, can't be told apart in the head file, and keep using deletion markers.
+func (s *segment[T]) usesHeadFileLocked() bool {
+	return s.options.HeadFile && s.options.headFile != nil && !s.readOnly && !s.header.createdAt.IsZero()
+}
+
+// headFileFreeLocked reports whether the segment may record its head position in the head file,
+// which holds the position of a single segment: the file must not hold the position of another
+// segment still in the queue folder, such as the first segment when this one is the last.
+func (s *segment[T]) headFileFreeLocked() bool {
+	// A position of a segment that had the number before this one is stale.
+	position := s.options.headFile.get()
+	if position.createdAt == 0 || position.segment == s.segmentNumber {
+		return true
+	}
+	_, err := os.Stat(s.options.SegmentNaming.path(s.folderPath, position.segment))
+	return os.IsNotExist(err)
+}
+
+// recordHeadLocked records count more removals from the head in the head file, along with the
+// index of the first item left.
+func (s *segment[T]) recordHeadLocked(count int) error {
+	s.headDropped += count
+	index := s.nextIndex
+	if len(s.entries) > 0 {
+		index = s.entries[0].index
+	}
+	position := headPosition{segment: s.segmentNumber, createdAt: s.header.createdAt.UnixNano(), index: index, count: s.headDropped}
+	if err := s.options.headFile.set(position); err != nil {
+		return err
+	}
+	// Counted as a write of the segment, so the sync policy applies to it.
+	s.unsynced++
+	return nil
+}
+
+// applyHeadLocked removes the items in front of the head position recorded for the segment, as
+// it is loaded.
+func (s *segment[T]) applyHeadLocked() {
+	position := s.options.headFile.get()
+	if !position.matches(s.segmentNumber, s.header) {
+		return
+	}
+	removed := 0
+	for removed < len(s.entries) && s.entries[removed].index < position.index {
+		if s.entries[removed].reserved {
+			s.reservedCount--
+		}
+		s.entries[removed] = entry[T]{}
+		removed++
+	}
+	s.entries = s.entries[removed:]
+	s.removeCount += removed
+	s.headDropped = position.count
+}
+
+// recordHeadInFileLocked records the removals from the head that only the head file holds in
+// the segment file, and removes the position, for a segment file that is going to be read
+// without it, such as one that is claimed or rewritten.
+func (s *segment[T]) recordHeadInFileLocked() error {
+	count := s.headDropped
+	if s.options.HeadFile {
+		count += s.unrecordedDrops
+		s.unrecordedDrops = 0
+	}
+	if count == 0 {
+		return nil
+	}
+	if err := s.writeDropsLocked(count); err != nil {
+		return errors.Wrap(err, "failed to write deletion to disk")
+	}
+	s.headDropped = 0
+	// The segment file must hold the removals before the position is gone.
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if !s.options.headFile.get().matches(s.segmentNumber, s.header) {
+		return nil
+	}
+	return s.options.headFile.clear()
+}
+
+// migrateHeadLocked moves the position in the head file of a queue opened without HeadFile
+// back into the file of the first segment, and removes the head file.
+func (q *Queue[T]) migrateHeadLocked() error {
+	if q.options.HeadFile || q.options.headFile.get().createdAt == 0 {
+		return nil
+	}
+	seg := q.firstSegment
+	seg.fileLock.Lock()
+	err := seg.recordHeadInFileLocked()
+	seg.fileLock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to move head position into segment")
+	}
+	return q.options.headFile.clear()
+}
@@ -0,0 +1,114 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueHeadFile(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 4,
+		HeadFile:             true,
+	}
+	headPath := filepath.Join(opts.FolderPath, "head")
+	sealedPath := filepath.Join(opts.FolderPath, "00002.queue")
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"})))
+	sealed, err := os.ReadFile(sealedPath)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 5, []string{"a", "b", "c", "d", "e"})
+	assert.Nil(t, queue.Close())
+
+	// Dequeuing from a sealed segment leaves its file as it was.
+	after, err := os.ReadFile(sealedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, sealed, after)
+	_, err = os.Stat(headPath)
+	assert.Nil(t, err)
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, queue.Len())
+	assertDequeue(t, queue, "f")
+	assert.Nil(t, queue.Close())
+
+	infos, err := koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, infos[0].Items)
+	report, err := koyori.Verify(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, report.Items)
+
+	// Opened without HeadFile, the position moves back into the segment file.
+	opts.HeadFile = false
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(headPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 4, queue.Len())
+	assertDequeue(t, queue, "g")
+	assert.Nil(t, queue.Close())
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"h", "i", "j"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueHeadFileCompaction(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		HeadFile:             true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	// The compacted file indexes its items anew, which the old position must not apply to.
+	assert.Nil(t, queue.Compact())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queue.Len())
+	assertDequeueMany(t, queue, 2, []string{"d", "e"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueHeadFileClaim(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+		HeadFile:             true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assertDequeue(t, queue, "a")
+	claim, err := queue.ClaimSegment()
+	assert.Nil(t, err)
+	assertDequeue(t, queue, "d")
+	// Both segments removed items from their head, which the head file only holds for one.
+	assert.Nil(t, claim.Release())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 5, []string{"b", "c", "e", "f", "g"})
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,271 @@
+package koyori
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// segmentMagic prefixes every versioned segment file. Legacy (v0) files start
+// directly with a 4-byte capacity, which never collides with this value in practice.
+var segmentMagic = [4]byte{'K', 'Y', 'R', 'I'}
+
+var (
+	// ErrNotSegment is returned when a file is neither a versioned nor a legacy segment.
+	ErrNotSegment = errors.New("not a koyori segment file")
+	// ErrUnsupportedFormat is returned for segments written by a newer version of koyori.
+	ErrUnsupportedFormat = errors.New("unsupported segment format")
+)
+
+// maxLegacyCapacity bounds the capacity of legacy segments. Anything larger is far more
+// likely to be the first bytes of some other file than a real capacity.
+const maxLegacyCapacity = 1<<24 - 1
+
+const (
+	segmentFormatV0 = 0
+	segmentFormatV1 = 1
+	// segmentFormatV2 adds a CRC32 to the header and to every record except tombstones.
+	segmentFormatV2      = 2
+	currentSegmentFormat = segmentFormatV2
+)
+
+type headerTag uint16
+
+const (
+	headerTagEnd headerTag = iota
+	headerTagCapacity
+	headerTagCreatedAt
+	headerTagCodec
+	headerTagKeyID
+	headerTagQueueName
+	headerTagFlags
+	headerTagCompression
+	headerTagSequence
+)
+
+const (
+	// segmentFlagSchemaVersion marks segments whose items start with the schema version of the
+	// VersionedConverter that encoded them.
+	segmentFlagSchemaVersion uint32 = 1 << iota
+	// segmentFlagDropRecords marks segments that may record removals from the head with a
+	// controlDrop record rather than a deletion marker per item.
+	segmentFlagDropRecords
+)
+
+// knownSegmentFlags holds every flag this version understands. Flags change how records
+// must be read, so a segment with any other flag set is rejected instead of misread.
+const knownSegmentFlags = segmentFlagSchemaVersion | segmentFlagDropRecords
+
+type headerField struct {
+	tag   headerTag
+	value []byte
+}
+
+// SegmentHeader is the metadata stored at the start of a segment file.
+type SegmentHeader struct {
+	Version   int
+	Capacity  int
+	CreatedAt time.Time
+	// Codec is the QueueOptions.ConverterName the segment was created with.
+	Codec     string
+	KeyID     string
+	QueueName string
+	Flags     uint32
+	// Compression is the algorithm items of the segment are compressed with.
+	Compression Compression
+	// Sequence is the sequence number the next item enqueued was to get when the segment was
+	// created, or zero for segments written before items were numbered.
+	Sequence uint64
+}
+
+// segmentHeader is the metadata stored at the start of each segment file.
+// From v1 on, fields are stored as a TLV list so new fields can be added
+// without breaking older readers; unknown fields are kept as-is.
+type segmentHeader struct {
+	version     int
+	capacity    int
+	createdAt   time.Time
+	codec       string
+	keyID       string
+	queueName   string
+	flags       uint32
+	compression Compression
+	sequence    uint64
+	unknown     []headerField
+}
+
+func (h *segmentHeader) marshal() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.Write(segmentMagic[:])
+	writeUint16(&buf, currentSegmentFormat)
+
+	capacityBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(capacityBytes, uint32(h.capacity))
+	writeHeaderField(&buf, headerTagCapacity, capacityBytes)
+	if !h.createdAt.IsZero() {
+		createdAtBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(createdAtBytes, uint64(h.createdAt.UnixNano()))
+		writeHeaderField(&buf, headerTagCreatedAt, createdAtBytes)
+	}
+	for _, v := range []string{h.codec, h.keyID, h.queueName} {
+		if len(v) > math.MaxUint16 {
+			return nil, errors.Errorf("header field too long (%d bytes)", len(v))
+		}
+	}
+	if h.codec != "" {
+		writeHeaderField(&buf, headerTagCodec, []byte(h.codec))
+	}
+	if h.keyID != "" {
+		writeHeaderField(&buf, headerTagKeyID, []byte(h.keyID))
+	}
+	if h.queueName != "" {
+		writeHeaderField(&buf, headerTagQueueName, []byte(h.queueName))
+	}
+	if h.flags != 0 {
+		flagBytes := make([]byte, 4)
+		binary.LittleEndian.PutUint32(flagBytes, h.flags)
+		writeHeaderField(&buf, headerTagFlags, flagBytes)
+	}
+	if h.compression != CompressionNone {
+		writeHeaderField(&buf, headerTagCompression, []byte{byte(h.compression)})
+	}
+	if h.sequence != 0 {
+		sequenceBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(sequenceBytes, h.sequence)
+		writeHeaderField(&buf, headerTagSequence, sequenceBytes)
+	}
+	for _, field := range h.unknown {
+		writeHeaderField(&buf, field.tag, field.value)
+	}
+	writeHeaderField(&buf, headerTagEnd, nil)
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(buf.Bytes(), crcTable))
+	buf.Write(checksum)
+	return buf.Bytes(), nil
+}
+
+func (h *segmentHeader) exported() SegmentHeader {
+	return SegmentHeader{
+		Version:     h.version,
+		Capacity:    h.capacity,
+		CreatedAt:   h.createdAt,
+		Codec:       h.codec,
+		KeyID:       h.keyID,
+		QueueName:   h.queueName,
+		Flags:       h.flags,
+		Compression: h.compression,
+		Sequence:    h.sequence,
+	}
+}
+
+func readSegmentHeader(source io.Reader) (segmentHeader, error) {
+	// raw keeps the header bytes for the checksum of v2+ headers.
+	raw := bytes.Buffer{}
+	r := io.TeeReader(source, &raw)
+	magicBuf := make([]byte, 4)
+	if n, err := io.ReadFull(r, magicBuf); err != nil {
+		return segmentHeader{}, errors.Wrapf(err, "error reading header (read %d bytes)", n)
+	}
+	if !bytes.Equal(magicBuf, segmentMagic[:]) {
+		// Legacy segment: the header is only the capacity
+		capacity := binary.LittleEndian.Uint32(magicBuf)
+		if capacity == 0 || capacity > maxLegacyCapacity {
+			return segmentHeader{}, errors.Wrapf(ErrNotSegment, "unknown file signature %x", magicBuf)
+		}
+		return segmentHeader{
+			version:  segmentFormatV0,
+			capacity: int(capacity),
+		}, nil
+	}
+
+	versionBuf := make([]byte, 2)
+	if n, err := io.ReadFull(r, versionBuf); err != nil {
+		return segmentHeader{}, errors.Wrapf(err, "error reading header version (read %d bytes)", n)
+	}
+	header := segmentHeader{version: int(binary.LittleEndian.Uint16(versionBuf))}
+	if header.version > currentSegmentFormat {
+		return segmentHeader{}, errors.Wrapf(ErrUnsupportedFormat, "version %d (newest supported is %d)", header.version, currentSegmentFormat)
+	}
+
+	fieldBuf := make([]byte, 4)
+	for {
+		if n, err := io.ReadFull(r, fieldBuf); err != nil {
+			return segmentHeader{}, errors.Wrapf(err, "error reading header field (read %d bytes)", n)
+		}
+		tag := headerTag(binary.LittleEndian.Uint16(fieldBuf[0:2]))
+		value := make([]byte, binary.LittleEndian.Uint16(fieldBuf[2:4]))
+		if n, err := io.ReadFull(r, value); err != nil {
+			return segmentHeader{}, errors.Wrapf(err, "error reading header field %d (read %d bytes)", tag, n)
+		}
+
+		switch tag {
+		case headerTagEnd:
+			if header.version >= segmentFormatV2 {
+				checksumBuf := make([]byte, 4)
+				if n, err := io.ReadFull(source, checksumBuf); err != nil {
+					return segmentHeader{}, errors.Wrapf(err, "error reading header checksum (read %d bytes)", n)
+				}
+				if binary.LittleEndian.Uint32(checksumBuf) != crc32.Checksum(raw.Bytes(), crcTable) {
+					return segmentHeader{}, &CorruptRecordError{Offset: 0, Reason: "header checksum mismatch"}
+				}
+			}
+			if unknown := header.flags &^ knownSegmentFlags; unknown != 0 {
+				return segmentHeader{}, errors.Wrapf(ErrUnsupportedFormat, "unknown flags %#x", unknown)
+			}
+			return header, nil
+		case headerTagCapacity:
+			if len(value) != 4 {
+				return segmentHeader{}, &CorruptRecordError{Reason: fmt.Sprintf("invalid capacity field length %d", len(value))}
+			}
+			header.capacity = int(binary.LittleEndian.Uint32(value))
+		case headerTagCreatedAt:
+			if len(value) != 8 {
+				return segmentHeader{}, &CorruptRecordError{Reason: fmt.Sprintf("invalid creation time field length %d", len(value))}
+			}
+			header.createdAt = time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+		case headerTagCodec:
+			header.codec = string(value)
+		case headerTagKeyID:
+			header.keyID = string(value)
+		case headerTagQueueName:
+			header.queueName = string(value)
+		case headerTagFlags:
+			if len(value) != 4 {
+				return segmentHeader{}, &CorruptRecordError{Reason: fmt.Sprintf("invalid flags field length %d", len(value))}
+			}
+			header.flags = binary.LittleEndian.Uint32(value)
+		case headerTagCompression:
+			if len(value) != 1 {
+				return segmentHeader{}, &CorruptRecordError{Reason: fmt.Sprintf("invalid compression field length %d", len(value))}
+			}
+			header.compression = Compression(value[0])
+			if !header.compression.valid() {
+				return segmentHeader{}, errors.Wrapf(ErrUnsupportedFormat, "unknown compression %d", value[0])
+			}
+		case headerTagSequence:
+			if len(value) != 8 {
+				return segmentHeader{}, &CorruptRecordError{Reason: fmt.Sprintf("invalid sequence field length %d", len(value))}
+			}
+			header.sequence = binary.LittleEndian.Uint64(value)
+		default:
+			header.unknown = append(header.unknown, headerField{tag: tag, value: value})
+		}
+	}
+}
+
+func writeHeaderField(buf *bytes.Buffer, tag headerTag, value []byte) {
+	writeUint16(buf, uint16(tag))
+	writeUint16(buf, uint16(len(value)))
+	buf.Write(value)
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	buf.Write(b)
+}
@@ -0,0 +1,91 @@
+package koyori
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// SegmentInfo describes a segment file of a queue directory.
+type SegmentInfo struct {
+	Number int
+	Path   string
+	Header SegmentHeader
+	// Size is the size of the file in bytes.
+	Size int64
+	// Items is the number of items left in the segment.
+	Items int
+	// OldestEnqueuedAt and NewestEnqueuedAt are the enqueue times of the first and last items
+	// left that have one recorded (see QueueOptions.RecordEnqueueTime), or zero.
+	OldestEnqueuedAt time.Time
+	NewestEnqueuedAt time.Time
+}
+
+// InspectSegments describes the segments in folderPath, oldest first, for tooling. The folder
+// isn't locked and nothing is modified, so it may be called on the directory of an open queue,
+// though the result may be out of date by the time it returns.
+func InspectSegments(folderPath string) ([]SegmentInfo, error) {
+	return InspectSegmentsWithNaming(folderPath, SegmentNaming{})
+}
+
+// InspectSegmentsWithNaming is InspectSegments for a queue whose segment files are named by
+// naming (see QueueOptions.SegmentNaming).
+func InspectSegmentsWithNaming(folderPath string, naming SegmentNaming) ([]SegmentInfo, error) {
+	if err := naming.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid segment naming")
+	}
+	numbers, err := listSegments(folderPath, naming, nopLogger{})
+	if err != nil {
+		return nil, err
+	}
+	// A head file that can't be read is passed over, as the queue does outside RecoveryStrict.
+	head, err := loadHeadFile(folderPath, defaultFileMode, RecoveryTruncate, nopLogger{})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SegmentInfo, 0, len(numbers))
+	for _, number := range numbers {
+		info := SegmentInfo{Number: number, Path: naming.path(folderPath, number)}
+		if info.Header, info.Size, err = statSegment(info.Path, number); err != nil {
+			return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+		}
+		if info.Items, err = countLiveItems(folderPath, naming, number, RecoveryStrict, head.get(), defaultMaxRecordSize); err != nil {
+			return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+		}
+		if info.OldestEnqueuedAt, info.NewestEnqueuedAt, err = segmentEnqueueTimes(folderPath, naming, number, head); err != nil {
+			return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// segmentEnqueueTimes returns the enqueue times of the first and last items left in a segment
+// that have one.
+func segmentEnqueueTimes(folderPath string, naming SegmentNaming, segmentNumber int, head *headFile) (time.Time, time.Time, error) {
+	options := QueueOptions[[]byte]{FolderPath: folderPath, SegmentNaming: naming, headFile: head}
+	seg := &segment[[]byte]{folderPath: folderPath, segmentNumber: segmentNumber, options: &options, readOnly: true}
+	if err := seg.load(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return seg.enqueuedAt(true), seg.enqueuedAt(false), nil
+}
+
+func statSegment(filePath string, segmentNumber int) (SegmentHeader, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return SegmentHeader{}, 0, errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return SegmentHeader{}, 0, errors.Wrap(err, "failed to stat file")
+	}
+	scanner, err := newRecordScanner(bufio.NewReader(file), segmentNumber)
+	if err != nil {
+		return SegmentHeader{}, 0, err
+	}
+	return scanner.header.exported(), stat.Size(), nil
+}
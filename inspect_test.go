@@ -0,0 +1,34 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInspectSegments(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err := koyori.NewBytesQueue(folder, koyori.WithMaxObjectsPerSegment(3))
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})))
+	_, err = queue.Dequeue()
+	assert.Nil(t, err)
+
+	// The directory of an open queue can be inspected.
+	segments, err := koyori.InspectSegments(folder)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, 1, segments[0].Number)
+	assert.Equal(t, 2, segments[0].Items)
+	assert.Equal(t, 3, segments[0].Header.Capacity)
+	assert.Equal(t, filepath.Join(folder, "00002.queue.open"), segments[1].Path)
+	assert.Equal(t, 1, segments[1].Items)
+	info, err := os.Stat(segments[1].Path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), segments[1].Size)
+	assert.Nil(t, queue.Close())
+}
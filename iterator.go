@@ -0,0 +1,191 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"sync/atomic"
+)
+
+// Iterator walks the items of a queue in FIFO order without removing them. Segments are read
+// from disk one at a time, so only one segment's item offsets are held in memory.
+//
+// Each segment is read as it was when the iterator reached it: items dequeued after that may
+// still be returned, and items enqueued to it afterwards are not. Segments started while
+// iterating are visited.
+type Iterator[T any] struct {
+	queue  *Queue[T]
+	seg    *segment[T]
+	number int
+	pos    int
+	lost   map[int]bool
+	item   T
+	err    error
+	done   bool
+	closed bool
+	// tmpDir holds the current segment if it was fetched from ColdStorage.
+	tmpDir string
+}
+
+// Iter returns an iterator over the items of the queue, including items that are reserved or
+// held back by MinAge. The iterator must be closed when done.
+func (q *Queue[T]) Iter() *Iterator[T] {
+	atomic.AddInt64(&q.iterators, 1)
+	return &Iterator[T]{queue: q}
+}
+
+// Range calls fn for every item of the queue in FIFO order, until fn returns false.
+func (q *Queue[T]) Range(fn func(item T) bool) error {
+	it := q.Iter()
+	for it.Next() {
+		if !fn(it.Item()) {
+			break
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	return it.Err()
+}
+
+// Next moves to the next item, returning false once all items were visited or reading failed.
+func (it *Iterator[T]) Next() bool {
+	for !it.done && it.err == nil {
+		if it.seg == nil || it.pos == len(it.seg.entries) {
+			if err := it.nextSegment(); err != nil {
+				it.err = err
+			}
+			continue
+		}
+		e := &it.seg.entries[it.pos]
+		it.pos++
+		if it.lost[e.index] {
+			continue
+		}
+		var item T
+		if err := it.seg.decodeLocked(e, &item); err != nil {
+			it.err = errors.Wrapf(err, "failed to read item of segment (#%d)", it.number)
+			return false
+		}
+		it.item = item
+		return true
+	}
+	return false
+}
+
+// Item returns the item Next moved to.
+func (it *Iterator[T]) Item() T {
+	return it.item
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Close releases the file of the segment being read.
+func (it *Iterator[T]) Close() error {
+	it.done = true
+	if !it.closed {
+		it.closed = true
+		atomic.AddInt64(&it.queue.iterators, -1)
+	}
+	return it.closeSegment()
+}
+
+func (it *Iterator[T]) closeSegment() error {
+	if it.seg == nil {
+		return nil
+	}
+	err := it.seg.closeReaderLocked()
+	it.seg = nil
+	if it.tmpDir != "" {
+		os.RemoveAll(it.tmpDir)
+		it.tmpDir = ""
+	}
+	return errors.Wrap(err, "failed to close segment file")
+}
+
+// nextSegment loads the first segment after the current one, or ends the iteration if there
+// is none.
+func (it *Iterator[T]) nextSegment() error {
+	if err := it.closeSegment(); err != nil {
+		return err
+	}
+
+	q := it.queue
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.readOnly {
+		if err := q.refreshReadOnlyLocked(); err != nil {
+			return err
+		}
+	} else {
+		// Buffered writes must be in the files read below.
+		if err := q.firstSegment.writePending(); err != nil {
+			return err
+		}
+		if err := q.lastSegment.writePending(); err != nil {
+			return err
+		}
+	}
+
+	next := 0
+	for _, number := range q.segments {
+		if number > it.number {
+			next = number
+			break
+		}
+	}
+	if next == 0 {
+		it.done = true
+		return nil
+	}
+	folderPath := q.options.FolderPath
+	if q.isColdLocked(next) {
+		dir, err := q.fetchColdTemp(next)
+		if err != nil {
+			return err
+		}
+		folderPath, it.tmpDir = dir, dir
+	}
+	var seg *segment[T]
+	open := func() error {
+		seg = &segment[T]{
+			folderPath:    folderPath,
+			segmentNumber: next,
+			converter:     q.options.Converter,
+			options:       &q.options,
+			readOnly:      true,
+		}
+		if err := seg.load(); err != nil {
+			return errors.Wrapf(err, "failed to read segment (#%d)", next)
+		}
+		// Open the file now, as the segment may be deleted once the queue is unlocked.
+		reader, err := os.Open(seg.filePath())
+		if err != nil {
+			return errors.Wrapf(err, "failed to open segment (#%d)", next)
+		}
+		seg.reader = reader
+		return nil
+	}
+	if q.readOnly {
+		if found, err := readRenamed(open); err != nil {
+			return err
+		} else if !found {
+			it.number = next
+			return nil
+		}
+	} else if err := open(); err != nil {
+		return err
+	}
+	it.lost = map[int]bool{}
+	for _, index := range seg.lostIndexes {
+		it.lost[index] = true
+	}
+	it.seg, it.number, it.pos = seg, next, 0
+	return nil
+}
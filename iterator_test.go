@@ -0,0 +1,46 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueIter(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	defer queue.Close()
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeue(t, queue, "a")
+
+	items := []string{}
+	it := queue.Iter()
+	for it.Next() {
+		items = append(items, it.Item())
+		if it.Item() == "c" {
+			// Segments started while iterating are visited
+			assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+		}
+	}
+	assert.Nil(t, it.Err())
+	assert.Nil(t, it.Close())
+	assert.Equal(t, []string{"b", "c", "d", "e", "f"}, items)
+	assert.Equal(t, 5, queue.Len())
+
+	items = []string{}
+	assert.Nil(t, queue.Range(func(item string) bool {
+		items = append(items, item)
+		return len(items) < 2
+	}))
+	assert.Equal(t, []string{"b", "c"}, items)
+}
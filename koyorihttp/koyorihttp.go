@@ -0,0 +1,189 @@
+// Package koyorihttp exposes a queue over HTTP, so that processes not written in Go can use it:
+//
+//	POST /enqueue   adds the item in the request body
+//	POST /dequeue   removes the first item and returns it as the response body
+//	GET  /peek      returns the first item without removing it
+//	GET  /stats     returns the number of items and the age of the oldest as JSON
+//
+// /dequeue and /peek respond with 204 No Content if the queue is empty. Item headers (see
+// Queue.EnqueueWithHeaders) are passed as HTTP headers prefixed with Koyori-Header-, with
+// their names in lower case.
+package koyorihttp
+
+import (
+	"encoding/json"
+	"github.com/jungnoh/koyori"
+	"github.com/jungnoh/koyori/converters"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HeaderPrefix starts the names of HTTP headers carrying item headers.
+const HeaderPrefix = "Koyori-Header-"
+
+const defaultMaxBodySize = 16 << 20
+
+// Options configure a Handler.
+type Options[T any] struct {
+	// Converter decodes request bodies into items and encodes items into response bodies. It
+	// defaults to converters.JSONConverter. It doesn't have to be the converter of the queue.
+	Converter koyori.Converter[T]
+	// ContentType is the media type of item bodies. It defaults to application/json with the
+	// default converter, and to application/octet-stream otherwise.
+	ContentType string
+	// MaxBodySize limits the size of an enqueued item, 16 MiB by default.
+	MaxBodySize int64
+}
+
+// Stats is the response of /stats. The ages are in seconds, and zero unless the queue records
+// enqueue times (see koyori.QueueOptions.RecordEnqueueTime).
+type Stats struct {
+	Len           int     `json:"len"`
+	ScheduledLen  int     `json:"scheduledLen"`
+	OldestItemAge float64 `json:"oldestItemAge"`
+	NewestItemAge float64 `json:"newestItemAge"`
+}
+
+type handler[T any] struct {
+	queue   *koyori.Queue[T]
+	options Options[T]
+	mux     *http.ServeMux
+}
+
+// NewHandler returns a handler serving queue. The routes are relative to the handler, so it
+// can be mounted under a prefix with http.StripPrefix.
+func NewHandler[T any](queue *koyori.Queue[T], options Options[T]) http.Handler {
+	if options.Converter == nil {
+		options.Converter = converters.JSONConverter[T]{}
+		if options.ContentType == "" {
+			options.ContentType = "application/json"
+		}
+	}
+	if options.ContentType == "" {
+		options.ContentType = "application/octet-stream"
+	}
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = defaultMaxBodySize
+	}
+	h := &handler[T]{queue: queue, options: options, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/enqueue", h.method(http.MethodPost, h.enqueue))
+	h.mux.HandleFunc("/dequeue", h.method(http.MethodPost, h.dequeue))
+	h.mux.HandleFunc("/peek", h.method(http.MethodGet, h.peek))
+	h.mux.HandleFunc("/stats", h.method(http.MethodGet, h.stats))
+	return h
+}
+
+func (h *handler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler[T]) method(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (h *handler[T]) enqueue(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.options.MaxBodySize))
+	if err != nil {
+		http.Error(w, "failed to read body: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	item, err := h.options.Converter.Unmarshal(body)
+	if err != nil {
+		http.Error(w, "failed to decode item: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, HeaderPrefix) && len(values) > 0 {
+			headers[strings.ToLower(strings.TrimPrefix(name, HeaderPrefix))] = values[0]
+		}
+	}
+	if len(headers) > 0 {
+		_, err = h.queue.EnqueueWithHeaders(item, headers)
+	} else {
+		_, err = h.queue.Enqueue(item)
+	}
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler[T]) dequeue(w http.ResponseWriter, r *http.Request) {
+	msg, err := h.queue.DequeueMessage()
+	if errors.Is(err, koyori.ErrEmpty) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		h.fail(w, err)
+		return
+	}
+	for name, value := range msg.Headers {
+		w.Header().Set(HeaderPrefix+name, value)
+	}
+	h.writeItem(w, msg.Item)
+}
+
+func (h *handler[T]) peek(w http.ResponseWriter, r *http.Request) {
+	it := h.queue.Iter()
+	found := it.Next()
+	item := it.Item()
+	it.Close()
+	if err := it.Err(); err != nil {
+		h.fail(w, err)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.writeItem(w, item)
+}
+
+func (h *handler[T]) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Stats{
+		Len:           h.queue.Len(),
+		ScheduledLen:  h.queue.ScheduledLen(),
+		OldestItemAge: h.queue.OldestItemAge().Seconds(),
+		NewestItemAge: h.queue.NewestItemAge().Seconds(),
+	})
+}
+
+func (h *handler[T]) writeItem(w http.ResponseWriter, item T) {
+	body, err := h.options.Converter.Marshal(item)
+	if err != nil {
+		http.Error(w, "failed to encode item: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", h.options.ContentType)
+	w.Write(body)
+}
+
+// fail responds with the status matching an error of the queue.
+func (h *handler[T]) fail(w http.ResponseWriter, err error) {
+	var full *koyori.FullError
+	switch {
+	case errors.As(err, &full):
+		if full.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(full.RetryAfter.Seconds()))))
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, koyori.ErrQueueFull), errors.Is(err, koyori.ErrClosed), errors.Is(err, koyori.ErrDraining):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
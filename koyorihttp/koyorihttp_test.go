@@ -0,0 +1,91 @@
+package koyorihttp_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/jungnoh/koyori/converters"
+	"github.com/jungnoh/koyori/koyorihttp"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type job struct {
+	Name string `json:"name"`
+}
+
+func TestHandler(t *testing.T) {
+	queue, err := koyori.NewQueue(koyori.QueueOptions[job]{
+		Converter:            converters.JSONConverter[job]{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+		MaxItems:             2,
+	})
+	assert.Nil(t, err)
+	server := httptest.NewServer(koyorihttp.NewHandler(queue, koyorihttp.Options[job]{}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/dequeue", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/enqueue", "application/json", strings.NewReader(`{"name":"a"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/enqueue", strings.NewReader(`{"name":"b"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Koyori-Header-Traceparent", "00-abc-def-01")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, err = http.Post(server.URL+"/enqueue", "application/json", strings.NewReader(`{"name":"c"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp, err = http.Post(server.URL+"/enqueue", "application/json", strings.NewReader(`not json`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(server.URL + "/enqueue")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/stats")
+	assert.Nil(t, err)
+	stats := koyorihttp.Stats{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 2, stats.Len)
+	assert.Equal(t, 0, stats.ScheduledLen)
+	// Only "b" was enqueued with headers, which record the enqueue time.
+	assert.Greater(t, stats.OldestItemAge, 0.0)
+	assert.Greater(t, stats.NewestItemAge, 0.0)
+
+	resp, err = http.Get(server.URL + "/peek")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"a"}`, readBody(t, resp))
+	resp, err = http.Post(server.URL+"/dequeue", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"name":"a"}`, readBody(t, resp))
+	resp, err = http.Post(server.URL+"/dequeue", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "00-abc-def-01", resp.Header.Get("Koyori-Header-Traceparent"))
+	assert.Equal(t, `{"name":"b"}`, readBody(t, resp))
+	resp, err = http.Get(server.URL + "/peek")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Nil(t, queue.Close())
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
@@ -0,0 +1,116 @@
+// Package koyoriotel carries OpenTelemetry trace context through koyori queues. The span
+// context of the producer is stored in the headers of each item, so a trace continues on the
+// consumer side, even after a restart. It is a separate module, so that koyori itself doesn't
+// depend on OpenTelemetry.
+package koyoriotel
+
+import (
+	"context"
+	"github.com/jungnoh/koyori"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/jungnoh/koyori/koyoriotel"
+
+type config struct {
+	propagator     propagation.TextMapPropagator
+	tracerProvider trace.TracerProvider
+}
+
+// Option configures how trace context is propagated.
+type Option func(*config)
+
+// WithPropagator sets the propagator that writes the span context into the headers of items
+// and reads it back. It defaults to the global propagator.
+func WithPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagator = propagator
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer that starts consumer spans. It defaults
+// to the global provider.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = provider
+	}
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		propagator:     otel.GetTextMapPropagator(),
+		tracerProvider: otel.GetTracerProvider(),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// Enqueue adds item to queue with the span context of ctx in its headers, and returns its
+// sequence number.
+func Enqueue[T any](ctx context.Context, queue *koyori.Queue[T], item T, opts ...Option) (uint64, error) {
+	return EnqueueWithHeaders(ctx, queue, item, nil, opts...)
+}
+
+// EnqueueWithHeaders adds item to queue with the given headers and the span context of ctx.
+func EnqueueWithHeaders[T any](ctx context.Context, queue *koyori.Queue[T], item T, headers map[string]string, opts ...Option) (uint64, error) {
+	c := newConfig(opts)
+	carrier := propagation.MapCarrier{}
+	for key, value := range headers {
+		carrier[key] = value
+	}
+	c.propagator.Inject(ctx, carrier)
+	return queue.EnqueueWithHeaders(item, carrier)
+}
+
+// Dequeue removes the first item of queue. The returned context is derived from ctx and holds
+// the span context the item was enqueued with, so spans started from it continue the trace of
+// the producer.
+func Dequeue[T any](ctx context.Context, queue *koyori.Queue[T], opts ...Option) (koyori.Message[T], context.Context, error) {
+	msg, err := queue.DequeueMessage()
+	if err != nil {
+		return msg, ctx, err
+	}
+	return msg, Extract(ctx, msg, opts...), nil
+}
+
+// DequeueSpan removes the first item of queue and starts a consumer span for processing it,
+// which links to the span the item was enqueued in. Unlike a child span, the consumer span
+// stays in the trace of ctx. The caller must end the span.
+func DequeueSpan[T any](ctx context.Context, queue *koyori.Queue[T], opts ...Option) (koyori.Message[T], context.Context, trace.Span, error) {
+	msg, err := queue.DequeueMessage()
+	if err != nil {
+		return msg, ctx, nil, err
+	}
+	ctx, span := StartConsumerSpan(ctx, msg, opts...)
+	return msg, ctx, span, nil
+}
+
+// Extract returns a copy of ctx holding the span context stored in the headers of msg, if any.
+func Extract[T any](ctx context.Context, msg koyori.Message[T], opts ...Option) context.Context {
+	c := newConfig(opts)
+	return c.propagator.Extract(ctx, propagation.MapCarrier(msg.Headers))
+}
+
+// StartConsumerSpan starts a consumer span as a child of ctx for processing msg, linked to the
+// span the item was enqueued in.
+func StartConsumerSpan[T any](ctx context.Context, msg koyori.Message[T], opts ...Option) (context.Context, trace.Span) {
+	c := newConfig(opts)
+	producer := trace.SpanContextFromContext(c.propagator.Extract(context.Background(), propagation.MapCarrier(msg.Headers)))
+	spanOpts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "koyori"),
+			attribute.String("messaging.operation", "process"),
+			attribute.Int("messaging.koyori.attempts", msg.Attempts),
+		),
+	}
+	if producer.IsValid() {
+		spanOpts = append(spanOpts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	return c.tracerProvider.Tracer(instrumentationName).Start(ctx, "koyori process", spanOpts...)
+}
@@ -0,0 +1,81 @@
+package koyoriotel_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/jungnoh/koyori/koyoriotel"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type StringConverter struct{}
+
+func (s StringConverter) Marshal(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (s StringConverter) Unmarshal(v []byte) (string, error) {
+	return string(v), nil
+}
+
+func TestPropagation(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otelOpts := []koyoriotel.Option{
+		koyoriotel.WithPropagator(propagation.TraceContext{}),
+		koyoriotel.WithTracerProvider(provider),
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	ctx, producer := provider.Tracer("test").Start(context.Background(), "produce")
+	_, err = koyoriotel.Enqueue(ctx, queue, "a", otelOpts...)
+	assert.Nil(t, err)
+	sequence, err := koyoriotel.EnqueueWithHeaders(ctx, queue, "b", map[string]string{"k": "v"}, otelOpts...)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), sequence)
+	producer.End()
+	assert.Nil(t, queue.Close())
+
+	// The span context survives reopening the queue.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	msg, ctx, err := koyoriotel.Dequeue(context.Background(), queue, otelOpts...)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", msg.Item)
+	remote := trace.SpanContextFromContext(ctx)
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, producer.SpanContext().TraceID(), remote.TraceID())
+	assert.Equal(t, producer.SpanContext().SpanID(), remote.SpanID())
+
+	msg, _, span, err := koyoriotel.DequeueSpan(context.Background(), queue, otelOpts...)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", msg.Item)
+	assert.Equal(t, "v", msg.Headers["k"])
+	span.End()
+	ended := recorder.Ended()
+	assert.Equal(t, 2, len(ended))
+	consumer := ended[1]
+	assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+	assert.NotEqual(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+	assert.Equal(t, 1, len(consumer.Links()))
+	assert.Equal(t, producer.SpanContext().SpanID(), consumer.Links()[0].SpanContext.SpanID())
+
+	_, _, _, err = koyoriotel.DequeueSpan(context.Background(), queue, otelOpts...)
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,279 @@
+package koyori
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("queue is full")
+
+// FullError is returned when MaxItems or MaxBytes keep items from being enqueued. It matches
+// ErrQueueFull with errors.Is.
+type FullError struct {
+	// RetryAfter estimates when there will be room for the items from the recent rate at which
+	// items were dequeued. It is zero if nothing was dequeued recently.
+	RetryAfter time.Duration
+}
+
+func (e *FullError) Error() string {
+	if e.RetryAfter == 0 {
+		return ErrQueueFull.Error()
+	}
+	return fmt.Sprintf("%v, retry after %v", ErrQueueFull, e.RetryAfter)
+}
+
+func (e *FullError) Is(target error) bool {
+	return target == ErrQueueFull
+}
+
+// EnqueueWait adds item to the queue, waiting for room while it is full.
+func (q *Queue[T]) EnqueueWait(ctx context.Context, item T) error {
+	for {
+		removed := q.removed.wait()
+		_, err := q.Enqueue(item)
+		if !errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		// Space freed by deleting a segment may come after the wakeup, so check now and then.
+		timer := time.NewTimer(waitPollInterval)
+		select {
+		case <-removed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-q.closed:
+			timer.Stop()
+			return ErrClosed
+		}
+		timer.Stop()
+	}
+}
+
+// OverflowPolicy decides what happens to items enqueued while MaxItems or MaxBytes is reached.
+type OverflowPolicy int
+
+const (
+	// OverflowReject returns a FullError.
+	OverflowReject OverflowPolicy = iota
+	// OverflowDropOldest removes items from the head of the queue to make room, so the queue
+	// works as a ring buffer. As removed items only free up disk space once their segment is
+	// deleted, MaxBytes drops a whole segment's worth. Reserved items aren't dropped, and a
+	// FullError is returned if there is no room without them. Enqueuing into a full queue then
+	// also waits for dequeuers.
+	OverflowDropOldest
+	// OverflowDropNewest drops the enqueued items instead, without returning an error. As items
+	// are numbered from 1 on, Enqueue and the like return 0 as the sequence number of dropped
+	// items.
+	OverflowDropNewest
+)
+
+// lockForEnqueue takes the locks to enqueue count items, making room for them according to
+// OverflowPolicy. If admit is false, the items are not to be enqueued: they were dropped, or
+// rejected with err. unlock must be called either way.
+func (q *Queue[T]) lockForEnqueue(count int) (unlock func(), admit bool, err error) {
+	q.tailMutex.Lock()
+	if err := q.checkAcceptingLocked(); err != nil {
+		return q.tailMutex.Unlock, false, err
+	}
+	full := q.checkCapacityLocked(count)
+	if full == nil {
+		return q.tailMutex.Unlock, true, nil
+	}
+	switch q.options.OverflowPolicy {
+	case OverflowDropNewest:
+		q.emit(Event{Type: EventDrop, Count: count})
+		return q.tailMutex.Unlock, false, nil
+	case OverflowDropOldest:
+		// Dropping items takes headMutex, which has to be locked first.
+		q.tailMutex.Unlock()
+		q.lock()
+		if err := q.checkAcceptingLocked(); err != nil {
+			return q.unlock, false, err
+		}
+		if err := q.dropOldestLocked(count); err != nil {
+			return q.unlock, false, err
+		}
+		return q.unlock, true, nil
+	}
+	return q.tailMutex.Unlock, false, full
+}
+
+// dropOldestLocked removes items from the head of the queue until count more items fit, or
+// returns a FullError if they can't. The caller holds both locks.
+func (q *Queue[T]) dropOldestLocked(count int) error {
+	for {
+		items, overBytes := q.excessLocked(count)
+		if items == 0 && !overBytes {
+			return nil
+		}
+		if overBytes {
+			if firstCount := q.firstSegment.count(); firstCount > items {
+				items = firstCount
+			}
+		}
+		first := q.firstSegment
+		dropped, err := first.dropOldest(items)
+		if err != nil {
+			return errors.Wrap(err, "failed to drop items")
+		}
+		if dropped > 0 {
+			q.emit(Event{Type: EventDrop, Count: dropped})
+		}
+		if err := q.closeDrainedSegmentsBothLocked(); err != nil {
+			return errors.Wrap(err, "failed to close segment")
+		}
+		if dropped == 0 && q.firstSegment == first {
+			return q.checkCapacityLocked(count)
+		}
+	}
+}
+
+// dropOldest removes up to max items from the head of the segment, skipping reserved ones.
+func (s *segment[T]) dropOldest(max int) (int, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	legacy := s.header.version < segmentFormatV1
+	now := s.options.now()
+	indexes := []int{}
+	for i := range s.entries {
+		if len(indexes) == max {
+			break
+		}
+		e := &s.entries[i]
+		if s.reservedLocked(e, now) {
+			if legacy {
+				break
+			}
+			continue
+		}
+		indexes = append(indexes, e.index)
+	}
+	if len(indexes) == 0 {
+		return 0, nil
+	}
+	return len(indexes), s.dropIndexesLocked(indexes)
+}
+
+// excessLocked returns by how many items count more items exceed MaxItems, and whether the
+// segment files reached MaxBytes. A queue holding no items takes them regardless of MaxBytes,
+// as the space of removed items may only be reclaimed once more are added. The caller holds
+// tailMutex.
+func (q *Queue[T]) excessLocked(count int) (int, bool) {
+	if q.options.MaxItems <= 0 && q.options.MaxBytes <= 0 {
+		return 0, false
+	}
+	length := q.lenLocked()
+	items := 0
+	if q.options.MaxItems > 0 && length+count > q.options.MaxItems {
+		items = length + count - q.options.MaxItems
+	}
+	overBytes := q.options.MaxBytes > 0 && length > 0 && q.bytesLocked() >= q.options.MaxBytes
+	return items, overBytes
+}
+
+// checkCapacityLocked returns a FullError if count more items don't fit in the queue. The caller
+// holds tailMutex.
+func (q *Queue[T]) checkCapacityLocked(count int) error {
+	items, overBytes := q.excessLocked(count)
+	if items == 0 && !overBytes {
+		return nil
+	}
+	excess := float64(items)
+	if overBytes {
+		excessItems := 1.0
+		if q.avgItemSize > 0 {
+			excessItems = float64(q.bytesLocked()-q.options.MaxBytes)/q.avgItemSize + 1
+		}
+		if excessItems > excess {
+			excess = excessItems
+		}
+	}
+	err := &FullError{}
+	if rate := q.dequeueRate.perSecond(); rate > 0 {
+		err.RetryAfter = time.Duration(excess / rate * float64(time.Second))
+	}
+	return err
+}
+
+// lenLocked returns the number of items in the queue. Moving firstSegment takes tailMutex as
+// well, so holding either lock is enough.
+func (q *Queue[T]) lenLocked() int {
+	count := q.firstSegment.count() + q.middleCount
+	if q.lastSegment != q.firstSegment {
+		count += q.lastSegment.count()
+	}
+	return count
+}
+
+// bytesLocked returns the size of the queue's segment files. The caller holds tailMutex.
+func (q *Queue[T]) bytesLocked() int64 {
+	size := q.firstSegment.fileSize() + q.middleBytes
+	if q.lastSegment != q.firstSegment {
+		size += q.lastSegment.fileSize()
+	}
+	return size
+}
+
+const (
+	rateWindow    = time.Second
+	rateSmoothing = 0.5
+)
+
+// rateEstimator keeps a running average of how many items per second are counted by observe.
+type rateEstimator struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	count       int
+	rate        float64
+}
+
+func (r *rateEstimator) observe(count int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+	}
+	r.count += count
+	r.closeWindowLocked(now)
+}
+
+// closeWindowLocked folds the counted items into the average once a window has passed.
+func (r *rateEstimator) closeWindowLocked(now time.Time) {
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	windowRate := float64(r.count) / elapsed.Seconds()
+	if r.rate == 0 {
+		r.rate = windowRate
+	} else {
+		r.rate += rateSmoothing * (windowRate - r.rate)
+	}
+	r.windowStart = now
+	r.count = 0
+}
+
+// perSecond returns the average rate, or the rate of the current window until a window passed.
+func (r *rateEstimator) perSecond() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.windowStart.IsZero() {
+		return 0
+	}
+	now := time.Now()
+	r.closeWindowLocked(now)
+	if r.rate == 0 {
+		if elapsed := now.Sub(r.windowStart); elapsed > 0 {
+			return float64(r.count) / elapsed.Seconds()
+		}
+	}
+	return r.rate
+}
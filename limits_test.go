@@ -0,0 +1,152 @@
+package koyori_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueMaxItems(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		MaxItems:             3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+	assert.ErrorIs(t, enqueueErr(queue.EnqueueMany([]string{"c", "d"})), koyori.ErrQueueFull)
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	_, err = queue.Enqueue("d")
+	assert.ErrorIs(t, err, koyori.ErrQueueFull)
+	var fullErr *koyori.FullError
+	assert.True(t, errors.As(err, &fullErr))
+	assert.Equal(t, 3, queue.Len())
+
+	// Dequeuing makes room, and gives an estimate of when there will be room again.
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	_, err = queue.Enqueue("e")
+	assert.True(t, errors.As(err, &fullErr))
+	assert.Greater(t, fullErr.RetryAfter, time.Duration(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, queue.EnqueueWait(ctx, "e"), context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assertDequeue(t, queue, "b")
+	}()
+	assert.Nil(t, queue.EnqueueWait(context.Background(), "e"))
+	assertDequeueMany(t, queue, 3, []string{"c", "d", "e"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		MaxBytes:             1000,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	item := strings.Repeat("x", 100)
+	enqueued := 0
+	for ; enqueued < 20; enqueued++ {
+		if _, err := queue.Enqueue(item); err != nil {
+			assert.ErrorIs(t, err, koyori.ErrQueueFull)
+			break
+		}
+	}
+	assert.Greater(t, enqueued, 5)
+	assert.Less(t, enqueued, 20)
+
+	// A reopened queue counts the size of the segments in the middle from their files.
+	assert.Nil(t, queue.Close())
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, enqueueErr(queue.Enqueue(item)), koyori.ErrQueueFull)
+	for i := 0; i < enqueued; i++ {
+		assertDequeue(t, queue, item)
+	}
+	assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueOverflowPolicy(t *testing.T) {
+	policies := map[koyori.OverflowPolicy][]string{
+		koyori.OverflowDropOldest: {"3", "4", "5"},
+		koyori.OverflowDropNewest: {"0", "1", "2"},
+	}
+	for policy, expected := range policies {
+		dropped := 0
+		opts := koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 2,
+			MaxItems:             3,
+			OverflowPolicy:       policy,
+			OnEvent: func(event koyori.Event) {
+				if event.Type == koyori.EventDrop {
+					dropped += event.Count
+				}
+			},
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"0", "1"})))
+		for i := 2; i < 6; i++ {
+			sequence, err := queue.Enqueue(fmt.Sprintf("%d", i))
+			assert.Nil(t, err)
+			// Dropped items aren't numbered.
+			if policy == koyori.OverflowDropNewest && i > 2 {
+				assert.Equal(t, uint64(0), sequence)
+			} else {
+				assert.Equal(t, uint64(i+1), sequence)
+			}
+		}
+		assert.Equal(t, 3, dropped)
+		assert.Equal(t, 3, queue.Len())
+		assertDequeueMany(t, queue, 3, expected)
+		// A batch larger than the queue can't be made room for.
+		if policy == koyori.OverflowDropOldest {
+			assert.ErrorIs(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})), koyori.ErrQueueFull)
+		}
+		assert.Nil(t, queue.Close())
+	}
+}
+
+func TestQueueOverflowDropOldestBytes(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		MaxBytes:             1000,
+		OverflowPolicy:       koyori.OverflowDropOldest,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, enqueueErr(queue.Enqueue(fmt.Sprintf("%02d%s", i, strings.Repeat("x", 100)))))
+	}
+	length := queue.Len()
+	assert.Less(t, length, 12)
+	items, err := queue.DequeueMany(length)
+	assert.Nil(t, err)
+	assert.Equal(t, "29", items[len(items)-1][:2])
+	assert.Nil(t, queue.Close())
+}
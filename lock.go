@@ -0,0 +1,72 @@
+package koyori
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrQueueLocked = errors.New("queue is locked by another process")
+
+const lockFilename = "koyori.lock"
+
+// producerLockFilename and consumerLockFilename are locked by the Producer and the Consumer of a
+// queue shared by two processes, which also share the lock on lockFilename between them.
+const (
+	producerLockFilename = "koyori.producer.lock"
+	consumerLockFilename = "koyori.consumer.lock"
+)
+
+// lockRetryInterval is how often a locked queue is retried while waiting for LockTimeout.
+const lockRetryInterval = 50 * time.Millisecond
+
+// acquireLock takes the exclusive lock on the queue folder, waiting up to timeout, or until ctx
+// is done, for another holder to release it.
+func acquireLock(ctx context.Context, folderPath string, mode os.FileMode, timeout time.Duration) (*os.File, error) {
+	return acquireLockFile(ctx, folderPath, lockFilename, mode, timeout, false)
+}
+
+// acquireLockFile takes the lock on the file with the given name in the queue folder, which
+// other holders of a shared lock can take as well if shared is set.
+func acquireLockFile(ctx context.Context, folderPath, name string, mode os.FileMode, timeout time.Duration, shared bool) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(folderPath, name), os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(file, shared)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to lock queue folder")
+		}
+		if locked {
+			return file, nil
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, errors.Wrap(ErrQueueLocked, folderPath)
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, errors.Wrap(ctx.Err(), "gave up waiting for lock")
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// releaseLock unlocks and closes a lock file returned by acquireLock. The file itself is left
+// in place, as removing it could let two processes lock different files.
+func releaseLock(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	if err := unlockFile(file); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to unlock queue folder")
+	}
+	return errors.Wrap(file.Close(), "failed to close lock file")
+}
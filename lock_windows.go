@@ -0,0 +1,25 @@
+//go:build windows
+
+package koyori
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+func tryLockFile(file *os.File, shared bool) (bool, error) {
+	overlapped := &windows.Overlapped{}
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if !shared {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,44 @@
+package koyori
+
+import "time"
+
+// slowSyncThreshold is how long syncing a segment file may take before it is logged as slow.
+const slowSyncThreshold = time.Second
+
+// Logger receives the warnings and debug traces of a queue, as a message followed by
+// alternating keys and values. *slog.Logger implements it; for other loggers, see LoggerFuncs.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Warn(msg string, args ...any)
+}
+
+// LoggerFuncs adapts a pair of functions to Logger, such as the Debugw and Warnw methods of a
+// zap.SugaredLogger.
+type LoggerFuncs struct {
+	DebugFunc func(msg string, keysAndValues ...any)
+	WarnFunc  func(msg string, keysAndValues ...any)
+}
+
+func (l LoggerFuncs) Debug(msg string, args ...any) {
+	if l.DebugFunc != nil {
+		l.DebugFunc(msg, args...)
+	}
+}
+
+func (l LoggerFuncs) Warn(msg string, args ...any) {
+	if l.WarnFunc != nil {
+		l.WarnFunc(msg, args...)
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Warn(string, ...any)  {}
+
+func (o *QueueOptions[T]) logger() Logger {
+	if o.Logger == nil {
+		return nopLogger{}
+	}
+	return o.Logger
+}
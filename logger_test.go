@@ -0,0 +1,62 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	debug []string
+	warn  []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.debug = append(l.debug, msg) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.warn = append(l.warn, msg) }
+
+func TestQueueLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		RecoveryMode:         koyori.RecoveryTruncate,
+		Logger:               logger,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, []string{"created segment"}, logger.debug)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, "notes.txt"), []byte("hello"), 0644))
+	file, err := os.OpenFile(filepath.Join(opts.FolderPath, "00001.queue.open"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{5, 0})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Contains(t, logger.debug, "skipping file that is not a segment")
+	assert.Equal(t, []string{"gave up on unreadable record"}, logger.warn)
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+}
+
+func TestLoggerFuncs(t *testing.T) {
+	messages := []string{}
+	logger := koyori.LoggerFuncs{
+		WarnFunc: func(msg string, keysAndValues ...any) {
+			messages = append(messages, fmt.Sprintln(append([]any{msg}, keysAndValues...)...))
+		},
+	}
+	logger.Debug("ignored")
+	logger.Warn("warned", "key", 1)
+	assert.Equal(t, []string{"warned key 1\n"}, messages)
+}
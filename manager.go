@@ -0,0 +1,229 @@
+package koyori
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCloseParallelism = 8
+
+var ErrManagerClosed = errors.New("manager is closed")
+
+// ManagerOptions configures a Manager.
+type ManagerOptions[T any] struct {
+	// Queue holds the options of every queue. Its FolderPath is the root folder of the manager,
+	// and each queue lives in the subfolder named after it.
+	Queue QueueOptions[T]
+	// OnEvent, if set, is called for the events of every queue along with its name, in addition
+	// to Queue.OnEvent.
+	OnEvent func(name string, event Event)
+	// CloseParallelism bounds how many queues CloseAll closes at once. Defaults to 8.
+	CloseParallelism int
+}
+
+// Manager opens named queues in subfolders of a root folder. With SyncPolicy set to
+// SyncInterval, the queues are synced by a single goroutine of the manager.
+type Manager[T any] struct {
+	options ManagerOptions[T]
+	// mutex is held for reading while the open queues are synced.
+	mutex  sync.RWMutex
+	queues map[string]*Queue[T]
+	closed bool
+
+	stopSync chan struct{}
+	syncDone sync.WaitGroup
+}
+
+// NewManager creates the root folder if needed and returns a manager for the queues in it.
+func NewManager[T any](options ManagerOptions[T]) (*Manager[T], error) {
+	if err := os.MkdirAll(options.Queue.FolderPath, options.Queue.dirMode()); err != nil {
+		return nil, errors.Wrap(err, "failed to ensure folder exists")
+	}
+	if options.CloseParallelism <= 0 {
+		options.CloseParallelism = defaultCloseParallelism
+	}
+	m := &Manager[T]{options: options, queues: map[string]*Queue[T]{}, stopSync: make(chan struct{})}
+	if policy := options.Queue.syncPolicy(); policy.Mode == SyncInterval && policy.Interval > 0 {
+		m.syncDone.Add(1)
+		go m.runSync(policy.Interval)
+	}
+	return m, nil
+}
+
+// Open returns the queue with the given name, opening it if it isn't open yet. Queues stay open
+// until they are deleted or the manager is closed, and must not be closed by the caller.
+func (m *Manager[T]) Open(name string) (*Queue[T], error) {
+	if err := checkQueueName(name); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if queue, ok := m.queues[name]; ok {
+		return queue, nil
+	}
+	options := m.options.Queue
+	options.FolderPath = filepath.Join(m.options.Queue.FolderPath, name)
+	if onEvent := m.options.OnEvent; onEvent != nil {
+		queueOnEvent := options.OnEvent
+		options.OnEvent = func(event Event) {
+			if queueOnEvent != nil {
+				queueOnEvent(event)
+			}
+			onEvent(name, event)
+		}
+	}
+	queue, err := openQueue(context.Background(), options, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open queue %s", name)
+	}
+	m.queues[name] = queue
+	return queue, nil
+}
+
+// List returns the names of all queues in the root folder, whether they are open or not.
+func (m *Manager[T]) List() ([]string, error) {
+	entries, err := os.ReadDir(m.options.Queue.FolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read folder")
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && checkQueueName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete closes the queue with the given name if it is open, and deletes its folder.
+func (m *Manager[T]) Delete(name string) error {
+	if err := checkQueueName(name); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if queue, ok := m.queues[name]; ok {
+		delete(m.queues, name)
+		if err := queue.Close(); err != nil {
+			return errors.Wrapf(err, "failed to close queue %s", name)
+		}
+	}
+	return errors.Wrapf(os.RemoveAll(filepath.Join(m.options.Queue.FolderPath, name)), "failed to delete queue %s", name)
+}
+
+// CloseAll flushes and closes the open queues, up to CloseParallelism at once. The failures are
+// returned as a QueueErrors. Queues it didn't get to before ctx was done are listed there with
+// the error of ctx, and stay open, holding their folders, until CloseAll is called again.
+// The manager can't open queues afterwards.
+func (m *Manager[T]) CloseAll(ctx context.Context) error {
+	m.mutex.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.stopSync)
+	}
+	queues := make(map[string]*Queue[T], len(m.queues))
+	for name, queue := range m.queues {
+		queues[name] = queue
+	}
+	m.mutex.Unlock()
+	m.syncDone.Wait()
+	closed := func(name string) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		delete(m.queues, name)
+	}
+
+	failures := QueueErrors{}
+	var failuresMutex sync.Mutex
+	fail := func(name string, err error) {
+		failuresMutex.Lock()
+		defer failuresMutex.Unlock()
+		failures[name] = err
+	}
+	slots := make(chan struct{}, m.options.CloseParallelism)
+	var wg sync.WaitGroup
+	for name, queue := range queues {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			fail(name, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(name string, queue *Queue[T]) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer closed(name)
+			if err := queue.Flush(); err != nil {
+				queue.Close()
+				fail(name, err)
+				return
+			}
+			if err := queue.Close(); err != nil {
+				fail(name, err)
+			}
+		}(name, queue)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// runSync syncs the open queues every interval until the manager is closed.
+func (m *Manager[T]) runSync(interval time.Duration) {
+	defer m.syncDone.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopSync:
+			return
+		case <-ticker.C:
+			m.mutex.RLock()
+			for _, queue := range m.queues {
+				if err := queue.syncDirty(); err != nil {
+					queue.options.logger().Warn("background sync failed", "folder", queue.options.FolderPath, "err", err)
+				}
+			}
+			m.mutex.RUnlock()
+		}
+	}
+}
+
+// checkQueueName fails for names that can't be used as a single folder name.
+func checkQueueName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid queue name %q", name)
+	}
+	return nil
+}
+
+// QueueErrors holds the errors of several queues by name.
+type QueueErrors map[string]error
+
+func (e QueueErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("%s: %v", name, e[name])
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,110 @@
+package koyori_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	enqueued := map[string]int{}
+	options := koyori.ManagerOptions[string]{
+		Queue: koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 10,
+			SyncPolicy:           koyori.SyncPolicy{Mode: koyori.SyncInterval, Interval: time.Millisecond},
+		},
+		OnEvent: func(name string, event koyori.Event) {
+			if event.Type == koyori.EventEnqueue {
+				enqueued[name] += event.Count
+			}
+		},
+	}
+	manager, err := koyori.NewManager(options)
+	assert.Nil(t, err)
+	a, err := manager.Open("a")
+	assert.Nil(t, err)
+	b, err := manager.Open("b")
+	assert.Nil(t, err)
+	again, err := manager.Open("a")
+	assert.Nil(t, err)
+	assert.Same(t, a, again)
+	_, err = manager.Open("../c")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, enqueueErr(a.EnqueueMany([]string{"1", "2"})))
+	assert.Nil(t, enqueueErr(b.Enqueue("3")))
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, enqueued)
+	time.Sleep(10 * time.Millisecond)
+
+	names, err := manager.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, names)
+	assert.Nil(t, manager.Delete("b"))
+	names, err = manager.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, names)
+
+	assert.Nil(t, manager.CloseAll(context.Background()))
+	_, err = manager.Open("a")
+	assert.ErrorIs(t, err, koyori.ErrManagerClosed)
+
+	manager, err = koyori.NewManager(options)
+	assert.Nil(t, err)
+	a, err = manager.Open("a")
+	assert.Nil(t, err)
+	assertDequeueMany(t, a, 2, []string{"1", "2"})
+	b, err = manager.Open("b")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, b.Len())
+	assert.Nil(t, manager.CloseAll(context.Background()))
+}
+
+func TestManagerCloseAllCanceled(t *testing.T) {
+	options := koyori.ManagerOptions[string]{
+		Queue: koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 10,
+		},
+		CloseParallelism: 1,
+	}
+	manager, err := koyori.NewManager(options)
+	assert.Nil(t, err)
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		queue, err := manager.Open(name)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.Enqueue(name)))
+	}
+
+	// Queues left open when ctx is done are reported, and closed by calling CloseAll again.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = manager.CloseAll(ctx)
+	if err != nil {
+		var failures koyori.QueueErrors
+		assert.ErrorAs(t, err, &failures)
+		for _, failure := range failures {
+			assert.ErrorIs(t, failure, context.Canceled)
+		}
+	}
+	assert.Nil(t, manager.CloseAll(context.Background()))
+
+	manager, err = koyori.NewManager(options)
+	assert.Nil(t, err)
+	for _, name := range names {
+		queue, err := manager.Open(name)
+		assert.Nil(t, err)
+		assertDequeue(t, queue, name)
+	}
+	assert.Nil(t, manager.CloseAll(context.Background()))
+}
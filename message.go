@@ -0,0 +1,128 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Message is an item together with the metadata stored alongside it, as returned by
+// DequeueMessage.
+type Message[T any] struct {
+	Item T
+	// Headers are the headers the item was enqueued with by EnqueueWithHeaders, or nil.
+	Headers map[string]string
+	// EnqueuedAt is when the item was enqueued. It is only known for items enqueued with
+	// headers, or with MinAge, ItemTTL or RecordEnqueueTime set, and zero otherwise.
+	EnqueuedAt time.Time
+	// Attempts counts the deliveries of the item, including this one. Reservations that were
+	// nacked or expired count as deliveries; they are only remembered across restarts with
+	// VisibilityTimeout set.
+	Attempts int
+	// Priority is the priority level of the item in a PriorityQueue.
+	Priority int
+	// Sequence is the number Enqueue returned for the item. Items keep it when they are
+	// retried, but get a new one when moved to a dead letter queue. It is zero for items
+	// added by PushFront or enqueued before items were numbered.
+	Sequence uint64
+}
+
+// EnqueueWithHeaders adds an item along with user-defined headers, such as a tracing context,
+// which DequeueMessage returns with the item. The item is stored in an envelope that also
+// records its enqueue time. Items added otherwise have no headers. It returns the sequence
+// number of the item, like Enqueue.
+func (q *Queue[T]) EnqueueWithHeaders(item T, headers map[string]string) (uint64, error) {
+	return q.enqueueEnvelope(item, envelope{headers: headers})
+}
+
+// enqueueEnvelope adds an item with the metadata of env, stamped with the current time unless
+// env has an enqueue time, and returns its sequence number.
+func (q *Queue[T]) enqueueEnvelope(item T, env envelope) (uint64, error) {
+	if len(env.headers) > 0 {
+		headers := make(map[string]string, len(env.headers))
+		for key, value := range env.headers {
+			headers[key] = value
+		}
+		env.headers = headers
+	} else {
+		env.headers = nil
+	}
+	if env.enqueuedAt.IsZero() {
+		env.enqueuedAt = q.options.now()
+	}
+
+	unlock, admit, err := q.lockForEnqueue(1)
+	defer unlock()
+	if !admit {
+		return 0, err
+	}
+	return q.enqueueEnvelopeLocked(item, env)
+}
+
+// enqueueEnvelopeLocked adds an item with the metadata of env, numbered as the next item unless
+// env has a sequence number already, and returns the number. The caller holds tailMutex.
+func (q *Queue[T]) enqueueEnvelopeLocked(item T, env envelope) (uint64, error) {
+	if q.lastSegment.full() {
+		if err := q.addSegmentLocked(); err != nil {
+			return 0, errors.Wrap(err, "failed to add new segment")
+		}
+	}
+	if env.sequence == 0 {
+		env.sequence = q.nextSequence
+	}
+	bytesBefore, _ := q.lastSegment.recordStats()
+	if err := q.lastSegment.addEnvelope(item, env); err != nil {
+		return 0, errors.Wrap(err, "failed to insert")
+	}
+	q.raiseSequenceLocked(env.sequence + 1)
+	bytesAfter, _ := q.lastSegment.recordStats()
+	q.observeItemSizes(bytesAfter-bytesBefore, 1)
+	q.emit(Event{Type: EventEnqueue, Count: 1})
+	q.notifyAdded()
+	return env.sequence, nil
+}
+
+// DequeueMessage removes the first item of the queue like Dequeue, returning it along with its
+// metadata.
+func (q *Queue[T]) DequeueMessage() (Message[T], error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return Message[T]{}, err
+	}
+	if err := q.beforeDequeueLocked(); err != nil {
+		return Message[T]{}, err
+	}
+	msg := Message[T]{}
+	if err := q.skipPoisonLocked(func() error { return q.firstSegment.removeMessage(&msg) }); err != nil {
+		if err == errEmptySegment {
+			return Message[T]{}, ErrEmpty
+		}
+		return Message[T]{}, errors.Wrap(err, "failed to dequeue from segment")
+	}
+	q.emit(Event{Type: EventDequeue, Count: 1})
+	return msg, q.closeDrainedSegmentsLocked()
+}
+
+// EnqueueWithHeaders adds an item with the given priority along with user-defined headers,
+// returning its sequence number within the level (see Enqueue).
+func (pq *PriorityQueue[T]) EnqueueWithHeaders(item T, priority int, headers map[string]string) (uint64, error) {
+	queue, err := pq.level(priority)
+	if err != nil {
+		return 0, err
+	}
+	return queue.enqueueEnvelope(item, envelope{headers: headers, priority: priority})
+}
+
+// DequeueMessage removes the first item of the highest priority level holding any, returning
+// it along with its metadata.
+func (pq *PriorityQueue[T]) DequeueMessage() (Message[T], error) {
+	for priority := len(pq.levels) - 1; priority >= 0; priority-- {
+		msg, err := pq.levels[priority].DequeueMessage()
+		if !errors.Is(err, ErrEmpty) {
+			msg.Priority = priority
+			return msg, err
+		}
+	}
+	return Message[T]{}, ErrEmpty
+}
@@ -0,0 +1,104 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueHeaders(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+		VisibilityTimeout:    time.Minute,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	start := time.Now()
+	headers := map[string]string{"traceparent": "00-abc-def-01", "tenant": "a"}
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("a", headers)))
+	headers["tenant"] = "changed"
+	assert.Nil(t, enqueueErr(queue.Enqueue("b")))
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("c", nil)))
+
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Nil(t, delivery.Nack())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	msg, err := queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", msg.Item)
+	assert.Equal(t, map[string]string{"traceparent": "00-abc-def-01", "tenant": "a"}, msg.Headers)
+	assert.False(t, msg.EnqueuedAt.Before(start.Truncate(time.Microsecond)))
+	assert.Equal(t, 2, msg.Attempts)
+
+	msg, err = queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, koyori.Message[string]{Item: "b", Attempts: 1, Sequence: 2}, msg)
+	msg, err = queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "c", msg.Item)
+	assert.Nil(t, msg.Headers)
+	assert.False(t, msg.EnqueuedAt.IsZero())
+	_, err = queue.DequeueMessage()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueHeadersCompact(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("b", map[string]string{"k": "v"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Compact())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	msg, err := queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "b", msg.Item)
+	assert.Equal(t, map[string]string{"k": "v"}, msg.Headers)
+	assert.Nil(t, queue.Close())
+}
+
+func TestPriorityQueueHeaders(t *testing.T) {
+	queue, err := koyori.NewPriorityQueue(koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+	}, 3)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("low", 0, map[string]string{"k": "low"})))
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("high", 2, map[string]string{"k": "high"})))
+
+	msg, err := queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "high", msg.Item)
+	assert.Equal(t, 2, msg.Priority)
+	assert.Equal(t, "high", msg.Headers["k"])
+	msg, err = queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "low", msg.Item)
+	assert.Equal(t, 0, msg.Priority)
+	_, err = queue.DequeueMessage()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,66 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type viewStringConverter struct {
+	StringConverter
+}
+
+func (viewStringConverter) AcceptsViews() bool {
+	return true
+}
+
+func TestQueueMmap(t *testing.T) {
+	for _, converter := range []koyori.Converter[string]{StringConverter{}, viewStringConverter{}} {
+		opts := koyori.QueueOptions[string]{
+			Converter:            converter,
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 4,
+			RecoveryMode:         koyori.RecoveryTruncate,
+			UseMmap:              true,
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f"})))
+		assert.Nil(t, queue.Close())
+
+		// A torn write at the end of the mapped file is cut off.
+		file, err := os.OpenFile(filepath.Join(opts.FolderPath, "00002.queue.open"), os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.Write([]byte{5, 0})
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		queue, err = koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assertDequeue(t, queue, "a")
+		assert.Nil(t, enqueueErr(queue.Enqueue("g")))
+		assertDequeueMany(t, queue, 6, []string{"b", "c", "d", "e", "f", "g"})
+		assert.Nil(t, queue.Close())
+	}
+}
+
+func TestBytesQueueMmap(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err := koyori.NewBytesQueue(folder, koyori.WithMaxObjectsPerSegment(10), koyori.WithMmap())
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([][]byte{[]byte("hello"), []byte("world")})))
+	assert.Nil(t, queue.Close())
+
+	// The dequeued bytes are copies, still valid once the file is unmapped.
+	queue, err = koyori.NewBytesQueue(folder, koyori.WithMaxObjectsPerSegment(10), koyori.WithMmap())
+	assert.Nil(t, err)
+	items, err := queue.DequeueMany(2)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, items)
+}
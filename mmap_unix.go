@@ -0,0 +1,26 @@
+//go:build !windows
+
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"math"
+	"os"
+)
+
+// mmapFile maps the first size bytes of file into memory, read-only. It returns nil for an
+// empty file. The mapping stays valid after the file is closed or deleted.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	if size > math.MaxInt32 {
+		return nil, errors.Errorf("file too large to map (%d bytes)", size)
+	}
+	return unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
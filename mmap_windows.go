@@ -0,0 +1,15 @@
+//go:build windows
+
+package koyori
+
+import "os"
+
+// mmapFile isn't supported on Windows, where a mapped file can't be deleted or truncated. It
+// returns nil, so the file is read as usual.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
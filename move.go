@@ -0,0 +1,201 @@
+package koyori
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Move relocates the files of the queue to newFolder, which must not exist or be empty, while
+// the queue stays open. Operations on the queue wait until the move is done.
+//
+// Every file is copied and synced before the queue switches to the copies, so if the process
+// dies before Move returns, the queue is still complete in its old folder and the new one can
+// be deleted. Only once the queue has switched are the old files removed. Queues opened by a
+// Manager must not be moved.
+func (q *Queue[T]) Move(newFolder string) error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	oldFolder := q.options.FolderPath
+	if filepath.Clean(newFolder) == filepath.Clean(oldFolder) {
+		return nil
+	}
+	if err := os.MkdirAll(newFolder, q.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create folder")
+	}
+	if entries, err := os.ReadDir(newFolder); err != nil {
+		return errors.Wrap(err, "failed to read folder")
+	} else if len(entries) > 0 {
+		return errors.Errorf("folder %s is not empty", newFolder)
+	}
+	lockFile, err := acquireLock(context.Background(), newFolder, q.options.FileMode, 0)
+	if err != nil {
+		return err
+	}
+
+	// The copies must hold everything written so far.
+	if err := q.firstSegment.writePending(); err != nil {
+		releaseLock(lockFile)
+		return errors.Wrap(err, "failed to write segment")
+	}
+	if err := q.lastSegment.writePending(); err != nil {
+		releaseLock(lockFile)
+		return errors.Wrap(err, "failed to write segment")
+	}
+	if q.schedule.last != nil {
+		if err := q.schedule.last.writePending(); err != nil {
+			releaseLock(lockFile)
+			return errors.Wrap(err, "failed to write scheduled segment")
+		}
+	}
+	moved, err := copyFolder(oldFolder, newFolder, q.options.FileMode, q.options.dirMode())
+	if err != nil {
+		releaseLock(lockFile)
+		return errors.Wrap(err, "failed to copy queue files")
+	}
+
+	q.options.FolderPath = newFolder
+	q.schedule.options.FolderPath = filepath.Join(newFolder, scheduledFolder)
+	if q.options.replicator != nil {
+		q.options.replicator.setFolder(newFolder)
+	}
+	q.options.headFile.setFolder(newFolder)
+	if err := q.firstSegment.relocate(newFolder); err != nil {
+		return errors.Wrap(err, "failed to switch to moved segment")
+	}
+	if q.lastSegment != q.firstSegment {
+		if err := q.lastSegment.relocate(newFolder); err != nil {
+			return errors.Wrap(err, "failed to switch to moved segment")
+		}
+	}
+	for _, seg := range q.schedule.segments {
+		if err := seg.relocate(q.schedule.options.FolderPath); err != nil {
+			return errors.Wrap(err, "failed to switch to moved scheduled segment")
+		}
+	}
+	// The copies were synced, including the segments closed without syncing.
+	q.unsyncedSegments = nil
+	q.schedule.unsynced = map[int]bool{}
+	oldLock := q.lockFile
+	q.lockFile = lockFile
+	if err := releaseLock(oldLock); err != nil {
+		return err
+	}
+
+	for _, name := range moved {
+		if err := os.Remove(filepath.Join(oldFolder, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "queue was moved, but failed to remove old file")
+		}
+	}
+	if err := os.Remove(filepath.Join(oldFolder, lockFilename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "queue was moved, but failed to remove old lock file")
+	}
+	// The old folders are only removed if nothing else was left in them.
+	os.Remove(filepath.Join(oldFolder, scheduledFolder))
+	os.Remove(oldFolder)
+	return nil
+}
+
+// relocate points the segment at the copy of its file in folderPath, reopening the file for
+// appending if it was open.
+func (s *segment[T]) relocate(folderPath string) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.closeReaderLocked(); err != nil {
+		return err
+	}
+	s.folderPath = folderPath
+	if s.file == nil {
+		return nil
+	}
+	file, err := os.OpenFile(s.filePath(), os.O_APPEND|os.O_WRONLY, s.options.FileMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to open segment file")
+	}
+	old := s.file
+	s.file = file
+	return errors.Wrap(old.Close(), "failed to close segment file")
+}
+
+// copyFolder copies the files of the queue folder src, and of its scheduled items and consumer
+// groups folders, to dst. It returns the copied files, relative to src. The lock file isn't copied.
+func copyFolder(src, dst string, mode, dirMode os.FileMode) ([]string, error) {
+	copied := []string{}
+	for _, folder := range []string{"", scheduledFolder, groupsFolder} {
+		names, err := listFolder(filepath.Join(src, folder))
+		if os.IsNotExist(errors.Cause(err)) && folder != "" {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if folder != "" {
+			if err := os.MkdirAll(filepath.Join(dst, folder), dirMode); err != nil {
+				return nil, errors.Wrap(err, "failed to create folder")
+			}
+		}
+		for _, name := range names {
+			name = filepath.Join(folder, name)
+			if name == lockFilename {
+				continue
+			}
+			if err := copyFileSynced(filepath.Join(src, name), filepath.Join(dst, name), mode); err != nil {
+				return nil, errors.Wrapf(err, "failed to copy %s", name)
+			}
+			copied = append(copied, name)
+		}
+		if err := syncDir(filepath.Join(dst, folder)); err != nil {
+			return nil, errors.Wrap(err, "failed to sync folder")
+		}
+	}
+	return copied, syncDir(dst)
+}
+
+// listFolder returns the names of the regular files in a folder.
+func listFolder(folderPath string) ([]string, error) {
+	entries, err := os.ReadDir(folderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read folder")
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// copyFileSynced copies src to dst through a temporary file, which is synced before it is
+// renamed into place.
+func copyFileSynced(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
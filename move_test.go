@@ -0,0 +1,47 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueMove(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "old"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("later", 50*time.Millisecond)))
+
+	newFolder := filepath.Join(root, "new")
+	assert.Nil(t, os.MkdirAll(newFolder, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(newFolder, "other"), nil, 0644))
+	assert.NotNil(t, queue.Move(newFolder))
+	assert.Nil(t, os.Remove(filepath.Join(newFolder, "other")))
+
+	assert.Nil(t, queue.Move(newFolder))
+	_, err = os.Stat(opts.FolderPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assertDequeue(t, queue, "b")
+	assert.Nil(t, queue.Close())
+
+	opts.FolderPath = newFolder
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.ScheduledLen())
+	time.Sleep(50 * time.Millisecond)
+	assertDequeueMany(t, queue, 10, []string{"c", "d", "e", "f", "later"})
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,111 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultSegmentNumberWidth = 5
+
+// SegmentNaming decides the names of segment files: Prefix, then the segment number padded with
+// zeros to Width digits, then Extension. The zero value names them as 00001.queue, 00002.queue,
+// and so on. Numbers that need more digits than Width are written in full, so Width only
+// decides how long names stay sortable as strings.
+//
+// A queue only sees the files named the way it is configured, so the naming of a folder can't
+// be changed once it holds segments.
+type SegmentNaming struct {
+	Prefix string
+	// Width is the least number of digits of the segment number. Defaults to 5.
+	Width int
+	// Extension must start with a dot. Defaults to ".queue".
+	Extension string
+}
+
+func (n SegmentNaming) width() int {
+	if n.Width > 0 {
+		return n.Width
+	}
+	return defaultSegmentNumberWidth
+}
+
+func (n SegmentNaming) extension() string {
+	if n.Extension != "" {
+		return n.Extension
+	}
+	return segmentFileExtension
+}
+
+// validate checks that names can be told apart from each other and from the other files of the
+// queue folder.
+func (n SegmentNaming) validate() error {
+	if strings.ContainsAny(n.Prefix, `/\`) {
+		return errors.Errorf("segment file prefix %q contains a path separator", n.Prefix)
+	}
+	if last := len(n.Prefix) - 1; last >= 0 && n.Prefix[last] >= '0' && n.Prefix[last] <= '9' {
+		return errors.Errorf("segment file prefix %q ends with a digit", n.Prefix)
+	}
+	if n.Width < 0 || n.Width > 19 {
+		return errors.Errorf("segment number width %d is not between 1 and 19", n.Width)
+	}
+	ext := n.extension()
+	if !strings.HasPrefix(ext, ".") {
+		return errors.Errorf("segment file extension %q doesn't start with a dot", ext)
+	}
+	if strings.ContainsAny(ext, `/\`) || strings.HasSuffix(ext, openSegmentSuffix) {
+		return errors.Errorf("segment file extension %q is not allowed", ext)
+	}
+	return nil
+}
+
+// filename returns the name of the file of a sealed segment.
+func (n SegmentNaming) filename(segmentNumber int) string {
+	return fmt.Sprintf("%s%0*d%s", n.Prefix, n.width(), segmentNumber, n.extension())
+}
+
+// path returns the path of the file of a segment in folderPath, which has openSegmentSuffix if
+// the segment is the last one.
+func (n SegmentNaming) path(folderPath string, segmentNumber int) string {
+	sealedPath := filepath.Join(folderPath, n.filename(segmentNumber))
+	if n.isOpen(folderPath, segmentNumber) {
+		return sealedPath + openSegmentSuffix
+	}
+	return sealedPath
+}
+
+// isOpen reports whether the file of a segment in folderPath has openSegmentSuffix.
+func (n SegmentNaming) isOpen(folderPath string, segmentNumber int) bool {
+	sealedPath := filepath.Join(folderPath, n.filename(segmentNumber))
+	if _, err := os.Stat(sealedPath); err == nil {
+		return false
+	}
+	_, err := os.Stat(sealedPath + openSegmentSuffix)
+	return err == nil
+}
+
+// parse returns the segment number of a segment file name such as 00012.queue or
+// 00012.queue.open.
+func (n SegmentNaming) parse(name string) (int, bool) {
+	name = strings.TrimSuffix(name, openSegmentSuffix)
+	ext := n.extension()
+	if len(name) <= len(n.Prefix)+len(ext) || !strings.HasPrefix(name, n.Prefix) || !strings.HasSuffix(name, ext) {
+		return 0, false
+	}
+	digits := name[len(n.Prefix) : len(name)-len(ext)]
+	number := 0
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if number > (math.MaxInt-int(c-'0'))/10 {
+			return 0, false
+		}
+		number = number*10 + int(c-'0')
+	}
+	return number, true
+}
@@ -0,0 +1,85 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueSegmentNaming(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		SegmentNaming:        koyori.SegmentNaming{Prefix: "seg-", Width: 8, Extension: ".log"},
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, queue.Close())
+
+	names := []string{}
+	entries, err := os.ReadDir(opts.FolderPath)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".log" || filepath.Ext(entry.Name()) == ".open" {
+			names = append(names, entry.Name())
+		}
+	}
+	assert.Equal(t, []string{"seg-00000001.log", "seg-00000002.log.open"}, names)
+
+	// Files named otherwise, such as those of another tool, are left alone.
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, "00003.queue"), []byte("other"), 0644))
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, queue.Len())
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+
+	segments, err := koyori.InspectSegmentsWithNaming(opts.FolderPath, opts.SegmentNaming)
+	assert.Nil(t, err)
+	assert.Len(t, segments, 1)
+
+	for _, naming := range []koyori.SegmentNaming{{Prefix: "seg1"}, {Extension: "queue"}, {Prefix: "a/b"}, {Width: -1}} {
+		opts.SegmentNaming = naming
+		_, err := koyori.NewQueue(opts)
+		assert.NotNil(t, err, "%+v", naming)
+	}
+}
+
+func TestQueueSegmentNumberBeyond32Bits(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("segment numbers are limited to 32 bits on this platform")
+	}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, queue.Close())
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00001.queue.open"), filepath.Join(opts.FolderPath, "99999999999.queue.open")))
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"b", "c"})))
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, []string{
+		filepath.Join(opts.FolderPath, "99999999999.queue"),
+		filepath.Join(opts.FolderPath, "100000000000.queue.open"),
+	}, segmentFiles(t, opts.FolderPath))
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+}
@@ -1,11 +1,536 @@
 package koyori
 
-import "os"
+import (
+	"github.com/pkg/errors"
+	"os"
+	"runtime"
+	"time"
+)
 
 type QueueOptions[T any] struct {
-	FolderPath           string
+	FolderPath string
+	Name       string
+	// AlwaysFlush syncs every write to disk. It takes precedence over SyncPolicy.
 	AlwaysFlush          bool
 	MaxObjectsPerSegment int
-	FileMode             os.FileMode
-	Converter            Converter[T]
+	// FileMode is used when creating files. On Windows, which only honours the owner's write
+	// bit, that bit is always added.
+	FileMode os.FileMode
+	// Converter encodes items. If nil, they are stored with encoding/gob, and ConverterName
+	// defaults to "gob". Items of an interface type are then registered with gob.Register as
+	// they are enqueued, but a process that only dequeues them has to register them itself.
+	Converter Converter[T]
+
+	// BlockSize, if positive, packs consecutive small items of a batch into blocks of up to
+	// BlockSize bytes sharing a single length and checksum. Useful for queues of tiny records.
+	BlockSize int
+	// TargetSegmentSize, if positive, sizes the capacity of new segments from a running average
+	// of item sizes so segment files end up around this many bytes.
+	// MaxObjectsPerSegment is then only used until the first items have been measured.
+	TargetSegmentSize int64
+	// MinAge, if positive, keeps items from being dequeued until they have been in the queue
+	// for at least this long. Items enqueued while MinAge was unset are visible immediately.
+	MinAge time.Duration
+	// DirMode is used when creating FolderPath. If unset, it is derived from FileMode by adding
+	// the execute bit wherever the read bit is set (0644 becomes 0755).
+	DirMode os.FileMode
+	// ConverterName is recorded in the header of new segments (see SegmentHeader.Codec).
+	ConverterName string
+	// ConverterFor, if set, picks the converter for an existing segment from its header, so
+	// segments written with an earlier format stay readable after Converter changes. Returning
+	// nil uses Converter. New items are never appended to a segment whose codec differs from
+	// ConverterName or that is read with another converter; a new segment is started instead.
+	ConverterFor func(header SegmentHeader) Converter[T]
+	// VisibilityTimeout, if positive, makes items reserved with Reserve available again when
+	// they weren't acked or nacked within this time. Reservations are then also recorded in
+	// the segment, so a reopened queue keeps reserved items hidden until their deadline.
+	VisibilityTimeout time.Duration
+	// MaxSegmentBytes, if positive, starts a new segment once a segment file reaches this size,
+	// in addition to the item limit of a segment. The item that crosses the limit still goes
+	// into the segment, so files can end up one item larger.
+	MaxSegmentBytes int64
+	// Compression compresses every item before it is written. It is recorded in the header of
+	// new segments, and existing segments are always read with the compression they were
+	// written with.
+	Compression Compression
+	// LockTimeout is how long opening the queue waits for another process holding the queue
+	// folder to close it. If unset, opening a locked queue fails immediately with ErrQueueLocked.
+	LockTimeout time.Duration
+	// RecoveryMode decides how unreadable records are handled when segments are loaded. By
+	// default, the queue fails to open. Queues created by NewJSONQueue, NewBytesQueue and
+	// NewRawQueue default to RecoveryTruncate instead, so a write torn by a crash doesn't keep
+	// them from opening.
+	RecoveryMode RecoveryMode
+	// OnRecovery, if set, is called for every record given up on under RecoveryMode.
+	OnRecovery func(event RecoveryEvent)
+	// ItemTTL, if positive, drops items that were enqueued longer ago than this instead of
+	// handing them out. Reserved items don't expire, nor do items enqueued while neither ItemTTL,
+	// MinAge nor RecordEnqueueTime was set, as their enqueue time wasn't recorded.
+	ItemTTL time.Duration
+	// RecordEnqueueTime stores the time items are enqueued, for Queue.OldestItemAge,
+	// Queue.NewestItemAge and Message.EnqueuedAt. It is also stored with MinAge or ItemTTL set.
+	RecordEnqueueTime bool
+	// DeadLetterQueue, if set, receives the items dropped by ItemTTL, and those RetryPolicy gives
+	// up on. It must be another queue.
+	DeadLetterQueue *Queue[T]
+	// MaxRecordSize is the largest record of a segment file in bytes, which holds an item as
+	// encoded (and compressed), or a block of items under BlockSize. Larger items are rejected,
+	// and a record whose length prefix says it is larger is taken as corrupt (ErrCorruptRecord)
+	// when segments are read, rather than allocated. It defaults to 64MiB, and can be raised to
+	// just under 256MiB for queues of larger items, which have to set it whenever they are
+	// opened. Tools reading segment files, such as InspectSegments and OpenSegment, use the
+	// default.
+	MaxRecordSize int
+	// Clock, if set, tells the time to the features that depend on it: enqueue times and
+	// MinAge, ItemTTL, VisibilityTimeout, EnqueueAt and EnqueueAfter, RetryPolicy and the MaxAge
+	// of ArchivePolicy. Tests can pass a ManualClock to move time forward without waiting.
+	// Waiting for items or for a locked queue still takes real time, though consumers that wait,
+	// such as Subscribe and DequeueChan, look at the queue again at least every 100ms.
+	Clock Clock
+	// ArchivePolicy, if enabled, keeps the segment files the queue is done with in the archive
+	// subfolder instead of deleting them.
+	ArchivePolicy ArchivePolicy
+	// RetryPolicy decides when items handed back with Delivery.Retry or Batch.Retry are
+	// delivered again. By default, they are put back in their places right away.
+	RetryPolicy RetryPolicy
+	// CompactInterval, if positive, runs compaction (see Queue.Compact) in the background this
+	// often, on a first segment where at least half of the items it held were removed.
+	CompactInterval time.Duration
+	// OnEvent, if set, is called for every Event of the queue. It is called with the queue
+	// locked, so it must not call methods of the queue, and may be called concurrently by an
+	// enqueuing and a dequeuing goroutine.
+	OnEvent func(event Event)
+	// Logger, if set, receives warnings about conditions the queue recovers from on its own,
+	// such as skipped records and slow syncs, and debug traces of segment changes.
+	Logger Logger
+	// SyncPolicy decides when writes are synced to disk, unless AlwaysFlush is set. By default,
+	// they are only synced by Flush.
+	SyncPolicy SyncPolicy
+	// WriteBufferSize, if positive, collects writes in a buffer of this many bytes, which is
+	// written to the file once full, on every sync and when the segment is closed. Unlike
+	// writes synced late, buffered writes are lost when the process dies.
+	WriteBufferSize int
+	// MaxItems and MaxBytes, if positive, limit the queue to this many items, or its segment
+	// files (not counting scheduled items) to this size. Items that don't fit are rejected with
+	// a FullError, or dropped according to OverflowPolicy. Space taken by removed items is only reclaimed when their
+	// segment is deleted or compacted, so MaxBytes should be a multiple of the segment size.
+	MaxItems int
+	MaxBytes int64
+	// OverflowPolicy decides whether items enqueued while the queue is full are rejected or
+	// dropped. EnqueueFanout always rejects them.
+	OverflowPolicy OverflowPolicy
+	// UseMmap maps segment files into memory to load them and to read the items not kept in
+	// memory, instead of reading them through a buffer. Converters implementing ViewUnmarshaler
+	// are then passed the mapped bytes directly. Where mapping isn't supported, files are read
+	// as usual.
+	UseMmap bool
+	// Preallocate reserves disk space for new segment files up front, so they don't fragment
+	// as they grow: TargetSegmentSize if set, or else the segment capacity times the average
+	// item size seen so far. Only supported on Linux; the space is released when the segment
+	// is closed before it filled up.
+	Preallocate bool
+	// ColdStorage, if set, offloads the segments between the first and the last one to it in
+	// the background, keeping only those two in FolderPath, which are fetched back when the
+	// head of the queue reaches them. Offloaded segments are listed in a manifest in FolderPath,
+	// so a queue that has any can't be opened without ColdStorage. They still count towards
+	// MaxBytes.
+	ColdStorage ColdStorage
+	// Replica, if set, receives a copy of the queue's files, which a standby process can open as
+	// a queue to take over after a host failure. Opening the queue brings the replica up to date
+	// with the files left from an earlier run. See ReplicationMode for when later changes are
+	// copied; the replica is also brought up to date by Close.
+	Replica         Replica
+	ReplicationMode ReplicationMode
+	// SegmentNaming decides the names of segment files, which are 00001.queue and so on by
+	// default. It applies to scheduled segments and cold storage objects as well.
+	SegmentNaming SegmentNaming
+	// RenumberSegments renames the segment files to 1, 2, and so on when the queue is opened,
+	// and when it is compacted by Compact or CompactInterval once the number of the first
+	// segment exceeds the number of segments, so segment numbers stay below twice the number of
+	// segments. A manifest in the queue folder lets the next open finish a renumbering cut short
+	// by a crash. Queues with segments offloaded to ColdStorage or with consumer groups keep their
+	// numbers, and compaction leaves them while items are reserved, segments are claimed or
+	// iterators are open. Without it, numbering only starts over once the queue drained to no
+	// segments while no groups were registered.
+	RenumberSegments bool
+	// MaxInMemoryItems and MaxInMemoryBytes bound the items whose objects a segment keeps in
+	// memory as they were enqueued. Once the segment holds MaxInMemoryItems items (1024 if unset,
+	// none if negative), or the objects it keeps took MaxInMemoryBytes to encode, later items
+	// are only kept as their offset in the segment file and decoded when they are dequeued. This
+	// keeps memory use of large segments bounded. Items of segments loaded from disk are never
+	// kept in memory.
+	MaxInMemoryItems int
+	MaxInMemoryBytes int64
+	// PoisonPolicy decides what happens to items the Converter fails to decode. By default,
+	// they are left at the head of the queue, and dequeuing fails with an *UnmarshalError.
+	PoisonPolicy PoisonPolicy
+	// LoadConcurrency, if above 1, loads this many segments at once when the queue is opened,
+	// so opening a queue of many segments is bound by disk bandwidth rather than the latency of
+	// every file. Logger and OnRecovery may then be called concurrently while the queue opens.
+	LoadConcurrency int
+	// DropBatchSize, if above 1, holds back recording items dequeued from the head of a segment
+	// until this many were dequeued, then records all of them with a single small record. The
+	// record is also written by Flush, by a sync under SyncPolicy and when the segment is closed.
+	// Items dequeued since the last record are delivered again if the process dies.
+	DropBatchSize int
+	// HeadFile records where the items left in the first segment start in a small file of the
+	// queue folder, replaced as a whole on every change, rather than by appending deletion
+	// markers to the segment. Files of sealed segments are then only written to for removals
+	// other than from the head, such as acknowledgements of reservations. The file is synced as
+	// the segment would be under SyncPolicy.
+	//
+	// Queues written without HeadFile switch over when opened with it, keeping the deletion
+	// markers already written, and the position moves back into the segment file when the
+	// queue is opened without it again. HeadFile can't be used with Replica.
+	HeadFile bool
+	// PollInterval is how often Consumer.Watch looks for items added by the producer process
+	// where it can't be notified of them. Defaults to 100ms.
+	PollInterval time.Duration
+
+	// replicator is set by NewQueue when Replica is.
+	replicator *replicator
+	// headFile is read by NewQueue and OpenReadOnly, whether or not HeadFile is set.
+	headFile *headFile
+}
+
+// prepare fills in the defaults NewQueue and OpenReadOnly don't take as they are, and checks
+// the options.
+func (o *QueueOptions[T]) prepare() error {
+	o.FileMode = fileModeFor(o.FileMode)
+	if o.Converter == nil {
+		o.Converter = gobConverter[T]{}
+		if o.ConverterName == "" {
+			o.ConverterName = gobConverterName
+		}
+	}
+	if o.MaxRecordSize > maxRecordLength {
+		return errors.Errorf("MaxRecordSize can't be above %d", maxRecordLength)
+	}
+	if o.BlockSize > o.maxRecordSize() {
+		return errors.New("BlockSize can't be above MaxRecordSize")
+	}
+	return errors.Wrap(o.SegmentNaming.validate(), "invalid segment naming")
+}
+
+// maxRecordSize returns MaxRecordSize, or its default if it isn't set.
+func (o *QueueOptions[T]) maxRecordSize() int {
+	if o.MaxRecordSize <= 0 {
+		return defaultMaxRecordSize
+	}
+	return o.MaxRecordSize
+}
+
+// recordsEnqueueTime reports whether items are stored with the time they were enqueued.
+func (o *QueueOptions[T]) recordsEnqueueTime() bool {
+	return o.MinAge > 0 || o.ItemTTL > 0 || o.RecordEnqueueTime
+}
+
+func (o *QueueOptions[T]) dirMode() os.FileMode {
+	if o.DirMode != 0 {
+		return o.DirMode
+	}
+	return dirModeFor(o.FileMode)
+}
+
+// dirModeFor derives the mode of a folder from the mode of the files in it, by adding the execute
+// bit wherever the read bit is set.
+func dirModeFor(fileMode os.FileMode) os.FileMode {
+	perm := fileMode.Perm()
+	return perm | (perm&0444)>>2
+}
+
+// fileModeFor returns the mode to create files with. Windows creates files without the owner's
+// write bit read-only, and those can then neither be deleted nor replaced.
+func fileModeFor(mode os.FileMode) os.FileMode {
+	if runtime.GOOS == "windows" {
+		return mode | 0200
+	}
+	return mode
+}
+
+const defaultFileMode os.FileMode = 0644
+
+// Option configures a queue created by NewJSONQueue or NewBytesQueue.
+type Option func(o *commonOptions)
+
+// commonOptions holds the QueueOptions fields that don't depend on the item type.
+type commonOptions struct {
+	name                 string
+	alwaysFlush          bool
+	maxObjectsPerSegment int
+	fileMode             os.FileMode
+	dirMode              os.FileMode
+	blockSize            int
+	targetSegmentSize    int64
+	minAge               time.Duration
+	compression          Compression
+	syncPolicy           SyncPolicy
+	writeBufferSize      int
+	useMmap              bool
+	preallocate          bool
+	coldStorage          ColdStorage
+	recordEnqueueTime    bool
+	segmentNaming        SegmentNaming
+	renumberSegments     bool
+	maxInMemoryItems     int
+	maxInMemoryBytes     int64
+	poisonPolicy         PoisonPolicy
+	loadConcurrency      int
+	dropBatchSize        int
+	headFile             bool
+	retryPolicy          RetryPolicy
+	archivePolicy        ArchivePolicy
+	clock                Clock
+	maxRecordSize        int
+	recoveryMode         RecoveryMode
+	onRecovery           func(event RecoveryEvent)
+	maxSegmentBytes      int64
+	lockTimeout          time.Duration
+	visibilityTimeout    time.Duration
+	itemTTL              time.Duration
+	compactInterval      time.Duration
+	onEvent              func(event Event)
+	logger               Logger
+	maxItems             int
+	maxBytes             int64
+	overflowPolicy       OverflowPolicy
+	pollInterval         time.Duration
+	replica              Replica
+	replicationMode      ReplicationMode
+}
+
+func WithName(name string) Option {
+	return func(o *commonOptions) { o.name = name }
+}
+
+func WithAlwaysFlush() Option {
+	return func(o *commonOptions) { o.alwaysFlush = true }
+}
+
+func WithMaxObjectsPerSegment(n int) Option {
+	return func(o *commonOptions) { o.maxObjectsPerSegment = n }
+}
+
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *commonOptions) { o.fileMode = mode }
+}
+
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *commonOptions) { o.dirMode = mode }
+}
+
+func WithBlockSize(size int) Option {
+	return func(o *commonOptions) { o.blockSize = size }
+}
+
+func WithTargetSegmentSize(size int64) Option {
+	return func(o *commonOptions) { o.targetSegmentSize = size }
+}
+
+func WithMinAge(age time.Duration) Option {
+	return func(o *commonOptions) { o.minAge = age }
+}
+
+func WithCompression(compression Compression) Option {
+	return func(o *commonOptions) { o.compression = compression }
+}
+
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *commonOptions) { o.syncPolicy = policy }
+}
+
+func WithWriteBufferSize(size int) Option {
+	return func(o *commonOptions) { o.writeBufferSize = size }
+}
+
+func WithMmap() Option {
+	return func(o *commonOptions) { o.useMmap = true }
+}
+
+func WithPreallocate() Option {
+	return func(o *commonOptions) { o.preallocate = true }
+}
+
+func WithColdStorage(storage ColdStorage) Option {
+	return func(o *commonOptions) { o.coldStorage = storage }
+}
+
+func WithRecordEnqueueTime() Option {
+	return func(o *commonOptions) { o.recordEnqueueTime = true }
+}
+
+func WithSegmentNaming(naming SegmentNaming) Option {
+	return func(o *commonOptions) { o.segmentNaming = naming }
+}
+
+func WithRenumberSegments() Option {
+	return func(o *commonOptions) { o.renumberSegments = true }
+}
+
+func WithMaxInMemoryItems(n int) Option {
+	return func(o *commonOptions) { o.maxInMemoryItems = n }
+}
+
+func WithMaxInMemoryBytes(size int64) Option {
+	return func(o *commonOptions) { o.maxInMemoryBytes = size }
+}
+
+func WithPoisonPolicy(policy PoisonPolicy) Option {
+	return func(o *commonOptions) { o.poisonPolicy = policy }
+}
+
+func WithLoadConcurrency(n int) Option {
+	return func(o *commonOptions) { o.loadConcurrency = n }
+}
+
+func WithDropBatchSize(n int) Option {
+	return func(o *commonOptions) { o.dropBatchSize = n }
+}
+
+func WithHeadFile() Option {
+	return func(o *commonOptions) { o.headFile = true }
+}
+
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *commonOptions) { o.retryPolicy = policy }
+}
+
+func WithArchivePolicy(policy ArchivePolicy) Option {
+	return func(o *commonOptions) { o.archivePolicy = policy }
+}
+
+func WithClock(clock Clock) Option {
+	return func(o *commonOptions) { o.clock = clock }
+}
+
+func WithMaxRecordSize(size int) Option {
+	return func(o *commonOptions) { o.maxRecordSize = size }
+}
+
+func WithRecoveryMode(mode RecoveryMode) Option {
+	return func(o *commonOptions) { o.recoveryMode = mode }
+}
+
+func WithOnRecovery(fn func(event RecoveryEvent)) Option {
+	return func(o *commonOptions) { o.onRecovery = fn }
+}
+
+func WithMaxSegmentBytes(size int64) Option {
+	return func(o *commonOptions) { o.maxSegmentBytes = size }
+}
+
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *commonOptions) { o.lockTimeout = timeout }
+}
+
+func WithVisibilityTimeout(timeout time.Duration) Option {
+	return func(o *commonOptions) { o.visibilityTimeout = timeout }
+}
+
+func WithItemTTL(ttl time.Duration) Option {
+	return func(o *commonOptions) { o.itemTTL = ttl }
+}
+
+func WithCompactInterval(interval time.Duration) Option {
+	return func(o *commonOptions) { o.compactInterval = interval }
+}
+
+func WithOnEvent(fn func(event Event)) Option {
+	return func(o *commonOptions) { o.onEvent = fn }
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *commonOptions) { o.logger = logger }
+}
+
+func WithMaxItems(n int) Option {
+	return func(o *commonOptions) { o.maxItems = n }
+}
+
+func WithMaxBytes(size int64) Option {
+	return func(o *commonOptions) { o.maxBytes = size }
+}
+
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *commonOptions) { o.overflowPolicy = policy }
+}
+
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *commonOptions) { o.pollInterval = interval }
+}
+
+func WithReplica(replica Replica) Option {
+	return func(o *commonOptions) { o.replica = replica }
+}
+
+func WithReplicationMode(mode ReplicationMode) Option {
+	return func(o *commonOptions) { o.replicationMode = mode }
+}
+
+// converterFor returns the converter for a segment with the given header, and whether it is
+// a different one than for new segments.
+func (o *QueueOptions[T]) converterFor(header segmentHeader) (Converter[T], bool) {
+	if o.ConverterFor != nil {
+		if converter := o.ConverterFor(header.exported()); converter != nil {
+			return converter, true
+		}
+	}
+	return o.Converter, header.codec != o.ConverterName
+}
+
+func buildOptions[T any](folderPath string, converter Converter[T], opts []Option) QueueOptions[T] {
+	common := commonOptions{
+		maxObjectsPerSegment: defaultSegmentCapacity,
+		fileMode:             defaultFileMode,
+		recoveryMode:         RecoveryTruncate,
+	}
+	for _, opt := range opts {
+		opt(&common)
+	}
+	return QueueOptions[T]{
+		FolderPath:           folderPath,
+		Name:                 common.name,
+		AlwaysFlush:          common.alwaysFlush,
+		MaxObjectsPerSegment: common.maxObjectsPerSegment,
+		FileMode:             common.fileMode,
+		Converter:            converter,
+		BlockSize:            common.blockSize,
+		TargetSegmentSize:    common.targetSegmentSize,
+		MinAge:               common.minAge,
+		DirMode:              common.dirMode,
+		Compression:          common.compression,
+		SyncPolicy:           common.syncPolicy,
+		WriteBufferSize:      common.writeBufferSize,
+		UseMmap:              common.useMmap,
+		Preallocate:          common.preallocate,
+		ColdStorage:          common.coldStorage,
+		RecordEnqueueTime:    common.recordEnqueueTime,
+		SegmentNaming:        common.segmentNaming,
+		RenumberSegments:     common.renumberSegments,
+		MaxInMemoryItems:     common.maxInMemoryItems,
+		MaxInMemoryBytes:     common.maxInMemoryBytes,
+		PoisonPolicy:         common.poisonPolicy,
+		LoadConcurrency:      common.loadConcurrency,
+		DropBatchSize:        common.dropBatchSize,
+		HeadFile:             common.headFile,
+		RetryPolicy:          common.retryPolicy,
+		ArchivePolicy:        common.archivePolicy,
+		Clock:                common.clock,
+		MaxRecordSize:        common.maxRecordSize,
+		RecoveryMode:         common.recoveryMode,
+		OnRecovery:           common.onRecovery,
+		MaxSegmentBytes:      common.maxSegmentBytes,
+		LockTimeout:          common.lockTimeout,
+		VisibilityTimeout:    common.visibilityTimeout,
+		ItemTTL:              common.itemTTL,
+		CompactInterval:      common.compactInterval,
+		OnEvent:              common.onEvent,
+		Logger:               common.logger,
+		MaxItems:             common.maxItems,
+		MaxBytes:             common.maxBytes,
+		OverflowPolicy:       common.overflowPolicy,
+		PollInterval:         common.pollInterval,
+		Replica:              common.replica,
+		ReplicationMode:      common.replicationMode,
+	}
 }
@@ -0,0 +1,49 @@
+package koyori
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// runParallel calls fn with every i from 0 to count-1, from up to workers goroutines, or in
+// order from the calling one if workers is below 2. Once a call failed, no more are started.
+// It returns the error of the lowest i that failed.
+func runParallel(workers, count int, fn func(i int) error) error {
+	if workers < 2 || count < 2 {
+		for i := 0; i < count; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if workers > count {
+		workers = count
+	}
+	errs := make([]error, count)
+	var next int64 = -1
+	var failed int32
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= count {
+					return
+				}
+				if errs[i] = fn(i); errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
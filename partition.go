@@ -0,0 +1,196 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const partitionFolderPrefix = "partition-"
+
+// PartitionedQueue is a set of queues, one per partition, stored in subfolders of FolderPath.
+// Items are assigned to a partition by hashing their key, so items with the same key stay in
+// order, while Reserve lets several consumers work on different partitions at once.
+type PartitionedQueue[T any] struct {
+	partitions []*Queue[T]
+
+	// mutex guards busy, which marks the partitions with an outstanding delivery by the
+	// number of the Reserve call that handed it out, and next, the partition Reserve looks at
+	// first.
+	mutex    sync.Mutex
+	busy     []uint64
+	reserves uint64
+	next     int
+}
+
+// PartitionDelivery is an item handed out by PartitionedQueue.Reserve. No other item of its
+// partition is handed out until it is acked or nacked.
+type PartitionDelivery[T any] struct {
+	Delivery[T]
+	Partition int
+
+	pq      *PartitionedQueue[T]
+	reserve uint64
+}
+
+// NewPartitionedQueue opens a partitioned queue with the given number of partitions. options
+// apply to the queue of every partition, each of which lives in its own subfolder of
+// options.FolderPath. As changing the number of partitions would move keys to other
+// partitions, opening a folder holding partitions above the given number fails.
+func NewPartitionedQueue[T any](options QueueOptions[T], partitions int) (*PartitionedQueue[T], error) {
+	if partitions < 1 {
+		return nil, errors.Errorf("invalid number of partitions %d", partitions)
+	}
+	if err := checkPartitionFolders(options.FolderPath, partitions); err != nil {
+		return nil, err
+	}
+	pq := &PartitionedQueue[T]{busy: make([]uint64, partitions)}
+	for partition := 0; partition < partitions; partition++ {
+		partitionOptions := options
+		partitionOptions.FolderPath = filepath.Join(options.FolderPath, fmt.Sprintf("%s%d", partitionFolderPrefix, partition))
+		queue, err := NewQueue(partitionOptions)
+		if err != nil {
+			pq.Close()
+			return nil, errors.Wrapf(err, "failed to open partition %d", partition)
+		}
+		pq.partitions = append(pq.partitions, queue)
+	}
+	return pq, nil
+}
+
+// checkPartitionFolders fails if folderPath has the folder of a partition of partitions or above.
+func checkPartitionFolders(folderPath string, partitions int) error {
+	entries, err := os.ReadDir(folderPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read queue directory")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), partitionFolderPrefix) {
+			continue
+		}
+		partition, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), partitionFolderPrefix))
+		if err == nil && partition >= partitions {
+			return errors.Errorf("found partition %d, but the queue has %d partitions", partition, partitions)
+		}
+	}
+	return nil
+}
+
+// PartitionFor returns the partition of key.
+func (pq *PartitionedQueue[T]) PartitionFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(pq.partitions)))
+}
+
+// EnqueueWithKey adds an item to the partition of key, returning its sequence number within the
+// partition (see Queue.Enqueue).
+func (pq *PartitionedQueue[T]) EnqueueWithKey(key string, item T) (uint64, error) {
+	return pq.partitions[pq.PartitionFor(key)].Enqueue(item)
+}
+
+// EnqueueManyWithKey adds items to the partition of key, in order, returning the sequence number
+// of the first one within the partition (see Queue.EnqueueMany).
+func (pq *PartitionedQueue[T]) EnqueueManyWithKey(key string, items []T) (uint64, error) {
+	return pq.partitions[pq.PartitionFor(key)].EnqueueMany(items)
+}
+
+// Reserve hands out the first item of a partition that has no outstanding delivery, going
+// through partitions in turn so that none is starved. It returns ErrEmpty if every partition
+// is either empty or busy.
+//
+// As a partition only has one outstanding delivery at a time, items with the same key are
+// processed one after the other and in order, even by concurrent consumers.
+func (pq *PartitionedQueue[T]) Reserve() (PartitionDelivery[T], error) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	for i := range pq.partitions {
+		partition := (pq.next + i) % len(pq.partitions)
+		if pq.busy[partition] != 0 {
+			continue
+		}
+		delivery, err := pq.partitions[partition].Reserve()
+		if errors.Is(err, ErrEmpty) {
+			continue
+		} else if err != nil {
+			return PartitionDelivery[T]{}, errors.Wrapf(err, "failed to reserve from partition %d", partition)
+		}
+		pq.reserves++
+		pq.busy[partition] = pq.reserves
+		pq.next = (partition + 1) % len(pq.partitions)
+		return PartitionDelivery[T]{Delivery: delivery, Partition: partition, pq: pq, reserve: pq.reserves}, nil
+	}
+	return PartitionDelivery[T]{}, ErrEmpty
+}
+
+// Ack removes the item from the queue, and lets Reserve hand out the next item of its partition.
+func (d PartitionDelivery[T]) Ack() error {
+	defer d.pq.release(d.Partition, d.reserve)
+	return d.Delivery.Ack()
+}
+
+// Nack returns the item to the head of its partition, and lets Reserve hand it out again.
+func (d PartitionDelivery[T]) Nack() error {
+	defer d.pq.release(d.Partition, d.reserve)
+	return d.Delivery.Nack()
+}
+
+// release frees partition, unless it has since been handed out again by another Reserve call.
+func (pq *PartitionedQueue[T]) release(partition int, reserve uint64) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.busy[partition] == reserve {
+		pq.busy[partition] = 0
+	}
+}
+
+// Partitions returns the number of partitions.
+func (pq *PartitionedQueue[T]) Partitions() int {
+	return len(pq.partitions)
+}
+
+// Len returns the number of items over all partitions.
+func (pq *PartitionedQueue[T]) Len() int {
+	count := 0
+	for _, queue := range pq.partitions {
+		count += queue.Len()
+	}
+	return count
+}
+
+// LenPartition returns the number of items in the given partition.
+func (pq *PartitionedQueue[T]) LenPartition(partition int) int {
+	if partition < 0 || partition >= len(pq.partitions) {
+		return 0
+	}
+	return pq.partitions[partition].Len()
+}
+
+func (pq *PartitionedQueue[T]) Flush() error {
+	for partition, queue := range pq.partitions {
+		if err := queue.Flush(); err != nil {
+			return errors.Wrapf(err, "failed to flush partition %d", partition)
+		}
+	}
+	return nil
+}
+
+// Close closes the queue of every partition, returning the first error.
+func (pq *PartitionedQueue[T]) Close() error {
+	var firstErr error
+	for partition, queue := range pq.partitions {
+		if err := queue.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to close partition %d", partition)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,84 @@
+package koyori_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartitionedQueue(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewPartitionedQueue(opts, 4)
+	assert.Nil(t, err)
+	// Find two keys in different partitions.
+	keyA, keyB := "a", ""
+	for i := 0; keyB == ""; i++ {
+		if key := fmt.Sprintf("b%d", i); queue.PartitionFor(key) != queue.PartitionFor(keyA) {
+			keyB = key
+		}
+	}
+	assert.Nil(t, enqueueErr(queue.EnqueueManyWithKey(keyA, []string{"a1", "a2", "a3"})))
+	// Each partition numbers its own items.
+	sequence, err := queue.EnqueueWithKey(keyB, "b1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	assert.Equal(t, 4, queue.Len())
+	assert.Equal(t, 3, queue.LenPartition(queue.PartitionFor(keyA)))
+
+	// Only one item of a partition is handed out at a time.
+	first, err := queue.Reserve()
+	assert.Nil(t, err)
+	second, err := queue.Reserve()
+	assert.Nil(t, err)
+	got := []string{first.Item, second.Item}
+	assert.ElementsMatch(t, []string{"a1", "b1"}, got)
+	_, err = queue.Reserve()
+	assert.True(t, errors.Is(err, koyori.ErrEmpty))
+
+	deliveryA, deliveryB := first, second
+	if second.Item == "a1" {
+		deliveryA, deliveryB = second, first
+	}
+	assert.Nil(t, deliveryA.Nack())
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a1", delivery.Item)
+	assert.Nil(t, delivery.Ack())
+	delivery, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a2", delivery.Item)
+	assert.Nil(t, delivery.Ack())
+	// Acking twice doesn't free the partition for the next delivery.
+	delivery, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a3", delivery.Item)
+	assert.NotNil(t, deliveryA.Ack())
+	_, err = queue.Reserve()
+	assert.True(t, errors.Is(err, koyori.ErrEmpty))
+	assert.Nil(t, delivery.Nack())
+	assert.Nil(t, deliveryB.Ack())
+	assert.Equal(t, 1, queue.Len())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewPartitionedQueue(opts, 4)
+	assert.Nil(t, err)
+	delivery, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a3", delivery.Item)
+	assert.Nil(t, delivery.Ack())
+	assert.Nil(t, queue.Close())
+
+	// Fewer partitions would move keys around
+	_, err = koyori.NewPartitionedQueue(opts, 2)
+	assert.NotNil(t, err)
+}
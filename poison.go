@@ -0,0 +1,126 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+)
+
+// PoisonPolicy decides what happens to items the Converter fails to decode, such as items
+// written before a change of schema.
+type PoisonPolicy int
+
+const (
+	// PoisonFail returns an *UnmarshalError, leaving the item at the head of the queue. Items of
+	// pending transactions that fail to decode keep the queue from opening.
+	PoisonFail PoisonPolicy = iota
+	// PoisonSkip drops the item, logging a warning. Items dropped while dequeuing are also
+	// reported as an EventDrop.
+	PoisonSkip
+	// PoisonQuarantine drops the item like PoisonSkip, after saving it to a file of its own in
+	// the quarantine subfolder of the queue folder. The file holds the item as it was passed to
+	// the Converter.
+	PoisonQuarantine
+)
+
+// quarantineFolder is the subfolder of the queue folder holding items dropped by
+// PoisonQuarantine.
+const quarantineFolder = "quarantine"
+
+// skipPoisonLocked calls take, which removes items from the first segment, again after dropping
+// an item it failed to decode if PoisonPolicy allows it. The caller holds headMutex.
+func (q *Queue[T]) skipPoisonLocked(take func() error) error {
+	for {
+		err := take()
+		if err == nil {
+			return nil
+		}
+		var poison *UnmarshalError
+		if q.options.PoisonPolicy == PoisonFail || !errors.As(err, &poison) {
+			return err
+		}
+		if err := q.firstSegment.dropPoison(poison); err != nil {
+			return errors.Wrap(err, "failed to drop item that failed to decode")
+		}
+		q.emit(Event{Type: EventDrop, Count: 1})
+		// The item may have been the last of a full segment.
+		if err := q.closeDrainedSegmentsLocked(); err != nil {
+			return errors.Wrap(err, "failed to close segment")
+		}
+	}
+}
+
+// dropPoison removes the item poison is about from the segment, quarantining it first under
+// PoisonQuarantine.
+func (s *segment[T]) dropPoison(poison *UnmarshalError) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	pos := -1
+	for i := range s.entries {
+		if s.entries[i].onDisk && s.entries[i].offset == poison.Offset {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 || poison.Segment != s.segmentNumber {
+		return poison
+	}
+	e := &s.entries[pos]
+	if err := s.giveUpPoisonLocked(e, poison); err != nil {
+		return err
+	}
+	return s.dropIndexesLocked([]int{e.index})
+}
+
+// giveUpPoisonLocked quarantines the item of e under PoisonQuarantine, and reports it, before
+// it is removed.
+func (s *segment[T]) giveUpPoisonLocked(e *entry[T], poison *UnmarshalError) error {
+	if s.options.PoisonPolicy == PoisonQuarantine {
+		data, err := s.readItemLocked(e, false)
+		if err != nil {
+			return err
+		}
+		if data, err = decompress(s.header.compression, data); err != nil {
+			return errors.Wrap(err, "failed to decompress object")
+		}
+		if err := s.quarantineLocked(poison.Offset, data); err != nil {
+			return err
+		}
+	}
+	s.reportPoison(poison)
+	return nil
+}
+
+// quarantineLocked saves the item at offset, decompressed, to the quarantine folder.
+func (s *segment[T]) quarantineLocked(offset int64, data []byte) error {
+	_, data, err := splitSchemaVersion(s.header.flags, data)
+	if err != nil {
+		return err
+	}
+	folderPath := filepath.Join(s.options.FolderPath, quarantineFolder)
+	if err := os.MkdirAll(folderPath, s.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create quarantine folder")
+	}
+	// Segment numbers start over, so the creation time of the segment keeps names apart and in
+	// order. An item quarantined again on a later load replaces its earlier copy.
+	created := int64(0)
+	if !s.header.createdAt.IsZero() {
+		created = s.header.createdAt.UnixNano()
+	}
+	filePath := filepath.Join(folderPath, fmt.Sprintf("%d-%d-%d", created, s.segmentNumber, offset))
+	if err := os.WriteFile(filePath, data, s.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to quarantine item")
+	}
+	// The item must not be lost once its removal is recorded.
+	if err := syncFile(filePath, s.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to sync quarantined item")
+	}
+	return errors.Wrap(syncDir(folderPath), "failed to sync quarantine folder")
+}
+
+func (s *segment[T]) reportPoison(poison *UnmarshalError) {
+	s.options.logger().Warn("dropped item that failed to decode", "folder", s.folderPath, "segment", poison.Segment,
+		"offset", poison.Offset, "err", poison.Err)
+}
@@ -0,0 +1,58 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueuePoisonPolicy(t *testing.T) {
+	for _, policy := range []koyori.PoisonPolicy{koyori.PoisonSkip, koyori.PoisonQuarantine} {
+		opts := koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 2,
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "bad", "b", "bad", "bad", "c", "d"})))
+		assert.Nil(t, queue.Close())
+
+		dropped := 0
+		opts.Converter = pickyConverter{}
+		opts.PoisonPolicy = policy
+		opts.OnEvent = func(event koyori.Event) {
+			if event.Type == koyori.EventDrop {
+				dropped += event.Count
+			}
+		}
+		queue, err = koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assertDequeue(t, queue, "a")
+		assertDequeue(t, queue, "b")
+		// A segment of nothing but bad items is passed over.
+		assertDequeueMany(t, queue, 2, []string{"c", "d"})
+		assert.Equal(t, 3, dropped)
+		_, err = queue.Dequeue()
+		assert.ErrorIs(t, err, koyori.ErrEmpty)
+		assert.Nil(t, queue.Close())
+
+		quarantined, err := filepath.Glob(filepath.Join(opts.FolderPath, "quarantine", "*"))
+		assert.Nil(t, err)
+		if policy == koyori.PoisonSkip {
+			assert.Empty(t, quarantined)
+			continue
+		}
+		assert.Len(t, quarantined, 3)
+		for _, filePath := range quarantined {
+			data, err := os.ReadFile(filePath)
+			assert.Nil(t, err)
+			assert.Equal(t, "bad", string(data))
+		}
+	}
+}
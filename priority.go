@@ -0,0 +1,164 @@
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const priorityFolderPrefix = "priority-"
+
+// PriorityQueue is a set of queues, one per priority level, stored in subfolders of
+// FolderPath. Dequeue takes items from the highest priority level holding any.
+type PriorityQueue[T any] struct {
+	// levels holds the queue of each priority, lowest first.
+	levels []*Queue[T]
+}
+
+// NewPriorityQueue opens a priority queue with levels priorities, from 0 (lowest) to levels-1.
+// options apply to the queue of every level, each of which lives in its own subfolder of
+// options.FolderPath. Opening a folder holding levels above the given number fails, so items
+// aren't silently left behind.
+func NewPriorityQueue[T any](options QueueOptions[T], levels int) (*PriorityQueue[T], error) {
+	if levels < 1 {
+		return nil, errors.Errorf("invalid number of priority levels %d", levels)
+	}
+	if err := checkPriorityFolders(options.FolderPath, levels); err != nil {
+		return nil, err
+	}
+	pq := &PriorityQueue[T]{}
+	for priority := 0; priority < levels; priority++ {
+		levelOptions := options
+		levelOptions.FolderPath = filepath.Join(options.FolderPath, fmt.Sprintf("%s%d", priorityFolderPrefix, priority))
+		queue, err := NewQueue(levelOptions)
+		if err != nil {
+			pq.Close()
+			return nil, errors.Wrapf(err, "failed to open priority %d", priority)
+		}
+		pq.levels = append(pq.levels, queue)
+	}
+	return pq, nil
+}
+
+// checkPriorityFolders fails if folderPath has the folder of a priority level of levels or above.
+func checkPriorityFolders(folderPath string, levels int) error {
+	entries, err := os.ReadDir(folderPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read queue directory")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), priorityFolderPrefix) {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), priorityFolderPrefix))
+		if err == nil && priority >= levels {
+			return errors.Errorf("found priority %d, but the queue has %d levels", priority, levels)
+		}
+	}
+	return nil
+}
+
+func (pq *PriorityQueue[T]) level(priority int) (*Queue[T], error) {
+	if priority < 0 || priority >= len(pq.levels) {
+		return nil, errors.Errorf("invalid priority %d", priority)
+	}
+	return pq.levels[priority], nil
+}
+
+// Enqueue adds an item to the level of priority, returning its sequence number within the
+// level (see Queue.Enqueue).
+func (pq *PriorityQueue[T]) Enqueue(item T, priority int) (uint64, error) {
+	queue, err := pq.level(priority)
+	if err != nil {
+		return 0, err
+	}
+	return queue.Enqueue(item)
+}
+
+// EnqueueMany adds items to the level of priority, returning the sequence number of the first
+// one within the level (see Queue.EnqueueMany).
+func (pq *PriorityQueue[T]) EnqueueMany(items []T, priority int) (uint64, error) {
+	queue, err := pq.level(priority)
+	if err != nil {
+		return 0, err
+	}
+	return queue.EnqueueMany(items)
+}
+
+// Dequeue removes the first item of the highest priority level holding any.
+func (pq *PriorityQueue[T]) Dequeue() (*T, error) {
+	for priority := len(pq.levels) - 1; priority >= 0; priority-- {
+		item, err := pq.levels[priority].Dequeue()
+		if !errors.Is(err, ErrEmpty) {
+			return item, err
+		}
+	}
+	return nil, ErrEmpty
+}
+
+// DequeueMany removes up to count items, going through priority levels from the highest. It
+// returns ErrEmpty if no level holds an item.
+func (pq *PriorityQueue[T]) DequeueMany(count int) ([]T, error) {
+	result, err := pq.DequeueUpTo(count)
+	if err == nil && len(result) == 0 && count > 0 {
+		return nil, ErrEmpty
+	}
+	return result, err
+}
+
+// DequeueUpTo removes up to count items like DequeueMany, returning an empty slice rather than
+// ErrEmpty if there are none.
+func (pq *PriorityQueue[T]) DequeueUpTo(count int) ([]T, error) {
+	result := []T{}
+	for priority := len(pq.levels) - 1; priority >= 0 && len(result) < count; priority-- {
+		items, err := pq.levels[priority].DequeueUpTo(count - len(result))
+		if err != nil {
+			return result, err
+		}
+		result = append(result, items...)
+	}
+	return result, nil
+}
+
+// Len returns the number of items over all priority levels.
+func (pq *PriorityQueue[T]) Len() int {
+	count := 0
+	for _, queue := range pq.levels {
+		count += queue.Len()
+	}
+	return count
+}
+
+// LenPriority returns the number of items with the given priority.
+func (pq *PriorityQueue[T]) LenPriority(priority int) int {
+	queue, err := pq.level(priority)
+	if err != nil {
+		return 0
+	}
+	return queue.Len()
+}
+
+func (pq *PriorityQueue[T]) Flush() error {
+	for priority, queue := range pq.levels {
+		if err := queue.Flush(); err != nil {
+			return errors.Wrapf(err, "failed to flush priority %d", priority)
+		}
+	}
+	return nil
+}
+
+// Close closes the queue of every priority level, returning the first error.
+func (pq *PriorityQueue[T]) Close() error {
+	var firstErr error
+	for priority, queue := range pq.levels {
+		if err := queue.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to close priority %d", priority)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,52 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewPriorityQueue(opts, 3)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"low1", "low2", "low3"}, 0)))
+	assert.Nil(t, enqueueErr(queue.Enqueue("high", 2)))
+	// Each level numbers its own items.
+	sequence, err := queue.Enqueue("mid", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	assert.NotNil(t, enqueueErr(queue.Enqueue("invalid", 3)))
+	assert.Equal(t, 5, queue.Len())
+
+	item, err := queue.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "high", *item)
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewPriorityQueue(opts, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.LenPriority(1))
+	items, err := queue.DequeueMany(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mid", "low1", "low2"}, items)
+	items, err = queue.DequeueUpTo(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"low3"}, items)
+	_, err = queue.DequeueMany(3)
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, queue.Close())
+
+	// Dropping a level would strand its items
+	_, err = koyori.NewPriorityQueue(opts, 2)
+	assert.NotNil(t, err)
+}
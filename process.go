@@ -0,0 +1,132 @@
+package koyori
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Process runs a pool of workers that take batches of up to batchSize items from the queue and
+// pass them to fn, waiting for new items while the queue is empty, until ctx is done. It then
+// waits for the calls to fn that are running and returns ctx.Err(). It takes the same options
+// as Subscribe.
+//
+// The items of a batch are reserved (see BeginDequeue) while fn runs, and removed at once when
+// it returns nil, so a crash before then delivers them again. A batch for which fn returns an
+// error or panics is put back in its place after a backoff, and retried. Items that failed as
+// many times as set by WithMaxAttempts are moved to QueueOptions.DeadLetterQueue, or dropped if
+// that isn't set, instead of being retried. As fn handles a batch as a whole, this gives up on
+// the oldest items of the batch, which aren't necessarily the ones it failed on. Attempts are
+// only remembered across restarts with VisibilityTimeout set. With QueueOptions.RetryPolicy
+// set, failed batches are handed to Batch.Retry instead, and WithMaxAttempts and WithBackoff
+// don't apply.
+//
+// Process stops early, returning the error, if the queue is closed or fails.
+func (q *Queue[T]) Process(ctx context.Context, batchSize int, fn func([]T) error, opts ...SubOpt) error {
+	if batchSize < 1 {
+		return errors.Errorf("invalid batch size %d", batchSize)
+	}
+	o := subOptions{concurrency: 1, maxAttempts: 3, initialBackoff: 100 * time.Millisecond, maxBackoff: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+	return runWorkers(ctx, o.concurrency, func(ctx context.Context) error {
+		return q.runProcessor(ctx, batchSize, fn, &o)
+	})
+}
+
+// runProcessor handles batches until ctx is done, which returns nil, or the queue fails.
+func (q *Queue[T]) runProcessor(ctx context.Context, batchSize int, fn func([]T) error, o *subOptions) error {
+	for {
+		added := q.added.wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+		batch, err := q.BeginDequeue(batchSize)
+		if errors.Is(err, ErrEmpty) {
+			q.waitAdded(ctx, added)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fnErr := callBatchFunc(fn, batch.Items); fnErr == nil {
+			err = batch.Commit()
+		} else {
+			err = q.handleBatchFailure(ctx, batch, fnErr, o)
+		}
+		// A reservation expired under VisibilityTimeout, and the items were handed out again.
+		if err != nil && !errors.Is(err, ErrDeliveryDone) {
+			return err
+		}
+	}
+}
+
+func callBatchFunc[T any](fn func([]T) error, items []T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("batch function panicked: %v", r)
+		}
+	}()
+	return fn(items)
+}
+
+// handleBatchFailure gives up on the items of a batch that failed too many times, and retries
+// the rest after a backoff.
+func (q *Queue[T]) handleBatchFailure(ctx context.Context, batch Batch[T], fnErr error, o *subOptions) error {
+	if q.options.RetryPolicy.enabled() {
+		return batch.Retry()
+	}
+	giveUp, retry := batch.split(func(attempts int) bool {
+		return o.maxAttempts > 0 && attempts >= o.maxAttempts
+	})
+	if len(giveUp.Items) > 0 {
+		if dlq := q.options.DeadLetterQueue; dlq != nil {
+			if _, err := dlq.EnqueueMany(giveUp.Items); err != nil {
+				// Retried rather than lost.
+				q.options.logger().Warn("failed to move items to dead letter queue", "folder", q.options.FolderPath, "err", err)
+				retry = batch
+				giveUp = Batch[T]{}
+			}
+		}
+	}
+	if len(giveUp.Items) > 0 {
+		q.options.logger().Warn("gave up on items", "folder", q.options.FolderPath, "count", len(giveUp.Items), "err", fnErr)
+		// The items to retry are still put back if the reservations expired.
+		if err := giveUp.Commit(); err != nil && !errors.Is(err, ErrDeliveryDone) {
+			return err
+		}
+	}
+	if len(retry.Items) == 0 {
+		return nil
+	}
+	timer := time.NewTimer(o.backoff(retry.attempts[0]))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-q.closed:
+	}
+	return retry.Rollback()
+}
+
+// split divides the items of the batch by whether match returns true for their attempts.
+func (b Batch[T]) split(match func(attempts int) bool) (Batch[T], Batch[T]) {
+	matched := Batch[T]{queue: b.queue, segmentNumber: b.segmentNumber}
+	rest := matched
+	for i := range b.Items {
+		part := &rest
+		if match(b.attempts[i]) {
+			part = &matched
+		}
+		part.Items = append(part.Items, b.Items[i])
+		part.indexes = append(part.indexes, b.indexes[i])
+		part.reservations = append(part.reservations, b.reservations[i])
+		part.attempts = append(part.attempts, b.attempts[i])
+	}
+	return matched, rest
+}
@@ -0,0 +1,110 @@
+package koyori_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueProcess(t *testing.T) {
+	newOpts := func() koyori.QueueOptions[string] {
+		return koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 10,
+		}
+	}
+	dlq, err := koyori.NewQueue(newOpts())
+	assert.Nil(t, err)
+	opts := newOpts()
+	opts.DeadLetterQueue = dlq
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+
+	var mutex sync.Mutex
+	batches := [][]string{}
+	done := make(chan struct{})
+	fn := func(items []string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		batches = append(batches, append([]string(nil), items...))
+		for _, item := range items {
+			switch item {
+			case "bad":
+				return errors.New("always fails")
+			case "panic":
+				panic("boom")
+			}
+		}
+		if items[len(items)-1] == "e" {
+			close(done)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- queue.Process(ctx, 2, fn, koyori.WithMaxAttempts(2), koyori.WithBackoff(time.Millisecond, 5*time.Millisecond))
+	}()
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "bad", "c", "panic", "d", "e"})))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("items weren't processed")
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-result)
+
+	// A failed batch is retried, and given up on once it failed as many times as allowed,
+	// leaving the items added since to the next batch.
+	mutex.Lock()
+	assert.Equal(t, [][]string{{"a", "b"}, {"bad", "c"}, {"bad", "c"}, {"panic", "d"}, {"panic", "d"}, {"e"}}, batches)
+	mutex.Unlock()
+	assert.Equal(t, 0, queue.Len())
+	assertDequeueMany(t, dlq, 4, []string{"bad", "c", "panic", "d"})
+
+	// Process stops once the queue is closed.
+	go func() {
+		result <- queue.Process(context.Background(), 2, fn)
+	}()
+	assert.Nil(t, queue.Close())
+	assert.ErrorIs(t, <-result, koyori.ErrClosed)
+	assert.Nil(t, dlq.Close())
+}
+
+func TestQueueProcessCrash(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+
+	// The queue is closed while a batch is processed, as if the process crashed.
+	result := make(chan error)
+	go func() {
+		result <- queue.Process(context.Background(), 2, func(items []string) error {
+			assert.Nil(t, queue.Close())
+			return nil
+		})
+	}()
+	assert.ErrorIs(t, <-result, koyori.ErrClosed)
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+}
@@ -1,39 +1,177 @@
 package koyori
 
 import (
+	"context"
+	"fmt"
 	"github.com/pkg/errors"
 	"math"
 	"os"
-	"strconv"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrEmpty = errors.New("queue is empty")
+var ErrFolderNotWritable = errors.New("queue folder is not writable")
 
+const (
+	defaultSegmentCapacity = 1024
+	itemSizeSmoothing      = 0.2
+)
+
+// Queue is safe for concurrent use. Enqueuing and dequeuing take separate locks, so producers
+// and consumers only wait for each other while segments are rotated; when both work on the same
+// segment, the segment's own lock hands it over between them.
 type Queue[T any] struct {
-	options       QueueOptions[T]
-	firstSegment  *segment[T]
+	options QueueOptions[T]
+
+	// headMutex guards the dequeuing side: firstSegment, reservations and the schedule.
+	headMutex    sync.Mutex
+	firstSegment *segment[T]
+	// tailMutex guards the enqueuing side and the list of segments. Both are held to move
+	// firstSegment to another segment, always locking headMutex first.
+	tailMutex     sync.Mutex
 	lastSegment   *segment[T]
 	segmentNumber int
-	mutex         sync.Mutex
+	segments      []int
+	avgItemSize   float64
+	// nextSequence is the sequence number the next item enqueued gets (see Enqueue).
+	nextSequence uint64
+	// middleCount is the number of items in the segments between the first and the last.
+	middleCount int
+	// folderUnsynced is set when segment files were created or deleted since the queue folder
+	// was last synced.
+	folderUnsynced bool
+	// unsyncedSegments holds the segments closed with writes that weren't synced yet.
+	unsyncedSegments []int
+	// lockFile holds the lock on the queue folder until the queue is closed.
+	lockFile *os.File
+	schedule *schedule[T]
+	// closed is closed by Close, stopping the goroutines started for the queue. background
+	// waits for those started by NewQueue.
+	closed     chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
+	// draining is closed by Drain, after which no more items are accepted.
+	draining  chan struct{}
+	drainOnce sync.Once
+	// filesClosed is set once Close closed the files, so that calling it again does nothing.
+	filesClosed bool
+	// added is notified when items are added or become available again, and removed when
+	// items or segments are removed.
+	added   signal
+	removed signal
+	// dequeueRate estimates how fast items are removed, for FullError.RetryAfter.
+	dequeueRate rateEstimator
+	// middleBytes is the size of the segment files between the first and the last.
+	middleBytes int64
+	// claimed holds the segments taken out of the queue by ClaimSegment that weren't committed
+	// or released yet. It is changed with both locks held.
+	claimed map[int]bool
+	// groups holds the registered consumer groups. It is changed with both locks held.
+	groups map[string]*ConsumerGroup[T]
+	// cold holds the segments offloaded to ColdStorage, and sealed is notified when a segment
+	// stops being the last one, making it a candidate for offloading.
+	cold   map[int]coldSegment
+	sealed signal
+	// archived is notified when a segment file is moved to the archive folder.
+	archived signal
+	// readOnly is set for queues opened by OpenReadOnly, which only have options, segments
+	// and cold set, listed anew by refreshReadOnlyLocked.
+	readOnly bool
+	// producer is set for the queue of a Producer, which only holds the last segment and leaves
+	// the others to the Consumer.
+	producer bool
+	// iterators counts the iterators that weren't closed, which keep segments from being
+	// renumbered.
+	iterators int64
 }
 
-func (q *Queue[T]) Enqueue(item T) error {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
-
-	if q.lastSegment.countOnDisk() >= q.lastSegment.capacity {
+// Enqueue adds an item to the end of the queue and returns its sequence number. Items are
+// numbered from 1 on in the order they are enqueued, across restarts, so that a consumer can
+// tell from Message.Sequence whether it missed an item or got one twice. Numbers may be
+// skipped after a crash, by the items of a transaction that was rolled back when the queue was
+// loaded for instance. An item dropped by OverflowDropNewest isn't numbered, and 0 is returned.
+func (q *Queue[T]) Enqueue(item T) (uint64, error) {
+	unlock, admit, err := q.lockForEnqueue(1)
+	defer unlock()
+	if !admit {
+		return 0, err
+	}
+	if q.lastSegment.full() {
 		if err := q.addSegmentLocked(); err != nil {
-			return errors.Wrap(err, "failed to add new segment")
+			return 0, errors.Wrap(err, "failed to add new segment")
 		}
 	}
-	return errors.Wrap(q.lastSegment.add(item), "failed to insert")
+	sequence := q.nextSequence
+	bytesBefore, _ := q.lastSegment.recordStats()
+	if err := q.lastSegment.add(item, sequence); err != nil {
+		return 0, errors.Wrap(err, "failed to insert")
+	}
+	q.nextSequence++
+	bytesAfter, _ := q.lastSegment.recordStats()
+	q.observeItemSizes(bytesAfter-bytesBefore, 1)
+	q.emit(Event{Type: EventEnqueue, Count: 1})
+	q.notifyAdded()
+	return sequence, nil
 }
 
-func (q *Queue[T]) EnqueueMany(items []T) error {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+// EnqueueMany adds items to the queue and returns the sequence number of the first one, the
+// others following it in order (see Enqueue). With MaxItems or MaxBytes set, either all of
+// them are added or, if they don't fit, none, and 0 is returned if OverflowDropNewest dropped
+// them.
+func (q *Queue[T]) EnqueueMany(items []T) (uint64, error) {
+	unlock, admit, err := q.lockForEnqueue(len(items))
+	defer unlock()
+	if !admit {
+		return 0, err
+	}
+	sequence := q.nextSequence
+	return sequence, q.enqueueManyLocked(items, sequence)
+}
+
+// PushFront adds an item to the head of the queue, so that a consumer can put back an item it
+// took but can't handle yet without it losing its place. See PushFrontMany.
+func (q *Queue[T]) PushFront(item T) error {
+	return q.PushFrontMany([]T{item})
+}
+
+// PushFrontMany adds items to the head of the queue, in order, ahead of the items already there.
+// The first segment is rewritten with the items in front of its live ones, as Compact does, so
+// it is meant for putting back the odd item rather than for every one. It isn't limited by
+// MaxItems or MaxBytes, and the items don't keep their enqueue time, so MinAge and ItemTTL
+// don't apply to them.
+//
+// It fails while items of the first segment are reserved or belong to a pending EnqueueFanout
+// transaction, and while consumer groups are registered, as those refer to items by position.
+func (q *Queue[T]) PushFrontMany(items []T) error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	seg := q.firstSegment
+	if seg.reservedCount > 0 || len(seg.txns) > 0 {
+		return errors.New("can't push to the front while items at the head are reserved or in a transaction")
+	}
+	if len(q.groups) > 0 {
+		return errors.New("can't push to the front while consumer groups are registered")
+	}
+	if err := q.rewriteFirstSegmentLocked(items); err != nil {
+		return errors.Wrap(err, "failed to push to the front")
+	}
+	q.emit(Event{Type: EventEnqueue, Count: len(items)})
+	q.notifyAdded()
+	return nil
+}
 
+// enqueueManyLocked adds items numbered from sequence on. The caller holds tailMutex.
+func (q *Queue[T]) enqueueManyLocked(items []T, sequence uint64) error {
 	originalLen := len(items)
 	for len(items) > 0 {
 		enqueueCount := len(items)
@@ -42,12 +180,26 @@ func (q *Queue[T]) EnqueueMany(items []T) error {
 			enqueueCount = allowedEnqueueCount
 		}
 		if enqueueCount > 0 {
-			if err := q.lastSegment.addMany(items[0:enqueueCount]); err != nil {
+			bytesBefore, _ := q.lastSegment.recordStats()
+			added, err := q.lastSegment.addMany(items[0:enqueueCount], sequence)
+			sequence = nthSequence(sequence, added)
+			q.raiseSequenceLocked(sequence)
+			if added > 0 {
+				bytesAfter, _ := q.lastSegment.recordStats()
+				q.observeItemSizes(bytesAfter-bytesBefore, added)
+				q.emit(Event{Type: EventEnqueue, Count: added})
+				q.notifyAdded()
+			}
+			if err != nil {
+				var marshalErr *MarshalError
+				if errors.As(err, &marshalErr) {
+					marshalErr.Index += originalLen - len(items)
+				}
 				return errors.Wrap(err, "failed to enqueueMany")
 			}
-			items = items[enqueueCount:]
+			items = items[added:]
 		}
-		if q.lastSegment.countOnDisk() >= q.lastSegment.capacity {
+		if q.lastSegment.full() {
 			if err := q.addSegmentLocked(); err != nil {
 				return errors.Wrapf(err, "failed to add new segment (added %d)", originalLen-len(items))
 			}
@@ -57,53 +209,122 @@ func (q *Queue[T]) EnqueueMany(items []T) error {
 }
 
 func (q *Queue[T]) Dequeue() (*T, error) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
 
-	item, err := q.firstSegment.remove()
+	if err := q.checkOpenLocked(); err != nil {
+		return nil, err
+	}
+	if err := q.beforeDequeueLocked(); err != nil {
+		return nil, err
+	}
+	var item *T
+	err := q.skipPoisonLocked(func() error {
+		var err error
+		item, err = q.firstSegment.remove()
+		return err
+	})
 	if err != nil {
 		if err == errEmptySegment {
 			return nil, ErrEmpty
 		}
 		return nil, errors.Wrap(err, "failed to dequeue from segment")
 	}
-	if q.firstSegment.count() > 0 {
-		return item, nil
+	q.emit(Event{Type: EventDequeue, Count: 1})
+	return item, q.closeDrainedSegmentsLocked()
+}
+
+// DequeueInto removes the first item of the queue and stores it in dst. With a converter that
+// implements IntoUnmarshaler, items loaded from disk are decoded directly into dst.
+func (q *Queue[T]) DequeueInto(dst *T) error {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
 	}
-	if q.firstSegment.countOnDisk() >= q.firstSegment.capacity {
-		if err := q.closeFullFirstSegment(); err != nil {
-			return item, err
+	if err := q.beforeDequeueLocked(); err != nil {
+		return err
+	}
+	if err := q.skipPoisonLocked(func() error { return q.firstSegment.removeInto(dst) }); err != nil {
+		if err == errEmptySegment {
+			return ErrEmpty
 		}
+		return errors.Wrap(err, "failed to dequeue from segment")
 	}
-	return item, nil
+	q.emit(Event{Type: EventDequeue, Count: 1})
+	return q.closeDrainedSegmentsLocked()
 }
 
-func (q *Queue[T]) DequeueMany(count int) ([]T, error) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+// closeDrainedSegmentsLocked deletes the first segment while it holds no items and won't get
+// any more. The caller holds headMutex only.
+func (q *Queue[T]) closeDrainedSegmentsLocked() error {
+	if q.firstSegment.count() > 0 && len(q.groups) == 0 {
+		return nil
+	}
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
 
-	results := [][]T{}
-	for {
-		removed, err := q.firstSegment.removeMany(count)
-		if err != nil {
-			if err == errEmptySegment {
-				break
-			}
-			return []T{}, errors.Wrap(err, "failed to dequeueMany")
-		}
-		results = append(results, removed)
-		count -= len(removed)
-		if count == 0 || len(removed) == 0 || q.firstSegment.countOnDisk() < q.firstSegment.capacity {
-			break
+	return q.closeDrainedSegmentsBothLocked()
+}
+
+// closeDrainedSegmentsBothLocked is closeDrainedSegmentsLocked for a caller holding both locks.
+func (q *Queue[T]) closeDrainedSegmentsBothLocked() error {
+	if q.producer {
+		return nil
+	}
+	for q.firstSegmentSealedLocked() && q.firstSegmentReleasedLocked() {
+		if dropped := q.firstSegment.count(); dropped > 0 {
+			q.emit(Event{Type: EventDrop, Count: dropped})
 		}
 		if err := q.closeFullFirstSegment(); err != nil {
-			return []T{}, errors.Wrap(err, "failed to close segment")
+			return err
 		}
 	}
-	if q.firstSegment.countOnDisk() >= q.firstSegment.capacity {
-		if err := q.closeFullFirstSegment(); err != nil {
-			return []T{}, errors.Wrap(err, "failed to close segment")
-		}
+	return nil
+}
+
+// firstSegmentReleasedLocked reports whether the first segment may be deleted once sealed: when
+// it was drained or, with consumer groups registered, when every group has passed it.
+func (q *Queue[T]) firstSegmentReleasedLocked() bool {
+	if len(q.groups) == 0 {
+		return q.firstSegment.count() == 0
+	}
+	return q.groupsPassedLocked()
+}
+
+// firstSegmentSealedLocked reports whether no more items will be added to the first segment,
+// either because it is full or because later segments were started before it filled up.
+func (q *Queue[T]) firstSegmentSealedLocked() bool {
+	return q.firstSegment != q.lastSegment || q.firstSegment.full()
+}
+
+// DequeueMany removes up to count items from the head of the queue. It returns ErrEmpty if the
+// queue holds no items to dequeue, so at least one item is returned whenever the error is nil
+// and count is positive. See DequeueUpTo for a batch that may be empty.
+func (q *Queue[T]) DequeueMany(count int) ([]T, error) {
+	result, err := q.DequeueUpTo(count)
+	if err == nil && len(result) == 0 && count > 0 {
+		return nil, ErrEmpty
+	}
+	return result, err
+}
+
+// DequeueUpTo removes up to count items from the head of the queue, like DequeueMany, but
+// returns an empty slice rather than ErrEmpty if there are none, for consumers that poll the
+// queue and treat an empty batch like any other.
+func (q *Queue[T]) DequeueUpTo(count int) ([]T, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	results := [][]T{}
+	err := q.dequeueManyLocked(count, func(seg *segment[T], count int) (int, error) {
+		removed, err := seg.removeMany(count)
+		results = append(results, removed)
+		return len(removed), err
+	})
+	if err != nil {
+		return []T{}, err
 	}
 
 	lenSum := 0
@@ -119,136 +340,743 @@ func (q *Queue[T]) DequeueMany(count int) ([]T, error) {
 	return result, nil
 }
 
+// DequeueManyInto removes up to len(dst) items from the queue, storing them in dst.
+// It returns the number of items stored.
+func (q *Queue[T]) DequeueManyInto(dst []T) (int, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	filled := 0
+	err := q.dequeueManyLocked(len(dst), func(seg *segment[T], count int) (int, error) {
+		removed, err := seg.removeManyInto(dst[filled : filled+count])
+		filled += removed
+		return removed, err
+	})
+	return filled, err
+}
+
+// DequeueManyFunc removes up to max items from the head of the queue as long as pred holds for
+// them, so consumers can batch items by their own rules, like a shared tenant or a total payload
+// size. pred is called on the items in order, and the first item it rejects stays at the head.
+// pred runs with the queue locked, and must not call into the queue.
+func (q *Queue[T]) DequeueManyFunc(max int, pred func(T) bool) ([]T, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	return q.dequeueWhileLocked(max, func(item T, _ int) bool { return pred(item) })
+}
+
+// DequeueWhile removes items from the head of the queue as long as pred holds for them. See
+// DequeueManyFunc.
+func (q *Queue[T]) DequeueWhile(pred func(T) bool) ([]T, error) {
+	return q.DequeueManyFunc(math.MaxInt, pred)
+}
+
+// DequeueManyBytes removes items from the head of the queue as long as their total size stays
+// within maxBytes, for batches bounded in size. Items are counted by the size they are stored
+// with, which is after Compression. The first item is removed even if it alone exceeds maxBytes,
+// so that a large item can't hold up the queue.
+func (q *Queue[T]) DequeueManyBytes(maxBytes int) ([]T, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	total, taken := 0, 0
+	return q.dequeueWhileLocked(math.MaxInt, func(_ T, size int) bool {
+		if taken > 0 && total+size > maxBytes {
+			return false
+		}
+		total += size
+		taken++
+		return true
+	})
+}
+
+// dequeueWhileLocked removes up to max items from the head of the queue as long as pred holds
+// for them and their stored size, stopping at the first item it rejects.
+func (q *Queue[T]) dequeueWhileLocked(max int, pred func(item T, size int) bool) ([]T, error) {
+	result := []T{}
+	err := q.dequeueManyLocked(max, func(seg *segment[T], count int) (int, error) {
+		removed, rejected, err := seg.removeWhile(count, pred)
+		result = append(result, removed...)
+		if err == nil && rejected {
+			// Stop here rather than look at later segments.
+			err = errEmptySegment
+		}
+		return len(removed), err
+	})
+	if err != nil {
+		return []T{}, err
+	}
+	return result, nil
+}
+
+// dequeueManyLocked calls take on the first segment until count items were taken or the
+// queue is drained, rotating past full segments in between.
+func (q *Queue[T]) dequeueManyLocked(count int, take func(seg *segment[T], count int) (int, error)) error {
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if err := q.beforeDequeueLocked(); err != nil {
+		return err
+	}
+	for {
+		removed := 0
+		err := q.skipPoisonLocked(func() error {
+			var err error
+			removed, err = take(q.firstSegment, count)
+			return err
+		})
+		if removed > 0 {
+			q.emit(Event{Type: EventDequeue, Count: removed})
+		}
+		if err != nil {
+			if err == errEmptySegment {
+				break
+			}
+			return errors.Wrap(err, "failed to dequeueMany")
+		}
+		count -= removed
+		if count == 0 || removed == 0 {
+			break
+		}
+		drained := q.firstSegment
+		if err := q.closeDrainedSegmentsLocked(); err != nil {
+			return errors.Wrap(err, "failed to close segment")
+		}
+		if q.firstSegment == drained {
+			break
+		}
+	}
+	return errors.Wrap(q.closeDrainedSegmentsLocked(), "failed to close segment")
+}
+
+// Flush syncs the queue's segment files and folder to disk, including scheduled items and
+// segments closed since the last sync. Whatever the SyncPolicy, items enqueued or dequeued
+// before a successful Flush survive a crash.
+func (q *Queue[T]) Flush() error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := q.firstSegment.flush(); err != nil {
+		return errors.Wrap(err, "failed to flush segment")
+	}
+	if q.lastSegment != q.firstSegment {
+		if err := q.lastSegment.flush(); err != nil {
+			return errors.Wrap(err, "failed to flush segment")
+		}
+	}
+	for len(q.unsyncedSegments) > 0 {
+		number := q.unsyncedSegments[0]
+		if err := syncFile(q.options.SegmentNaming.path(q.options.FolderPath, number), q.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to flush segment (#%d)", number)
+		}
+		q.unsyncedSegments = q.unsyncedSegments[1:]
+	}
+	if err := q.schedule.flush(); err != nil {
+		return errors.Wrap(err, "failed to flush scheduled items")
+	}
+	if err := q.syncGroupsLocked(); err != nil {
+		return err
+	}
+	if err := syncDir(q.options.FolderPath); err != nil {
+		return errors.Wrap(err, "failed to sync folder")
+	}
+	q.folderUnsynced = false
+	q.emit(Event{Type: EventFlush, Duration: time.Since(start)})
+	return nil
+}
+
+// Len returns the number of items in the queue, including items held back by MinAge.
+func (q *Queue[T]) Len() int {
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+
+	return q.lenLocked()
+}
+
+// Close stops the queue's background work and closes its files. Every other method called
+// afterwards returns ErrClosed. Close waits for operations in progress, and calling it again
+// does nothing.
 func (q *Queue[T]) Close() error {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.closeOnce.Do(func() { close(q.closed) })
+	q.background.Wait()
+
+	q.lock()
+	defer q.unlock()
+
+	if q.filesClosed {
+		return nil
+	}
+	q.filesClosed = true
 
 	if err := q.firstSegment.close(); err != nil {
 		return errors.Wrap(err, "failed to close segment file")
 	}
-	if err := q.lastSegment.close(); err != nil {
+	if q.lastSegment != q.firstSegment {
+		if err := q.lastSegment.close(); err != nil {
+			return errors.Wrap(err, "failed to close segment file")
+		}
+	}
+	if err := q.schedule.close(); err != nil {
+		return err
+	}
+	// Like the segments, the folder is left for a later Flush under SyncManual.
+	if q.folderUnsynced && q.options.syncPolicy().Mode != SyncManual {
+		if err := syncDir(q.options.FolderPath); err != nil {
+			return errors.Wrap(err, "failed to sync folder")
+		}
+		q.folderUnsynced = false
+	}
+	if q.options.replicator != nil {
+		if err := q.options.replicator.catchUp(); err != nil && q.options.ReplicationMode == ReplicateSync {
+			releaseLock(q.lockFile)
+			q.lockFile = nil
+			return errors.Wrap(err, "failed to replicate queue")
+		} else if err != nil {
+			q.options.logger().Warn("replication failed", "folder", q.options.FolderPath, "err", err)
+		}
+	}
+	err := releaseLock(q.lockFile)
+	q.lockFile = nil
+	return err
+}
+
+// checkOpenLocked returns ErrClosed once Close was called. As the caller holds one of the
+// locks, Close waits for it before closing the files.
+func (q *Queue[T]) checkOpenLocked() error {
+	select {
+	case <-q.closed:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// checkAcceptingLocked is checkOpenLocked for adding items, which also returns ErrDraining
+// once Drain was called.
+func (q *Queue[T]) checkAcceptingLocked() error {
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	select {
+	case <-q.draining:
+		return ErrDraining
+	default:
+		return nil
+	}
+}
+
+// Clear removes every item of the queue, including scheduled ones, leaving a single empty
+// segment. Items handed out by Reserve can no longer be acked or nacked afterwards.
+//
+// The new segment is created before the old ones are deleted, oldest first, so if the process
+// dies during Clear, the queue reopens with the newest of the items it held.
+func (q *Queue[T]) Clear() error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	segment, err := q.newSegmentLocked(q.segmentNumber + 1)
+	if err != nil {
+		return errors.Wrap(err, "failed to add new segment")
+	}
+	if err := q.firstSegment.close(); err != nil {
+		segment.close()
 		return errors.Wrap(err, "failed to close segment file")
 	}
-	return nil
+	if q.lastSegment != q.firstSegment {
+		if err := q.lastSegment.close(); err != nil {
+			segment.close()
+			return errors.Wrap(err, "failed to close segment file")
+		}
+	}
+	if err := q.schedule.clear(); err != nil {
+		segment.close()
+		return errors.Wrap(err, "failed to clear scheduled items")
+	}
+	old := q.segments
+	q.segmentNumber++
+	q.segments = []int{q.segmentNumber}
+	q.firstSegment = segment
+	q.lastSegment = segment
+	q.middleCount = 0
+	q.middleBytes = 0
+	q.unsyncedSegments = nil
+	q.emit(Event{Type: EventSegmentCreate, Segment: q.segmentNumber})
+	if err := q.clearColdLocked(); err != nil {
+		return err
+	}
+	for _, number := range old {
+		if err := os.Remove(q.options.SegmentNaming.path(q.options.FolderPath, number)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to delete segment (#%d)", number)
+		}
+		q.emit(Event{Type: EventSegmentDelete, Segment: number})
+	}
+	return q.folderChangedLocked()
 }
 
 func (q *Queue[T]) closeFullFirstSegment() error {
-	if err := q.firstSegment.deleteSegment(); err != nil {
+	if q.options.ArchivePolicy.Enabled {
+		if err := q.archiveFirstSegmentLocked(); err != nil {
+			return errors.Wrap(err, "failed to archive segment")
+		}
+	} else if err := q.firstSegment.deleteSegment(); err != nil {
 		return errors.Wrap(err, "failed to delete segment")
 	}
-	if q.segmentCount() == 1 {
-		segment, err := newSegment(q.options.MaxObjectsPerSegment, q.segmentNumber+1, &q.options)
+	q.emit(Event{Type: EventSegmentDelete, Segment: q.segments[0]})
+	q.segments = q.segments[1:]
+	if len(q.segments) == 0 {
+		number := q.segmentNumber + 1
+		if len(q.groups) == 0 && len(q.claimed) == 0 {
+			// Nothing refers to the old numbers anymore, so numbering starts over. Consumer
+			// group cursors rely on numbers only growing, and claimed segments still have
+			// theirs. The deletion is synced first, so a crash can't bring the old segment
+			// back behind the new one.
+			if err := syncDir(q.options.FolderPath); err != nil {
+				return errors.Wrap(err, "failed to sync folder")
+			}
+			number = 1
+			q.unsyncedSegments = nil
+		}
+		segment, err := q.newSegmentLocked(number)
 		if err != nil {
 			return errors.Wrap(err, "failed to add new segment")
 		}
-		q.segmentNumber++
-		q.firstSegment = &segment
-		q.lastSegment = &segment
-	} else if q.segmentCount() == 2 {
+		q.segmentNumber = number
+		q.segments = append(q.segments, q.segmentNumber)
+		q.firstSegment = segment
+		q.lastSegment = segment
+		q.emit(Event{Type: EventSegmentCreate, Segment: q.segmentNumber})
+	} else if err := q.advanceFirstSegmentLocked(); err != nil {
+		return err
+	}
+	return q.folderChangedLocked()
+}
+
+// advanceFirstSegmentLocked makes the oldest of the remaining segments the first one, once the
+// former first segment was taken off segments.
+func (q *Queue[T]) advanceFirstSegmentLocked() error {
+	if len(q.segments) == 1 {
 		q.firstSegment = q.lastSegment
-	} else {
-		seg, err := readSegment(q.firstSegment.segmentNumber+1, &q.options)
-		if err != nil {
-			return errors.Wrap(err, "error creating new segment")
-		}
-		q.firstSegment = &seg
+		return nil
 	}
+	if err := q.ensureLocalLocked(q.segments[0]); err != nil {
+		return err
+	}
+	seg, err := readSegment(q.segments[0], &q.options)
+	if err != nil {
+		return errors.Wrap(err, "error creating new segment")
+	}
+	q.middleCount -= seg.count()
+	q.middleBytes -= seg.fileSize()
+	q.firstSegment = seg
 	return nil
 }
 
 func (q *Queue[T]) addSegmentLocked() error {
-	if q.segmentCount() > 1 {
-		if err := q.lastSegment.close(); err != nil {
+	if q.segmentCount() > 1 || q.producer {
+		if err := q.lastSegment.writeFooter(); err != nil {
+			return errors.Wrap(err, "failed to write segment footer")
+		}
+		unsynced, err := q.lastSegment.closeUnsynced()
+		if err != nil {
 			return errors.Wrap(err, "failed to close segment file")
 		}
+		if unsynced {
+			q.unsyncedSegments = append(q.unsyncedSegments, q.lastSegment.segmentNumber)
+		}
 	}
-	segment, err := newSegment(q.options.MaxObjectsPerSegment, q.segmentNumber+1, &q.options)
+	segment, err := q.newSegmentLocked(q.segmentNumber + 1)
 	if err != nil {
 		return errors.Wrap(err, "failed to add new segment")
 	}
+	// The first segment stays open for removals. Failing to rename is only logged, as
+	// loading the queue renames the files the same way. The consumer of a producer may
+	// already have deleted the file.
+	err = q.lastSegment.seal(q.lastSegment == q.firstSegment && !q.producer)
+	if err != nil && !(q.producer && os.IsNotExist(errors.Cause(err))) {
+		q.options.logger().Warn("failed to seal segment", "folder", q.options.FolderPath, "segment", q.lastSegment.segmentNumber, "err", err)
+	}
+	if q.segmentCount() > 1 {
+		q.middleCount += q.lastSegment.count()
+		q.middleBytes += q.lastSegment.fileSize()
+	}
 	q.segmentNumber++
-	q.lastSegment = &segment
-	return nil
+	q.segments = append(q.segments, q.segmentNumber)
+	q.lastSegment = segment
+	if q.producer {
+		q.segments = q.segments[1:]
+		q.firstSegment = segment
+	}
+	q.emit(Event{Type: EventSegmentCreate, Segment: q.segmentNumber})
+	q.sealed.notify()
+	if err := q.folderChangedLocked(); err != nil {
+		return err
+	}
+	// A consumer holding headMutex closes drained segments itself once it's done.
+	if !q.headMutex.TryLock() {
+		return nil
+	}
+	defer q.headMutex.Unlock()
+	return q.closeDrainedSegmentsBothLocked()
+}
+
+// lock takes both locks of the queue, for operations on the whole queue.
+func (q *Queue[T]) lock() {
+	q.headMutex.Lock()
+	q.tailMutex.Lock()
+}
+
+func (q *Queue[T]) unlock() {
+	q.tailMutex.Unlock()
+	q.headMutex.Unlock()
 }
 
-func (q *Queue[T]) load() error {
-	if err := os.MkdirAll(q.options.FolderPath, q.options.FileMode); err != nil {
+// prepareFolder creates FolderPath if needed and checks that segment files can be created in it.
+func (q *Queue[T]) prepareFolder() error {
+	if err := os.MkdirAll(q.options.FolderPath, q.options.dirMode()); err != nil {
 		return errors.Wrap(err, "failed to ensure folder exists")
 	}
-	minSegment, maxSegment, count, err := q.loadSegmentRanges()
+	info, err := os.Stat(q.options.FolderPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat folder")
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", q.options.FolderPath)
+	}
+
+	probePath := filepath.Join(q.options.FolderPath, fmt.Sprintf(".koyori-probe-%d", os.Getpid()))
+	probe, err := os.OpenFile(probePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, q.options.FileMode)
+	if err != nil {
+		return errors.Wrapf(ErrFolderNotWritable, "%s (mode %v): %v", q.options.FolderPath, info.Mode().Perm(), err)
+	}
+	probe.Close()
+	if err := os.Remove(probePath); err != nil {
+		return errors.Wrapf(ErrFolderNotWritable, "%s (mode %v): %v", q.options.FolderPath, info.Mode().Perm(), err)
+	}
+	return nil
+}
+
+// observeItemSizes feeds the running average of on-disk item sizes used by TargetSegmentSize.
+func (q *Queue[T]) observeItemSizes(bytes int64, count int) {
+	if count == 0 || bytes <= 0 {
+		return
+	}
+	batchAvg := float64(bytes) / float64(count)
+	if q.avgItemSize == 0 {
+		q.avgItemSize = batchAvg
+	} else {
+		q.avgItemSize += itemSizeSmoothing * (batchAvg - q.avgItemSize)
+	}
+}
+
+// nextSegmentCapacity returns the capacity for a new segment. With TargetSegmentSize set, it
+// is derived from the observed item sizes; MaxObjectsPerSegment only seeds the first segments.
+// newSegmentLocked creates the segment with the given number, preallocating its file with
+// Preallocate set.
+func (q *Queue[T]) newSegmentLocked(number int) (*segment[T], error) {
+	seg, err := newSegment(q.nextSegmentCapacity(), number, true, q.nextSequence, &q.options)
+	if err != nil || !q.options.Preallocate {
+		return seg, err
+	}
+	size := q.options.TargetSegmentSize
+	if size <= 0 {
+		// Without any items written yet, there is nothing to base the size on.
+		size = int64(float64(seg.capacity) * q.avgItemSize)
+	}
+	if size > 0 {
+		if err := seg.preallocate(size); err != nil {
+			q.options.logger().Warn("failed to preallocate segment", "folder", q.options.FolderPath, "segment", number, "err", err)
+		}
+	}
+	return seg, nil
+}
+
+func (q *Queue[T]) nextSegmentCapacity() int {
+	if q.options.TargetSegmentSize <= 0 {
+		return q.options.MaxObjectsPerSegment
+	}
+	if q.avgItemSize == 0 {
+		if q.options.MaxObjectsPerSegment > 0 {
+			return q.options.MaxObjectsPerSegment
+		}
+		return defaultSegmentCapacity
+	}
+	capacity := int64(float64(q.options.TargetSegmentSize) / q.avgItemSize)
+	if capacity < 1 {
+		capacity = 1
+	} else if capacity > math.MaxInt32 {
+		capacity = math.MaxInt32
+	}
+	return int(capacity)
+}
+
+// load opens the segments in the queue folder, giving up with an *OpenCanceledError once ctx
+// is done.
+func (q *Queue[T]) load(ctx context.Context) error {
+	if err := q.prepareFolder(); err != nil {
+		return err
+	}
+	// A producer shares the folder with its consumer.
+	lockFile, err := acquireLockFile(ctx, q.options.FolderPath, lockFilename, q.options.FileMode, q.options.LockTimeout, q.producer)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			return &OpenCanceledError{Err: ctxErr}
+		}
+		return err
+	}
+	q.lockFile = lockFile
+	q.nextSequence = 1
+	// The head file of a producer's queue belongs to the consumer.
+	if !q.producer {
+		if q.options.headFile, err = loadHeadFile(q.options.FolderPath, q.options.FileMode, q.options.RecoveryMode, q.options.logger()); err != nil {
+			return err
+		}
+		if err := q.resumeRenumberLocked(); err != nil {
+			return err
+		}
+	}
+	segments, err := listSegments(q.options.FolderPath, q.options.SegmentNaming, q.options.logger())
 	if err != nil {
 		return errors.Wrap(err, "error while reading queue directory")
 	}
-	if count == 0 {
-		segment, err := newSegment(q.options.MaxObjectsPerSegment, 1, &q.options)
+	var loaded int64
+	checkCanceled := func() error {
+		if err := ctx.Err(); err != nil {
+			return &OpenCanceledError{SegmentsLoaded: int(atomic.LoadInt64(&loaded)), Segments: len(segments), Err: err}
+		}
+		return nil
+	}
+	if err := checkCanceled(); err != nil {
+		return err
+	}
+	if segments, err = q.loadColdLocked(segments); err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		if err := q.ensureLocalLocked(segments[len(segments)-1]); err != nil {
+			return err
+		}
+		if err := nameSegmentFiles(q.options.FolderPath, q.options.SegmentNaming, segments); err != nil {
+			return err
+		}
+		if q.options.RenumberSegments {
+			if segments, err = q.renumberSegmentsLocked(segments); err != nil {
+				return err
+			}
+		}
+		if q.producer {
+			segments = segments[len(segments)-1:]
+		}
+	}
+	if len(segments) == 0 {
+		segment, err := q.newSegmentLocked(1)
 		if err != nil {
 			return errors.Wrap(err, "failed to create first segment")
 		}
 		q.segmentNumber = 1
-		q.firstSegment = &segment
-		q.lastSegment = &segment
-	} else if count == 1 {
-		segment, err := readSegment(minSegment, &q.options)
+		q.segments = []int{1}
+		q.firstSegment = segment
+		q.lastSegment = segment
+		q.emit(Event{Type: EventSegmentCreate, Segment: 1})
+		if err := q.folderChangedLocked(); err != nil {
+			return err
+		}
+	} else if len(segments) == 1 {
+		if err := q.ensureLocalLocked(segments[0]); err != nil {
+			return err
+		}
+		segment, err := readSegment(segments[0], &q.options)
 		if err != nil {
-			return errors.Wrapf(err, "failed to read segment (#%d)", minSegment)
+			return errors.Wrapf(err, "failed to read segment (#%d)", segments[0])
 		}
-		q.segmentNumber = minSegment
-		q.firstSegment = &segment
-		q.lastSegment = &segment
+		loaded++
+		q.segmentNumber = segments[0]
+		q.segments = segments
+		q.firstSegment = segment
+		q.lastSegment = segment
 	} else {
-		firstSegment, err := readSegment(minSegment, &q.options)
-		if err != nil {
-			return errors.Wrapf(err, "failed to read segment (#%d)", minSegment)
+		minSegment, maxSegment := segments[0], segments[len(segments)-1]
+		if err := q.ensureLocalLocked(minSegment); err != nil {
+			return err
 		}
-		lastSegment, err := readSegment(maxSegment, &q.options)
+		if err := q.ensureLocalLocked(maxSegment); err != nil {
+			return err
+		}
+		// The first and the last segment are read, and the others counted, by the tasks 0, 1
+		// and 2 on.
+		var firstSegment, lastSegment *segment[T]
+		middle := segments[1 : len(segments)-1]
+		counts := make([]int, len(middle))
+		sizes := make([]int64, len(middle))
+		err := runParallel(q.options.LoadConcurrency, len(middle)+2, func(i int) error {
+			if err := checkCanceled(); err != nil {
+				return err
+			}
+			defer atomic.AddInt64(&loaded, 1)
+			switch i {
+			case 0:
+				seg, err := readSegment(minSegment, &q.options)
+				firstSegment = seg
+				return errors.Wrapf(err, "failed to read segment (#%d)", minSegment)
+			case 1:
+				seg, err := readSegment(maxSegment, &q.options)
+				lastSegment = seg
+				return errors.Wrapf(err, "failed to read segment (#%d)", maxSegment)
+			}
+			number := middle[i-2]
+			if seg, ok := q.cold[number]; ok {
+				counts[i-2], sizes[i-2] = seg.items, seg.size
+				return nil
+			}
+			count, err := countLiveItems(q.options.FolderPath, q.options.SegmentNaming, number, q.options.RecoveryMode, q.options.headFile.get(), q.options.maxRecordSize())
+			if err != nil {
+				return errors.Wrapf(err, "failed to count items of segment (#%d)", number)
+			}
+			info, err := os.Stat(q.options.SegmentNaming.path(q.options.FolderPath, number))
+			if err != nil {
+				return errors.Wrapf(err, "failed to stat segment (#%d)", number)
+			}
+			counts[i-2], sizes[i-2] = count, info.Size()
+			return nil
+		})
 		if err != nil {
-			return errors.Wrapf(err, "failed to read segment (#%d)", maxSegment)
+			for _, seg := range []*segment[T]{firstSegment, lastSegment} {
+				if seg != nil {
+					seg.close()
+				}
+			}
+			return err
+		}
+		for i := range middle {
+			q.middleCount += counts[i]
+			q.middleBytes += sizes[i]
 		}
 		q.segmentNumber = maxSegment
-		q.firstSegment = &firstSegment
-		q.lastSegment = &lastSegment
+		q.segments = segments
+		q.firstSegment = firstSegment
+		q.lastSegment = lastSegment
+	}
+	if err := q.migrateHeadLocked(); err != nil {
+		return err
+	}
+	if err := checkCanceled(); err != nil {
+		return err
+	}
+	if q.schedule, err = loadSchedule(q.options); err != nil {
+		return err
+	}
+	q.recoverSequenceLocked()
+	if err := q.loadGroups(); err != nil {
+		return err
+	}
+	q.observeItemSizes(q.lastSegment.recordStats())
+	if err := q.expireLocked(); err != nil {
+		return err
+	}
+	if q.lastSegment.foreignCodec {
+		if err := q.addSegmentLocked(); err != nil {
+			return errors.Wrap(err, "failed to add segment for the current converter")
+		}
+	}
+	if err := q.closeDrainedSegmentsBothLocked(); err != nil {
+		return errors.Wrap(err, "failed to close segment")
+	}
+	// The loaded segments resolved their transactions, which may leave markers unneeded.
+	if !q.producer {
+		removeResolvedMarkers(q.options.FolderPath, q.options.logger())
 	}
 	return nil
 }
 
-func (q *Queue[T]) loadSegmentRanges() (min, max, count int, err error) {
-	dir, err := os.ReadDir(q.options.FolderPath)
-	if err != nil {
-		err = errors.Wrap(err, "failed to read directory")
-		return
+// abandonLoad closes what load opened before it failed.
+func (q *Queue[T]) abandonLoad() {
+	if q.schedule != nil {
+		q.schedule.close()
 	}
-	min, max = math.MaxInt32, 0
-	for _, entry := range dir {
-		if entry.IsDir() {
-			continue
-		}
-		nameMatch := segmentFilenameRegex.FindStringSubmatch(entry.Name())
-		if len(nameMatch) == 0 {
-			continue
-		}
-		segment, err := strconv.ParseInt(nameMatch[1], 10, 32)
-		if err != nil {
-			continue
-		}
-		count++
-		if int(segment) < min {
-			min = int(segment)
-		}
-		if int(segment) > max {
-			max = int(segment)
-		}
+	if q.firstSegment != nil {
+		q.firstSegment.close()
+	}
+	if q.lastSegment != nil && q.lastSegment != q.firstSegment {
+		q.lastSegment.close()
 	}
-	return
+	releaseLock(q.lockFile)
 }
 
 func (q *Queue[T]) segmentCount() int {
-	return q.lastSegment.segmentNumber - q.firstSegment.segmentNumber + 1
+	return len(q.segments)
 }
 
-func NewQueue[T any](options QueueOptions[T]) (Queue[T], error) {
-	queue := Queue[T]{options: options}
-	if err := queue.load(); err != nil {
-		return Queue[T]{}, errors.Wrap(err, "error while loading queue")
+// NewQueue opens the queue in options.FolderPath, creating the folder if needed. It returns a
+// pointer because a Queue holds locks and must not be copied; earlier versions returned a
+// Queue value, so callers that stored one need to store the pointer instead.
+func NewQueue[T any](options QueueOptions[T]) (*Queue[T], error) {
+	return openQueue(context.Background(), options, false)
+}
+
+// NewQueueContext is NewQueue, giving up once ctx is done, including while waiting for
+// LockTimeout. The error returned then is an *OpenCanceledError, which also matches ctx.Err()
+// with errors.Is. Segments are only read, or truncated under RecoveryMode, before the queue is
+// given up on, so opening it again later starts over.
+func NewQueueContext[T any](ctx context.Context, options QueueOptions[T]) (*Queue[T], error) {
+	return openQueue(ctx, options, false)
+}
+
+// openQueue opens a queue, leaving syncing under SyncInterval to the caller if sharedSync is set.
+func openQueue[T any](ctx context.Context, options QueueOptions[T], sharedSync bool) (*Queue[T], error) {
+	if err := options.prepare(); err != nil {
+		return nil, err
+	}
+	queue := &Queue[T]{options: options, closed: make(chan struct{}), draining: make(chan struct{})}
+	if err := queue.load(ctx); err != nil {
+		queue.abandonLoad()
+		return nil, errors.Wrap(err, "error while loading queue")
+	}
+	if options.Replica != nil {
+		if options.HeadFile {
+			queue.Close()
+			return nil, errors.New("HeadFile can't be used with Replica")
+		}
+		if err := queue.startReplication(); err != nil {
+			queue.Close()
+			return nil, err
+		}
+	}
+	if options.CompactInterval > 0 {
+		queue.background.Add(1)
+		go queue.runCompaction()
+	}
+	if policy := options.syncPolicy(); policy.Mode == SyncInterval && policy.Interval > 0 && !sharedSync {
+		queue.background.Add(1)
+		go queue.runSync()
+	}
+	if options.ColdStorage != nil {
+		queue.background.Add(1)
+		go queue.runOffload()
+	}
+	if options.ArchivePolicy.Enabled {
+		queue.background.Add(1)
+		go queue.runArchival()
 	}
 	return queue, nil
 }
+
+// NewJSONQueue opens a queue in folderPath that stores items as JSON.
+// Segments hold 1024 items, files are created with mode 0644 and a record torn by a crash at
+// the end of a segment is cut off (RecoveryTruncate) unless changed by opts.
+func NewJSONQueue[T any](folderPath string, opts ...Option) (*Queue[T], error) {
+	return NewQueue(buildOptions[T](folderPath, jsonConverter[T]{}, opts))
+}
+
+// NewBytesQueue opens a queue in folderPath that stores byte slices as-is.
+// Segments hold 1024 items, files are created with mode 0644 and a record torn by a crash at
+// the end of a segment is cut off (RecoveryTruncate) unless changed by opts.
+func NewBytesQueue(folderPath string, opts ...Option) (*Queue[[]byte], error) {
+	return NewQueue(buildOptions[[]byte](folderPath, rawConverter{}, opts))
+}
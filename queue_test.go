@@ -1,11 +1,17 @@
 package koyori_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/jungnoh/koyori"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,6 +26,19 @@ func (s StringConverter) Unmarshal(v []byte) (string, error) {
 	return string(v), nil
 }
 
+func segmentFiles(t *testing.T, folderPath string) []string {
+	files, err := filepath.Glob(filepath.Join(folderPath, "*.queue"))
+	assert.Nil(t, err)
+	open, err := filepath.Glob(filepath.Join(folderPath, "*.queue.open"))
+	assert.Nil(t, err)
+	return append(files, open...)
+}
+
+// enqueueErr drops the sequence number returned by Enqueue and the like.
+func enqueueErr(_ uint64, err error) error {
+	return err
+}
+
 func assertDequeue[T any](t *testing.T, queue *koyori.Queue[T], expected T) {
 	item, err := queue.Dequeue()
 	assert.Nil(t, err)
@@ -35,22 +54,22 @@ func assertDequeueMany[T any](t *testing.T, queue *koyori.Queue[T], count int, e
 func TestQueueBasicInsert(t *testing.T) {
 	queue, err := koyori.NewQueue(koyori.QueueOptions[string]{
 		Converter:            StringConverter{},
-		FolderPath:           path.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
 		FileMode:             os.ModePerm,
 		MaxObjectsPerSegment: 2,
 	})
 	assert.Nil(t, err)
 
-	assert.Nil(t, queue.Enqueue("a"))
-	assert.Nil(t, queue.Enqueue("b"))
-	assert.Nil(t, queue.Enqueue("c"))
-	assert.Nil(t, queue.Enqueue("d"))
-	assertDequeue(t, &queue, "a")
-	assertDequeue(t, &queue, "b")
-	assertDequeue(t, &queue, "c")
-	assert.Nil(t, queue.Enqueue("e"))
-	assertDequeue(t, &queue, "d")
-	assertDequeue(t, &queue, "e")
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("b")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	assertDequeue(t, queue, "a")
+	assertDequeue(t, queue, "b")
+	assertDequeue(t, queue, "c")
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	assertDequeue(t, queue, "d")
+	assertDequeue(t, queue, "e")
 	_, err = queue.Dequeue()
 	assert.Equal(t, koyori.ErrEmpty, err)
 }
@@ -58,7 +77,7 @@ func TestQueueBasicInsert(t *testing.T) {
 func TestQueuePersist(t *testing.T) {
 	opts := koyori.QueueOptions[string]{
 		Converter:            StringConverter{},
-		FolderPath:           path.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
 		FileMode:             os.ModePerm,
 		MaxObjectsPerSegment: 2,
 	}
@@ -66,64 +85,1547 @@ func TestQueuePersist(t *testing.T) {
 	queue, err := koyori.NewQueue(opts)
 	assert.Nil(t, err)
 
-	assert.Nil(t, queue.Enqueue("a"))
-	assert.Nil(t, queue.Enqueue("b"))
-	assert.Nil(t, queue.Enqueue("c"))
-	assert.Nil(t, queue.Enqueue("d"))
-	assert.Nil(t, queue.Enqueue("e"))
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("b")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
 	assert.Nil(t, queue.Close())
 
 	queue, err = koyori.NewQueue(opts)
 	assert.Nil(t, err)
-	assertDequeue(t, &queue, "a")
-	assertDequeue(t, &queue, "b")
-	assertDequeue(t, &queue, "c")
-	assertDequeue(t, &queue, "d")
-	assertDequeue(t, &queue, "e")
+	assertDequeue(t, queue, "a")
+	assertDequeue(t, queue, "b")
+	assertDequeue(t, queue, "c")
+	assertDequeue(t, queue, "d")
+	assertDequeue(t, queue, "e")
 }
 
 func TestQueueBatch(t *testing.T) {
 	opts := koyori.QueueOptions[string]{
 		Converter:            StringConverter{},
-		FolderPath:           path.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	assertDequeueMany(t, queue, 4, []string{"c", "d", "e"})
+
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f"})))
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assertDequeue(t, queue, "d")
+	assertDequeueMany(t, queue, 1, []string{"e"})
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"g"})))
+	assertDequeueMany(t, queue, 2, []string{"f", "g"})
+}
+
+func TestQueueDequeueUpTo(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = queue.DequeueMany(2)
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	items, err := queue.DequeueUpTo(2)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	items, err = queue.DequeueUpTo(5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, items)
+	_, err = queue.DequeueMany(1)
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueDequeueManyFunc(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
 		FileMode:             os.ModePerm,
 		MaxObjectsPerSegment: 2,
 	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a1", "a2", "a3", "b1", "a4", "a5"})))
+
+	tenantA := func(item string) bool { return strings.HasPrefix(item, "a") }
+	items, err := queue.DequeueManyFunc(2, tenantA)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a1", "a2"}, items)
+	// Stops at the first rejected item, across segments.
+	items, err = queue.DequeueWhile(tenantA)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a3"}, items)
+	items, err = queue.DequeueWhile(tenantA)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, items)
+
+	// A stateful predicate can bound the size of a batch.
+	size := 0
+	items, err = queue.DequeueWhile(func(item string) bool {
+		size += len(item)
+		return size <= 4
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b1", "a4"}, items)
+	assertDequeueMany(t, queue, 3, []string{"a5"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueDequeueManyBytes(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"aa", "bbb", "c", "dddddd", "e"})))
+
+	items, err := queue.DequeueManyBytes(6)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aa", "bbb", "c"}, items)
+	// An item above the budget still comes out on its own.
+	items, err = queue.DequeueManyBytes(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dddddd"}, items)
+	items, err = queue.DequeueManyBytes(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, items)
+	items, err = queue.DequeueManyBytes(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, items)
+	assert.Nil(t, queue.Close())
+}
 
+func TestQueuePushFront(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
 	queue, err := koyori.NewQueue(opts)
 	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	assert.Nil(t, queue.PushFrontMany([]string{"a", "b"}))
+	assert.Nil(t, queue.PushFront("z"))
+	assert.Equal(t, 4, queue.Len())
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	assert.Nil(t, queue.Close())
 
-	assert.Nil(t, queue.EnqueueMany([]string{"a", "b", "c", "d", "e"}))
-	assertDequeueMany(t, &queue, 2, []string{"a", "b"})
-	assertDequeueMany(t, &queue, 4, []string{"c", "d", "e"})
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 10, []string{"z", "a", "b", "c", "d"})
 
-	assert.Nil(t, queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f"}))
-	assertDequeueMany(t, &queue, 3, []string{"a", "b", "c"})
-	assertDequeue(t, &queue, "d")
-	assertDequeueMany(t, &queue, 1, []string{"e"})
-	assert.Nil(t, queue.EnqueueMany([]string{"g"}))
-	assertDequeueMany(t, &queue, 2, []string{"f", "g"})
+	// Reserved items would be renumbered.
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.NotNil(t, queue.PushFront("y"))
+	assert.Nil(t, delivery.Nack())
+	assert.Nil(t, queue.PushFront("y"))
+	assertDequeueMany(t, queue, 10, []string{"y", "e"})
+	assert.Nil(t, queue.Close())
 }
 
 func TestQueueCapacityChange(t *testing.T) {
 	opts := koyori.QueueOptions[string]{
 		Converter:            StringConverter{},
-		FolderPath:           path.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
 		FileMode:             os.ModePerm,
 		MaxObjectsPerSegment: 2,
 	}
 
 	queue, err := koyori.NewQueue(opts)
 	assert.Nil(t, err)
-	assert.Nil(t, queue.EnqueueMany([]string{"a", "b", "c", "d", "e"}))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
 	assert.Nil(t, queue.Close())
 
 	opts.MaxObjectsPerSegment = 5
 	queue, err = koyori.NewQueue(opts)
 	assert.Nil(t, err)
-	assertDequeueMany(t, &queue, 2, []string{"a", "b"})
-	assert.Nil(t, queue.EnqueueMany([]string{"a", "b", "c", "d", "e"}))
-	assertDequeueMany(t, &queue, 4, []string{"c", "d", "e", "a"})
-	assertDequeueMany(t, &queue, 3, []string{"b", "c", "d"})
-	assertDequeueMany(t, &queue, 2, []string{"e"})
+	assertDequeueMany(t, queue, 2, []string{"a", "b"})
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeueMany(t, queue, 4, []string{"c", "d", "e", "a"})
+	assertDequeueMany(t, queue, 3, []string{"b", "c", "d"})
+	assertDequeueMany(t, queue, 2, []string{"e"})
+}
+
+func TestQueueLegacySegment(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	assert.Nil(t, os.MkdirAll(opts.FolderPath, os.ModePerm))
+
+	// v0 layout: 4-byte capacity, then length-prefixed records and zero-length deletion markers
+	legacy := []byte{
+		2, 0, 0, 0,
+		1, 0, 0, 0, 'a',
+		1, 0, 0, 0, 'b',
+		0, 0, 0, 0,
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, "00001.queue"), legacy, os.ModePerm))
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeue(t, queue, "b")
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assertDequeue(t, queue, "c")
+}
+
+func TestQueueBlockPacking(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 4,
+		BlockSize:            8,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "this one is larger than a block", "d", "e"})))
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"b", "c", "this one is larger than a block"})
+	assertDequeueMany(t, queue, 3, []string{"d", "e", "f"})
+}
+
+func TestQueueEmptyItems(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.Nil(t, enqueueErr(queue.Enqueue("")))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"", "b", ""})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+
+	// Empty items aren't mistaken for deletion markers once the queue is reopened, and keep
+	// their sequence numbers.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertSequence(t, queue, "", 2)
+	assertSequence(t, queue, "", 3)
+	assertSequence(t, queue, "b", 4)
+	assertSequence(t, queue, "", 5)
+	assert.Nil(t, queue.Close())
+
+	folder := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	bytesQueue, err := koyori.NewBytesQueue(folder)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(bytesQueue.EnqueueMany([][]byte{{}, []byte("c"), {}})))
+	assert.Nil(t, bytesQueue.Close())
+	bytesQueue, err = koyori.NewBytesQueue(folder)
+	assert.Nil(t, err)
+	items, err := bytesQueue.DequeueMany(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "c", ""}, []string{string(items[0]), string(items[1]), string(items[2])})
+	assert.Nil(t, bytesQueue.Close())
+}
+
+func TestQueueTargetSegmentSize(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		TargetSegmentSize:    45,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	// Each item takes 9 bytes on disk, so segments after the first hold 5 items
+	items := []string{"aaaaa", "bbbbb", "ccccc", "ddddd", "eeeee", "fffff", "ggggg", "hhhhh"}
+	for _, item := range items {
+		assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+	}
+	assert.Len(t, segmentFiles(t, opts.FolderPath), 3)
+
+	assertDequeueMany(t, queue, len(items), items)
+}
+
+func TestEnqueueFanout(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	optsA := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	optsB := optsA
+	optsB.FolderPath = filepath.Join(root, "b")
+
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+
+	assert.Nil(t, enqueueErr(queueA.Enqueue("a")))
+	assert.Nil(t, koyori.EnqueueFanout("both", queueA, queueB))
+	assert.Nil(t, enqueueErr(queueB.Enqueue("b")))
+	assert.Nil(t, koyori.EnqueueFanout("both again", queueB, queueA))
+	assert.NotNil(t, koyori.EnqueueFanout("twice", queueA, queueA))
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queueA, 5, []string{"a", "both", "both again"})
+	assertDequeueMany(t, queueB, 5, []string{"both", "b", "both again"})
+}
+
+func TestEnqueueFanoutSequence(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	optsA := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	optsB := optsA
+	optsB.FolderPath = filepath.Join(root, "b")
+	optsB.MaxItems = 1
+
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	defer queueA.Close()
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	defer queueB.Close()
+
+	// A fan-out rolled back after writing to the first queue doesn't use up a sequence number.
+	assert.Nil(t, enqueueErr(queueB.Enqueue("b")))
+	assert.NotNil(t, koyori.EnqueueFanout("both", queueA, queueB))
+	sequence, err := queueA.Enqueue("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	assertDequeue(t, queueA, "a")
+}
+
+func TestEnqueueFanoutLeftoverMarker(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	optsA := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	optsB := optsA
+	optsB.FolderPath = filepath.Join(root, "b")
+
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, koyori.EnqueueFanout("both", queueA, queueB))
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+
+	// Recreate a crash after the marker was written and only the first queue recorded the commit
+	segmentA := filepath.Join(optsA.FolderPath, "00001.queue.open")
+	segmentB := filepath.Join(optsB.FolderPath, "00001.queue.open")
+	reader, err := koyori.OpenSegment[string](segmentB, nil)
+	assert.Nil(t, err)
+	var commit koyori.Record[string]
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if record.Type == koyori.RecordTxnCommit {
+			commit = record
+		}
+	}
+	assert.Nil(t, reader.Close())
+	assert.NotZero(t, commit.TxnID)
+	assert.Nil(t, os.Truncate(segmentB, commit.Offset))
+	marker := filepath.Join(optsA.FolderPath, fmt.Sprintf("fanout-%016x.commit", commit.TxnID))
+	assert.Nil(t, os.WriteFile(marker, []byte(segmentA+"\n"+segmentB+"\n"), os.ModePerm))
+	// Markers without the list of segments can't be checked, so they are kept
+	unlisted := filepath.Join(optsA.FolderPath, fmt.Sprintf("fanout-%016x.commit", commit.TxnID+1))
+	assert.Nil(t, os.WriteFile(unlisted, nil, os.ModePerm))
+
+	// The second queue still needs the marker to commit its pending item.
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	assert.Nil(t, queueA.Close())
+	assert.FileExists(t, marker)
+
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assertDequeue(t, queueB, "both")
+	assert.Nil(t, queueB.Close())
+
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	assertDequeue(t, queueA, "both")
+	assert.Nil(t, queueA.Close())
+	assert.NoFileExists(t, marker)
+	assert.FileExists(t, unlisted)
+}
+
+func TestEnqueueFanoutMinAge(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	optsA := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		MinAge:               time.Minute,
+		Clock:                clock,
+	}
+	optsB := optsA
+	optsB.FolderPath = filepath.Join(root, "b")
+	optsB.MinAge = 0
+
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+
+	// Fanout items are held back and aged like any other item, where the queue keeps enqueue times.
+	assert.Nil(t, koyori.EnqueueFanout("both", queueA, queueB))
+	_, err = queueA.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Equal(t, time.Duration(0), queueB.OldestItemAge())
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Minute, queueA.OldestItemAge())
+	assert.Nil(t, queueA.Close())
+
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, queueA.OldestItemAge())
+	assertDequeue(t, queueA, "both")
+	assertDequeue(t, queueB, "both")
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+}
+
+type reusableItem struct {
+	Value string
+}
+
+type reusableItemConverter struct {
+	unmarshalIntoCalls *int
+}
+
+func (c reusableItemConverter) Marshal(v reusableItem) ([]byte, error) {
+	return []byte(v.Value), nil
+}
+
+func (c reusableItemConverter) Unmarshal(v []byte) (reusableItem, error) {
+	return reusableItem{Value: string(v)}, nil
+}
+
+func (c reusableItemConverter) UnmarshalInto(v []byte, dst *reusableItem) error {
+	*c.unmarshalIntoCalls++
+	dst.Value = string(v)
+	return nil
+}
+
+func TestQueueDequeueInto(t *testing.T) {
+	calls := 0
+	opts := koyori.QueueOptions[reusableItem]{
+		Converter:            reusableItemConverter{unmarshalIntoCalls: &calls},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]reusableItem{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	item := reusableItem{}
+	assert.Nil(t, queue.DequeueInto(&item))
+	assert.Equal(t, "a", item.Value)
+
+	items := make([]reusableItem, 3)
+	n, err := queue.DequeueManyInto(items)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []reusableItem{{"b"}, {"c"}, {"d"}}, items)
+
+	n, err = queue.DequeueManyInto(items)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "e", items[0].Value)
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, koyori.ErrEmpty, queue.DequeueInto(&item))
+}
+
+func TestQueueSegmentNumberGaps(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assert.Nil(t, queue.Close())
+
+	// Renumber segments 2-4 with gaps, and add files that aren't segments
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00004.queue.open"), filepath.Join(opts.FolderPath, "00120.queue.open")))
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00003.queue"), filepath.Join(opts.FolderPath, "00017.queue")))
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00002.queue"), filepath.Join(opts.FolderPath, "00005.queue")))
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, "00003.queue.bak"), []byte{}, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, "x0002.queue"), []byte{}, os.ModePerm))
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, enqueueErr(queue.Enqueue("h")))
+	assertDequeueMany(t, queue, 5, []string{"d", "e", "f", "g", "h"})
+}
+
+func TestQueueSealedSegmentNames(t *testing.T) {
+	replicaDir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		Replica:              koyori.NewDirReplica(replicaDir, os.ModePerm),
+		ReplicationMode:      koyori.ReplicateSync,
+	}
+	exists := func(dir, name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.True(t, exists(opts.FolderPath, "00001.queue.open"))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeue(t, queue, "a")
+	for _, dir := range []string{opts.FolderPath, replicaDir} {
+		assert.True(t, exists(dir, "00001.queue"))
+		assert.True(t, exists(dir, "00002.queue"))
+		assert.True(t, exists(dir, "00003.queue.open"))
+		assert.False(t, exists(dir, "00001.queue.open"))
+	}
+	assert.Nil(t, queue.Close())
+
+	// As left by a crash while sealing the last segment, or by a queue that didn't name them
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00002.queue"), filepath.Join(opts.FolderPath, "00002.queue.open")))
+	assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, "00003.queue.open"), filepath.Join(opts.FolderPath, "00003.queue")))
+	opts.Replica = nil
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.True(t, exists(opts.FolderPath, "00002.queue"))
+	assert.True(t, exists(opts.FolderPath, "00003.queue.open"))
+	assertDequeueMany(t, queue, 4, []string{"b", "c", "d", "e"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueMinAge(t *testing.T) {
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		MinAge:               time.Minute,
+		Clock:                clock,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+	_, err = queue.Dequeue()
+	assert.Equal(t, koyori.ErrEmpty, err)
+
+	clock.Advance(time.Minute)
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assertDequeueMany(t, queue, 3, []string{"a", "b"})
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = queue.Dequeue()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	clock.Advance(time.Minute - time.Nanosecond)
+	_, err = queue.Dequeue()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	clock.Advance(time.Nanosecond)
+	assertDequeue(t, queue, "c")
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueDirMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't have Unix permissions")
+	}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             0600,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Close())
+	info, err := os.Stat(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks don't apply to root")
+	}
+	assert.Nil(t, os.Chmod(opts.FolderPath, 0500))
+	defer os.Chmod(opts.FolderPath, 0700)
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrFolderNotWritable)
+}
+
+func TestQueueFlush(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Flush())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 2, []string{"b", "c"})
+	assert.Nil(t, queue.Flush())
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueFlushClosedSegments(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, enqueueErr(queue.EnqueueAfter(fmt.Sprintf("s%d", i), time.Millisecond)))
+	}
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, queue.Flush())
+	assertDequeueMany(t, queue, 4, []string{"d", "e", "f", "g"})
+	assert.Nil(t, queue.Flush())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 5, []string{"s0", "s1", "s2", "s3", "s4"})
+	assert.Nil(t, queue.Close())
+}
+
+type jsonItem struct {
+	ID   int
+	Tags []string
+}
+
+func TestNewJSONQueue(t *testing.T) {
+	folderPath := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err := koyori.NewJSONQueue[jsonItem](folderPath, koyori.WithMaxObjectsPerSegment(2))
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]jsonItem{{ID: 1}, {ID: 2, Tags: []string{"a"}}, {ID: 3}})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewJSONQueue[jsonItem](folderPath, koyori.WithMaxObjectsPerSegment(2))
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []jsonItem{{ID: 1}, {ID: 2, Tags: []string{"a"}}, {ID: 3}})
+	assert.Nil(t, queue.Close())
+
+	bytesQueue, err := koyori.NewBytesQueue(filepath.Join(folderPath, "bytes"))
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(bytesQueue.Enqueue([]byte("raw"))))
+	assertDequeue(t, bytesQueue, []byte("raw"))
+	assert.Nil(t, bytesQueue.Close())
+}
+
+func TestNewJSONQueueRecovery(t *testing.T) {
+	folderPath := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err := koyori.NewJSONQueue[int](folderPath, koyori.WithMaxObjectsPerSegment(10))
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]int{1, 2})))
+	assert.Nil(t, queue.Close())
+
+	// A record cut short by a crash.
+	file, err := os.OpenFile(filepath.Join(folderPath, "00001.queue.open"), os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0x10, 0, 0, 0, 1, 2})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	_, err = koyori.NewJSONQueue[int](folderPath, koyori.WithMaxObjectsPerSegment(10), koyori.WithRecoveryMode(koyori.RecoveryStrict))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// It is cut off by default.
+	events := []koyori.RecoveryEvent{}
+	queue, err = koyori.NewJSONQueue[int](folderPath, koyori.WithMaxObjectsPerSegment(10),
+		koyori.WithOnRecovery(func(event koyori.RecoveryEvent) { events = append(events, event) }))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.True(t, events[0].Truncated)
+	assert.Nil(t, enqueueErr(queue.Enqueue(3)))
+	assertDequeueMany(t, queue, 3, []int{1, 2, 3})
+	assert.Nil(t, queue.Close())
+}
+
+type upperStringConverter struct{}
+
+func (upperStringConverter) Marshal(v string) ([]byte, error) {
+	return []byte(strings.ToUpper(v)), nil
+}
+
+func (upperStringConverter) Unmarshal(v []byte) (string, error) {
+	return strings.ToLower(string(v)), nil
+}
+
+func TestQueueConverterUpgrade(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	assert.Nil(t, queue.Close())
+
+	opts.Converter = upperStringConverter{}
+	opts.ConverterName = "upper"
+	opts.ConverterFor = func(header koyori.SegmentHeader) koyori.Converter[string] {
+		if header.Codec == "" {
+			return StringConverter{}
+		}
+		return nil
+	}
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"e", "f"})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 6, []string{"a", "b", "c", "d", "e", "f"})
+	assert.Nil(t, queue.Close())
+
+	raw, err := os.ReadFile(filepath.Join(opts.FolderPath, "00003.queue.open"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), "upper")
+	assert.Contains(t, string(raw), "F")
+}
+
+func TestQueueLen(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assert.Equal(t, 7, queue.Len())
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Equal(t, 4, queue.Len())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, queue.Len())
+	assert.Nil(t, enqueueErr(queue.Enqueue("h")))
+	assertDequeue(t, queue, "d")
+	assert.Equal(t, 4, queue.Len())
+	assertDequeueMany(t, queue, 10, []string{"e", "f", "g", "h"})
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueLoadConcurrency(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		LoadConcurrency:      4,
+	}
+	items := make([]string, 41)
+	for i := range items {
+		items[i] = fmt.Sprintf("item %d", i)
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany(items)))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, enqueueErr(queue.EnqueueAt(fmt.Sprintf("later %d", i), time.Now().Add(time.Hour))))
+	}
+	assertDequeueMany(t, queue, 3, items[:3])
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 38, queue.Len())
+	assert.Equal(t, 5, queue.ScheduledLen())
+	assert.Nil(t, queue.Close())
+
+	// A segment that can't be read fails the whole load.
+	file, err := os.OpenFile(filepath.Join(opts.FolderPath, "00010.queue"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorContains(t, err, "segment (#10)")
+}
+
+func TestQueueLargeSegment(t *testing.T) {
+	for _, blockSize := range []int{0, 64} {
+		opts := koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 5000,
+			BlockSize:            blockSize,
+		}
+		items := make([]string, 3000)
+		for i := range items {
+			items[i] = fmt.Sprintf("item %d", i)
+		}
+
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany(items[:2000])))
+		assertDequeueMany(t, queue, 1500, items[:1500])
+		assert.Nil(t, queue.Close())
+
+		queue, err = koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany(items[2000:])))
+		assertDequeueMany(t, queue, 1500, items[1500:])
+		assert.Nil(t, queue.Close())
+	}
+}
+
+// countingConverter counts the items it decodes.
+type countingConverter struct {
+	StringConverter
+	unmarshaled *int
+}
+
+func (c countingConverter) Unmarshal(v []byte) (string, error) {
+	*c.unmarshaled++
+	return string(v), nil
+}
+
+func TestQueueMaxInMemory(t *testing.T) {
+	items := []string{"aaaa", "bbbb", "cccc", "dddd", "eeee", "ffff"}
+	for _, tc := range []struct {
+		items       int
+		bytes       int64
+		unmarshaled int
+	}{
+		{0, 0, 0},
+		{-1, 0, 6},
+		{2, 0, 4},
+		{0, 12, 1},
+	} {
+		unmarshaled := 0
+		queue, err := koyori.NewQueue(koyori.QueueOptions[string]{
+			Converter:            countingConverter{unmarshaled: &unmarshaled},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 10,
+			MaxInMemoryItems:     tc.items,
+			MaxInMemoryBytes:     tc.bytes,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany(items[:4])))
+		assertDequeueMany(t, queue, 2, items[:2])
+		assert.Nil(t, enqueueErr(queue.EnqueueMany(items[4:])))
+		assertDequeueMany(t, queue, 4, items[2:])
+		assert.Equal(t, tc.unmarshaled, unmarshaled)
+		assert.Nil(t, queue.Close())
+	}
+}
+
+func TestQueueDropBatchSize(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 100,
+		DropBatchSize:        4,
+	}
+	filePath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	fileSize := func() int64 {
+		info, err := os.Stat(filePath)
+		assert.Nil(t, err)
+		return info.Size()
+	}
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany(items)))
+	size := fileSize()
+	for _, item := range items[:3] {
+		assertDequeue(t, queue, item)
+	}
+	assert.Equal(t, size, fileSize())
+	// The fourth item fills the batch, recorded with a single record.
+	assertDequeue(t, queue, "d")
+	assert.True(t, fileSize()-size < 16)
+	assertDequeueMany(t, queue, 5, items[4:9])
+	assert.Nil(t, queue.Close())
+
+	reader, err := koyori.OpenSegment(filePath, koyori.Converter[string](StringConverter{}))
+	assert.Nil(t, err)
+	drops := []int{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.NotEqual(t, koyori.RecordTombstone, record.Type)
+		if record.Type == koyori.RecordDrop {
+			drops = append(drops, record.Count)
+		}
+	}
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, []int{4, 5}, drops)
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "j")
+	assert.Nil(t, queue.Close())
+
+	report, err := koyori.Verify(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 0, report.Items)
+}
+
+func TestQueueMaxSegmentBytes(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 100,
+		MaxSegmentBytes:      100,
+	}
+	items := make([]string, 20)
+	for i := range items {
+		items[i] = fmt.Sprintf("item %02d", i)
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany(items[:10])))
+	assert.Greater(t, len(segmentFiles(t, opts.FolderPath)), 1)
+	assertDequeueMany(t, queue, 10, items[:10])
+
+	for _, item := range items[10:] {
+		assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+	}
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 10, items[10:])
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueDrainedSegmentRotation(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	assertDequeueMany(t, queue, 4, []string{"a", "b", "c", "d"})
+	assert.Nil(t, queue.Close())
+
+	// The drained segment of d is not full, but the new converter starts another segment.
+	opts.ConverterName = "upper"
+	opts.Converter = upperStringConverter{}
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"e", "f"})))
+	assertDequeueMany(t, queue, 2, []string{"e", "f"})
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, 1, len(segmentFiles(t, opts.FolderPath)))
+}
+
+func TestQueueCorruptRecord(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"hello", "world"})))
+	assert.Nil(t, queue.Close())
+
+	// Flip the last byte of "world"
+	filePath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	data, err := os.ReadFile(filePath)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(filePath, data, 0644))
+
+	_, err = koyori.NewQueue(opts)
+	assert.True(t, errors.Is(err, koyori.ErrCorruptRecord))
+	var corrupt *koyori.CorruptRecordError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, 1, corrupt.Segment)
+	assert.Equal(t, int64(len(data)-len("world")-8), corrupt.Offset)
+}
+
+func TestQueueCompression(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	large := strings.Repeat("koyori", 1000)
+	compressions := []koyori.Compression{
+		koyori.CompressionGzip, koyori.CompressionSnappy, koyori.CompressionZstd, koyori.CompressionNone,
+	}
+	// Every restart changes the compression, leaving segments of each kind behind.
+	for i, compression := range compressions {
+		opts.Compression = compression
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{large, fmt.Sprintf("%d", i)})))
+		assert.Nil(t, queue.Close())
+	}
+
+	reader, err := koyori.OpenSegment[string](filepath.Join(opts.FolderPath, "00001.queue"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, koyori.CompressionGzip, reader.Header().Compression)
+	assert.Nil(t, reader.Close())
+	info, err := os.Stat(filepath.Join(opts.FolderPath, "00001.queue"))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(len(large)))
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 8, []string{large, "0", large, "1", large, "2", large, "3"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueLock(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrQueueLocked)
+
+	// A waiting open succeeds once the queue is closed.
+	go func(queue *koyori.Queue[string]) {
+		time.Sleep(100 * time.Millisecond)
+		queue.Close()
+	}(queue)
+	opts.LockTimeout = 5 * time.Second
+	reopened, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, reopened.Close())
+}
+
+func TestNewQueueContext(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		LockTimeout:          5 * time.Second,
+	}
+	queue, err := koyori.NewQueueContext(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+
+	// Waiting for the lock is given up on.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = koyori.NewQueueContext(ctx, opts)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, queue.Close())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = koyori.NewQueueContext(ctx, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	var canceled *koyori.OpenCanceledError
+	assert.ErrorAs(t, err, &canceled)
+	assert.Equal(t, 3, canceled.Segments)
+
+	// Nothing is left open.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 5, []string{"a", "b", "c", "d", "e"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueRecoverTornRecord(t *testing.T) {
+	events := []koyori.RecoveryEvent{}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		OnRecovery:           func(event koyori.RecoveryEvent) { events = append(events, event) },
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "bbbb"})))
+	assert.Nil(t, queue.Close())
+
+	// Cut "bbbb" short, as if the process died while writing it
+	filePath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	info, err := os.Stat(filePath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(filePath, info.Size()-2))
+
+	_, err = koyori.NewQueue(opts)
+	assert.NotNil(t, err)
+
+	opts.RecoveryMode = koyori.RecoveryTruncate
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.True(t, events[0].Truncated)
+	assert.Equal(t, int64(info.Size()-2-events[0].Offset), events[0].Dropped)
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assertDequeueMany(t, queue, 2, []string{"a", "c"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueMaxRecordSize(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		MaxRecordSize:        16,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	assert.NotNil(t, enqueueErr(queue.Enqueue(strings.Repeat("x", 17))))
+	assert.Nil(t, queue.Close())
+
+	// A length prefix of 256MiB is taken as corrupt rather than read.
+	filePath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0x0f, 1, 2, 3, 4})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	opts.MaxRecordSize = 0
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrCorruptRecord)
+	opts.RecoveryMode = koyori.RecoveryTruncate
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue(strings.Repeat("x", 17))))
+	assert.Nil(t, queue.Close())
+
+	// Records above the limit a queue is opened with can't be read back.
+	opts.MaxRecordSize = 16
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrCorruptRecord)
+
+	opts.MaxRecordSize = 1 << 28
+	_, err = koyori.NewQueue(opts)
+	assert.NotNil(t, err)
+	opts.MaxRecordSize = 16
+	opts.BlockSize = 32
+	_, err = koyori.NewQueue(opts)
+	assert.NotNil(t, err)
+}
+
+func TestQueueRecoverSkip(t *testing.T) {
+	events := []koyori.RecoveryEvent{}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		RecoveryMode:         koyori.RecoveryTruncate,
+		OnRecovery:           func(event koyori.RecoveryEvent) { events = append(events, event) },
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, queue.Close())
+
+	// Corrupt "b"; every item record takes 9 bytes
+	filePath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	data, err := os.ReadFile(filePath)
+	assert.Nil(t, err)
+	data[len(data)-10] ^= 0xff
+	assert.Nil(t, os.WriteFile(filePath, data, os.ModePerm))
+
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrCorruptRecord)
+
+	opts.RecoveryMode = koyori.RecoverySkip
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.False(t, events[0].Truncated)
+	assert.Equal(t, 2, queue.Len())
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 1, []string{"c"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueClear(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.Clear())
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, 1, len(segmentFiles(t, opts.FolderPath)))
+	assert.ErrorIs(t, delivery.Ack(), koyori.ErrDeliveryDone)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assert.Nil(t, queue.Close())
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "f")
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueItemTTL(t *testing.T) {
+	dlqOpts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	dlq, err := koyori.NewQueue(dlqOpts)
+	assert.Nil(t, err)
+	defer dlq.Close()
+
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		ItemTTL:              100 * time.Millisecond,
+		DeadLetterQueue:      dlq,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+
+	// Reserved items don't expire
+	assertDequeue(t, queue, "d")
+	assertDequeueMany(t, dlq, 10, []string{"b", "c"})
+	assert.Nil(t, delivery.Nack())
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assertDequeue(t, dlq, "a")
+
+	// Items also expire when the queue is opened
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	assert.Nil(t, queue.Close())
+	time.Sleep(150 * time.Millisecond)
+	opts.DeadLetterQueue = nil
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueItemTTLFanout(t *testing.T) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		Clock:                clock,
+	}
+	otherOpts := opts
+	otherOpts.FolderPath = filepath.Join(root, "b")
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	other, err := koyori.NewQueue(otherOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, koyori.EnqueueFanout("fanout", queue, other))
+	assert.Nil(t, queue.Close())
+
+	// A fanout item added without an enqueue time doesn't hold back the expiry of later items.
+	opts.ItemTTL = time.Hour
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	clock.Advance(2 * time.Hour)
+	assert.Nil(t, enqueueErr(queue.Enqueue("b")))
+	assertDequeue(t, queue, "fanout")
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "b")
+	assert.Nil(t, queue.Close())
+	assert.Nil(t, other.Close())
+}
+
+func TestQueueConcurrentProducersConsumers(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 7,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+
+	const producers, perProducer = 4, 250
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				item := fmt.Sprintf("%d-%d", p, i)
+				if i%5 == 0 {
+					assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{item + "a", item + "b"})))
+				} else {
+					assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+				}
+			}
+		}(p)
+	}
+
+	total := producers * perProducer * 6 / 5
+	received := make(chan string, total)
+	var consumers sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for len(received) < total {
+				items, err := queue.DequeueUpTo(3)
+				assert.Nil(t, err)
+				for _, item := range items {
+					received <- item
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	consumers.Wait()
+	close(received)
+
+	seen := map[string]bool{}
+	for item := range received {
+		assert.False(t, seen[item], item)
+		seen[item] = true
+	}
+	assert.Equal(t, total, len(seen))
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Close())
+	assert.Len(t, segmentFiles(t, opts.FolderPath), 1)
+}
+
+func TestQueueWriteBuffer(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 100,
+		WriteBufferSize:      1 << 16,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	segmentPath := filepath.Join(opts.FolderPath, "00001.queue.open")
+	info, err := os.Stat(segmentPath)
+	assert.Nil(t, err)
+	headerSize := info.Size()
+
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, enqueueErr(queue.Enqueue("d")))
+	assertDequeue(t, queue, "a")
+	info, err = os.Stat(segmentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, headerSize, info.Size())
+
+	items := []string{}
+	assert.Nil(t, queue.Range(func(item string) bool {
+		items = append(items, item)
+		return true
+	}))
+	assert.Equal(t, []string{"b", "c", "d"}, items)
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"b", "c", "d"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueUseAfterClose(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+
+	// Close waits for operations in progress, and may be called any number of times
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := queue.Enqueue("d")
+			assert.True(t, err == nil || errors.Is(err, koyori.ErrClosed))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, queue.Close())
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, queue.Close())
+
+	assert.ErrorIs(t, enqueueErr(queue.Enqueue("e")), koyori.ErrClosed)
+	assert.ErrorIs(t, enqueueErr(queue.EnqueueMany([]string{"e"})), koyori.ErrClosed)
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrClosed)
+	_, err = queue.DequeueMany(2)
+	assert.ErrorIs(t, err, koyori.ErrClosed)
+	_, err = queue.Reserve()
+	assert.ErrorIs(t, err, koyori.ErrClosed)
+	assert.ErrorIs(t, delivery.Ack(), koyori.ErrClosed)
+	assert.ErrorIs(t, queue.Flush(), koyori.ErrClosed)
+	assert.ErrorIs(t, queue.Clear(), koyori.ErrClosed)
+	assert.ErrorIs(t, enqueueErr(queue.EnqueueAfter("e", time.Second)), koyori.ErrClosed)
+	assert.ErrorIs(t, queue.Range(func(string) bool { return true }), koyori.ErrClosed)
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, queue.Len(), 3)
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueuePreallocate(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+		Preallocate:          true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, queue.Close())
+
+	// Preallocated space doesn't count towards the file size, so reading is unaffected.
+	info, err := os.Stat(filepath.Join(opts.FolderPath, "00002.queue.open"))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(100))
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	assertDequeueMany(t, queue, 4, []string{"b", "c", "d", "e"})
+	assert.Nil(t, queue.Close())
 }
@@ -0,0 +1,59 @@
+package koyori
+
+import "sync"
+
+// RawQueue is a queue of byte slices stored as they are, for callers that encode items
+// themselves. Items go to and from segment files without being marshalled or unmarshalled, and
+// DequeueBuffer hands them out in buffers taken from a pool, so that once the buffers have grown
+// to the size of the items, dequeuing them allocates nothing.
+//
+// As with NewBytesQueue, items kept in memory share their bytes with the slices they were
+// enqueued as, which must not be modified afterwards.
+type RawQueue struct {
+	*Queue[[]byte]
+	buffers sync.Pool
+}
+
+// Buffer holds an item dequeued by DequeueBuffer.
+type Buffer struct {
+	Data  []byte
+	queue *RawQueue
+}
+
+// Release returns the buffer to the pool of its queue. Neither the buffer nor Data may be used
+// afterwards.
+func (b *Buffer) Release() {
+	b.Data = b.Data[:0]
+	b.queue.buffers.Put(b)
+}
+
+// NewRawQueue opens a queue in folderPath that stores byte slices as-is.
+// Segments hold 1024 items, files are created with mode 0644 and a record torn by a crash at
+// the end of a segment is cut off (RecoveryTruncate) unless changed by opts.
+func NewRawQueue(folderPath string, opts ...Option) (*RawQueue, error) {
+	queue, err := NewBytesQueue(folderPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &RawQueue{Queue: queue}, nil
+}
+
+// DequeueBuffer removes the first item of the queue, copying it into a pooled buffer that should
+// be released once the item was handled.
+func (q *RawQueue) DequeueBuffer() (*Buffer, error) {
+	buf, _ := q.buffers.Get().(*Buffer)
+	if buf == nil {
+		buf = &Buffer{queue: q}
+	}
+	owned := buf.Data
+	if err := q.DequeueInto(&buf.Data); err != nil {
+		buf.Release()
+		return nil, err
+	}
+	// Items read from disk are copied into the buffer, but those kept in memory are the
+	// enqueued slices themselves.
+	if data := buf.Data; len(data) > 0 && (cap(owned) == 0 || &data[0] != &owned[:1][0]) {
+		buf.Data = append(owned[:0], data...)
+	}
+	return buf, nil
+}
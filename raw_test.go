@@ -0,0 +1,58 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRawQueueDequeueBuffer(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err := koyori.NewRawQueue(folder, koyori.WithMaxObjectsPerSegment(1000))
+	assert.Nil(t, err)
+	item := []byte("abc")
+	assert.Nil(t, enqueueErr(queue.Enqueue(item)))
+
+	// Items kept in memory are copied rather than handed out as the enqueued slice.
+	buf, err := queue.DequeueBuffer()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), buf.Data)
+	buf.Data[0] = 'x'
+	assert.Equal(t, []byte("abc"), item)
+	buf.Release()
+
+	_, err = queue.DequeueBuffer()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, enqueueErr(queue.Enqueue([]byte(fmt.Sprintf("item %03d", i)))))
+	}
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewRawQueue(folder, koyori.WithMaxObjectsPerSegment(1000))
+	assert.Nil(t, err)
+	buf, err = queue.DequeueBuffer()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("item 000"), buf.Data)
+	buf.Release()
+
+	// Dequeuing items read from disk into pooled buffers allocates nothing.
+	expected := make([]string, 500)
+	for i := range expected {
+		expected[i] = fmt.Sprintf("item %03d", i)
+	}
+	i := 1
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, err := queue.DequeueBuffer()
+		if err != nil || string(buf.Data) != expected[i] {
+			t.Fatalf("dequeued %q, %v", buf.Data, err)
+		}
+		buf.Release()
+		i++
+	})
+	assert.Equal(t, 0.0, allocs)
+	assert.Nil(t, queue.Close())
+}
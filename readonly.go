@@ -0,0 +1,238 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadOnlyQueue reads a queue without opening it, for dashboards and debugging tools. It takes
+// no lock on the queue folder and never writes to it, so it can be used while another process
+// has the queue open. Every call reads the segment files anew: items it returns may have been
+// dequeued since, and an item being written while it reads is left out.
+type ReadOnlyQueue[T any] struct {
+	queue     *Queue[T]
+	closeOnce sync.Once
+}
+
+// ReadOnlyStats describes a queue read by a ReadOnlyQueue.
+type ReadOnlyStats struct {
+	// Len is the number of items, not counting scheduled ones, which ScheduledLen counts.
+	Len          int
+	ScheduledLen int
+	Segments     int
+	// Bytes is the size of the segment files, including those offloaded to ColdStorage, but not
+	// those of scheduled items.
+	Bytes int64
+	// OldestItemAge and NewestItemAge are as returned by Queue.OldestItemAge and
+	// Queue.NewestItemAge.
+	OldestItemAge time.Duration
+	NewestItemAge time.Duration
+}
+
+// OpenReadOnly opens the queue in options.FolderPath for reading. Only the options about
+// reading segments are used, such as Converter, SegmentNaming and UseMmap; ColdStorage is only
+// needed to read the items of offloaded segments. Under RecoveryStrict, a record that can't be
+// read at the end of a segment is passed over, as the process that has the queue open may be
+// writing it.
+func OpenReadOnly[T any](options QueueOptions[T]) (*ReadOnlyQueue[T], error) {
+	if err := options.prepare(); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(options.FolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat folder")
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", options.FolderPath)
+	}
+	if options.RecoveryMode == RecoveryStrict {
+		// Segments are loaded read-only, so the file is left as it is.
+		options.RecoveryMode = RecoveryTruncate
+	}
+	queue := &Queue[T]{options: options, readOnly: true, closed: make(chan struct{})}
+	return &ReadOnlyQueue[T]{queue: queue}, nil
+}
+
+// Iter returns an iterator over the items of the queue, as Queue.Iter does.
+func (r *ReadOnlyQueue[T]) Iter() *Iterator[T] {
+	return &Iterator[T]{queue: r.queue}
+}
+
+// Peek returns the first item of the queue, or ErrEmpty. Like Iter, it counts items that are
+// reserved or held back by MinAge.
+func (r *ReadOnlyQueue[T]) Peek() (T, error) {
+	var zero T
+	it := r.Iter()
+	defer it.Close()
+	if it.Next() {
+		return it.Item(), nil
+	}
+	if err := it.Err(); err != nil {
+		return zero, err
+	}
+	return zero, ErrEmpty
+}
+
+// Stats counts the items and segments of the queue.
+func (r *ReadOnlyQueue[T]) Stats() (ReadOnlyStats, error) {
+	q := r.queue
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return ReadOnlyStats{}, err
+	}
+	if err := q.refreshReadOnlyLocked(); err != nil {
+		return ReadOnlyStats{}, err
+	}
+	stats := ReadOnlyStats{}
+	local := []int{}
+	for _, number := range q.segments {
+		if seg, ok := q.cold[number]; ok {
+			stats.Len += seg.items
+			stats.Bytes += seg.size
+			stats.Segments++
+			continue
+		}
+		items, size, found, err := q.countReadOnlyLocked(q.options.FolderPath, number)
+		if err != nil {
+			return ReadOnlyStats{}, errors.Wrapf(err, "failed to count items of segment (#%d)", number)
+		} else if found {
+			stats.Len += items
+			stats.Bytes += size
+			stats.Segments++
+			local = append(local, number)
+		}
+	}
+
+	scheduledPath := filepath.Join(q.options.FolderPath, scheduledFolder)
+	scheduled, err := listSegments(scheduledPath, q.options.SegmentNaming, q.options.logger())
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return ReadOnlyStats{}, errors.Wrap(err, "error while reading scheduled items directory")
+	}
+	for _, number := range scheduled {
+		items, _, _, err := q.countReadOnlyLocked(scheduledPath, number)
+		if err != nil {
+			return ReadOnlyStats{}, errors.Wrapf(err, "failed to count items of scheduled segment (#%d)", number)
+		}
+		stats.ScheduledLen += items
+	}
+
+	if len(local) > 0 {
+		oldest, newest, err := q.enqueueTimesReadOnlyLocked(local)
+		if err != nil {
+			return ReadOnlyStats{}, err
+		}
+		now := q.options.now()
+		stats.OldestItemAge, stats.NewestItemAge = ageSince(oldest, now), ageSince(newest, now)
+	}
+	return stats, nil
+}
+
+// Close makes later calls fail with ErrClosed. Iterators still open keep their segment until
+// they are closed.
+func (r *ReadOnlyQueue[T]) Close() error {
+	r.closeOnce.Do(func() { close(r.queue.closed) })
+	return nil
+}
+
+// refreshReadOnlyLocked lists the segments of a queue opened by OpenReadOnly, including those
+// offloaded to ColdStorage.
+func (q *Queue[T]) refreshReadOnlyLocked() error {
+	local, err := listSegments(q.options.FolderPath, q.options.SegmentNaming, q.options.logger())
+	if err != nil {
+		return errors.Wrap(err, "error while reading queue directory")
+	}
+	cold, err := readColdManifest(q.options.FolderPath)
+	if err != nil {
+		return err
+	}
+	segments := local
+	for _, number := range local {
+		delete(cold, number)
+	}
+	for number := range cold {
+		segments = append(segments, number)
+	}
+	sort.Ints(segments)
+	head, err := loadHeadFile(q.options.FolderPath, q.options.FileMode, q.options.RecoveryMode, q.options.logger())
+	if err != nil {
+		return err
+	}
+	q.segments, q.cold, q.options.headFile = segments, cold, head
+	return nil
+}
+
+// countReadOnlyLocked returns the number of items of a segment in folderPath and the size of
+// its file, or false if it was deleted.
+func (q *Queue[T]) countReadOnlyLocked(folderPath string, number int) (int, int64, bool, error) {
+	var items int
+	var size int64
+	found, err := readRenamed(func() error {
+		var err error
+		if items, err = countLiveItems(folderPath, q.options.SegmentNaming, number, q.options.RecoveryMode, q.options.headFile.get(), q.options.maxRecordSize()); err != nil {
+			return err
+		}
+		info, err := os.Stat(q.options.SegmentNaming.path(folderPath, number))
+		if err == nil {
+			size = info.Size()
+		}
+		return err
+	})
+	return items, size, found, err
+}
+
+// enqueueTimesReadOnlyLocked returns the enqueue times of the first and last items of the
+// local segments of a queue opened by OpenReadOnly, looking at the first and the last segment
+// as Queue.OldestItemAge and Queue.NewestItemAge do.
+func (q *Queue[T]) enqueueTimesReadOnlyLocked(local []int) (time.Time, time.Time, error) {
+	load := func(number int) (*segment[T], error) {
+		var seg *segment[T]
+		found, err := readRenamed(func() error {
+			seg = &segment[T]{folderPath: q.options.FolderPath, segmentNumber: number, converter: q.options.Converter, options: &q.options, readOnly: true}
+			return seg.load()
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read segment (#%d)", number)
+		} else if !found {
+			return &segment[T]{}, nil
+		}
+		return seg, nil
+	}
+	first, err := load(local[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	last := first
+	if len(local) > 1 {
+		if last, err = load(local[len(local)-1]); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	oldest, newest := first.enqueuedAt(true), last.enqueuedAt(false)
+	if len(local) == 2 {
+		if oldest.IsZero() {
+			oldest = last.enqueuedAt(true)
+		}
+		if newest.IsZero() {
+			newest = first.enqueuedAt(false)
+		}
+	}
+	return oldest, newest, nil
+}
+
+// readRenamed calls read, again if it didn't find the file of a segment, which the process that
+// has the queue open renames when it seals the segment. It reports false if the file is gone,
+// as the segment was deleted.
+func readRenamed(read func() error) (bool, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := read(); !os.IsNotExist(errors.Cause(err)) {
+			return true, err
+		}
+	}
+	return false, nil
+}
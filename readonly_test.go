@@ -0,0 +1,71 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	defer queue.Close()
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+
+	// The queue is read while it is open.
+	reader, err := koyori.OpenReadOnly(opts)
+	assert.Nil(t, err)
+	item, err := reader.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", item)
+	items := []string{}
+	it := reader.Iter()
+	for it.Next() {
+		items = append(items, it.Item())
+	}
+	assert.Nil(t, it.Err())
+	assert.Nil(t, it.Close())
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, items)
+	stats, err := reader.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, stats.Len)
+	assert.Equal(t, 3, stats.Segments)
+	assert.True(t, stats.Bytes > 0)
+
+	// Changes made by the queue are seen by later calls.
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	item, err = reader.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "d", item)
+	stats, err = reader.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Len)
+	assert.Equal(t, 2, stats.Segments)
+
+	assertDequeueMany(t, queue, 3, []string{"d", "e", "f"})
+	_, err = reader.Peek()
+	assert.Equal(t, koyori.ErrEmpty, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("g")))
+
+	assert.Nil(t, reader.Close())
+	_, err = reader.Stats()
+	assert.Equal(t, koyori.ErrClosed, err)
+	assertDequeue(t, queue, "g")
+
+	_, err = koyori.OpenReadOnly(koyori.QueueOptions[string]{
+		Converter:  StringConverter{},
+		FolderPath: filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+	})
+	assert.NotNil(t, err)
+}
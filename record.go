@@ -0,0 +1,781 @@
+package koyori
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// In v1+ segments, the top bits of a record's 4-byte length word hold the record kind.
+const (
+	recordKindShift  = 28
+	recordLengthMask = 1<<recordKindShift - 1
+	maxRecordLength  = recordLengthMask
+)
+
+// defaultMaxRecordSize is the default of QueueOptions.MaxRecordSize.
+const defaultMaxRecordSize = 64 << 20
+
+type recordKind uint8
+
+const (
+	recordKindItem recordKind = iota
+	// recordKindBlock packs several small items behind a single length and CRC32.
+	// The body is a sequence of uvarint-length-prefixed items.
+	recordKindBlock
+	// recordKindEnvelope is an item preceded by an uvarint-length-prefixed envelope of
+	// per-item metadata (see envelope).
+	recordKindEnvelope
+	// recordKindControl carries queue bookkeeping rather than an item. The first byte of
+	// the body is the control type.
+	recordKindControl
+)
+
+type controlType uint8
+
+const (
+	controlTxnCommit controlType = iota + 1
+	controlTxnAbort
+	// controlTimestamp sets the enqueue time of the items that follow it in the segment.
+	controlTimestamp
+	// controlAck removes the item with the uvarint index that follows, counting all items
+	// added to the segment. Used instead of a deletion marker when the item isn't first.
+	controlAck
+	// controlReserve hides the item with the uvarint index that follows until the unix nanos
+	// deadline after it. A zero deadline releases the item.
+	controlReserve
+	// controlDue sets the time the items that follow it in the segment become due. Only used
+	// in segments of scheduled items.
+	controlDue
+	// controlTxnAck removes an item once its transaction commits. The body is the 8 byte
+	// transaction ID, the uvarint index of the item and the transaction's coordinator.
+	controlTxnAck
+	// controlFooter describes the items left in a segment, which is loaded from it if it is
+	// the last record of the file (see segmentFooter).
+	controlFooter
+	// controlDrop removes the uvarint number that follows of the oldest items left, as that
+	// many deletion markers would. Only used in segments with segmentFlagDropRecords.
+	controlDrop
+	// controlSequence sets the uvarint sequence number of the next item record or block item
+	// that follows, those after it being numbered on from there. Zero leaves them unnumbered.
+	controlSequence
+	// controlReserveAs is controlReserve for a reservation made by ReserveAs, followed by the
+	// uvarint-length-prefixed ID of the consumer. Versions from before it pass over control
+	// records they don't know, so to them the item isn't reserved, and it is delivered again
+	// rather than failing to load.
+	controlReserveAs
+)
+
+type envelopeTag uint8
+
+const (
+	envelopeTagTxnID envelopeTag = iota + 1
+	envelopeTagTxnCoordinator
+	// envelopeTagEnqueuedAt is the enqueue time as 8 bytes of unix nanos.
+	envelopeTagEnqueuedAt
+	// envelopeTagPriority is a varint priority level.
+	envelopeTagPriority
+	// envelopeTagHeaders is a sequence of uvarint-length-prefixed keys, each followed by its
+	// uvarint-length-prefixed value.
+	envelopeTagHeaders
+	// envelopeTagAttempts is the uvarint number of past deliveries, kept by compaction.
+	envelopeTagAttempts
+	// envelopeTagSchemaVersion is the single-byte schema version of an exported item.
+	envelopeTagSchemaVersion
+	// envelopeTagSequence is the uvarint sequence number of the item. Unlike that of item
+	// records, it doesn't number the items that follow.
+	envelopeTagSequence
+)
+
+// envelope is per-item metadata stored in front of the item as a TLV list.
+// Unknown tags are skipped when reading.
+type envelope struct {
+	// txnID, if set, marks the item as part of a transaction. The item only becomes
+	// visible once a commit control record for the transaction follows it.
+	txnID          uint64
+	txnCoordinator string
+
+	enqueuedAt time.Time
+	priority   int
+	headers    map[string]string
+	attempts   int
+	sequence   uint64
+	// schemaVersion is only set in archives, as segments store it with the item.
+	schemaVersion byte
+}
+
+func (e *envelope) marshal() []byte {
+	buf := bytes.Buffer{}
+	if e.txnID != 0 {
+		idBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(idBytes, e.txnID)
+		writeEnvelopeField(&buf, envelopeTagTxnID, idBytes)
+	}
+	if e.txnCoordinator != "" {
+		writeEnvelopeField(&buf, envelopeTagTxnCoordinator, []byte(e.txnCoordinator))
+	}
+	if !e.enqueuedAt.IsZero() {
+		nanos := make([]byte, 8)
+		binary.LittleEndian.PutUint64(nanos, uint64(e.enqueuedAt.UnixNano()))
+		writeEnvelopeField(&buf, envelopeTagEnqueuedAt, nanos)
+	}
+	if e.priority != 0 {
+		b := make([]byte, binary.MaxVarintLen64)
+		writeEnvelopeField(&buf, envelopeTagPriority, b[:binary.PutVarint(b, int64(e.priority))])
+	}
+	if len(e.headers) > 0 {
+		keys := make([]string, 0, len(e.headers))
+		for key := range e.headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		headers := bytes.Buffer{}
+		for _, key := range keys {
+			writeUvarint(&headers, uint64(len(key)))
+			headers.WriteString(key)
+			writeUvarint(&headers, uint64(len(e.headers[key])))
+			headers.WriteString(e.headers[key])
+		}
+		writeEnvelopeField(&buf, envelopeTagHeaders, headers.Bytes())
+	}
+	if e.attempts > 0 {
+		b := make([]byte, binary.MaxVarintLen64)
+		writeEnvelopeField(&buf, envelopeTagAttempts, b[:binary.PutUvarint(b, uint64(e.attempts))])
+	}
+	if e.schemaVersion != 0 {
+		writeEnvelopeField(&buf, envelopeTagSchemaVersion, []byte{e.schemaVersion})
+	}
+	if e.sequence != 0 {
+		b := make([]byte, binary.MaxVarintLen64)
+		writeEnvelopeField(&buf, envelopeTagSequence, b[:binary.PutUvarint(b, e.sequence)])
+	}
+	return buf.Bytes()
+}
+
+func writeEnvelopeField(buf *bytes.Buffer, tag envelopeTag, value []byte) {
+	buf.WriteByte(byte(tag))
+	writeUvarint(buf, uint64(len(value)))
+	buf.Write(value)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, v)])
+}
+
+// encodeEnvelopeRecord returns the body of an envelope record for the item.
+func encodeEnvelopeRecord(env envelope, item []byte) []byte {
+	envBytes := env.marshal()
+	buf := bytes.Buffer{}
+	writeUvarint(&buf, uint64(len(envBytes)))
+	buf.Write(envBytes)
+	buf.Write(item)
+	return buf.Bytes()
+}
+
+// decodeEnvelopeRecord splits the body of an envelope record into its envelope and item.
+func decodeEnvelopeRecord(body []byte) (envelope, []byte, error) {
+	envLen, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < envLen {
+		return envelope{}, nil, errors.New("malformed envelope length")
+	}
+	env, err := decodeEnvelope(body[n : n+int(envLen)])
+	if err != nil {
+		return envelope{}, nil, err
+	}
+	return env, body[n+int(envLen):], nil
+}
+
+// decodeEnvelope decodes the TLV list of an envelope.
+func decodeEnvelope(envBytes []byte) (envelope, error) {
+	env := envelope{}
+	for len(envBytes) > 0 {
+		tag := envelopeTag(envBytes[0])
+		valueLen, n := binary.Uvarint(envBytes[1:])
+		if n <= 0 || uint64(len(envBytes)-1-n) < valueLen {
+			return envelope{}, errors.New("malformed envelope field")
+		}
+		value := envBytes[1+n : 1+n+int(valueLen)]
+		envBytes = envBytes[1+n+int(valueLen):]
+
+		switch tag {
+		case envelopeTagTxnID:
+			if len(value) != 8 {
+				return envelope{}, errors.Errorf("invalid transaction ID length %d", len(value))
+			}
+			env.txnID = binary.LittleEndian.Uint64(value)
+		case envelopeTagTxnCoordinator:
+			env.txnCoordinator = string(value)
+		case envelopeTagEnqueuedAt:
+			if len(value) != 8 {
+				return envelope{}, errors.Errorf("invalid enqueue time length %d", len(value))
+			}
+			env.enqueuedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+		case envelopeTagPriority:
+			priority, n := binary.Varint(value)
+			if n <= 0 || n != len(value) || priority < math.MinInt32 || priority > math.MaxInt32 {
+				return envelope{}, errors.New("malformed priority")
+			}
+			env.priority = int(priority)
+		case envelopeTagHeaders:
+			headers, err := decodeHeaders(value)
+			if err != nil {
+				return envelope{}, err
+			}
+			env.headers = headers
+		case envelopeTagAttempts:
+			attempts, n := binary.Uvarint(value)
+			if n <= 0 || n != len(value) || attempts > math.MaxInt32 {
+				return envelope{}, errors.New("malformed delivery attempts")
+			}
+			env.attempts = int(attempts)
+		case envelopeTagSchemaVersion:
+			if len(value) != 1 {
+				return envelope{}, errors.Errorf("invalid schema version length %d", len(value))
+			}
+			env.schemaVersion = value[0]
+		case envelopeTagSequence:
+			sequence, n := binary.Uvarint(value)
+			if n <= 0 || n != len(value) {
+				return envelope{}, errors.New("malformed sequence number")
+			}
+			env.sequence = sequence
+		}
+	}
+	return env, nil
+}
+
+func decodeHeaders(data []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	next := func() (string, bool) {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return "", false
+		}
+		value := string(data[n : n+int(length)])
+		data = data[n+int(length):]
+		return value, true
+	}
+	for len(data) > 0 {
+		key, ok := next()
+		if !ok {
+			return nil, errors.New("malformed header key")
+		}
+		value, ok := next()
+		if !ok {
+			return nil, errors.New("malformed header value")
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+func encodeTimestampControl(t time.Time) []byte {
+	return encodeTimeControl(controlTimestamp, t)
+}
+
+func encodeSequenceControl(sequence uint64) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(controlSequence))
+	writeUvarint(&buf, sequence)
+	return buf.Bytes()
+}
+
+func encodeDueControl(t time.Time) []byte {
+	return encodeTimeControl(controlDue, t)
+}
+
+func encodeTimeControl(control controlType, t time.Time) []byte {
+	buf := make([]byte, 9)
+	buf[0] = byte(control)
+	binary.LittleEndian.PutUint64(buf[1:], uint64(t.UnixNano()))
+	return buf
+}
+
+func encodeAckControl(index int) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(controlAck))
+	writeUvarint(&buf, uint64(index))
+	return buf.Bytes()
+}
+
+func decodeAckControl(data []byte) (int, bool) {
+	index, n := binary.Uvarint(data)
+	if n <= 0 || n != len(data) || index > math.MaxInt32 {
+		return 0, false
+	}
+	return int(index), true
+}
+
+func encodeDropControl(count int) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(controlDrop))
+	writeUvarint(&buf, uint64(count))
+	return buf.Bytes()
+}
+
+func decodeDropControl(data []byte) (int, bool) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || n != len(data) || count == 0 || count > math.MaxInt32 {
+		return 0, false
+	}
+	return int(count), true
+}
+
+// encodeReserveControl encodes a controlReserve record, or a controlReserveAs record if consumer
+// is set.
+func encodeReserveControl(index int, deadline time.Time, consumer string) []byte {
+	buf := bytes.Buffer{}
+	if consumer == "" {
+		buf.WriteByte(byte(controlReserve))
+	} else {
+		buf.WriteByte(byte(controlReserveAs))
+	}
+	writeUvarint(&buf, uint64(index))
+	deadlineBytes := make([]byte, 8)
+	if !deadline.IsZero() {
+		binary.LittleEndian.PutUint64(deadlineBytes, uint64(deadline.UnixNano()))
+	}
+	buf.Write(deadlineBytes)
+	if consumer != "" {
+		writeUvarint(&buf, uint64(len(consumer)))
+		buf.WriteString(consumer)
+	}
+	return buf.Bytes()
+}
+
+// decodeReserveControl decodes the body of a controlReserve or controlReserveAs record.
+func decodeReserveControl(control controlType, data []byte) (int, time.Time, string, bool) {
+	index, n := binary.Uvarint(data)
+	if n <= 0 || len(data)-n < 8 || index > math.MaxInt32 {
+		return 0, time.Time{}, "", false
+	}
+	deadline := time.Time{}
+	if nanos := binary.LittleEndian.Uint64(data[n:]); nanos != 0 {
+		deadline = time.Unix(0, int64(nanos))
+	}
+	rest := data[n+8:]
+	if control == controlReserve {
+		return int(index), deadline, "", len(rest) == 0
+	}
+	length, m := binary.Uvarint(rest)
+	if m <= 0 || length == 0 || uint64(len(rest)-m) != length {
+		return 0, time.Time{}, "", false
+	}
+	return int(index), deadline, string(rest[m:]), true
+}
+
+// isReserveControl reports whether a control record is a reservation.
+func isReserveControl(control controlType) bool {
+	return control == controlReserve || control == controlReserveAs
+}
+
+// appendRecord appends a record in the given segment format. Blocks carry their own checksum,
+// so it must not be used for them.
+func appendRecord(buf *bytes.Buffer, version int, kind recordKind, body []byte) {
+	// The length word of an empty item would be zero, which is a deletion marker, so it is
+	// written as a block holding just that item instead.
+	if kind == recordKindItem && len(body) == 0 && version >= segmentFormatV1 {
+		block := []byte{0}
+		appendRecordWord(buf, recordWord(recordKindBlock, len(block)))
+		appendChecksum(buf, block)
+		buf.Write(block)
+		return
+	}
+	appendRecordWord(buf, recordWord(kind, len(body)))
+	if version >= segmentFormatV2 {
+		appendChecksum(buf, body)
+	}
+	buf.Write(body)
+}
+
+func appendChecksum(buf *bytes.Buffer, body []byte) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(body, crcTable))
+	buf.Write(b)
+}
+
+// recordOverhead returns the bytes in front of the body of a record that isn't a block.
+func recordOverhead(version int) int {
+	if version >= segmentFormatV2 {
+		return 8
+	}
+	return 4
+}
+
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// CorruptRecordError is returned when a segment file fails a checksum, can't be parsed or
+// refers to items it doesn't hold. It matches ErrCorruptRecord (and ErrCorrupt) with errors.Is.
+type CorruptRecordError struct {
+	// Segment is the segment number, or 0 if the file name isn't one of a segment.
+	Segment int
+	// Offset is the position of the record in the segment file.
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d of segment %d: %s", e.Offset, e.Segment, e.Reason)
+}
+
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+func encodeTxnControl(control controlType, txnID uint64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = byte(control)
+	binary.LittleEndian.PutUint64(buf[1:], txnID)
+	return buf
+}
+
+func encodeTxnAckControl(txnID uint64, index int, coordinator string) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(byte(controlTxnAck))
+	idBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(idBytes, txnID)
+	buf.Write(idBytes)
+	writeUvarint(&buf, uint64(index))
+	buf.WriteString(coordinator)
+	return buf.Bytes()
+}
+
+func decodeTxnAckControl(data []byte) (uint64, int, string, bool) {
+	if len(data) < 8 {
+		return 0, 0, "", false
+	}
+	index, n := binary.Uvarint(data[8:])
+	if n <= 0 || index > math.MaxInt32 {
+		return 0, 0, "", false
+	}
+	return binary.LittleEndian.Uint64(data), int(index), string(data[8+n:]), true
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func recordWord(kind recordKind, length int) uint32 {
+	return uint32(kind)<<recordKindShift | uint32(length)
+}
+
+func splitRecordWord(word uint32) (recordKind, int) {
+	return recordKind(word >> recordKindShift), int(word & recordLengthMask)
+}
+
+func appendRecordWord(buf *bytes.Buffer, word uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, word)
+	buf.Write(b)
+}
+
+// blockWriter accumulates items into blocks of at most blockSize bytes.
+// Items that don't fit in a block on their own are written as plain records.
+type blockWriter struct {
+	out       bytes.Buffer
+	block     bytes.Buffer
+	blockSize int
+	version   int
+	// offsets holds the position in out of every item added, once its block is flushed.
+	offsets      []int64
+	blockOffsets []int
+}
+
+func (w *blockWriter) add(item []byte) {
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	lenBytes := lenBuf[:binary.PutUvarint(lenBuf, uint64(len(item)))]
+	encodedLen := len(lenBytes) + len(item)
+
+	if encodedLen > w.blockSize {
+		w.flushBlock()
+		w.offsets = append(w.offsets, int64(w.out.Len()+recordOverhead(w.version)))
+		appendRecord(&w.out, w.version, recordKindItem, item)
+		return
+	}
+	if w.block.Len()+encodedLen > w.blockSize {
+		w.flushBlock()
+	}
+	w.blockOffsets = append(w.blockOffsets, w.block.Len()+len(lenBytes))
+	w.block.Write(lenBytes)
+	w.block.Write(item)
+}
+
+func (w *blockWriter) flushBlock() {
+	if w.block.Len() == 0 {
+		return
+	}
+	for _, offset := range w.blockOffsets {
+		w.offsets = append(w.offsets, int64(w.out.Len()+8+offset))
+	}
+	w.blockOffsets = w.blockOffsets[:0]
+	appendRecordWord(&w.out, recordWord(recordKindBlock, w.block.Len()))
+	crcBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crcBytes, crc32.Checksum(w.block.Bytes(), crcTable))
+	w.out.Write(crcBytes)
+	w.out.Write(w.block.Bytes())
+	w.block.Reset()
+}
+
+func (w *blockWriter) bytes() []byte {
+	w.flushBlock()
+	return w.out.Bytes()
+}
+
+// splitBlock verifies a block body against its checksum and returns the items inside, along
+// with their offsets in the body.
+func splitBlock(body []byte, checksum uint32) ([][]byte, []int, error) {
+	if actual := crc32.Checksum(body, crcTable); actual != checksum {
+		return nil, nil, errors.Errorf("block checksum mismatch (expected %08x, got %08x)", checksum, actual)
+	}
+	items := [][]byte{}
+	offsets := []int{}
+	for pos := 0; pos < len(body); {
+		length, n := binary.Uvarint(body[pos:])
+		if n <= 0 || uint64(len(body)-pos-n) < length {
+			return nil, nil, errors.New("malformed block item length")
+		}
+		items = append(items, body[pos+n:pos+n+int(length)])
+		offsets = append(offsets, pos+n)
+		pos += n + int(length)
+	}
+	return items, offsets, nil
+}
+
+type scannedKind uint8
+
+const (
+	scannedItem scannedKind = iota + 1
+	scannedTombstone
+	scannedControl
+)
+
+// scannedRecord is a single logical record of a segment file. Items packed in a block are
+// returned one by one, sharing the block's offset.
+type scannedRecord struct {
+	kind   scannedKind
+	offset int64
+	// data is the item for scannedItem, and the control body (without its type) for scannedControl
+	data []byte
+	// dataOffset is the position of data in the file.
+	dataOffset int64
+	env        envelope
+	control    controlType
+	enqueuedAt time.Time
+	dueAt      time.Time
+	sequence   uint64
+}
+
+// recordScanner reads the header and records of a segment file in order.
+type recordScanner struct {
+	r             io.Reader
+	segmentNumber int
+	header        segmentHeader
+	headerSize    int64
+	offset        int64
+	tombstones    int
+	blockItems    [][]byte
+	blockOffsets  []int64
+	blockStart    int64
+	enqueuedAt    time.Time
+	dueAt         time.Time
+	// recordStart is the offset of the last record read, and recordKind its kind once the
+	// whole record was read.
+	recordStart int64
+	recordKind  recordKind
+	recordRead  bool
+	// maxLength is the longest record body read; longer length prefixes are taken as corrupt
+	// rather than allocated. pastLimitEnd is where the last such record would have ended.
+	maxLength    int
+	pastLimitEnd int64
+	// sequence is the sequence number of the next item record or block item, or zero if they
+	// aren't numbered. sequenceEnd is one past the highest sequence number read so far, or the
+	// one of the header if higher.
+	sequence    uint64
+	sequenceEnd uint64
+}
+
+func newRecordScanner(r io.Reader, segmentNumber int) (*recordScanner, error) {
+	counter := &countingReader{r: r}
+	header, err := readSegmentHeader(counter)
+	if err != nil {
+		if corrupt, ok := err.(*CorruptRecordError); ok {
+			corrupt.Segment = segmentNumber
+		}
+		return nil, errors.Wrap(err, "failed to read segment header")
+	}
+	return &recordScanner{r: r, segmentNumber: segmentNumber, header: header, headerSize: counter.n, offset: counter.n, maxLength: defaultMaxRecordSize,
+		sequence: header.sequence, sequenceEnd: header.sequence}, nil
+}
+
+// resumeRecordScanner reads the records of a segment with the given header from offset on, r
+// being positioned there. recordBytes then only counts the records read from offset on.
+func resumeRecordScanner(r io.Reader, segmentNumber int, header segmentHeader, offset int64) *recordScanner {
+	return &recordScanner{r: r, segmentNumber: segmentNumber, header: header, headerSize: offset, offset: offset, maxLength: defaultMaxRecordSize}
+}
+
+func (s *recordScanner) corrupt(offset int64, format string, args ...interface{}) error {
+	return &CorruptRecordError{Segment: s.segmentNumber, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// next returns the next record, or io.EOF after the last one.
+func (s *recordScanner) next() (scannedRecord, error) {
+	if len(s.blockItems) > 0 {
+		item, itemOffset := s.blockItems[0], s.blockOffsets[0]
+		s.blockItems, s.blockOffsets = s.blockItems[1:], s.blockOffsets[1:]
+		return scannedRecord{kind: scannedItem, offset: s.blockStart, data: item, dataOffset: itemOffset, enqueuedAt: s.enqueuedAt, dueAt: s.dueAt, sequence: s.takeSequence()}, nil
+	}
+
+	recordOffset := s.offset
+	s.recordStart, s.recordRead = recordOffset, false
+	lengthBuf := make([]byte, 4)
+	if n, err := io.ReadFull(s.r, lengthBuf); err != nil {
+		if err == io.EOF {
+			return scannedRecord{}, io.EOF
+		}
+		return scannedRecord{}, errors.Wrapf(err, "error reading object length bytes (read %d bytes)", n)
+	}
+	s.offset += 4
+	word := binary.LittleEndian.Uint32(lengthBuf)
+	if word == 0 {
+		s.tombstones++
+		return scannedRecord{kind: scannedTombstone, offset: recordOffset}, nil
+	}
+	kind, length := recordKindItem, int(word)
+	if s.header.version >= segmentFormatV1 {
+		kind, length = splitRecordWord(word)
+	}
+	if kind > recordKindControl {
+		return scannedRecord{}, s.corrupt(recordOffset, "unknown record kind %d", kind)
+	}
+	if length > s.maxLength {
+		s.pastLimitEnd = s.offset + int64(length)
+		return scannedRecord{}, s.corrupt(recordOffset, "record length %d exceeds limit of %d bytes", length, s.maxLength)
+	}
+	checksummed := kind == recordKindBlock || s.header.version >= segmentFormatV2
+	if checksummed {
+		length += 4
+	}
+
+	buf := make([]byte, length)
+	if n, err := io.ReadFull(s.r, buf); err != nil {
+		return scannedRecord{}, errors.Wrapf(err, "error reading record (read %d bytes)", n)
+	}
+	s.offset += int64(length)
+	s.recordKind, s.recordRead = kind, true
+	bodyOffset := recordOffset + 4
+	checksum := uint32(0)
+	if checksummed {
+		checksum, buf = binary.LittleEndian.Uint32(buf[0:4]), buf[4:]
+		bodyOffset += 4
+	}
+	if checksummed && kind != recordKindBlock {
+		if actual := crc32.Checksum(buf, crcTable); actual != checksum {
+			return scannedRecord{}, s.corrupt(recordOffset, "checksum mismatch (expected %08x, got %08x)", checksum, actual)
+		}
+	}
+
+	switch kind {
+	case recordKindBlock:
+		items, offsets, err := splitBlock(buf, checksum)
+		if err != nil {
+			return scannedRecord{}, s.corrupt(recordOffset, "%v", err)
+		}
+		s.blockItems, s.blockStart = items, recordOffset
+		s.blockOffsets = make([]int64, len(offsets))
+		for i, offset := range offsets {
+			s.blockOffsets[i] = bodyOffset + int64(offset)
+		}
+		return s.next()
+	case recordKindEnvelope:
+		env, item, err := decodeEnvelopeRecord(buf)
+		if err != nil {
+			return scannedRecord{}, s.corrupt(recordOffset, "%v", err)
+		}
+		dataOffset := bodyOffset + int64(len(buf)-len(item))
+		enqueuedAt := s.enqueuedAt
+		if !env.enqueuedAt.IsZero() {
+			enqueuedAt = env.enqueuedAt
+		}
+		if env.sequence != 0 {
+			s.raiseSequenceEnd(env.sequence + 1)
+		}
+		return scannedRecord{kind: scannedItem, offset: recordOffset, data: item, dataOffset: dataOffset, env: env, enqueuedAt: enqueuedAt, dueAt: s.dueAt, sequence: env.sequence}, nil
+	case recordKindControl:
+		if len(buf) == 0 {
+			return scannedRecord{}, s.corrupt(recordOffset, "empty control record")
+		}
+		if controlType(buf[0]) == controlTimestamp && len(buf) == 9 {
+			s.enqueuedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[1:])))
+			return s.next()
+		}
+		if controlType(buf[0]) == controlDue && len(buf) == 9 {
+			s.dueAt = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[1:])))
+			return s.next()
+		}
+		if controlType(buf[0]) == controlSequence {
+			sequence, n := binary.Uvarint(buf[1:])
+			if n <= 0 || n != len(buf)-1 {
+				return scannedRecord{}, s.corrupt(recordOffset, "malformed sequence number")
+			}
+			s.sequence = sequence
+			s.raiseSequenceEnd(sequence)
+			return s.next()
+		}
+		return scannedRecord{kind: scannedControl, offset: recordOffset, control: controlType(buf[0]), data: buf[1:]}, nil
+	default:
+		return scannedRecord{kind: scannedItem, offset: recordOffset, data: buf, dataOffset: bodyOffset, enqueuedAt: s.enqueuedAt, dueAt: s.dueAt, sequence: s.takeSequence()}, nil
+	}
+}
+
+// takeSequence returns the sequence number of the next item record or block item.
+func (s *recordScanner) takeSequence() uint64 {
+	sequence := s.sequence
+	if sequence != 0 {
+		s.sequence++
+		s.raiseSequenceEnd(s.sequence)
+	}
+	return sequence
+}
+
+func (s *recordScanner) raiseSequenceEnd(end uint64) {
+	if end > s.sequenceEnd {
+		s.sequenceEnd = end
+	}
+}
+
+// skippable tells if err, returned by next, is about a single item or control record that
+// can be skipped to read on. Blocks and envelopes can't be skipped without losing track of
+// which items the following records refer to.
+func (s *recordScanner) skippable(err error) bool {
+	var corrupt *CorruptRecordError
+	if !errors.As(err, &corrupt) || !s.recordRead || s.header.version < segmentFormatV1 {
+		return false
+	}
+	return s.recordKind == recordKindItem || s.recordKind == recordKindControl
+}
+
+// torn tells if err, returned by next, is about a record cut short by the end of the file.
+func torn(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// recordBytes returns the bytes taken by everything read so far except the header and tombstones.
+func (s *recordScanner) recordBytes() int64 {
+	return s.offset - s.headerSize - 4*int64(s.tombstones)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,99 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+// RecoveryMode decides what loading a segment does with records that can't be read.
+type RecoveryMode int
+
+const (
+	// RecoveryStrict fails to open the queue on any unreadable record.
+	RecoveryStrict RecoveryMode = iota
+	// RecoveryTruncate cuts off a record left partially written at the end of a segment, as
+	// happens when the process dies mid-write, and fails on anything else.
+	RecoveryTruncate
+	// RecoverySkip also skips corrupt items and control records in the middle of a segment.
+	// Corrupt blocks and transaction items can't be skipped, so the segment is cut off there.
+	RecoverySkip
+)
+
+// RecoveryEvent describes data given up on while loading a segment.
+type RecoveryEvent struct {
+	Segment int
+	// Offset is where the unreadable record starts.
+	Offset int64
+	// Truncated is set if the segment was cut off at Offset, dropping Dropped bytes. Otherwise
+	// the single record at Offset, of Dropped bytes, was skipped.
+	Truncated bool
+	Dropped   int64
+	// Err is the error the record failed to load with.
+	Err error
+}
+
+// recoverLocked handles an error loading the records of the segment according to the recovery
+// mode. It returns whether loading can go on with the next record; if not and the error was
+// recovered from, the segment was truncated.
+func (s *segment[T]) recoverLocked(scanner *recordScanner, loadErr error, fileSize int64) (bool, error) {
+	mode := s.options.RecoveryMode
+	if mode == RecoveryStrict {
+		return false, loadErr
+	}
+	start := scanner.recordStart
+	skippable := scanner.skippable(loadErr)
+	// A corrupt last record is as likely to be torn as a short one, and so is one whose length
+	// is past the limit but runs beyond the end of the file.
+	atTail := torn(loadErr) || (skippable && scanner.offset == fileSize) || scanner.pastLimitEnd > fileSize
+	if mode == RecoverySkip && skippable && !atTail {
+		if scanner.recordKind == recordKindItem {
+			s.lostIndexes = append(s.lostIndexes, s.nextIndex)
+			s.appendEntryLocked(entry[T]{onDisk: true})
+		}
+		s.reportRecovery(RecoveryEvent{Segment: s.segmentNumber, Offset: start, Dropped: scanner.offset - start, Err: loadErr})
+		return true, nil
+	}
+	if !atTail && mode != RecoverySkip {
+		return false, loadErr
+	}
+
+	if s.readOnly {
+		return false, nil
+	}
+	if err := os.Truncate(s.filePath(), start); err != nil {
+		return false, errors.Wrap(err, "failed to truncate segment")
+	}
+	s.reportRecovery(RecoveryEvent{Segment: s.segmentNumber, Offset: start, Truncated: true, Dropped: fileSize - start, Err: loadErr})
+	return false, nil
+}
+
+func (s *segment[T]) reportRecovery(event RecoveryEvent) {
+	if s.readOnly {
+		return
+	}
+	s.options.logger().Warn("gave up on unreadable record", "folder", s.folderPath, "segment", event.Segment,
+		"offset", event.Offset, "truncated", event.Truncated, "dropped", event.Dropped, "err", event.Err)
+	if s.options.OnRecovery != nil {
+		s.options.OnRecovery(event)
+	}
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(Event{Type: EventRecovery, Segment: event.Segment, Recovery: event})
+	}
+}
+
+// dropLostLocked removes the placeholders of items skipped by RecoverySkip, recording their
+// removal so the items following them keep their place on the next load.
+func (s *segment[T]) dropLostLocked() error {
+	// Items already removed by a later record don't need to be dropped again.
+	indexes := []int{}
+	for _, index := range s.lostIndexes {
+		if s.positionLocked(index) >= 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	s.lostIndexes = nil
+	if len(indexes) == 0 {
+		return nil
+	}
+	return s.dropIndexesLocked(indexes)
+}
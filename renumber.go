@@ -0,0 +1,370 @@
+package koyori
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// renumberManifestFilename is the file in the queue folder listing the renames of a renumbering
+// in progress. The line after the version holds the number of the segment the head position
+// was about when it started, 0 if none, and each line after that the number of a segment and
+// the number it is given.
+//
+// Segment files are first moved to their new names with renumberFileSuffix, as a new name may
+// still be taken by another segment, then the manifest is renamed to
+// renumberedManifestFilename, and the files are given their new names. The manifest is removed
+// once they all have them. Loading the queue finishes a renumbering that was cut short.
+const renumberManifestFilename = "renumber.manifest"
+
+const renumberedManifestFilename = "renumbered.manifest"
+
+const renumberManifestVersion = "koyori-renumber 1"
+
+// renumberFileSuffix is appended to the new name of a segment file while it is renumbered.
+const renumberFileSuffix = ".renumber"
+
+// segmentRename gives the segment numbered from the number to.
+type segmentRename struct {
+	from, to int
+}
+
+type renumberManifest struct {
+	head    int
+	renames []segmentRename
+}
+
+// planRenumber returns the renames numbering segments 1, 2, and so on, oldest first.
+func planRenumber(segments []int) []segmentRename {
+	renames := []segmentRename{}
+	for i, number := range segments {
+		if number != i+1 {
+			renames = append(renames, segmentRename{from: number, to: i + 1})
+		}
+	}
+	return renames
+}
+
+func readRenumberManifest(manifestPath string) (*renumberManifest, error) {
+	file, err := os.Open(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open renumbering manifest")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != renumberManifestVersion || !scanner.Scan() {
+		return nil, errors.Wrap(ErrCorrupt, "invalid renumbering manifest")
+	}
+	m := &renumberManifest{}
+	if _, err := fmt.Sscanf(scanner.Text(), "head %d", &m.head); err != nil {
+		return nil, errors.Wrapf(ErrCorrupt, "invalid renumbering manifest line %q", scanner.Text())
+	}
+	for scanner.Scan() {
+		var r segmentRename
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &r.from, &r.to); err != nil {
+			return nil, errors.Wrapf(ErrCorrupt, "invalid renumbering manifest line %q", scanner.Text())
+		}
+		m.renames = append(m.renames, r)
+	}
+	return m, errors.Wrap(scanner.Err(), "failed to read renumbering manifest")
+}
+
+func (q *Queue[T]) writeRenumberManifestLocked(m *renumberManifest) error {
+	manifestPath := filepath.Join(q.options.FolderPath, renumberManifestFilename)
+	lines := []string{renumberManifestVersion, fmt.Sprintf("head %d", m.head)}
+	for _, r := range m.renames {
+		lines = append(lines, fmt.Sprintf("%d %d", r.from, r.to))
+	}
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), q.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to write renumbering manifest")
+	}
+	if err := syncFile(tmpPath, q.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to sync renumbering manifest")
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return errors.Wrap(err, "failed to replace renumbering manifest")
+	}
+	return errors.Wrap(syncDir(q.options.FolderPath), "failed to sync folder")
+}
+
+// renumberFilesLocked renames the segment files as renames lists, through the manifest.
+func (q *Queue[T]) renumberFilesLocked(renames []segmentRename) error {
+	m := &renumberManifest{renames: renames}
+	if head := q.options.headFile.get(); head.createdAt != 0 {
+		m.head = head.segment
+	}
+	if err := q.writeRenumberManifestLocked(m); err != nil {
+		return err
+	}
+	return q.applyRenumberLocked(m, false)
+}
+
+// resumeRenumberLocked finishes the renumbering of a queue being loaded if it was cut short.
+func (q *Queue[T]) resumeRenumberLocked() error {
+	for _, renamed := range []bool{false, true} {
+		filename := renumberManifestFilename
+		if renamed {
+			filename = renumberedManifestFilename
+		}
+		m, err := readRenumberManifest(filepath.Join(q.options.FolderPath, filename))
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			q.options.logger().Warn("finishing renumbering of segments cut short", "folder", q.options.FolderPath)
+			return q.applyRenumberLocked(m, renamed)
+		}
+	}
+	return nil
+}
+
+// applyRenumberLocked carries out the renumbering m lists, starting by giving the files their
+// new names if renamed is set, as they were all moved to their temporary names already. Every
+// step can be done again after a crash.
+func (q *Queue[T]) applyRenumberLocked(m *renumberManifest, renamed bool) error {
+	folderPath, naming := q.options.FolderPath, q.options.SegmentNaming
+	tmpPath := func(number int, open bool) string {
+		filePath := filepath.Join(folderPath, naming.filename(number))
+		if open {
+			filePath += openSegmentSuffix
+		}
+		return filePath + renumberFileSuffix
+	}
+	exists := func(filePath string) (bool, error) {
+		_, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, errors.Wrap(err, "failed to stat segment file")
+	}
+
+	// The head position follows its segment. It is only updated while it has the number of the
+	// manifest, which the segment doesn't get back, and its creation time keeps it from
+	// applying to another segment meanwhile.
+	if head := q.options.headFile.get(); m.head != 0 && head.createdAt != 0 && head.segment == m.head {
+		for _, r := range m.renames {
+			if r.from == head.segment {
+				head.segment = r.to
+				if err := q.options.headFile.set(head); err != nil {
+					return err
+				}
+				if err := q.options.headFile.sync(); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	manifestPath := filepath.Join(folderPath, renumberManifestFilename)
+	renamedPath := filepath.Join(folderPath, renumberedManifestFilename)
+	if !renamed {
+		for _, r := range m.renames {
+			from := naming.path(folderPath, r.from)
+			open := strings.HasSuffix(from, openSegmentSuffix)
+			if ok, err := exists(from); err != nil {
+				return err
+			} else if ok {
+				if err := os.Rename(from, tmpPath(r.to, open)); err != nil {
+					return errors.Wrapf(err, "failed to renumber segment (#%d)", r.from)
+				}
+				continue
+			}
+			// The file was moved before the renumbering was cut short.
+			moved := false
+			for _, open := range []bool{false, true} {
+				ok, err := exists(tmpPath(r.to, open))
+				if err != nil {
+					return err
+				}
+				moved = moved || ok
+			}
+			if !moved {
+				return errors.Wrapf(ErrCorrupt, "segment (#%d) being renumbered is missing", r.from)
+			}
+		}
+		if err := syncDir(folderPath); err != nil {
+			return errors.Wrap(err, "failed to sync folder")
+		}
+		if err := os.Rename(manifestPath, renamedPath); err != nil {
+			return errors.Wrap(err, "failed to rename renumbering manifest")
+		}
+		if err := syncDir(folderPath); err != nil {
+			return errors.Wrap(err, "failed to sync folder")
+		}
+	}
+	for _, r := range m.renames {
+		for _, open := range []bool{false, true} {
+			from := tmpPath(r.to, open)
+			if ok, err := exists(from); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			to := strings.TrimSuffix(from, renumberFileSuffix)
+			if err := os.Rename(from, to); err != nil {
+				return errors.Wrapf(err, "failed to renumber segment (#%d)", r.from)
+			}
+			if replicator := q.options.replicator; replicator != nil {
+				oldPath := filepath.Join(folderPath, naming.filename(r.from))
+				if open {
+					oldPath += openSegmentSuffix
+				}
+				if err := replicator.renamed(oldPath, to); err != nil {
+					return err
+				}
+			}
+			q.options.logger().Debug("renumbered segment", "folder", folderPath, "segment", r.from, "number", r.to)
+		}
+	}
+	if err := syncDir(folderPath); err != nil {
+		return errors.Wrap(err, "failed to sync folder")
+	}
+	if err := os.Remove(renamedPath); err != nil {
+		return errors.Wrap(err, "failed to remove renumbering manifest")
+	}
+	return errors.Wrap(syncDir(folderPath), "failed to sync folder")
+}
+
+// canRenumberLocked reports whether segments may be renumbered. Queues with offloaded segments
+// or consumer groups keep their numbers, as those are recorded in the cold storage manifest and
+// the group cursors.
+func (q *Queue[T]) canRenumberLocked() (bool, error) {
+	if len(q.cold) > 0 || len(q.groups) > 0 {
+		return false, nil
+	}
+	groups, err := listFolder(filepath.Join(q.options.FolderPath, groupsFolder))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return false, err
+	}
+	for _, name := range groups {
+		if strings.HasSuffix(name, groupCursorExtension) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// renumberSegmentsLocked renames the segment files of a queue being loaded to 1, 2, and so on,
+// returning the new numbers.
+func (q *Queue[T]) renumberSegmentsLocked(segments []int) ([]int, error) {
+	renames := planRenumber(segments)
+	if len(renames) == 0 {
+		return segments, nil
+	}
+	if ok, err := q.canRenumberLocked(); err != nil || !ok {
+		return segments, err
+	}
+	if err := q.renumberFilesLocked(renames); err != nil {
+		return nil, err
+	}
+	renumbered := make([]int, len(segments))
+	for i := range renumbered {
+		renumbered[i] = i + 1
+	}
+	return renumbered, nil
+}
+
+// renumberLocked, called with both locks held, renames the segment files to 1, 2, and so on
+// under RenumberSegments once the number of the first segment exceeds the number of segments,
+// so numbers stay below twice that. The segments keep their numbers while anything refers to
+// them: reserved items, pending transactions, claimed segments and open iterators.
+func (q *Queue[T]) renumberLocked() error {
+	if !q.options.RenumberSegments || q.producer || q.readOnly || q.segments[0] <= len(q.segments) {
+		return nil
+	}
+	if len(q.claimed) > 0 || atomic.LoadInt64(&q.iterators) > 0 {
+		return nil
+	}
+	for _, seg := range []*segment[T]{q.firstSegment, q.lastSegment} {
+		if seg.reservedCount > 0 || len(seg.txns) > 0 {
+			return nil
+		}
+	}
+	if ok, err := q.canRenumberLocked(); err != nil || !ok {
+		return err
+	}
+
+	renames := planRenumber(q.segments)
+	numbers := map[int]int{}
+	for _, r := range renames {
+		numbers[r.from] = r.to
+	}
+	open := []*segment[T]{q.firstSegment}
+	if q.lastSegment != q.firstSegment {
+		open = append(open, q.lastSegment)
+	}
+	for _, seg := range open {
+		if err := seg.closeForRename(); err != nil {
+			return err
+		}
+	}
+	err := q.renumberFilesLocked(renames)
+	if err != nil {
+		// The segments are reopened from the files they are left with, and loading the queue
+		// finishes the renumbering.
+		for _, seg := range open {
+			if _, statErr := os.Stat(seg.filePath()); os.IsNotExist(statErr) {
+				seg.reopen(numbers[seg.segmentNumber])
+			} else {
+				seg.reopen(seg.segmentNumber)
+			}
+		}
+		return errors.Wrap(err, "failed to renumber segments")
+	}
+	for _, seg := range open {
+		if err := seg.reopen(numbers[seg.segmentNumber]); err != nil {
+			return err
+		}
+	}
+	for i := range q.segments {
+		q.segments[i] = i + 1
+	}
+	q.segmentNumber = len(q.segments)
+	for i, number := range q.unsyncedSegments {
+		if to, ok := numbers[number]; ok {
+			q.unsyncedSegments[i] = to
+		}
+	}
+	return nil
+}
+
+// closeForRename writes what is pending and closes the files of the segment, for reopen to open
+// them again under its new number, as Windows can't rename open files.
+func (s *segment[T]) closeForRename() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.writePendingLocked(); err != nil {
+		return err
+	}
+	if err := s.closeReaderLocked(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	return errors.Wrap(s.file.Close(), "failed to close file")
+}
+
+// reopen gives the segment the number its file was renamed to, and opens the file for
+// appending again.
+func (s *segment[T]) reopen(number int) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if number != 0 {
+		s.segmentNumber = number
+	}
+	file, err := os.OpenFile(s.filePath(), os.O_APPEND|os.O_WRONLY, s.options.FileMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to reopen segment file")
+	}
+	s.file = file
+	return nil
+}
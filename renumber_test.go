@@ -0,0 +1,177 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueNumberingRestartsWhenDrained(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d"})))
+	assert.Nil(t, enqueueErr(queue.Enqueue("e")))
+	assertDequeueMany(t, queue, 5, []string{"a", "b", "c", "d", "e"})
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assert.Equal(t, []string{filepath.Join(opts.FolderPath, "00003.queue.open")}, segmentFiles(t, opts.FolderPath))
+
+	// Draining a full segment leaves no segments, so the next one is numbered 1 again.
+	assertDequeue(t, queue, "f")
+	assert.Equal(t, []string{filepath.Join(opts.FolderPath, "00001.queue.open")}, segmentFiles(t, opts.FolderPath))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"g", "h", "i"})))
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []string{"g", "h", "i"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueRenumberSegments(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeueMany(t, queue, 3, []string{"a", "b", "c"})
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, []string{
+		filepath.Join(opts.FolderPath, "00002.queue"),
+		filepath.Join(opts.FolderPath, "00003.queue.open"),
+	}, segmentFiles(t, opts.FolderPath))
+
+	opts.RenumberSegments = true
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(opts.FolderPath, "00001.queue"),
+		filepath.Join(opts.FolderPath, "00002.queue.open"),
+	}, segmentFiles(t, opts.FolderPath))
+	assert.Nil(t, enqueueErr(queue.Enqueue("f")))
+	assertDequeueMany(t, queue, 3, []string{"d", "e", "f"})
+	assert.Nil(t, queue.Close())
+
+	// Consumer group cursors refer to segment numbers, so they are kept.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	group, err := queue.Group("g")
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"g", "h", "i", "j", "k"})))
+	for _, expected := range []string{"g", "h", "i"} {
+		item, err := group.Dequeue()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, item)
+	}
+	assert.Nil(t, queue.Close())
+	before := segmentFiles(t, opts.FolderPath)
+	assert.NotEqual(t, filepath.Join(opts.FolderPath, "00001.queue"), before[0])
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, before, segmentFiles(t, opts.FolderPath))
+	group, err = queue.Group("g")
+	assert.Nil(t, err)
+	item, err := group.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "j", item)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueCompactRenumbersSegments(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		RenumberSegments:     true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i"})))
+	assertDequeueMany(t, queue, 6, []string{"a", "b", "c", "d", "e", "f"})
+	assert.Equal(t, []string{
+		filepath.Join(opts.FolderPath, "00004.queue"),
+		filepath.Join(opts.FolderPath, "00005.queue.open"),
+	}, segmentFiles(t, opts.FolderPath))
+
+	// Open iterators refer to segment numbers, so they are kept meanwhile.
+	it := queue.Iter()
+	assert.Nil(t, queue.Compact())
+	assert.Equal(t, filepath.Join(opts.FolderPath, "00004.queue"), segmentFiles(t, opts.FolderPath)[0])
+	assert.Nil(t, it.Close())
+
+	assert.Nil(t, queue.Compact())
+	assert.Equal(t, []string{
+		filepath.Join(opts.FolderPath, "00001.queue"),
+		filepath.Join(opts.FolderPath, "00002.queue.open"),
+	}, segmentFiles(t, opts.FolderPath))
+	_, err = os.Stat(filepath.Join(opts.FolderPath, "renumbered.manifest"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"j", "k"})))
+	assertDequeue(t, queue, "g")
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 4, []string{"h", "i", "j", "k"})
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueResumeRenumbering(t *testing.T) {
+	for _, renamed := range []bool{false, true} {
+		opts := koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 2,
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+		assertDequeueMany(t, queue, 2, []string{"a", "b"})
+		assert.Nil(t, queue.Close())
+
+		// A crash cut the renumbering short, after moving the first two files to their temporary
+		// names, or once all of them were and the first got its new name.
+		manifest := "koyori-renumber 1\nhead 0\n2 1\n3 2\n4 3\n"
+		renames := [][2]string{{"00002.queue", "00001.queue.renumber"}, {"00003.queue", "00002.queue.renumber"}}
+		manifestName := "renumber.manifest"
+		if renamed {
+			renames = append(renames, [2]string{"00004.queue.open", "00003.queue.open.renumber"}, [2]string{"00001.queue.renumber", "00001.queue"})
+			manifestName = "renumbered.manifest"
+		}
+		assert.Nil(t, os.WriteFile(filepath.Join(opts.FolderPath, manifestName), []byte(manifest), os.ModePerm))
+		for _, r := range renames {
+			assert.Nil(t, os.Rename(filepath.Join(opts.FolderPath, r[0]), filepath.Join(opts.FolderPath, r[1])))
+		}
+
+		queue, err = koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			filepath.Join(opts.FolderPath, "00001.queue"),
+			filepath.Join(opts.FolderPath, "00002.queue"),
+			filepath.Join(opts.FolderPath, "00003.queue.open"),
+		}, segmentFiles(t, opts.FolderPath))
+		for _, name := range []string{"renumber.manifest", "renumbered.manifest"} {
+			_, err = os.Stat(filepath.Join(opts.FolderPath, name))
+			assert.True(t, os.IsNotExist(err))
+		}
+		assert.Nil(t, enqueueErr(queue.Enqueue("h")))
+		assertDequeueMany(t, queue, 6, []string{"c", "d", "e", "f", "g", "h"})
+		assert.Nil(t, queue.Close())
+	}
+}
@@ -0,0 +1,456 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replica receives a copy of the files of a queue under QueueOptions.Replica, so that a standby
+// process can take the queue over after a host failure by opening a queue on the copy. Files
+// are named by their path relative to the queue folder, with forward slashes. Methods are
+// called by one goroutine at a time.
+type Replica interface {
+	// Files returns the size of every file held by the replica, by name.
+	Files() (map[string]int64, error)
+	// Write writes data to the named file at offset, creating the file if needed and discarding
+	// whatever it held past offset.
+	Write(name string, offset int64, data []byte) error
+	// Remove deletes the named file. Removing a missing file isn't an error.
+	Remove(name string) error
+	// Sync makes the writes and removals so far durable.
+	Sync() error
+}
+
+// ReplicaRenamer is implemented by a Replica that can rename files, which the queue does when a
+// segment stops being the last one. The file is copied again in full under its new name
+// otherwise.
+type ReplicaRenamer interface {
+	// Rename renames the file oldName to newName, replacing newName if it exists.
+	Rename(oldName, newName string) error
+}
+
+// ReplicationMode decides when writes to the queue reach its Replica.
+type ReplicationMode int
+
+const (
+	// ReplicateAsync copies changes to the replica in the background, shortly after they are
+	// made. Changes made just before a host failure may be missing from the replica.
+	ReplicateAsync ReplicationMode = iota
+	// ReplicateSync writes every record appended to a segment to the replica before the call
+	// appending it returns, and syncs the replica whenever the queue syncs a segment, so the
+	// replica is as durable as the queue under its SyncPolicy. New, deleted and compacted
+	// segment files are still copied in the background, so a replica may hold a segment that
+	// was already drained and deleted, but never one with items that were removed.
+	ReplicateSync
+)
+
+// replicationPollInterval is how often the replica is brought up to date in the background
+// when nothing woke the replicator, for changes such as reservations that don't signal.
+const replicationPollInterval = time.Second
+
+// replicationChunkSize bounds the size of a single Replica.Write when copying files.
+const replicationChunkSize = 1 << 20
+
+// replicator keeps a Replica up to date with the files of a queue folder. It remembers how much
+// of every file the replica holds, so that only appended bytes are copied, and copies a file in
+// full when it was replaced, as compaction does.
+type replicator struct {
+	mutex   sync.Mutex
+	replica Replica
+	mode    ReplicationMode
+	// folderPath is the queue folder, which Move changes.
+	folderPath string
+	naming     SegmentNaming
+	files      map[string]replicatedFile
+	// listed is set once the files the replica held to begin with were added to files.
+	listed bool
+}
+
+type replicatedFile struct {
+	// info is the file as it was last copied, or nil if it is only known from Replica.Files.
+	info os.FileInfo
+	size int64
+}
+
+func newReplicator(replica Replica, mode ReplicationMode, folderPath string, naming SegmentNaming) *replicator {
+	return &replicator{replica: replica, mode: mode, folderPath: folderPath, naming: naming, files: map[string]replicatedFile{}}
+}
+
+// isReplicatedFile reports whether a file of the queue folder is copied to the replica:
+// segments, scheduled segments, consumer group cursors, transaction commit markers and the
+// cold storage manifest. Lock and temporary files aren't.
+func (r *replicator) isReplicatedFile(name string) bool {
+	if group := strings.TrimPrefix(name, groupsFolder+"/"); group != name {
+		return strings.HasSuffix(group, groupCursorExtension) && validGroupName(strings.TrimSuffix(group, groupCursorExtension))
+	}
+	base := strings.TrimPrefix(name, scheduledFolder+"/")
+	if _, ok := r.naming.parse(base); ok {
+		return true
+	}
+	if base != name {
+		return false
+	}
+	return name == coldManifestFilename || (strings.HasPrefix(name, "fanout-") && strings.HasSuffix(name, ".commit"))
+}
+
+// appended copies a record just written to filePath at offset, under ReplicateSync.
+func (r *replicator) appended(filePath string, offset int64, data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name, ok := r.nameLocked(filePath)
+	if !ok {
+		return nil
+	}
+	if known, ok := r.files[name]; ok && known.info != nil && known.size == offset {
+		if err := r.replica.Write(name, offset, data); err != nil {
+			// Copied in full by the next catch-up, as it is unknown what the replica holds.
+			delete(r.files, name)
+			return errors.Wrap(err, "failed to replicate write")
+		}
+		known.size += int64(len(data))
+		r.files[name] = known
+		return nil
+	}
+	// The replica is behind, or the file was copied along with the record already.
+	return errors.Wrap(r.catchUpFileLocked(name), "failed to replicate write")
+}
+
+// renamed renames a file in the replica after it was renamed from oldPath to newPath, if the
+// replica is a ReplicaRenamer and holds the file. It is otherwise copied by the next catch-up.
+func (r *replicator) renamed(oldPath, newPath string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	oldName, ok := r.nameLocked(oldPath)
+	if !ok {
+		return nil
+	}
+	newName, ok := r.nameLocked(newPath)
+	if !ok {
+		return nil
+	}
+	known, ok := r.files[oldName]
+	renamer, canRename := r.replica.(ReplicaRenamer)
+	if !ok || !canRename {
+		return nil
+	}
+	delete(r.files, oldName)
+	if err := renamer.Rename(oldName, newName); err != nil {
+		return errors.Wrap(err, "failed to rename replica file")
+	}
+	r.files[newName] = known
+	return nil
+}
+
+// sync syncs the replica, under ReplicateSync.
+func (r *replicator) sync() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return errors.Wrap(r.replica.Sync(), "failed to sync replica")
+}
+
+func (r *replicator) setFolder(folderPath string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.folderPath = folderPath
+}
+
+func (r *replicator) nameLocked(filePath string) (string, bool) {
+	rel, err := filepath.Rel(r.folderPath, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	name := filepath.ToSlash(rel)
+	return name, r.isReplicatedFile(name)
+}
+
+// catchUp brings the replica up to date with the queue folder: files that grew have the new
+// bytes copied, files that were replaced or are new are copied in full, and files that were
+// deleted are removed. Files only known from Replica.Files are copied in full unless their
+// size matches.
+func (r *replicator) catchUp() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.listed {
+		sizes, err := r.replica.Files()
+		if err != nil {
+			return errors.Wrap(err, "failed to list replica files")
+		}
+		for name, size := range sizes {
+			if _, ok := r.files[name]; !ok && r.isReplicatedFile(name) {
+				r.files[name] = replicatedFile{size: size}
+			}
+		}
+		r.listed = true
+	}
+	local, err := r.listLocked()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.catchUpFileLocked(name); err != nil {
+			return err
+		}
+	}
+	for name := range r.files {
+		if _, ok := local[name]; ok {
+			continue
+		}
+		if err := r.replica.Remove(name); err != nil {
+			return errors.Wrapf(err, "failed to remove %s from replica", name)
+		}
+		delete(r.files, name)
+	}
+	return errors.Wrap(r.replica.Sync(), "failed to sync replica")
+}
+
+// listLocked returns the replicated files of the queue folder.
+func (r *replicator) listLocked() (map[string]bool, error) {
+	local := map[string]bool{}
+	for _, dir := range []string{"", scheduledFolder, groupsFolder} {
+		entries, err := os.ReadDir(filepath.Join(r.folderPath, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read queue folder")
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			if !entry.IsDir() && r.isReplicatedFile(name) {
+				local[name] = true
+			}
+		}
+	}
+	return local, nil
+}
+
+// catchUpFileLocked copies what the replica is missing of a file. A file deleted in the
+// meantime is left for catchUp to remove.
+func (r *replicator) catchUpFileLocked(name string) error {
+	file, err := os.Open(filepath.Join(r.folderPath, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to open %s", name)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", name)
+	}
+
+	from := int64(0)
+	if known, ok := r.files[name]; ok {
+		unchanged := known.info == nil && known.size == info.Size()
+		grown := known.info != nil && os.SameFile(known.info, info) && known.size <= info.Size()
+		if unchanged || grown {
+			if known.size == info.Size() {
+				r.files[name] = replicatedFile{info: info, size: known.size}
+				return nil
+			}
+			from = known.size
+		}
+	}
+	if _, err := file.Seek(from, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+	// Copying starts over if it fails partway.
+	delete(r.files, name)
+	buf := make([]byte, replicationChunkSize)
+	offset := from
+	for {
+		n, err := file.Read(buf)
+		if n > 0 || offset == 0 {
+			if err := r.replica.Write(name, offset, buf[:n]); err != nil {
+				return errors.Wrapf(err, "failed to copy %s to replica", name)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+	}
+	r.files[name] = replicatedFile{info: info, size: offset}
+	return nil
+}
+
+// replicateLocked forwards the bytes written to the segment file at offset to the replica under
+// ReplicateSync.
+func (s *segment[T]) replicateLocked(offset int64, buf []byte) error {
+	if r := s.options.replicator; r != nil && r.mode == ReplicateSync && !s.readOnly {
+		return r.appended(s.filePath(), offset, buf)
+	}
+	return nil
+}
+
+// startReplication brings the replica up to date with the files loaded by NewQueue, then keeps
+// it so in the background. Under ReplicateAsync, failing to reach the replica is only logged,
+// as it is retried in the background.
+func (q *Queue[T]) startReplication() error {
+	r := newReplicator(q.options.Replica, q.options.ReplicationMode, q.options.FolderPath, q.options.SegmentNaming)
+	q.options.replicator = r
+	q.schedule.options.replicator = r
+	if err := r.catchUp(); err != nil {
+		if q.options.ReplicationMode == ReplicateSync {
+			return errors.Wrap(err, "failed to replicate queue")
+		}
+		q.options.logger().Warn("replication failed", "folder", q.options.FolderPath, "err", err)
+	}
+	q.background.Add(1)
+	go q.runReplication()
+	return nil
+}
+
+// runReplication brings the replica up to date whenever the queue changes, until the queue is
+// closed.
+func (q *Queue[T]) runReplication() {
+	defer q.background.Done()
+	ticker := time.NewTicker(replicationPollInterval)
+	defer ticker.Stop()
+	for {
+		added, removed, sealed := q.added.wait(), q.removed.wait(), q.sealed.wait()
+		if err := q.options.replicator.catchUp(); err != nil {
+			q.options.logger().Warn("replication failed", "folder", q.options.FolderPath, "err", err)
+		}
+		select {
+		case <-q.closed:
+			return
+		case <-added:
+		case <-removed:
+		case <-sealed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewDirReplica returns a Replica writing to folderPath, typically on another disk or a network
+// file system, which a standby process opens as a queue to take over. Files are created with
+// mode, and folders with mode plus the execute bit wherever the read bit is set.
+func NewDirReplica(folderPath string, mode os.FileMode) Replica {
+	return &dirReplica{folderPath: folderPath, mode: fileModeFor(mode), open: map[string]*replicaFile{}}
+}
+
+type dirReplica struct {
+	folderPath string
+	mode       os.FileMode
+	// open holds the files written since the last Sync.
+	open map[string]*replicaFile
+}
+
+type replicaFile struct {
+	file *os.File
+	size int64
+}
+
+func (d *dirReplica) Files() (map[string]int64, error) {
+	files := map[string]int64{}
+	for _, dir := range []string{"", scheduledFolder, groupsFolder} {
+		entries, err := os.ReadDir(filepath.Join(d.folderPath, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			files[path.Join(dir, entry.Name())] = info.Size()
+		}
+	}
+	return files, nil
+}
+
+func (d *dirReplica) Write(name string, offset int64, data []byte) error {
+	f, ok := d.open[name]
+	if !ok {
+		filePath := filepath.Join(d.folderPath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), dirModeFor(d.mode)); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, d.mode)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		f = &replicaFile{file: file, size: info.Size()}
+		d.open[name] = f
+	}
+	if f.size != offset {
+		if err := f.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.WriteAt(data, offset)
+	f.size = offset + int64(n)
+	return err
+}
+
+func (d *dirReplica) Remove(name string) error {
+	if f, ok := d.open[name]; ok {
+		f.file.Close()
+		delete(d.open, name)
+	}
+	if err := os.Remove(filepath.Join(d.folderPath, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *dirReplica) Rename(oldName, newName string) error {
+	if f, ok := d.open[oldName]; ok {
+		delete(d.open, oldName)
+		if err := f.file.Sync(); err != nil {
+			f.file.Close()
+			return err
+		}
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(filepath.Join(d.folderPath, filepath.FromSlash(oldName)), filepath.Join(d.folderPath, filepath.FromSlash(newName)))
+}
+
+func (d *dirReplica) Sync() error {
+	for name, f := range d.open {
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		delete(d.open, name)
+	}
+	for _, dir := range []string{d.folderPath, filepath.Join(d.folderPath, scheduledFolder), filepath.Join(d.folderPath, groupsFolder)} {
+		if err := syncDir(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
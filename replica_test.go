@@ -0,0 +1,85 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueReplicaAsync(t *testing.T) {
+	replicaDir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+
+	// Items enqueued before replication was set up are caught up with.
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("later", time.Hour)))
+	assert.Nil(t, queue.Close())
+
+	opts.Replica = koyori.NewDirReplica(replicaDir, os.ModePerm)
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"d", "e"})))
+	assertDequeueMany(t, queue, 2, []string{"b", "c"})
+	assert.Nil(t, queue.Close())
+
+	standbyOpts := opts
+	standbyOpts.FolderPath = replicaDir
+	standbyOpts.Replica = nil
+	standby, err := koyori.NewQueue(standbyOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, standby.ScheduledLen())
+	assertDequeueMany(t, standby, 10, []string{"d", "e"})
+	assert.Nil(t, standby.Close())
+}
+
+func TestQueueReplicaSync(t *testing.T) {
+	replicaDir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+		Replica:              koyori.NewDirReplica(replicaDir, os.ModePerm),
+		ReplicationMode:      koyori.ReplicateSync,
+		WriteBufferSize:      1 << 10,
+		AlwaysFlush:          true,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+	assertDequeue(t, queue, "a")
+
+	// The replica is up to date as soon as the calls return. It is copied as the queue still
+	// writes to it.
+	copyDir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	assert.Nil(t, os.MkdirAll(copyDir, os.ModePerm))
+	entries, err := os.ReadDir(replicaDir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(replicaDir, entry.Name()))
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(copyDir, entry.Name()), data, os.ModePerm))
+	}
+	standbyOpts := opts
+	standbyOpts.FolderPath = copyDir
+	standbyOpts.Replica = nil
+	standby, err := koyori.NewQueue(standbyOpts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, standby, 10, []string{"b", "c"})
+	assert.Nil(t, standby.Close())
+
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,161 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+// RetryPolicy decides when items whose handling failed, as reported by Delivery.Retry and
+// Batch.Retry, are delivered again. Items that wait for a retry are kept apart from the queue
+// like items added by EnqueueAt, along with their metadata and the number of past deliveries,
+// which are kept across restarts.
+type RetryPolicy struct {
+	// InitialDelay is how long an item waits after its first failed delivery. If unset, items
+	// are put back in their places right away, like Nack does.
+	InitialDelay time.Duration
+	// Multiplier scales the delay after every further failed delivery. It defaults to 2.
+	Multiplier float64
+	// MaxDelay, if positive, caps the delay.
+	MaxDelay time.Duration
+	// MaxAttempts, if positive, gives up on items that failed this many times, moving them to
+	// QueueOptions.DeadLetterQueue, or dropping them if that isn't set.
+	MaxAttempts int
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.InitialDelay > 0 || p.MaxAttempts > 0
+}
+
+// delay returns how long an item waits after its delivery number attempts failed.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay := float64(p.InitialDelay)
+	for i := 1; i < attempts && (p.MaxDelay <= 0 || delay < float64(p.MaxDelay)); i++ {
+		delay *= multiplier
+		if delay >= math.MaxInt64 {
+			return math.MaxInt64
+		}
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// Retry reports that handling the item failed. Under QueueOptions.RetryPolicy, the item is
+// removed from the queue and added back once its delay passed, or given up on after too many
+// attempts. Otherwise, it is put back in its place like Nack does.
+//
+// If the process dies while the item is moved, it may be delivered twice.
+func (d Delivery[T]) Retry() error {
+	q := d.queue
+	if !q.options.RetryPolicy.enabled() {
+		return d.Nack()
+	}
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != d.segmentNumber {
+		return ErrDeliveryDone
+	}
+	return q.retryLocked([]T{d.Item}, []int{d.index}, []uint64{d.reservation})
+}
+
+// Retry reports that handling the items of the batch failed, and handles each of them like
+// Delivery.Retry does.
+func (b Batch[T]) Retry() error {
+	q := b.queue
+	if !q.options.RetryPolicy.enabled() {
+		return b.Rollback()
+	}
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if q.firstSegment.segmentNumber != b.segmentNumber {
+		return ErrDeliveryDone
+	}
+	return q.retryLocked(b.Items, b.indexes, b.reservations)
+}
+
+// retryLocked schedules reserved items of the first segment to be delivered again, or gives up
+// on them, under RetryPolicy. The items that are moved away are removed from the segment, while
+// the others are put back in their places. The caller holds headMutex.
+func (q *Queue[T]) retryLocked(items []T, indexes []int, reservations []uint64) error {
+	seg := q.firstSegment
+	envs, err := seg.reservedEnvelopes(indexes, reservations)
+	if err == errNotReserved {
+		return ErrDeliveryDone
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read reserved items")
+	}
+	policy := q.options.RetryPolicy
+	now := q.options.now()
+	var ackIndexes, nackIndexes []int
+	var ackReservations, nackReservations []uint64
+	var moveErr error
+	for i, env := range envs {
+		moved := false
+		if moveErr == nil {
+			moved, moveErr = q.moveFailedLocked(items[i], env, policy, now)
+		}
+		if moved {
+			ackIndexes = append(ackIndexes, indexes[i])
+			ackReservations = append(ackReservations, reservations[i])
+		} else {
+			nackIndexes = append(nackIndexes, indexes[i])
+			nackReservations = append(nackReservations, reservations[i])
+		}
+	}
+	if len(ackIndexes) > 0 {
+		if err := seg.ackMany(ackIndexes, ackReservations); err != nil {
+			return errors.Wrap(err, "failed to remove retried items")
+		}
+		q.emit(Event{Type: EventDequeue, Count: len(ackIndexes)})
+	}
+	if len(nackIndexes) > 0 {
+		if err := seg.nackMany(nackIndexes, nackReservations); err != nil {
+			return errors.Wrap(err, "failed to put back items")
+		}
+	}
+	// Items after the removed ones may only be reachable now.
+	q.notifyAdded()
+	if moveErr != nil {
+		return moveErr
+	}
+	return q.closeDrainedSegmentsLocked()
+}
+
+// moveFailedLocked schedules an item whose delivery failed to be delivered again, or moves it to
+// DeadLetterQueue after too many attempts. It reports whether the item is to be removed from the
+// queue: items retried right away stay in place, and so do items the dead letter queue failed
+// to take, which are retried rather than lost.
+func (q *Queue[T]) moveFailedLocked(item T, env envelope, policy RetryPolicy, now time.Time) (bool, error) {
+	if policy.MaxAttempts > 0 && env.attempts >= policy.MaxAttempts {
+		if dlq := q.options.DeadLetterQueue; dlq != nil {
+			env.sequence = 0
+			if _, err := dlq.enqueueEnvelope(item, env); err != nil {
+				q.options.logger().Warn("failed to move item to dead letter queue", "folder", q.options.FolderPath, "err", err)
+				return false, nil
+			}
+		}
+		q.options.logger().Warn("gave up on item", "folder", q.options.FolderPath, "attempts", env.attempts)
+		return true, nil
+	}
+	if policy.InitialDelay <= 0 {
+		return false, nil
+	}
+	if err := q.schedule.add(item, now.Add(policy.delay(env.attempts)), env.sequence, &env); err != nil {
+		return false, errors.Wrap(err, "failed to schedule retry")
+	}
+	return true, nil
+}
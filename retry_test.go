@@ -0,0 +1,104 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeliveryRetry(t *testing.T) {
+	newOpts := func() koyori.QueueOptions[string] {
+		return koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 3,
+		}
+	}
+	dlq, err := koyori.NewQueue(newOpts())
+	assert.Nil(t, err)
+	opts := newOpts()
+	opts.DeadLetterQueue = dlq
+	opts.RetryPolicy = koyori.RetryPolicy{InitialDelay: 20 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueWithHeaders("a", map[string]string{"trace": "1"})))
+	assert.Nil(t, enqueueErr(queue.Enqueue("b")))
+
+	reserveWhenDue := func(queue *koyori.Queue[string]) koyori.Delivery[string] {
+		var delivery koyori.Delivery[string]
+		assert.Eventually(t, func() bool {
+			var err error
+			delivery, err = queue.Reserve()
+			return err == nil
+		}, 5*time.Second, 5*time.Millisecond)
+		return delivery
+	}
+
+	// A failed item waits for its delay apart from the queue, letting later items through.
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Nil(t, delivery.Retry())
+	assert.Equal(t, 1, queue.ScheduledLen())
+	assertDequeue(t, queue, "b")
+	_, err = queue.Reserve()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+
+	delivery = reserveWhenDue(queue)
+	assert.Equal(t, "a", delivery.Item)
+	assert.Equal(t, 2, delivery.Attempts)
+	start := time.Now()
+	assert.Nil(t, delivery.Retry())
+
+	// The attempts are kept across restarts, as are the headers.
+	assert.Nil(t, queue.Close())
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	delivery = reserveWhenDue(queue)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, "a", delivery.Item)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Nil(t, delivery.Retry())
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, 0, queue.ScheduledLen())
+
+	msg, err := dlq.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", msg.Item)
+	assert.Equal(t, map[string]string{"trace": "1"}, msg.Headers)
+
+	// A delivery that was given up on is done.
+	assert.ErrorIs(t, delivery.Retry(), koyori.ErrDeliveryDone)
+	assert.Nil(t, queue.Close())
+	assert.Nil(t, dlq.Close())
+}
+
+func TestBatchRetry(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		RetryPolicy:          koyori.RetryPolicy{MaxAttempts: 2},
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+
+	// Without InitialDelay, failed items are put back in place until they are given up on.
+	batch, err := queue.BeginDequeue(1)
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Retry())
+	batch, err = queue.BeginDequeue(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, batch.Items)
+	assert.Nil(t, batch.Retry())
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "b")
+	assert.Nil(t, queue.Close())
+}
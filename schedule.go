@@ -0,0 +1,431 @@
+package koyori
+
+import (
+	"container/heap"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scheduledFolder is the subfolder of the queue folder holding items that aren't due yet.
+const scheduledFolder = "scheduled"
+
+// EnqueueAt adds item to the queue once t has passed. Until then, the item is kept apart from
+// the queue and isn't counted by Len or visited by Iter.
+//
+// Due items are moved to the end of the queue by the next Dequeue or Reserve call, in the order
+// they became due. If the process dies while items are moved, they may end up in the queue twice.
+//
+// The item is numbered when it is scheduled, as if it was enqueued right away, and EnqueueAt
+// returns its sequence number like Enqueue.
+func (q *Queue[T]) EnqueueAt(item T, t time.Time) (uint64, error) {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	if err := q.checkAcceptingLocked(); err != nil {
+		return 0, err
+	}
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+	sequence := q.nextSequence
+	if err := q.schedule.add(item, t, sequence, nil); err != nil {
+		return 0, errors.Wrap(err, "failed to schedule item")
+	}
+	q.nextSequence++
+	return sequence, nil
+}
+
+// EnqueueAfter adds item to the queue once delay has passed. See EnqueueAt.
+func (q *Queue[T]) EnqueueAfter(item T, delay time.Duration) (uint64, error) {
+	return q.EnqueueAt(item, q.options.now().Add(delay))
+}
+
+// ScheduledLen returns the number of items added by EnqueueAt that aren't in the queue yet.
+func (q *Queue[T]) ScheduledLen() int {
+	q.headMutex.Lock()
+	defer q.headMutex.Unlock()
+
+	return len(q.schedule.due)
+}
+
+// promoteDueLocked moves the scheduled items that are due to the end of the queue.
+func (q *Queue[T]) promoteDueLocked() error {
+	items := q.schedule.popDue(q.options.now())
+	if len(items) == 0 {
+		return nil
+	}
+	objects := make([]T, len(items))
+	envs := make([]*envelope, len(items))
+	sequences := make([]uint64, len(items))
+	for i, item := range items {
+		if err := q.schedule.decode(item, &objects[i]); err != nil {
+			q.schedule.pushBack(items)
+			return errors.Wrap(err, "failed to read scheduled item")
+		}
+		envs[i], sequences[i] = q.schedule.envelope(item)
+	}
+	q.tailMutex.Lock()
+	err := q.enqueueDueLocked(objects, envs, sequences)
+	q.tailMutex.Unlock()
+	if err != nil {
+		q.schedule.pushBack(items)
+		return errors.Wrap(err, "failed to enqueue scheduled items")
+	}
+	return errors.Wrap(q.schedule.remove(items), "failed to remove scheduled items")
+}
+
+// enqueueDueLocked adds due items to the end of the queue, in order, those with metadata to
+// keep in envelopes, keeping the sequence numbers they were scheduled with. The caller holds
+// tailMutex.
+func (q *Queue[T]) enqueueDueLocked(objects []T, envs []*envelope, sequences []uint64) error {
+	for start := 0; start < len(objects); {
+		if envs[start] != nil {
+			if _, err := q.enqueueEnvelopeLocked(objects[start], *envs[start]); err != nil {
+				return err
+			}
+			start++
+			continue
+		}
+		// Runs of consecutive numbers are added at once.
+		end := start + 1
+		for end < len(objects) && envs[end] == nil && sequences[end] == nthSequence(sequences[start], end-start) {
+			end++
+		}
+		if err := q.enqueueManyLocked(objects[start:end], sequences[start]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// schedule holds the items added by EnqueueAt in a chain of segments of their own. All of them
+// are loaded, with their items indexed by due time. Only the last one is kept open for writing.
+type schedule[T any] struct {
+	options    QueueOptions[T]
+	segments   map[int]*segment[T]
+	last       *segment[T]
+	lastNumber int
+	due        dueHeap[T]
+	// unsynced holds the segments closed with writes that weren't synced yet.
+	unsynced map[int]bool
+}
+
+type dueItem[T any] struct {
+	dueAt time.Time
+	seg   *segment[T]
+	index int
+}
+
+// dueHeap orders scheduled items by due time, then by the order they were added in.
+type dueHeap[T any] []dueItem[T]
+
+func (h dueHeap[T]) Len() int { return len(h) }
+
+func (h dueHeap[T]) Less(i, j int) bool {
+	if !h[i].dueAt.Equal(h[j].dueAt) {
+		return h[i].dueAt.Before(h[j].dueAt)
+	}
+	if h[i].seg != h[j].seg {
+		return h[i].seg.segmentNumber < h[j].seg.segmentNumber
+	}
+	return h[i].index < h[j].index
+}
+
+func (h dueHeap[T]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *dueHeap[T]) Push(x any) { *h = append(*h, x.(dueItem[T])) }
+
+func (h *dueHeap[T]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func loadSchedule[T any](options QueueOptions[T]) (*schedule[T], error) {
+	options.FolderPath = filepath.Join(options.FolderPath, scheduledFolder)
+	// Scheduled items aren't removed from the head, and keep using deletion markers.
+	options.HeadFile, options.headFile = false, nil
+	sc := &schedule[T]{options: options, segments: map[int]*segment[T]{}, unsynced: map[int]bool{}}
+	if _, err := os.Stat(options.FolderPath); os.IsNotExist(err) {
+		return sc, nil
+	}
+	numbers, err := listSegments(options.FolderPath, options.SegmentNaming, options.logger())
+	if err != nil {
+		return nil, errors.Wrap(err, "error while reading scheduled items directory")
+	}
+	loaded := make([]*segment[T], len(numbers))
+	err = runParallel(options.LoadConcurrency, len(numbers), func(i int) error {
+		seg, err := readSegment(numbers[i], &sc.options)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read scheduled segment (#%d)", numbers[i])
+		}
+		loaded[i] = seg
+		if i == len(numbers)-1 {
+			return nil
+		}
+		// Only the last segment is written to.
+		return errors.Wrap(seg.close(), "failed to close segment file")
+	})
+	if err != nil {
+		for _, seg := range loaded {
+			if seg != nil {
+				seg.close()
+			}
+		}
+		return nil, err
+	}
+	for i, number := range numbers {
+		seg := loaded[i]
+		sc.segments[number] = seg
+		if i == len(numbers)-1 {
+			sc.last, sc.lastNumber = seg, number
+			sc.pushEntries(seg)
+			continue
+		}
+		if len(seg.entries) == 0 {
+			// Drained, but not deleted yet when the queue was closed
+			if err := sc.deleteSegment(seg); err != nil {
+				sc.close()
+				return nil, err
+			}
+			continue
+		}
+		sc.pushEntries(seg)
+	}
+	heap.Init(&sc.due)
+	return sc, nil
+}
+
+func (sc *schedule[T]) pushEntries(seg *segment[T]) {
+	for _, e := range seg.entries {
+		sc.due = append(sc.due, dueItem[T]{dueAt: e.dueAt, seg: seg, index: e.index})
+	}
+}
+
+// add schedules an object numbered sequence to become due at dueAt, along with the metadata of
+// env if it isn't nil.
+func (sc *schedule[T]) add(object T, dueAt time.Time, sequence uint64, env *envelope) error {
+	if sc.last == nil || sc.last.full() {
+		if err := sc.addSegment(); err != nil {
+			return err
+		}
+	}
+	if err := sc.last.addScheduled(object, dueAt, sequence, env); err != nil {
+		return err
+	}
+	last := sc.last.lastEntry()
+	heap.Push(&sc.due, dueItem[T]{dueAt: dueAt, seg: sc.last, index: last.index})
+	return nil
+}
+
+func (sc *schedule[T]) addSegment() error {
+	if err := os.MkdirAll(sc.options.FolderPath, sc.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create scheduled items folder")
+	}
+	seg, err := newSegment(sc.options.MaxObjectsPerSegment, sc.lastNumber+1, false, 0, &sc.options)
+	if err != nil {
+		return errors.Wrap(err, "failed to add new segment")
+	}
+	previous := sc.last
+	sc.segments[seg.segmentNumber] = seg
+	sc.last, sc.lastNumber = seg, seg.segmentNumber
+	if previous == nil {
+		return nil
+	}
+	unsynced, err := previous.closeUnsynced()
+	if err != nil {
+		return errors.Wrap(err, "failed to close segment file")
+	}
+	if unsynced {
+		sc.unsynced[previous.segmentNumber] = true
+	}
+	if previous.count() == 0 {
+		return sc.deleteSegment(previous)
+	}
+	return nil
+}
+
+// popDue takes the items due at now off the heap, in the order they became due.
+func (sc *schedule[T]) popDue(now time.Time) []dueItem[T] {
+	items := []dueItem[T]{}
+	for len(sc.due) > 0 && !sc.due[0].dueAt.After(now) {
+		items = append(items, heap.Pop(&sc.due).(dueItem[T]))
+	}
+	return items
+}
+
+func (sc *schedule[T]) pushBack(items []dueItem[T]) {
+	for _, item := range items {
+		heap.Push(&sc.due, item)
+	}
+}
+
+func (sc *schedule[T]) decode(item dueItem[T], dst *T) error {
+	seg := item.seg
+	pos := seg.positionLocked(item.index)
+	if pos < 0 {
+		return errors.Errorf("scheduled item %d of segment (#%d) not found", item.index, seg.segmentNumber)
+	}
+	err := seg.decodeLocked(&seg.entries[pos], dst)
+	if seg != sc.last {
+		if closeErr := seg.closeReaderLocked(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// envelope returns the metadata a scheduled item keeps when it is moved to the queue, which
+// only items scheduled again by Delivery.Retry have, or nil if it has none, along with its
+// sequence number.
+func (sc *schedule[T]) envelope(item dueItem[T]) (*envelope, uint64) {
+	pos := item.seg.positionLocked(item.index)
+	if pos < 0 {
+		return nil, 0
+	}
+	e := &item.seg.entries[pos]
+	if e.attempts == 0 && e.meta == nil {
+		return nil, e.sequence
+	}
+	env := &envelope{enqueuedAt: e.enqueuedAt, attempts: e.attempts, sequence: e.sequence}
+	if e.meta != nil {
+		env.headers, env.priority = e.meta.headers, e.meta.priority
+	}
+	return env, e.sequence
+}
+
+// remove records the removal of items, deleting the segments it drains.
+func (sc *schedule[T]) remove(items []dueItem[T]) error {
+	indexes := map[*segment[T]][]int{}
+	order := []*segment[T]{}
+	for _, item := range items {
+		if _, ok := indexes[item.seg]; !ok {
+			order = append(order, item.seg)
+		}
+		indexes[item.seg] = append(indexes[item.seg], item.index)
+	}
+	for _, seg := range order {
+		if err := sc.dropIndexes(seg, indexes[seg]); err != nil {
+			return errors.Wrapf(err, "failed to remove items of segment (#%d)", seg.segmentNumber)
+		}
+	}
+	return nil
+}
+
+func (sc *schedule[T]) dropIndexes(seg *segment[T], indexes []int) error {
+	if seg == sc.last {
+		return seg.dropIndexesLocked(indexes)
+	}
+	file, err := os.OpenFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, sc.options.FileMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to open segment file")
+	}
+	seg.file = file
+	err = seg.dropIndexesLocked(indexes)
+	if err == nil {
+		err = seg.writePendingLocked()
+	}
+	if err == nil && seg.unsynced > 0 {
+		if seg.options.syncPolicy().Mode == SyncManual {
+			sc.unsynced[seg.segmentNumber] = true
+		} else {
+			err = seg.flushLocked()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = errors.Wrap(closeErr, "failed to close segment file")
+	}
+	if err != nil {
+		return err
+	}
+	if len(seg.entries) == 0 {
+		return sc.deleteSegment(seg)
+	}
+	return nil
+}
+
+// deleteSegment deletes a segment that isn't open for writing.
+func (sc *schedule[T]) deleteSegment(seg *segment[T]) error {
+	delete(sc.segments, seg.segmentNumber)
+	delete(sc.unsynced, seg.segmentNumber)
+	if err := seg.closeReaderLocked(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	return errors.Wrap(os.Remove(seg.filePath()), "failed to delete file")
+}
+
+// clear deletes every scheduled item.
+func (sc *schedule[T]) clear() error {
+	if err := sc.close(); err != nil {
+		return err
+	}
+	for number, seg := range sc.segments {
+		delete(sc.segments, number)
+		if err := os.Remove(seg.filePath()); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to delete scheduled segment (#%d)", number)
+		}
+	}
+	sc.last = nil
+	sc.due = nil
+	sc.unsynced = map[int]bool{}
+	return nil
+}
+
+// flush syncs the scheduled segments and their folder.
+func (sc *schedule[T]) flush() error {
+	if sc.last == nil {
+		return nil
+	}
+	if err := sc.last.flush(); err != nil {
+		return errors.Wrap(err, "failed to flush segment")
+	}
+	for number := range sc.unsynced {
+		if err := syncFile(filepath.Join(sc.options.FolderPath, sc.options.SegmentNaming.filename(number)), sc.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to flush segment (#%d)", number)
+		}
+		delete(sc.unsynced, number)
+	}
+	return errors.Wrap(syncDir(sc.options.FolderPath), "failed to sync folder")
+}
+
+func (sc *schedule[T]) close() error {
+	if sc.last == nil {
+		return nil
+	}
+	return errors.Wrap(sc.last.close(), "failed to close scheduled segment file")
+}
+
+// addScheduled adds an object numbered sequence that becomes due at dueAt, in an envelope record
+// holding env if it isn't nil.
+func (s *segment[T]) addScheduled(object T, dueAt time.Time, sequence uint64, env *envelope) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.fullLocked() {
+		return errors.New("segment is full")
+	}
+	if err := s.writeRecordLocked(recordKindControl, encodeDueControl(dueAt)); err != nil {
+		return errors.Wrap(err, "failed to write due time")
+	}
+	if env != nil {
+		scheduled := *env
+		scheduled.sequence = sequence
+		if err := s.addEnvelopeLocked(object, scheduled); err != nil {
+			return err
+		}
+	} else if _, err := s.addRecordsLocked([]T{object}, time.Time{}, sequence); err != nil {
+		return err
+	}
+	s.entries[len(s.entries)-1].dueAt = dueAt
+	return errors.Wrap(s.syncAfterWriteLocked(), "failed to sync")
+}
+
+func (s *segment[T]) lastEntry() entry[T] {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.entries[len(s.entries)-1]
+}
@@ -0,0 +1,51 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueEnqueueAt(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	now := time.Now()
+	assert.Nil(t, enqueueErr(queue.EnqueueAt("later", now.Add(time.Hour))))
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("soon2", 150*time.Millisecond)))
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("soon1", 100*time.Millisecond)))
+	assert.Nil(t, enqueueErr(queue.EnqueueAt("past", now.Add(-time.Second))))
+	assert.Nil(t, enqueueErr(queue.Enqueue("now")))
+	assert.Equal(t, 4, queue.ScheduledLen())
+	assert.Equal(t, 1, queue.Len())
+
+	assertDequeueMany(t, queue, 2, []string{"now", "past"})
+	_, err = queue.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, queue.Close())
+
+	// Scheduled items survive a restart
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, queue.ScheduledLen())
+	time.Sleep(200 * time.Millisecond)
+	assertDequeueMany(t, queue, 2, []string{"soon1", "soon2"})
+	assert.Equal(t, 1, queue.ScheduledLen())
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.ScheduledLen())
+	assert.Nil(t, queue.Clear())
+	assert.Equal(t, 0, queue.ScheduledLen())
+	assert.Nil(t, queue.Close())
+}
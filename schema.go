@@ -0,0 +1,98 @@
+package koyori
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+)
+
+// schemaFlags returns the header flags of new segments holding items encoded by converter.
+func schemaFlags[T any](converter Converter[T]) uint32 {
+	if _, ok := converter.(VersionedConverter[T]); ok {
+		return segmentFlagSchemaVersion
+	}
+	return 0
+}
+
+// schemaVersionOf returns the schema version of the items converter encodes, which is 0 for
+// converters that aren't versioned.
+func schemaVersionOf[T any](converter Converter[T]) byte {
+	if v, ok := converter.(VersionedConverter[T]); ok {
+		return v.SchemaVersion()
+	}
+	return 0
+}
+
+// splitSchemaVersion returns the schema version of an item of a segment with the given header
+// flags, and the item as the converter encoded it.
+func splitSchemaVersion(flags uint32, data []byte) (byte, []byte, error) {
+	if flags&segmentFlagSchemaVersion == 0 {
+		return 0, data, nil
+	}
+	if len(data) == 0 {
+		return 0, nil, errors.New("item is missing its schema version")
+	}
+	return data[0], data[1:], nil
+}
+
+// decodeItem decodes an item of a segment with the given header flags, once decompressed.
+func decodeItem[T any](converter Converter[T], flags uint32, data []byte, dst *T) error {
+	version, data, err := splitSchemaVersion(flags, data)
+	if err != nil {
+		return err
+	}
+	return unmarshalVersion(converter, version, data, dst)
+}
+
+// unmarshalVersion decodes an item encoded with the given schema version into dst, through
+// UnmarshalVersion if it is an earlier one than the converter's.
+func unmarshalVersion[T any](converter Converter[T], version byte, data []byte, dst *T) error {
+	var obj T
+	var err error
+	if v, ok := converter.(VersionedConverter[T]); ok && version != v.SchemaVersion() {
+		obj, err = v.UnmarshalVersion(version, data)
+	} else if stream, ok := converter.(StreamConverter[T]); ok {
+		obj, err = stream.UnmarshalFrom(bytes.NewReader(data))
+	} else if into, ok := converter.(IntoUnmarshaler[T]); ok {
+		return into.UnmarshalInto(data, dst)
+	} else {
+		obj, err = converter.Unmarshal(data)
+	}
+	if err != nil {
+		return err
+	}
+	*dst = obj
+	return nil
+}
+
+// upgradeItemLocked returns an item read from the segment as it is written to a copy of the
+// segment with the given header flags. Items of an earlier schema version than the converter's
+// are decoded and encoded again.
+func (s *segment[T]) upgradeItemLocked(data []byte, flags uint32) ([]byte, error) {
+	v, versioned := s.converter.(VersionedConverter[T])
+	if !versioned && flags == s.header.flags {
+		return data, nil
+	}
+	plain, err := decompress(s.header.compression, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress object")
+	}
+	version, plain, err := splitSchemaVersion(s.header.flags, plain)
+	if err != nil {
+		return nil, err
+	}
+	if versioned && version != v.SchemaVersion() {
+		var obj T
+		if err := unmarshalVersion(s.converter, version, plain, &obj); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal object")
+		}
+		return s.marshalWithFlags(obj, flags)
+	}
+	if flags == s.header.flags {
+		return data, nil
+	}
+	if flags&segmentFlagSchemaVersion != 0 {
+		plain = append([]byte{version}, plain...)
+	}
+	data, err = compress(s.header.compression, plain)
+	return data, errors.Wrap(err, "failed to compress object")
+}
@@ -0,0 +1,114 @@
+package koyori_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type schemaItem struct {
+	Name  string
+	Count int
+}
+
+// schemaV0Converter stores only the name of an item, as a bare string.
+type schemaV0Converter struct{}
+
+func (schemaV0Converter) Marshal(obj schemaItem) ([]byte, error) {
+	return []byte(obj.Name), nil
+}
+
+func (schemaV0Converter) Unmarshal(data []byte) (schemaItem, error) {
+	return schemaItem{Name: string(data)}, nil
+}
+
+// schemaV1Converter stores items as JSON, and reads those of schemaV0Converter with a count of 1.
+type schemaV1Converter struct{}
+
+func (schemaV1Converter) Marshal(obj schemaItem) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (schemaV1Converter) Unmarshal(data []byte) (schemaItem, error) {
+	obj := schemaItem{}
+	err := json.Unmarshal(data, &obj)
+	return obj, err
+}
+
+func (schemaV1Converter) SchemaVersion() byte {
+	return 1
+}
+
+func (schemaV1Converter) UnmarshalVersion(version byte, data []byte) (schemaItem, error) {
+	if version != 0 {
+		return schemaItem{}, fmt.Errorf("unknown schema version %d", version)
+	}
+	return schemaItem{Name: string(data), Count: 1}, nil
+}
+
+func readSchemaVersions(t *testing.T, filePath string) []byte {
+	reader, err := koyori.OpenSegment[schemaItem](filePath, nil)
+	assert.Nil(t, err)
+	defer reader.Close()
+	versions := []byte{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return versions
+		}
+		assert.Nil(t, err)
+		if record.Type == koyori.RecordItem {
+			versions = append(versions, record.SchemaVersion)
+		}
+	}
+}
+
+func TestQueueVersionedConverter(t *testing.T) {
+	opts := koyori.QueueOptions[schemaItem]{
+		Converter:            schemaV0Converter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 4,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]schemaItem{{Name: "a"}, {Name: "b"}, {Name: "c"}})))
+	assert.Nil(t, queue.Close())
+
+	// Items aren't appended to the segment of the unversioned converter.
+	opts.Converter = schemaV1Converter{}
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue(schemaItem{Name: "d", Count: 4})))
+	assertDequeue(t, queue, schemaItem{Name: "a", Count: 1})
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, []byte{1}, readSchemaVersions(t, filepath.Join(opts.FolderPath, "00002.queue.open")))
+
+	archive := bytes.Buffer{}
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Export(&archive))
+	// Compacting rewrites the items of the first segment in the current version.
+	assert.Nil(t, queue.Compact())
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, []byte{1, 1}, readSchemaVersions(t, filepath.Join(opts.FolderPath, "00001.queue")))
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 3, []schemaItem{{Name: "b", Count: 1}, {Name: "c", Count: 1}, {Name: "d", Count: 4}})
+	assert.Nil(t, queue.Close())
+
+	opts.FolderPath = filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Import(&archive))
+	assertDequeueMany(t, queue, 3, []schemaItem{{Name: "b", Count: 1}, {Name: "c", Count: 1}, {Name: "d", Count: 4}})
+	assert.Nil(t, queue.Close())
+}
@@ -1,134 +1,1260 @@
 package koyori
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
-	"fmt"
 	"github.com/pkg/errors"
+	"hash/crc32"
 	"io"
 	"os"
-	"path"
-	"regexp"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
+var errNotReserved = errors.New("item is not reserved")
 var errEmptySegment = errors.New("segment is empty")
-var segmentFilenameRegex = regexp.MustCompile(`^(\d+)\.queue`)
+
+const segmentFileExtension = ".queue"
+
+// openSegmentSuffix is appended to the file name of the last segment of a queue, the only one
+// items are added to. The file is renamed without it by seal once a later segment is started,
+// so a file without it is complete, and only the one with it can end in a torn write.
+const openSegmentSuffix = ".open"
 
 type segment[T any] struct {
 	folderPath    string
 	capacity      int
+	header        segmentHeader
 	segmentNumber int
 	file          *os.File
 	converter     Converter[T]
 	removeCount   int
-	objects       []T
-	fileLock      sync.Mutex
-	options       *QueueOptions[T]
+	// unrecordedDrops is the number of items removed from the head whose removal DropBatchSize
+	// holds back from the file.
+	unrecordedDrops int
+	// headDropped is the number of items removed from the head that only the head file records
+	// (see QueueOptions.HeadFile).
+	headDropped int
+	recordBytes int64
+	entries     []entry[T]
+	txns        map[uint64]*pendingTxn[T]
+	fileLock    sync.Mutex
+	options     *QueueOptions[T]
+
+	// foreignCodec is set when the segment was written in another format than new items use.
+	foreignCodec bool
+	// nextIndex is the index the next item added to the segment gets (see entry.index).
+	nextIndex       int
+	reservedCount   int
+	nextReservation uint64
+	// nextSequence is the sequence number the next item record written to the segment is read
+	// with (see controlSequence), and sequenceEnd one past the highest written to it.
+	nextSequence uint64
+	sequenceEnd  uint64
+	// size is the length of the segment file, where the next record will be written.
+	size int64
+	// pending holds the records written to the write buffer, which end at size.
+	pending []byte
+	// unsynced counts the writes since the file was last synced.
+	unsynced int
+	// reader is opened on demand to read items that aren't kept in memory.
+	reader *os.File
+	// mapped holds the segment file as it was when loaded, mapped into memory with UseMmap.
+	// Items written since are read through reader.
+	mapped []byte
+	// readBuf is reused by readItemLocked for views of items read through reader.
+	readBuf []byte
+	// lostIndexes holds the items skipped by RecoverySkip while loading, which stay in entries
+	// until dropLostLocked removes them.
+	lostIndexes []int
+	// readOnly keeps load from modifying the file, for segments loaded only to be read.
+	readOnly bool
+	// open is set while the file name has openSegmentSuffix.
+	open bool
+	// preallocated is set if disk space was reserved past the end of the file, which is
+	// released when the segment is closed.
+	preallocated bool
+	// memoryBytes is the encoded size of the items whose objects are kept in memory.
+	memoryBytes int64
+}
+
+// defaultInMemoryItems is the number of objects a segment keeps in memory unless
+// MaxInMemoryItems is set. Items added to a segment already holding that many, and all items of
+// segments read from disk, are read back from the file when they are removed.
+const defaultInMemoryItems = 1024
+
+// entry is an item held by a segment. Items that are only on disk are read and decoded
+// (into the caller's value) when removed.
+type entry[T any] struct {
+	object T
+	onDisk bool
+	// offset and length locate the encoded item in the segment file.
+	offset     int64
+	length     int
+	enqueuedAt time.Time
+	// index is the position of the item among all items added to the segment. It identifies
+	// the item in acknowledgement records.
+	index    int
+	reserved bool
+	// reservedUntil is the deadline of a reservation under VisibilityTimeout.
+	reservedUntil time.Time
+	// reservation tells apart successive reservations of the same item.
+	reservation uint64
+	// consumer is the ID of the consumer holding the reservation, if given to ReserveAs.
+	consumer string
+	// dueAt is when an item of a scheduled segment may be moved to the queue.
+	dueAt time.Time
+	// attempts counts the past deliveries of the item by Reserve.
+	attempts int
+	// meta is set for items enqueued with headers.
+	meta *itemMeta
+	// sequence is the sequence number of the item, or zero if it has none.
+	sequence uint64
+}
+
+// itemMeta is the metadata an item was enqueued with, besides its enqueue time.
+type itemMeta struct {
+	headers  map[string]string
+	priority int
+}
+
+// fillMessage sets the metadata of msg from the entry, counting the delivery in progress.
+func (e *entry[T]) fillMessage(msg *Message[T]) {
+	msg.EnqueuedAt = e.enqueuedAt
+	msg.Attempts = e.attempts + 1
+	msg.Sequence = e.sequence
+	if e.meta != nil {
+		msg.Headers = e.meta.headers
+		msg.Priority = e.meta.priority
+	}
+}
+
+// pendingTxn is what a transaction whose outcome is not known yet does to the segment: the
+// items it adds and the indexes of the items it removes. The entries of the items it adds are
+// given their indexes once it commits; those written by this process still hold their objects.
+type pendingTxn[T any] struct {
+	items       []entry[T]
+	acks        []int
+	coordinator string
+}
+
+func (s *segment[T]) add(object T, sequence uint64) error {
+	added, err := s.addMany([]T{object}, sequence)
+	if err == nil && added == 0 {
+		return errors.New("segment is full")
+	}
+	return err
+}
+
+// addMany adds objects, numbered from sequence on, until the segment is full and returns how
+// many were added.
+func (s *segment[T]) addMany(objects []T, sequence uint64) (int, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.fullLocked() {
+		return 0, nil
+	}
+	enqueuedAt := time.Time{}
+	if s.options.recordsEnqueueTime() && s.header.version >= segmentFormatV1 {
+		enqueuedAt = s.options.now()
+	}
+	var added int
+	var err error
+	if s.options.BlockSize > 0 && s.header.version >= segmentFormatV1 {
+		added, err = s.addBlocksLocked(objects, enqueuedAt, sequence)
+	} else {
+		added, err = s.addRecordsLocked(objects, enqueuedAt, sequence)
+	}
+	if err != nil && added == 0 {
+		return 0, err
+	}
+	// The items before one that failed to encode were written, and are synced like any others.
+	if syncErr := s.syncAfterWriteLocked(); syncErr != nil {
+		return added, errors.Wrap(syncErr, "failed to sync")
+	}
+	return added, err
+}
+
+// full reports whether the segment reached its item capacity or MaxSegmentBytes.
+func (s *segment[T]) full() bool {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.fullLocked()
+}
+
+func (s *segment[T]) fullLocked() bool {
+	// Items of pending transactions take their places once committed.
+	pending := 0
+	for _, txn := range s.txns {
+		pending += len(txn.items)
+	}
+	if len(s.entries)+s.removeCount+pending >= s.capacity {
+		return true
+	}
+	return s.options.MaxSegmentBytes > 0 && s.size >= s.options.MaxSegmentBytes
+}
+
+// If an object fails to encode, the ones before it are still added.
+func (s *segment[T]) addRecordsLocked(objects []T, enqueuedAt time.Time, sequence uint64) (int, error) {
+	batch := bytes.Buffer{}
+	if !enqueuedAt.IsZero() {
+		appendRecord(&batch, s.header.version, recordKindControl, encodeTimestampControl(enqueuedAt))
+	}
+	s.appendSequenceLocked(&batch, sequence)
+	capacityLeft := s.capacity - len(s.entries) - s.removeCount
+	offsets := []int64{}
+	lengths := []int{}
+	var encodeErr error
+	for i, obj := range objects {
+		if i == capacityLeft || (i > 0 && s.options.MaxSegmentBytes > 0 && s.size+int64(batch.Len()) >= s.options.MaxSegmentBytes) {
+			break
+		}
+		length, err := s.appendItemRecordLocked(&batch, obj)
+		if err != nil {
+			encodeErr = &MarshalError{Index: i, Err: err}
+			break
+		}
+		// The item ends the record, which is a block if the item is empty.
+		offsets = append(offsets, s.size+int64(batch.Len()-length))
+		lengths = append(lengths, length)
+	}
+	if len(lengths) == 0 {
+		return 0, encodeErr
+	}
+	if err := s.writeLocked(batch.Bytes()); err != nil {
+		return 0, errors.Wrap(err, "failed to write objects")
+	}
+	s.recordBytes += int64(batch.Len())
+	for i, length := range lengths {
+		s.appendItemLocked(objects[i], offsets[i], length, enqueuedAt, nthSequence(sequence, i))
+	}
+	s.numberedLocked(sequence, len(lengths))
+	return len(lengths), encodeErr
+}
+
+// appendSequenceLocked appends a control record to batch numbering the item records that
+// follow from sequence on, unless they would be read with it anyway.
+func (s *segment[T]) appendSequenceLocked(batch *bytes.Buffer, sequence uint64) {
+	if sequence != s.nextSequence && s.header.version >= segmentFormatV1 {
+		appendRecord(batch, s.header.version, recordKindControl, encodeSequenceControl(sequence))
+	}
+}
+
+// numberedLocked records that count item records numbered from sequence on were written.
+func (s *segment[T]) numberedLocked(sequence uint64, count int) {
+	s.nextSequence = nthSequence(sequence, count)
+	s.raiseSequenceEndLocked(s.nextSequence)
+}
+
+func (s *segment[T]) raiseSequenceEndLocked(end uint64) {
+	if end > s.sequenceEnd {
+		s.sequenceEnd = end
+	}
+}
+
+// nthSequence returns the sequence number of the item n places after one numbered sequence,
+// which stays zero for unnumbered items.
+func nthSequence(sequence uint64, n int) uint64 {
+	if sequence == 0 {
+		return 0
+	}
+	return sequence + uint64(n)
+}
+
+// appendItemRecordLocked encodes obj as an item record at the end of batch and returns the
+// length of its body. A StreamConverter writes uncompressed items straight into batch, whose
+// record header is filled in afterwards. On error, batch is left as it was.
+func (s *segment[T]) appendItemRecordLocked(batch *bytes.Buffer, obj T) (int, error) {
+	stream, ok := s.converter.(StreamConverter[T])
+	if !ok || s.header.compression != CompressionNone {
+		buf, err := s.marshal(obj)
+		if err != nil {
+			return 0, err
+		}
+		if len(buf) > s.options.maxRecordSize() {
+			return 0, errors.Errorf("object too large (%d bytes)", len(buf))
+		}
+		if len(buf) == 0 && s.header.version < segmentFormatV1 {
+			return 0, errors.New("empty objects can't be written to segments of format version 0")
+		}
+		appendRecord(batch, s.header.version, recordKindItem, buf)
+		return len(buf), nil
+	}
+
+	start := batch.Len()
+	overhead := recordOverhead(s.header.version)
+	batch.Write(make([]byte, overhead))
+	if s.header.flags&segmentFlagSchemaVersion != 0 {
+		batch.WriteByte(schemaVersionOf(s.converter))
+	}
+	if err := stream.MarshalTo(batch, obj); err != nil {
+		batch.Truncate(start)
+		return 0, errors.Wrap(err, "failed to marshal object")
+	}
+	record := batch.Bytes()[start:]
+	body := record[overhead:]
+	if len(body) > s.options.maxRecordSize() {
+		batch.Truncate(start)
+		return 0, errors.Errorf("object too large (%d bytes)", len(body))
+	}
+	if len(body) == 0 {
+		batch.Truncate(start)
+		if s.header.version < segmentFormatV1 {
+			return 0, errors.New("empty objects can't be written to segments of format version 0")
+		}
+		appendRecord(batch, s.header.version, recordKindItem, nil)
+		return 0, nil
+	}
+	binary.LittleEndian.PutUint32(record, recordWord(recordKindItem, len(body)))
+	if s.header.version >= segmentFormatV2 {
+		binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(body, crcTable))
+	}
+	return len(body), nil
+}
+
+// addBlocksLocked packs objects into blocks and writes the whole batch at once.
+func (s *segment[T]) addBlocksLocked(objects []T, enqueuedAt time.Time, sequence uint64) (int, error) {
+	writer := blockWriter{blockSize: s.options.BlockSize, version: s.header.version}
+	if !enqueuedAt.IsZero() {
+		appendRecord(&writer.out, s.header.version, recordKindControl, encodeTimestampControl(enqueuedAt))
+	}
+	s.appendSequenceLocked(&writer.out, sequence)
+	capacityLeft := s.capacity - len(s.entries) - s.removeCount
+	lengths := []int{}
+	var encodeErr error
+	for i, obj := range objects {
+		pending := int64(writer.out.Len() + writer.block.Len())
+		if i == capacityLeft || (i > 0 && s.options.MaxSegmentBytes > 0 && s.size+pending >= s.options.MaxSegmentBytes) {
+			break
+		}
+		buf, err := s.marshal(obj)
+		if err == nil && len(buf) > s.options.maxRecordSize() {
+			err = errors.Errorf("object too large (%d bytes)", len(buf))
+		}
+		if err != nil {
+			encodeErr = &MarshalError{Index: i, Err: err}
+			break
+		}
+		writer.add(buf)
+		lengths = append(lengths, len(buf))
+	}
+	if len(lengths) == 0 {
+		return 0, encodeErr
+	}
+	buf := writer.bytes()
+	start := s.size
+	if err := s.writeLocked(buf); err != nil {
+		return 0, errors.Wrap(err, "failed to write objects")
+	}
+	s.recordBytes += int64(len(buf))
+	for i, length := range lengths {
+		s.appendItemLocked(objects[i], start+writer.offsets[i], length, enqueuedAt, nthSequence(sequence, i))
+	}
+	s.numberedLocked(sequence, len(lengths))
+	return len(lengths), encodeErr
+}
+
+// addEnvelope adds an item along with its metadata in an envelope record.
+func (s *segment[T]) addEnvelope(object T, env envelope) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.header.version < segmentFormatV1 {
+		return errors.New("segment format too old for item metadata")
+	}
+	if s.fullLocked() {
+		return errors.New("segment is full")
+	}
+	if err := s.addEnvelopeLocked(object, env); err != nil {
+		return err
+	}
+	return errors.Wrap(s.syncAfterWriteLocked(), "failed to sync")
+}
+
+// addEnvelopeLocked writes an item with the metadata of env, leaving it to be synced.
+func (s *segment[T]) addEnvelopeLocked(object T, env envelope) error {
+	buf, err := s.marshal(object)
+	if err != nil {
+		return err
+	}
+	body := encodeEnvelopeRecord(env, buf)
+	offset := s.size + int64(recordOverhead(s.header.version)+len(body)-len(buf))
+	if err := s.writeRecordLocked(recordKindEnvelope, body); err != nil {
+		return errors.Wrap(err, "failed to write object")
+	}
+	s.appendItemLocked(object, offset, len(buf), env.enqueuedAt, env.sequence)
+	s.raiseSequenceEndLocked(nthSequence(env.sequence, 1))
+	last := &s.entries[len(s.entries)-1]
+	last.attempts = env.attempts
+	last.meta = &itemMeta{headers: env.headers, priority: env.priority}
+	return nil
+}
+
+// addTxn durably writes an item belonging to a transaction. The item stays invisible
+// until resolveTxn commits it.
+func (s *segment[T]) addTxn(object T, env envelope) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	buf, err := s.marshal(object)
+	if err != nil {
+		return err
+	}
+	body := encodeEnvelopeRecord(env, buf)
+	offset := s.size + int64(recordOverhead(s.header.version)+len(body)-len(buf))
+	if err := s.writeRecordLocked(recordKindEnvelope, body); err != nil {
+		return errors.Wrap(err, "failed to write object")
+	}
+	s.raiseSequenceEndLocked(nthSequence(env.sequence, 1))
+	e := envelopeEntry[T](env, offset, len(buf))
+	e.object, e.onDisk = object, false
+	txn := s.pendingTxnLocked(env.txnID, env.txnCoordinator)
+	txn.items = append(txn.items, e)
+	return s.flushLocked()
+}
+
+// addTxnAck durably records that a transaction removes the reserved item with the given index.
+// The item stays reserved until resolveTxn removes it on commit.
+func (s *segment[T]) addTxnAck(index int, reservation uint64, env envelope) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.header.version < segmentFormatV1 {
+		return errors.New("segment format too old for transactions")
+	}
+	if err := s.checkReservedLocked([]int{index}, []uint64{reservation}); err != nil {
+		return err
+	}
+	if err := s.writeRecordLocked(recordKindControl, encodeTxnAckControl(env.txnID, index, env.txnCoordinator)); err != nil {
+		return errors.Wrap(err, "failed to write acknowledgement")
+	}
+	txn := s.pendingTxnLocked(env.txnID, env.txnCoordinator)
+	txn.acks = append(txn.acks, index)
+	return s.flushLocked()
+}
+
+func (s *segment[T]) pendingTxnLocked(txnID uint64, coordinator string) *pendingTxn[T] {
+	txn, ok := s.txns[txnID]
+	if !ok {
+		txn = &pendingTxn[T]{coordinator: coordinator}
+		s.txns[txnID] = txn
+	}
+	return txn
+}
+
+// resolveTxn durably records the outcome of a transaction, applying it on commit.
+func (s *segment[T]) resolveTxn(txnID uint64, commit bool) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	control := controlTxnAbort
+	if commit {
+		control = controlTxnCommit
+	}
+	if err := s.writeRecordLocked(recordKindControl, encodeTxnControl(control, txnID)); err != nil {
+		return errors.Wrap(err, "failed to write transaction outcome")
+	}
+	s.applyTxnLocked(control, txnID)
+	return s.flushLocked()
+}
+
+// resolveClosedTxn is resolveTxn for a segment the queue closed after the transaction wrote to
+// it, which is reopened for the outcome and closed again.
+func (s *segment[T]) resolveClosedTxn(txnID uint64, commit bool) error {
+	s.fileLock.Lock()
+	file, err := os.OpenFile(s.filePath(), os.O_APPEND|os.O_WRONLY, s.options.FileMode)
+	if err != nil {
+		s.fileLock.Unlock()
+		return errors.Wrap(err, "failed to reopen segment file")
+	}
+	s.file = file
+	s.fileLock.Unlock()
+
+	err = s.resolveTxn(txnID, commit)
+	if closeErr := file.Close(); err == nil {
+		err = errors.Wrap(closeErr, "failed to close segment file")
+	}
+	return err
+}
+
+// resolveTxnsFromMarkers settles transactions left open by a crash, committing those
+// whose coordinator marker exists and aborting the rest.
+func (s *segment[T]) resolveTxnsFromMarkers() error {
+	for txnID, txn := range s.txns {
+		_, err := os.Stat(fanoutMarkerPath(txn.coordinator, txnID))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to check transaction marker %x", txnID)
+		}
+		if err := s.resolveTxn(txnID, err == nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *segment[T]) applyTxnLocked(control controlType, txnID uint64) {
+	txn, ok := s.txns[txnID]
+	if !ok {
+		return
+	}
+	delete(s.txns, txnID)
+	if control != controlTxnCommit {
+		return
+	}
+	for _, index := range txn.acks {
+		if pos := s.positionLocked(index); pos >= 0 {
+			s.removeEntryLocked(pos)
+		}
+	}
+	for _, e := range txn.items {
+		// Like any other item, the object is only kept while the in-memory limits allow.
+		if !e.onDisk && s.keepInMemoryLocked(e.length) {
+			s.memoryBytes += int64(e.length)
+		} else {
+			var zero T
+			e.object, e.onDisk = zero, true
+		}
+		s.appendEntryLocked(e)
+	}
+}
+
+// envelopeEntry returns the entry of an item read from disk, whose record at offset holds env
+// and the item encoded in length bytes.
+func envelopeEntry[T any](env envelope, offset int64, length int) entry[T] {
+	e := entry[T]{onDisk: true, offset: offset, length: length, enqueuedAt: env.enqueuedAt, attempts: env.attempts, sequence: env.sequence}
+	if env.headers != nil || env.priority != 0 {
+		e.meta = &itemMeta{headers: env.headers, priority: env.priority}
+	}
+	return e
+}
+
+func (s *segment[T]) writeRecordLocked(kind recordKind, body []byte) error {
+	if len(body) > s.options.maxRecordSize() {
+		return errors.Errorf("record too large (%d bytes)", len(body))
+	}
+	buf := bytes.Buffer{}
+	appendRecord(&buf, s.header.version, kind, body)
+	if err := s.writeLocked(buf.Bytes()); err != nil {
+		return err
+	}
+	s.recordBytes += int64(buf.Len())
+	return nil
+}
+
+// writeLocked appends buf to the file, or to the write buffer with WriteBufferSize set.
+func (s *segment[T]) writeLocked(buf []byte) error {
+	s.unsynced++
+	if s.options.WriteBufferSize > 0 {
+		s.pending = append(s.pending, buf...)
+		s.size += int64(len(buf))
+		if len(s.pending) >= s.options.WriteBufferSize {
+			return s.writePendingLocked()
+		}
+		return nil
+	}
+	offset := s.size
+	n, err := s.appendFileLocked(offset, buf)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.replicateLocked(offset, buf)
+}
+
+// appendFileLocked writes buf at the end of the segment file, which is at offset, and returns
+// how many bytes of it the file holds. What a failed write left of buf is cut off again, so
+// that later records don't follow a torn one. A process killed mid-write can still leave a
+// torn record at the end of the file, which RecoveryTruncate cuts off when it is loaded.
+func (s *segment[T]) appendFileLocked(offset int64, buf []byte) (int, error) {
+	n, err := s.file.Write(buf)
+	if err != nil && n > 0 && s.file.Truncate(offset) == nil {
+		n = 0
+	}
+	return n, err
+}
+
+func (s *segment[T]) writePending() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.recordDropsLocked(); err != nil {
+		return errors.Wrap(err, "failed to write deletion to disk")
+	}
+	return s.writePendingLocked()
+}
+
+// writePendingLocked writes out the write buffer.
+func (s *segment[T]) writePendingLocked() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	offset := s.size - int64(len(s.pending))
+	_, err := s.appendFileLocked(offset, s.pending)
+	if err == nil {
+		err = s.replicateLocked(offset, s.pending)
+	}
+	s.pending = s.pending[:0]
+	return errors.Wrap(err, "failed to write buffered records")
+}
+
+func (s *segment[T]) remove() (*T, error) {
+	var popped T
+	if err := s.removeInto(&popped); err != nil {
+		return nil, err
+	}
+	return &popped, nil
+}
+
+func (s *segment[T]) removeMany(count int) ([]T, error) {
+	if available := s.count(); count > available {
+		count = available
+	}
+	popped := make([]T, count)
+	n, err := s.removeManyInto(popped)
+	return popped[:n], err
+}
+
+// removeInto removes the first item of the segment, decoding it into dst.
+func (s *segment[T]) removeInto(dst *T) error {
+	return s.removeFirst(dst, nil)
+}
+
+// removeMessage removes the first item of the segment along with its metadata.
+func (s *segment[T]) removeMessage(msg *Message[T]) error {
+	return s.removeFirst(&msg.Item, func(e *entry[T]) { e.fillMessage(msg) })
+}
+
+// removeFirst removes the first item of the segment, decoding it into dst. If describe isn't
+// nil, it is called with the entry of the item before it is removed.
+func (s *segment[T]) removeFirst(dst *T, describe func(e *entry[T])) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.reservedCount > 0 {
+		_, err := s.removeUnreservedLocked(1, func(_ int, e *entry[T]) *T {
+			if describe != nil {
+				describe(e)
+			}
+			return dst
+		})
+		return err
+	}
+	if s.visibleCountLocked(1) == 0 {
+		return errEmptySegment
+	}
+	if describe != nil {
+		describe(&s.entries[0])
+	}
+	if err := s.decodeLocked(&s.entries[0], dst); err != nil {
+		return err
+	}
+	return s.dropLocked(1)
+}
+
+// removeManyInto removes up to len(dst) items from the head of the segment, decoding them into dst.
+func (s *segment[T]) removeManyInto(dst []T) (int, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.reservedCount > 0 {
+		return s.removeUnreservedLocked(len(dst), func(i int, _ *entry[T]) *T { return &dst[i] })
+	}
+	removeCount := s.visibleCountLocked(len(dst))
+	if removeCount == 0 {
+		return 0, errEmptySegment
+	}
+	for i := 0; i < removeCount; i++ {
+		if err := s.decodeLocked(&s.entries[i], &dst[i]); err != nil {
+			return 0, err
+		}
+	}
+	return removeCount, s.dropLocked(removeCount)
+}
+
+// removeWhile removes up to max items from the head of the segment, skipping reserved ones, as
+// long as pred holds for them and the size they are stored with. It reports whether it stopped
+// at an item pred rejected, which is left in place.
+func (s *segment[T]) removeWhile(max int, pred func(item T, size int) bool) ([]T, bool, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	legacy := s.header.version < segmentFormatV1
+	now := s.options.now()
+	items := []T{}
+	indexes := []int{}
+	rejected := false
+	for i := range s.entries {
+		if len(indexes) == max {
+			break
+		}
+		e := &s.entries[i]
+		if s.reservedLocked(e, now) {
+			if legacy {
+				break
+			}
+			continue
+		}
+		if !s.visibleLocked(e, now) {
+			break
+		}
+		var item T
+		if err := s.decodeLocked(e, &item); err != nil {
+			return nil, false, err
+		}
+		if !pred(item, s.storedSizeLocked(e)) {
+			rejected = true
+			break
+		}
+		items = append(items, item)
+		indexes = append(indexes, e.index)
+	}
+	if len(indexes) == 0 {
+		if rejected {
+			return items, true, nil
+		}
+		return items, false, errEmptySegment
+	}
+	return items, rejected, s.dropIndexesLocked(indexes)
+}
+
+// storedSizeLocked returns the size of the encoded item as stored in the segment file.
+func (s *segment[T]) storedSizeLocked(e *entry[T]) int {
+	return e.length
+}
+
+// dropLocked removes count items from the head of the segment and records the deletion on disk,
+// unless DropBatchSize holds it back.
+func (s *segment[T]) dropLocked(count int) error {
+	// Remove from queue first
+	for i := 0; i < count; i++ {
+		s.forgetEntryLocked(&s.entries[i])
+		s.entries[i] = entry[T]{}
+	}
+	s.entries = s.entries[count:]
+	s.removeCount += count
+	s.unrecordedDrops += count
+	if s.unrecordedDrops < s.options.DropBatchSize {
+		return nil
+	}
+
+	if err := s.recordDropsLocked(); err != nil {
+		return errors.Wrap(err, "failed to write deletion to disk")
+	}
+	return errors.Wrap(s.syncAfterWriteLocked(), "failed to sync")
+}
+
+// recordDropsLocked records the removals dropLocked held back, in the head file under HeadFile.
+func (s *segment[T]) recordDropsLocked() error {
+	count := s.unrecordedDrops
+	if count == 0 {
+		return nil
+	}
+	s.unrecordedDrops = 0
+	if s.usesHeadFileLocked() && s.headFileFreeLocked() {
+		return s.recordHeadLocked(count)
+	}
+	return s.writeDropsLocked(count)
+}
+
+// writeDropsLocked records the removal of count items from the head in the segment file, as a
+// single drop record if the segment allows it and that is shorter than a deletion marker per
+// item. Other records may be written in between, as they never refer to the oldest items by
+// position.
+func (s *segment[T]) writeDropsLocked(count int) error {
+	// A drop record has a body of at least two bytes.
+	if s.header.flags&segmentFlagDropRecords != 0 && 4*count > 2+recordOverhead(s.header.version) {
+		body := encodeDropControl(count)
+		if len(body)+recordOverhead(s.header.version) < 4*count {
+			return s.writeRecordLocked(recordKindControl, body)
+		}
+	}
+	if n := 4 * count; n <= len(zeroMarkers) {
+		return s.writeLocked(zeroMarkers[:n:n])
+	}
+	return s.writeLocked(make([]byte, 4*count))
+}
+
+// zeroMarkers holds the deletion markers of up to 64 items, so that writing them doesn't
+// allocate. It is never written to.
+var zeroMarkers [256]byte
+
+// removeUnreservedLocked removes up to max visible items that aren't reserved, decoding the
+// i-th of them, e, into dst(i, e). Items behind the first one are removed with acknowledgement records,
+// which legacy segments can't hold, so those only give out items in front of the first reserved one.
+func (s *segment[T]) removeUnreservedLocked(max int, dst func(i int, e *entry[T]) *T) (int, error) {
+	legacy := s.header.version < segmentFormatV1
+	now := s.options.now()
+	indexes := []int{}
+	for i := range s.entries {
+		if len(indexes) == max {
+			break
+		}
+		e := &s.entries[i]
+		if s.reservedLocked(e, now) {
+			if legacy {
+				break
+			}
+			continue
+		}
+		if !s.visibleLocked(e, now) {
+			break
+		}
+		if err := s.decodeLocked(e, dst(len(indexes), e)); err != nil {
+			return 0, err
+		}
+		indexes = append(indexes, e.index)
+	}
+	if len(indexes) == 0 {
+		return 0, errEmptySegment
+	}
+	return len(indexes), s.dropIndexesLocked(indexes)
+}
+
+// dropIndexesLocked removes the items with the given indexes and records the removals on disk,
+// using a deletion marker for an item that is first in the segment at that point.
+func (s *segment[T]) dropIndexesLocked(indexes []int) error {
+	buf := bytes.Buffer{}
+	drops := 0
+	headFile := s.usesHeadFileLocked() && s.headFileFreeLocked()
+	for _, index := range indexes {
+		pos := s.positionLocked(index)
+		if pos == 0 && headFile {
+			drops++
+		} else if pos == 0 {
+			buf.Write(make([]byte, 4))
+		} else {
+			appendRecord(&buf, s.header.version, recordKindControl, encodeAckControl(index))
+		}
+		s.removeEntryLocked(pos)
+	}
+	if buf.Len() > 0 || drops == 0 {
+		if err := s.writeLocked(buf.Bytes()); err != nil {
+			return errors.Wrap(err, "failed to write deletion to disk")
+		}
+	}
+	if s.unrecordedDrops += drops; drops > 0 && s.unrecordedDrops >= s.options.DropBatchSize {
+		if err := s.recordDropsLocked(); err != nil {
+			return errors.Wrap(err, "failed to record head position")
+		}
+	}
+	return errors.Wrap(s.syncAfterWriteLocked(), "failed to sync")
+}
+
+// reserve marks the first visible item that isn't reserved yet as reserved, decodes it into dst
+// and returns its entry, holding its index, reservation and number of deliveries.
+func (s *segment[T]) reserve(dst *T, consumer string) (entry[T], error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	now := s.options.now()
+	if s.header.version < segmentFormatV1 && s.reservedCount > 0 {
+		if len(s.entries) == 0 || s.reservedLocked(&s.entries[0], now) {
+			return entry[T]{}, errEmptySegment
+		}
+	}
+	for i := range s.entries {
+		e := &s.entries[i]
+		if s.reservedLocked(e, now) {
+			continue
+		}
+		if !s.visibleLocked(e, now) {
+			break
+		}
+		if err := s.decodeLocked(e, dst); err != nil {
+			return entry[T]{}, err
+		}
+		if s.options.VisibilityTimeout > 0 {
+			if err := s.persistReservationLocked(e.index, now.Add(s.options.VisibilityTimeout), consumer); err != nil {
+				return entry[T]{}, err
+			}
+		}
+		s.nextReservation++
+		e.attempts++
+		e.reserved = true
+		e.reservation = s.nextReservation
+		e.consumer = consumer
+		if s.options.VisibilityTimeout > 0 {
+			e.reservedUntil = now.Add(s.options.VisibilityTimeout)
+		}
+		s.reservedCount++
+		return *e, nil
+	}
+	return entry[T]{}, errEmptySegment
+}
+
+// ack removes the reserved item with the given index.
+func (s *segment[T]) ack(index int, reservation uint64) error {
+	return s.ackMany([]int{index}, []uint64{reservation})
+}
+
+// ackMany removes the reserved items with the given indexes, with a single write. If any of them
+// isn't reserved under the given reservation anymore, none is removed.
+func (s *segment[T]) ackMany(indexes []int, reservations []uint64) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.checkReservedLocked(indexes, reservations); err != nil {
+		return err
+	}
+	return s.dropIndexesLocked(indexes)
+}
+
+// nack makes the reserved item with the given index available again.
+func (s *segment[T]) nack(index int, reservation uint64) error {
+	return s.nackMany([]int{index}, []uint64{reservation})
+}
+
+// nackMany makes the reserved items with the given indexes available again. If any of them isn't
+// reserved under the given reservation anymore, none is released.
+func (s *segment[T]) nackMany(indexes []int, reservations []uint64) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.checkReservedLocked(indexes, reservations); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if s.options.VisibilityTimeout > 0 {
+			if err := s.persistReservationLocked(index, time.Time{}, ""); err != nil {
+				return err
+			}
+		}
+		s.releaseLocked(&s.entries[s.positionLocked(index)])
+	}
+	return nil
+}
+
+func (s *segment[T]) checkReservedLocked(indexes []int, reservations []uint64) error {
+	now := s.options.now()
+	for i, index := range indexes {
+		pos := s.positionLocked(index)
+		if pos < 0 || !s.reservedLocked(&s.entries[pos], now) || s.entries[pos].reservation != reservations[i] {
+			return errNotReserved
+		}
+	}
+	return nil
+}
+
+// reservedEnvelopes returns the metadata of the reserved items with the given indexes, for
+// adding them to a queue again.
+func (s *segment[T]) reservedEnvelopes(indexes []int, reservations []uint64) ([]envelope, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.checkReservedLocked(indexes, reservations); err != nil {
+		return nil, err
+	}
+	envs := make([]envelope, len(indexes))
+	for i, index := range indexes {
+		e := &s.entries[s.positionLocked(index)]
+		envs[i] = envelope{enqueuedAt: e.enqueuedAt, attempts: e.attempts, sequence: e.sequence}
+		if e.meta != nil {
+			envs[i].headers, envs[i].priority = e.meta.headers, e.meta.priority
+		}
+	}
+	return envs, nil
+}
+
+// persistReservationLocked records a reservation deadline and the consumer holding it, or a
+// release for a zero deadline. Legacy segments can't hold it, so their reservations are lost
+// on restart.
+func (s *segment[T]) persistReservationLocked(index int, deadline time.Time, consumer string) error {
+	if s.header.version < segmentFormatV1 {
+		return nil
+	}
+	if err := s.writeRecordLocked(recordKindControl, encodeReserveControl(index, deadline, consumer)); err != nil {
+		return errors.Wrap(err, "failed to write reservation")
+	}
+	return errors.Wrap(s.syncAfterWriteLocked(), "failed to sync")
 }
 
-func (s *segment[T]) add(object T) error {
-	return s.addMany([]T{object})
+// reservedLocked reports whether the item is reserved, releasing it if its reservation expired.
+func (s *segment[T]) reservedLocked(e *entry[T], now time.Time) bool {
+	if !e.reserved {
+		return false
+	}
+	if !e.reservedUntil.IsZero() && !now.Before(e.reservedUntil) {
+		s.releaseLocked(e)
+		return false
+	}
+	return true
 }
 
-func (s *segment[T]) addMany(objects []T) error {
-	s.fileLock.Lock()
-	defer s.fileLock.Unlock()
+func (s *segment[T]) releaseLocked(e *entry[T]) {
+	e.reserved = false
+	e.reservedUntil = time.Time{}
+	e.consumer = ""
+	s.reservedCount--
+}
 
-	for _, obj := range objects {
-		buf, err := s.converter.Marshal(obj)
-		if err != nil {
-			return errors.Wrap(err, "failed to marshal object")
+func (s *segment[T]) visibleLocked(e *entry[T], now time.Time) bool {
+	return s.options.MinAge <= 0 || !e.enqueuedAt.After(now.Add(-s.options.MinAge))
+}
+
+// visibleCountLocked returns how many of the first max items can be dequeued now.
+// With MinAge set, items become visible only once they are old enough.
+func (s *segment[T]) visibleCountLocked(max int) int {
+	if max > len(s.entries) {
+		max = len(s.entries)
+	}
+	if s.options.MinAge <= 0 {
+		return max
+	}
+	cutoff := s.options.now().Add(-s.options.MinAge)
+	for i := 0; i < max; i++ {
+		if s.entries[i].enqueuedAt.After(cutoff) {
+			return i
 		}
+	}
+	return max
+}
+
+func (s *segment[T]) decodeLocked(e *entry[T], dst *T) error {
+	if !e.onDisk {
+		*dst = e.object
+		return nil
+	}
+	// Items with a schema version, or that might be of an earlier one, are decoded as a whole.
+	if stream, ok := s.converter.(StreamConverter[T]); ok && s.header.flags&segmentFlagSchemaVersion == 0 && schemaFlags(s.converter) == 0 {
+		return s.decodeStreamLocked(stream, e, dst)
+	}
+	// Decompressing copies the data anyway.
+	view := s.header.compression != CompressionNone
+	if v, ok := s.converter.(ViewUnmarshaler); ok && v.AcceptsViews() {
+		view = true
+	}
+	data, err := s.readItemLocked(e, view)
+	if err != nil {
+		return err
+	}
+	if data, err = decompress(s.header.compression, data); err != nil {
+		return errors.Wrap(err, "failed to decompress object")
+	}
+	return s.unmarshalError(e.offset, decodeItem(s.converter, s.header.flags, data, dst))
+}
 
-		bufLen := len(buf)
-		bufLenBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(bufLenBytes, uint32(bufLen))
-		if _, err := s.file.Write(bufLenBytes); err != nil {
-			return errors.Wrap(err, "failed to write object length")
+// decodeStreamLocked decodes an item with a StreamConverter, reading uncompressed items
+// straight from the file.
+func (s *segment[T]) decodeStreamLocked(stream StreamConverter[T], e *entry[T], dst *T) error {
+	var r io.Reader
+	if s.header.compression == CompressionNone {
+		if err := s.writePendingLocked(); err != nil {
+			return err
+		}
+		if end := e.offset + int64(e.length); end <= int64(len(s.mapped)) {
+			r = bytes.NewReader(s.mapped[e.offset:end])
+		} else if err := s.openReaderLocked(); err != nil {
+			return err
+		} else {
+			r = io.NewSectionReader(s.reader, e.offset, int64(e.length))
+		}
+	} else {
+		data, err := s.readItemLocked(e, true)
+		if err != nil {
+			return err
 		}
-		if _, err := s.file.Write(buf); err != nil {
-			return errors.Wrap(err, "failed to write object")
+		if data, err = decompress(s.header.compression, data); err != nil {
+			return errors.Wrap(err, "failed to decompress object")
 		}
+		r = bytes.NewReader(data)
+	}
+	obj, err := stream.UnmarshalFrom(r)
+	if err != nil {
+		return s.unmarshalError(e.offset, err)
+	}
+	*dst = obj
+	return nil
+}
+
+// marshal encodes an object the way it is stored in the segment file.
+func (s *segment[T]) marshal(object T) ([]byte, error) {
+	return s.marshalWithFlags(object, s.header.flags)
+}
 
-		s.objects = append(s.objects, obj)
+// marshalWithFlags is marshal for a segment with the given header flags.
+func (s *segment[T]) marshalWithFlags(object T, flags uint32) ([]byte, error) {
+	buf, err := s.encodeWithFlags(object, flags)
+	if err != nil {
+		return nil, err
 	}
+	buf, err = compress(s.header.compression, buf)
+	return buf, errors.Wrap(err, "failed to compress object")
+}
+
+// encode encodes an object with the converter, without compressing it.
+func (s *segment[T]) encode(object T) ([]byte, error) {
+	return s.encodeWithFlags(object, s.header.flags)
+}
 
-	if s.options.AlwaysFlush {
-		err := s.flushLocked()
-		return errors.Wrap(err, "failed to flushLocked")
+// encodeWithFlags is encode for a segment with the given header flags, which decide whether
+// the item starts with its schema version.
+func (s *segment[T]) encodeWithFlags(object T, flags uint32) ([]byte, error) {
+	var buf []byte
+	var err error
+	if stream, ok := s.converter.(StreamConverter[T]); ok {
+		b := bytes.Buffer{}
+		if flags&segmentFlagSchemaVersion != 0 {
+			b.WriteByte(schemaVersionOf(s.converter))
+		}
+		err = stream.MarshalTo(&b, object)
+		buf = b.Bytes()
 	} else {
-		return nil
+		buf, err = s.converter.Marshal(object)
+		if err == nil && flags&segmentFlagSchemaVersion != 0 {
+			buf = append([]byte{schemaVersionOf(s.converter)}, buf...)
+		}
 	}
+	return buf, errors.Wrap(err, "failed to marshal object")
 }
 
-func (s *segment[T]) remove() (*T, error) {
-	s.fileLock.Lock()
-	defer s.fileLock.Unlock()
+// unmarshal decodes the item at offset, read from the segment file.
+func (s *segment[T]) unmarshal(data []byte, offset int64) (T, error) {
+	data, err := decompress(s.header.compression, data)
+	if err != nil {
+		var obj T
+		return obj, errors.Wrap(err, "failed to decompress object")
+	}
+	var obj T
+	err = decodeItem(s.converter, s.header.flags, data, &obj)
+	return obj, s.unmarshalError(offset, err)
+}
 
-	if len(s.objects) == 0 {
-		return nil, errEmptySegment
+// unmarshalError returns an *UnmarshalError for the item at offset if err is set.
+func (s *segment[T]) unmarshalError(offset int64, err error) error {
+	if err == nil {
+		return nil
 	}
+	return &UnmarshalError{Segment: s.segmentNumber, Offset: offset, Err: err}
+}
 
-	// Remove from queue first
-	popped := s.objects[0]
-	s.objects = s.objects[1:]
-	if _, err := s.file.Write([]byte{0, 0, 0, 0}); err != nil {
-		return nil, errors.Wrap(err, "failed to write deletion to disk")
+// readItemLocked returns the encoded item. With view set, it may return a view of the mapped
+// file, which is only valid until the segment is closed, or of a buffer reused by the next read.
+func (s *segment[T]) readItemLocked(e *entry[T], view bool) ([]byte, error) {
+	if err := s.writePendingLocked(); err != nil {
+		return nil, err
 	}
-	s.removeCount++
-	if s.options.AlwaysFlush {
-		err := s.flushLocked()
-		return &popped, errors.Wrap(err, "failed to flushLocked")
+	if end := e.offset + int64(e.length); end <= int64(len(s.mapped)) {
+		data := s.mapped[e.offset:end:end]
+		if !view {
+			data = append([]byte(nil), data...)
+		}
+		return data, nil
+	}
+	if err := s.openReaderLocked(); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if view {
+		if cap(s.readBuf) < e.length {
+			s.readBuf = make([]byte, e.length)
+		}
+		data = s.readBuf[:e.length]
 	} else {
-		return &popped, nil
+		data = make([]byte, e.length)
 	}
+	if _, err := s.reader.ReadAt(data, e.offset); err != nil {
+		return nil, errors.Wrapf(err, "failed to read object at offset %d", e.offset)
+	}
+	return data, nil
 }
 
-func (s *segment[T]) removeMany(count int) ([]T, error) {
-	s.fileLock.Lock()
-	defer s.fileLock.Unlock()
-
-	if len(s.objects) == 0 {
-		return nil, errEmptySegment
+func (s *segment[T]) openReaderLocked() error {
+	if s.reader != nil {
+		return nil
 	}
-
-	// Remove from queue first
-	removeCount := count
-	if removeCount > len(s.objects) {
-		removeCount = len(s.objects)
+	reader, err := os.Open(s.filePath())
+	if err != nil {
+		return errors.Wrap(err, "failed to open file for reading")
 	}
-	popped := s.objects[0:removeCount]
-	s.objects = s.objects[removeCount:]
+	s.reader = reader
+	return nil
+}
 
-	poppedMarkerBytes := make([]byte, 4*removeCount)
-	if _, err := s.file.Write(poppedMarkerBytes); err != nil {
-		return nil, errors.Wrap(err, "failed to write deletion to disk")
+func (s *segment[T]) closeReaderLocked() error {
+	if s.mapped != nil {
+		if err := munmap(s.mapped[:cap(s.mapped)]); err != nil {
+			return errors.Wrap(err, "failed to unmap file")
+		}
+		s.mapped = nil
 	}
-	s.removeCount += removeCount
-	if s.options.AlwaysFlush {
-		err := s.flushLocked()
-		return popped, errors.Wrap(err, "failed to flushLocked")
-	} else {
-		return popped, nil
+	s.readBuf = nil
+	if s.reader == nil {
+		return nil
 	}
+	err := s.reader.Close()
+	s.reader = nil
+	return err
 }
 
 func (s *segment[T]) count() int {
 	s.fileLock.Lock()
 	defer s.fileLock.Unlock()
 
-	return len(s.objects)
+	return len(s.entries)
 }
 
 func (s *segment[T]) countOnDisk() int {
 	s.fileLock.Lock()
 	defer s.fileLock.Unlock()
 
-	return len(s.objects) + s.removeCount
+	return len(s.entries) + s.removeCount
+}
+
+// recordStats returns the bytes taken by item records and the number of items ever written.
+func (s *segment[T]) recordStats() (int64, int) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.recordBytes, len(s.entries) + s.removeCount
+}
+
+// fileSize returns the size of the segment file, including buffered writes.
+func (s *segment[T]) fileSize() int64 {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.size
+}
+
+func (s *segment[T]) flush() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	return s.flushLocked()
 }
 
 func (s *segment[T]) flushLocked() error {
-	return errors.Wrap(s.file.Sync(), "failed to sync file")
+	if err := s.recordDropsLocked(); err != nil {
+		return errors.Wrap(err, "failed to write deletion to disk")
+	}
+	if err := s.writePendingLocked(); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync file")
+	}
+	s.unsynced = 0
+	if s.usesHeadFileLocked() {
+		if err := s.options.headFile.sync(); err != nil {
+			return err
+		}
+	}
+	if r := s.options.replicator; r != nil && r.mode == ReplicateSync {
+		if err := r.sync(); err != nil {
+			return err
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= slowSyncThreshold {
+		s.options.logger().Warn("slow segment sync", "folder", s.folderPath, "segment", s.segmentNumber, "duration", elapsed)
+	}
+	return nil
 }
 
 func (s *segment[T]) load() error {
@@ -140,8 +1266,20 @@ func (s *segment[T]) load() error {
 			return errors.Wrap(err, "failed to close existing file")
 		}
 	}
+	if err := s.closeReaderLocked(); err != nil {
+		return errors.Wrap(err, "failed to close existing file")
+	}
 	s.removeCount = 0
-	s.objects = []T{}
+	s.unrecordedDrops = 0
+	s.headDropped = 0
+	s.nextIndex = 0
+	s.reservedCount = 0
+	s.recordBytes = 0
+	s.memoryBytes = 0
+	s.entries = []entry[T]{}
+	s.txns = map[uint64]*pendingTxn[T]{}
+	s.lostIndexes = nil
+	s.open = s.options.SegmentNaming.isOpen(s.folderPath, s.segmentNumber)
 
 	if file, err := os.OpenFile(s.filePath(), os.O_RDONLY, os.ModePerm); err == nil {
 		s.file = file
@@ -149,101 +1287,603 @@ func (s *segment[T]) load() error {
 	} else {
 		return errors.Wrap(err, "failed to open file")
 	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat file")
+	}
 
-	capacityBuf := make([]byte, 4)
-	if n, err := io.ReadFull(s.file, capacityBuf); err != nil {
-		return errors.Wrapf(err, "error reading header (read %d bytes)", n)
+	var source io.Reader = bufio.NewReader(s.file)
+	if s.options.UseMmap {
+		mapped, err := mmapFile(s.file, info.Size())
+		if err != nil {
+			return errors.Wrap(err, "failed to map file")
+		}
+		if mapped != nil {
+			s.mapped = mapped
+			source = bytes.NewReader(mapped)
+		}
+	}
+	scanner, err := newRecordScanner(source, s.segmentNumber)
+	if err != nil {
+		return err
+	}
+	scanner.maxLength = s.options.maxRecordSize()
+	s.header = scanner.header
+	s.capacity = scanner.header.capacity
+	s.converter, s.foreignCodec = s.options.converterFor(s.header)
+	if s.header.compression != s.options.Compression || s.header.flags&segmentFlagSchemaVersion != schemaFlags(s.options.Converter) {
+		s.foreignCodec = true
+	}
+	if s.loadFooterLocked(s.file, info.Size(), scanner.headerSize) {
+		s.applyHeadLocked()
+		return nil
+	}
+	if err := s.scanRecordsLocked(scanner, info.Size()); err != nil {
+		return err
 	}
-	s.capacity = int(binary.LittleEndian.Uint32(capacityBuf))
+	s.applyHeadLocked()
+	return nil
+}
+
+// scanRecordsLocked applies the records read by scanner from a file of the given size to the
+// segment, up to its end or to a record RecoveryMode cuts it off at.
+func (s *segment[T]) scanRecordsLocked(scanner *recordScanner, fileSize int64) error {
+	truncated := false
 	for {
-		lengthBuf := make([]byte, 4)
-		if n, err := io.ReadFull(s.file, lengthBuf); err != nil {
-			if err == io.EOF {
-				break
+		record, err := scanner.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			resume, err := s.recoverLocked(scanner, err, fileSize)
+			if err != nil {
+				return err
+			}
+			if resume {
+				continue
 			}
-			return errors.Wrapf(err, "error reading object length bytes (read %d bytes)", n)
+			truncated = true
+			break
 		}
-		length := binary.LittleEndian.Uint32(lengthBuf)
-		if length == 0 {
-			if len(s.objects) == 0 {
-				return errors.New("Found deletion marker, but no objects are left")
+
+		switch record.kind {
+		case scannedTombstone:
+			if len(s.entries) == 0 {
+				return scanner.corrupt(record.offset, "found deletion marker, but no objects are left")
 			}
-			s.objects = s.objects[1:]
+			s.entries = s.entries[1:]
 			s.removeCount++
-		} else {
-			buf := make([]byte, length)
-			if n, err := io.ReadFull(s.file, buf); err != nil {
-				return errors.Wrapf(err, "error reading object (read %d bytes)", n)
+		case scannedItem:
+			e := envelopeEntry[T](record.env, record.dataOffset, len(record.data))
+			e.enqueuedAt, e.dueAt, e.sequence = record.enqueuedAt, record.dueAt, record.sequence
+			if record.env.txnID == 0 {
+				s.appendEntryLocked(e)
+				break
 			}
-			obj, err := s.converter.Unmarshal(buf)
-			if err != nil {
-				return errors.Wrap(err, "failed to unmarshal object")
+			txn := s.pendingTxnLocked(record.env.txnID, record.env.txnCoordinator)
+			txn.items = append(txn.items, e)
+		case scannedControl:
+			if (record.control == controlTxnCommit || record.control == controlTxnAbort) && len(record.data) == 8 {
+				s.applyTxnLocked(record.control, binary.LittleEndian.Uint64(record.data))
+			} else if record.control == controlAck {
+				index, ok := decodeAckControl(record.data)
+				pos := -1
+				if ok {
+					pos = s.positionLocked(index)
+				}
+				if pos < 0 {
+					return scanner.corrupt(record.offset, "found acknowledgement of unknown item %d", index)
+				}
+				s.removeEntryLocked(pos)
+			} else if record.control == controlDrop {
+				count, ok := decodeDropControl(record.data)
+				if !ok || count > len(s.entries) {
+					return scanner.corrupt(record.offset, "found removal of %d items, but %d objects are left", count, len(s.entries))
+				}
+				s.entries = s.entries[count:]
+				s.removeCount += count
+			} else if isReserveControl(record.control) {
+				if err := s.loadReservationLocked(record.control, record.data); err != nil {
+					return scanner.corrupt(record.offset, "%v", err)
+				}
+			} else if record.control == controlTxnAck {
+				txnID, index, coordinator, ok := decodeTxnAckControl(record.data)
+				if !ok || s.positionLocked(index) < 0 {
+					return scanner.corrupt(record.offset, "found transactional acknowledgement of unknown item %d", index)
+				}
+				txn := s.pendingTxnLocked(txnID, coordinator)
+				txn.acks = append(txn.acks, index)
 			}
-			s.objects = append(s.objects, obj)
 		}
 	}
+	s.recordBytes += scanner.recordBytes()
+	s.size = scanner.offset
+	s.nextSequence = scanner.sequence
+	s.raiseSequenceEndLocked(scanner.sequenceEnd)
+	if truncated {
+		s.recordBytes -= s.size - scanner.recordStart
+		s.size = scanner.recordStart
+		if int64(len(s.mapped)) > s.size {
+			// The pages past the new end of the file can't be read anymore.
+			s.mapped = s.mapped[:s.size]
+		}
+	}
+	return nil
+}
+
+// appendItemLocked adds an item just written at offset, keeping its object in memory unless
+// that would exceed MaxInMemoryItems or MaxInMemoryBytes.
+func (s *segment[T]) appendItemLocked(object T, offset int64, length int, enqueuedAt time.Time, sequence uint64) {
+	e := entry[T]{offset: offset, length: length, enqueuedAt: enqueuedAt, sequence: sequence}
+	if s.keepInMemoryLocked(length) {
+		e.object = object
+		s.memoryBytes += int64(length)
+	} else {
+		e.onDisk = true
+	}
+	s.appendEntryLocked(e)
+}
+
+// keepInMemoryLocked reports whether the object of an item of the given encoded length, added
+// after the items the segment holds, is kept in memory.
+func (s *segment[T]) keepInMemoryLocked(length int) bool {
+	limit := s.options.MaxInMemoryItems
+	if limit == 0 {
+		limit = defaultInMemoryItems
+	}
+	if len(s.entries) >= limit {
+		return false
+	}
+	return s.options.MaxInMemoryBytes <= 0 || s.memoryBytes+int64(length) <= s.options.MaxInMemoryBytes
+}
+
+// forgetEntryLocked updates memoryBytes for an entry about to be removed from entries.
+func (s *segment[T]) forgetEntryLocked(e *entry[T]) {
+	if !e.onDisk {
+		s.memoryBytes -= int64(e.length)
+	}
+}
+
+func (s *segment[T]) loadReservationLocked(control controlType, data []byte) error {
+	index, deadline, consumer, ok := decodeReserveControl(control, data)
+	if !ok {
+		return errors.New("malformed reservation record")
+	}
+	pos := s.positionLocked(index)
+	if pos < 0 {
+		return errors.Errorf("found reservation of unknown item %d", index)
+	}
+	e := &s.entries[pos]
+	if e.reserved {
+		s.releaseLocked(e)
+	}
+	if !deadline.IsZero() {
+		e.attempts++
+		e.reserved = true
+		e.reservedUntil = deadline
+		e.consumer = consumer
+		s.reservedCount++
+	}
 	return nil
 }
 
+func (s *segment[T]) appendEntryLocked(e entry[T]) {
+	e.index = s.nextIndex
+	s.nextIndex++
+	s.entries = append(s.entries, e)
+}
+
+// positionLocked returns the position in entries of the item with the given index, or -1.
+func (s *segment[T]) positionLocked(index int) int {
+	pos := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index >= index })
+	if pos == len(s.entries) || s.entries[pos].index != index {
+		return -1
+	}
+	return pos
+}
+
+func (s *segment[T]) removeEntryLocked(pos int) {
+	if s.entries[pos].reserved {
+		s.reservedCount--
+	}
+	s.forgetEntryLocked(&s.entries[pos])
+	copy(s.entries[pos:], s.entries[pos+1:])
+	s.entries[len(s.entries)-1] = entry[T]{}
+	s.entries = s.entries[:len(s.entries)-1]
+	s.removeCount++
+}
+
 func (s *segment[T]) close() error {
 	s.fileLock.Lock()
 	defer s.fileLock.Unlock()
 
+	if err := s.closeReaderLocked(); err != nil {
+		return err
+	}
+	if err := s.recordDropsLocked(); err != nil {
+		s.file.Close()
+		return errors.Wrap(err, "failed to write deletion to disk")
+	}
+	if err := s.writePendingLocked(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if s.preallocated {
+		if err := s.file.Truncate(s.size); err != nil {
+			s.file.Close()
+			return errors.Wrap(err, "failed to release preallocated space")
+		}
+		s.preallocated = false
+	}
+	if s.unsynced > 0 && s.options.syncPolicy().Mode != SyncManual {
+		if err := s.flushLocked(); err != nil {
+			s.file.Close()
+			return err
+		}
+	}
 	return s.file.Close()
 }
 
+// preallocate reserves disk space for the segment file to grow to size, without changing its
+// size. It does nothing where preallocation isn't supported.
+func (s *segment[T]) preallocate(size int64) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if size <= s.size {
+		return nil
+	}
+	supported, err := preallocateFile(s.file, size)
+	if err != nil {
+		return err
+	}
+	s.preallocated = supported
+	return nil
+}
+
 func (s *segment[T]) deleteSegment() error {
-	if err := s.file.Close(); err != nil {
-		return errors.Wrap(err, "failed to close file")
+	if err := s.closeFilesLocked(); err != nil {
+		return err
 	}
 	return errors.Wrap(os.Remove(s.filePath()), "failed to delete file")
 }
 
+// closeFilesLocked closes the files of a segment whose file is about to be deleted.
+func (s *segment[T]) closeFilesLocked() error {
+	if err := s.closeReaderLocked(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	return errors.Wrap(s.file.Close(), "failed to close file")
+}
+
 func (s *segment[T]) filePath() string {
-	return path.Join(s.folderPath, s.filename())
+	return filepath.Join(s.folderPath, s.filename())
 }
 
 func (s *segment[T]) filename() string {
-	return fmt.Sprintf("%05d.queue", s.segmentNumber)
+	if s.open {
+		return s.options.SegmentNaming.filename(s.segmentNumber) + openSegmentSuffix
+	}
+	return s.options.SegmentNaming.filename(s.segmentNumber)
+}
+
+// seal renames the file of a segment that stopped being the last one, dropping
+// openSegmentSuffix. With reopen set, the segment is still in use, and its file is reopened
+// under the new name, as Windows can't rename open files.
+func (s *segment[T]) seal(reopen bool) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if !s.open {
+		return nil
+	}
+	if reopen {
+		if err := s.writePendingLocked(); err != nil {
+			return err
+		}
+		if err := s.closeReaderLocked(); err != nil {
+			return errors.Wrap(err, "failed to close file")
+		}
+		if err := s.file.Close(); err != nil {
+			return errors.Wrap(err, "failed to close file")
+		}
+	}
+	openPath := s.filePath()
+	s.open = false
+	renameErr := os.Rename(openPath, s.filePath())
+	if renameErr != nil {
+		s.open = true
+	} else if r := s.options.replicator; r != nil && !s.readOnly {
+		renameErr = r.renamed(openPath, s.filePath())
+	}
+	if reopen {
+		file, err := os.OpenFile(s.filePath(), os.O_APPEND|os.O_WRONLY, s.options.FileMode)
+		if err != nil {
+			return errors.Wrap(err, "failed to reopen segment file")
+		}
+		s.file = file
+	}
+	return errors.Wrap(renameErr, "failed to rename segment file")
+}
+
+// nameSegmentFiles gives the file of the last of segments openSegmentSuffix, and drops it from
+// the others. A crash while sealing a segment leaves two files with it, and folders written
+// before it was introduced have none.
+func nameSegmentFiles(folderPath string, naming SegmentNaming, segments []int) error {
+	renamed := false
+	for i, number := range segments {
+		sealedPath := filepath.Join(folderPath, naming.filename(number))
+		from, to := sealedPath+openSegmentSuffix, sealedPath
+		if i == len(segments)-1 {
+			from, to = to, from
+		}
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to stat segment (#%d)", number)
+		}
+		if err := os.Rename(from, to); err != nil {
+			return errors.Wrapf(err, "failed to rename segment (#%d)", number)
+		}
+		renamed = true
+	}
+	if !renamed {
+		return nil
+	}
+	return errors.Wrap(syncDir(folderPath), "failed to sync folder")
+}
+
+// countLiveItems counts the items of a segment file that were not dequeued yet, without
+// decoding them. Transactions left open are counted the way readSegment will resolve them.
+func countLiveItems(folderPath string, naming SegmentNaming, segmentNumber int, mode RecoveryMode, head headPosition, maxRecordSize int) (int, error) {
+	file, err := os.Open(naming.path(folderPath, segmentNumber))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat file")
+	}
+	scanner, err := newRecordScanner(bufio.NewReader(file), segmentNumber)
+	if err != nil {
+		return 0, err
+	}
+	scanner.maxLength = maxRecordSize
+	applies := head.matches(segmentNumber, scanner.header)
+	if footer, ok := readFooter(file, scanner.header.version, info.Size(), scanner.headerSize); ok {
+		live := len(footer.entries)
+		for _, e := range footer.entries {
+			if applies && e.index < head.index {
+				live--
+			}
+		}
+		return live, nil
+	}
+	live := 0
+	// pending holds the coordinator of each open transaction and how it changes the count.
+	type pendingCount struct {
+		coordinator string
+		delta       int
+	}
+	pending := map[uint64]*pendingCount{}
+	addPending := func(txnID uint64, coordinator string, delta int) {
+		if p, ok := pending[txnID]; ok {
+			p.delta += delta
+		} else {
+			pending[txnID] = &pendingCount{coordinator: coordinator, delta: delta}
+		}
+	}
+	for {
+		record, err := scanner.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Skipped and truncated records don't count, just like when the segment is loaded.
+			if mode == RecoveryStrict {
+				return 0, err
+			}
+			if mode == RecoverySkip && scanner.skippable(err) {
+				continue
+			}
+			break
+		}
+		switch record.kind {
+		case scannedTombstone:
+			live--
+		case scannedItem:
+			if record.env.txnID == 0 {
+				live++
+			} else {
+				addPending(record.env.txnID, record.env.txnCoordinator, 1)
+			}
+		case scannedControl:
+			if record.control == controlAck {
+				live--
+			} else if record.control == controlDrop {
+				if count, ok := decodeDropControl(record.data); ok {
+					live -= count
+				}
+			} else if record.control == controlTxnAck {
+				if txnID, _, coordinator, ok := decodeTxnAckControl(record.data); ok {
+					addPending(txnID, coordinator, -1)
+				}
+			} else if (record.control == controlTxnCommit || record.control == controlTxnAbort) && len(record.data) == 8 {
+				txnID := binary.LittleEndian.Uint64(record.data)
+				if p, ok := pending[txnID]; ok && record.control == controlTxnCommit {
+					live += p.delta
+				}
+				delete(pending, txnID)
+			}
+		}
+	}
+	for txnID, p := range pending {
+		if _, err := os.Stat(fanoutMarkerPath(p.coordinator, txnID)); err == nil {
+			live += p.delta
+		}
+	}
+	if applies {
+		live -= head.count
+	}
+	return live, nil
+}
+
+// queueFilenames are the names of the files of the queue folder other than segment files, which
+// listSegments passes over silently.
+var queueFilenames = map[string]bool{
+	lockFilename:               true,
+	producerLockFilename:       true,
+	consumerLockFilename:       true,
+	coldManifestFilename:       true,
+	headFilename:               true,
+	renumberManifestFilename:   true,
+	renumberedManifestFilename: true,
+}
+
+// listSegments returns the numbers of all segment files in the folder, in ascending order.
+// Other files are skipped, and logged to logger.
+func listSegments(folderPath string, naming SegmentNaming, logger Logger) ([]int, error) {
+	dir, err := os.Open(folderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open directory")
+	}
+	defer dir.Close()
+
+	segments := []int{}
+	for {
+		entries, err := dir.ReadDir(1024)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if number, ok := naming.parse(entry.Name()); ok {
+				segments = append(segments, number)
+			} else if !queueFilenames[entry.Name()] {
+				logger.Debug("skipping file that is not a segment", "folder", folderPath, "file", entry.Name())
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read directory")
+		}
+	}
+	sort.Ints(segments)
+	// A segment only has both files if the process died while they were copied.
+	unique := segments[:0]
+	for i, number := range segments {
+		if i == 0 || number != segments[i-1] {
+			unique = append(unique, number)
+		}
+	}
+	return unique, nil
 }
 
-func newSegment[T any](capacity, segmentNumber int, options *QueueOptions[T]) (segment[T], error) {
-	seg := segment[T]{
-		capacity:      capacity,
+// newSegment creates a segment file whose items are numbered from sequence on. With open set,
+// the file is named as the last segment of a queue, with openSegmentSuffix.
+func newSegment[T any](capacity, segmentNumber int, open bool, sequence uint64, options *QueueOptions[T]) (*segment[T], error) {
+	seg := &segment[T]{
+		open:     open,
+		capacity: capacity,
+		header: segmentHeader{
+			version:     currentSegmentFormat,
+			capacity:    capacity,
+			createdAt:   time.Now(),
+			codec:       options.ConverterName,
+			queueName:   options.Name,
+			compression: options.Compression,
+			flags:       schemaFlags(options.Converter) | segmentFlagDropRecords,
+			sequence:    sequence,
+		},
+		nextSequence:  sequence,
+		sequenceEnd:   sequence,
 		folderPath:    options.FolderPath,
 		segmentNumber: segmentNumber,
 		converter:     options.Converter,
+		txns:          map[uint64]*pendingTxn[T]{},
 		options:       options,
 	}
-	file, err := os.OpenFile(seg.filePath(), os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, seg.options.FileMode)
+	headerBytes, err := seg.header.marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode header")
+	}
+	file, err := createSegmentFile(seg.filePath(), seg.options.FileMode, headerBytes)
 	if err != nil {
-		return segment[T]{}, errors.Wrap(err, "failed to create segment file")
+		return nil, errors.Wrap(err, "failed to create segment file")
 	}
 	seg.file = file
+	seg.size = int64(len(headerBytes))
+	return seg, nil
+}
+
+func createSegmentFileDirect(filePath string, mode os.FileMode, header []byte) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+	return file, nil
+}
 
-	capacityBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(capacityBytes, uint32(seg.capacity))
-	if _, err := seg.file.Write(capacityBytes); err != nil {
-		return segment[T]{}, errors.Wrap(err, "failed to write header")
+// syncFile syncs a file that is no longer open, ignoring files deleted since.
+func syncFile(filePath string, mode os.FileMode) error {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, mode)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
 	}
+	return file.Close()
+}
 
-	return seg, nil
+// syncDir makes file creations and removals in the directory durable.
+func syncDir(dirPath string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
 }
 
-func readSegment[T any](segmentNumber int, options *QueueOptions[T]) (segment[T], error) {
-	seg := segment[T]{
+func readSegment[T any](segmentNumber int, options *QueueOptions[T]) (*segment[T], error) {
+	seg := &segment[T]{
 		folderPath:    options.FolderPath,
 		segmentNumber: segmentNumber,
 		converter:     options.Converter,
 		options:       options,
+		open:          options.SegmentNaming.isOpen(options.FolderPath, segmentNumber),
+	}
+	if err := unlinkSnapshot(seg.filePath(), seg.options.FileMode); err != nil {
+		return nil, errors.Wrap(err, "failed to copy segment file linked from a snapshot")
 	}
 	if err := seg.load(); err != nil {
-		return segment[T]{}, errors.Wrap(err, "failed to read segment file")
+		return nil, errors.Wrap(err, "failed to read segment file")
 	}
 	file, err := os.OpenFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, seg.options.FileMode)
 	if err != nil {
-		return segment[T]{}, errors.Wrap(err, "failed to open segment file")
+		return nil, errors.Wrap(err, "failed to open segment file")
 	}
 	seg.file = file
+	if err := seg.dropLostLocked(); err != nil {
+		return nil, errors.Wrap(err, "failed to drop skipped items")
+	}
+	if err := seg.resolveTxnsFromMarkers(); err != nil {
+		return nil, errors.Wrap(err, "failed to resolve transactions")
+	}
 	return seg, nil
 }
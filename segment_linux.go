@@ -0,0 +1,57 @@
+//go:build linux
+
+package koyori
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+)
+
+// createSegmentFile stages the segment in an unnamed O_TMPFILE inode and links it into the
+// directory only once the header is written and synced, so the directory never contains a
+// partially-initialized segment. Filesystems without O_TMPFILE support fall back to a plain create.
+func createSegmentFile(filePath string, mode os.FileMode, header []byte) (*os.File, error) {
+	fd, err := unix.Open(filepath.Dir(filePath), unix.O_TMPFILE|unix.O_WRONLY|unix.O_CLOEXEC, uint32(mode.Perm()))
+	if err != nil {
+		if err == unix.EOPNOTSUPP || err == unix.EISDIR || err == unix.EINVAL {
+			return createSegmentFileDirect(filePath, mode, header)
+		}
+		return nil, errors.Wrap(err, "failed to create temporary segment file")
+	}
+	tmpFile := os.NewFile(uintptr(fd), filePath)
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.Write(header); err != nil {
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return nil, errors.Wrap(err, "failed to sync header")
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove existing segment file")
+	}
+	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	if err := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, filePath, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return nil, errors.Wrap(err, "failed to link segment file")
+	}
+	// Like a rename, the link is only durable once the directory is synced.
+	if err := syncDir(filepath.Dir(filePath)); err != nil {
+		return nil, errors.Wrap(err, "failed to sync folder")
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, mode)
+	return file, errors.Wrap(err, "failed to open segment file")
+}
+
+// preallocateFile reserves the blocks for the file to grow to size without changing its size,
+// so appends don't extend it piece by piece. It returns false if the file system can't.
+func preallocateFile(file *os.File, size int64) (bool, error) {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return false, nil
+	}
+	return err == nil, errors.Wrap(err, "failed to preallocate file")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package koyori
+
+import "os"
+
+func createSegmentFile(filePath string, mode os.FileMode, header []byte) (*os.File, error) {
+	return createSegmentFileDirect(filePath, mode, header)
+}
+
+// preallocateFile isn't supported outside of Linux, so files just grow as they are written.
+func preallocateFile(file *os.File, size int64) (bool, error) {
+	return false, nil
+}
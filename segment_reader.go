@@ -0,0 +1,185 @@
+package koyori
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecordType is the type of a record read by SegmentReader.
+type RecordType int
+
+const (
+	// RecordItem is an enqueued item.
+	RecordItem RecordType = iota + 1
+	// RecordTombstone marks the oldest remaining item of the segment as dequeued.
+	RecordTombstone
+	// RecordTxnCommit makes the transactional item with the same TxnID visible.
+	RecordTxnCommit
+	// RecordTxnAbort discards the transactional item with the same TxnID.
+	RecordTxnAbort
+	// RecordAck removes the item at ItemIndex among all items added to the segment.
+	RecordAck
+	// RecordReserve hides the item at ItemIndex until ReservedUntil, or releases it if
+	// ReservedUntil is zero.
+	RecordReserve
+	// RecordTxnAck removes the item at ItemIndex once the transaction with the same TxnID
+	// commits.
+	RecordTxnAck
+	// RecordDrop marks the Count oldest remaining items of the segment as dequeued.
+	RecordDrop
+)
+
+// Record is a single record of a segment file.
+type Record[T any] struct {
+	Type RecordType
+	// Offset is the position of the record in the file. Items packed in a block share the
+	// block's offset.
+	Offset int64
+	// Item is the decoded item, and Data its encoded form. Only set for RecordItem.
+	Item T
+	Data []byte
+	// SchemaVersion is the version of a VersionedConverter Data was encoded with, or 0.
+	SchemaVersion byte
+	// TxnID is set for items written by EnqueueFanout or a Txn, and for commit, abort and
+	// RecordTxnAck records.
+	TxnID uint64
+	// Sequence is the sequence number of the item (see Queue.Enqueue), or 0 if the segment
+	// doesn't number its items.
+	Sequence uint64
+	// EnqueuedAt is the time the item was enqueued, if it was recorded.
+	EnqueuedAt time.Time
+	// Headers are the headers of an item added by EnqueueWithHeaders.
+	Headers map[string]string
+	// DueAt is the time a scheduled item becomes due.
+	DueAt time.Time
+	// ItemIndex is only set for RecordAck, RecordReserve and RecordTxnAck.
+	ItemIndex     int
+	ReservedUntil time.Time
+	// Consumer is the ID given to Queue.ReserveAs, only set for RecordReserve.
+	Consumer string
+	// Count is only set for RecordDrop.
+	Count int
+}
+
+// SegmentReader reads the records of a single segment file, for tooling and data recovery.
+// It never modifies the file.
+type SegmentReader[T any] struct {
+	file      *os.File
+	scanner   *recordScanner
+	converter Converter[T]
+}
+
+// OpenSegment opens the segment file at filePath. Items are decoded with converter; if it is nil,
+// only Record.Data is set.
+func OpenSegment[T any](filePath string, converter Converter[T]) (*SegmentReader[T], error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	segmentNumber, _ := SegmentNaming{}.parse(filepath.Base(filePath))
+	scanner, err := newRecordScanner(bufio.NewReader(file), segmentNumber)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &SegmentReader[T]{file: file, scanner: scanner, converter: converter}, nil
+}
+
+// Header returns the metadata stored at the start of the segment.
+func (r *SegmentReader[T]) Header() SegmentHeader {
+	return r.scanner.header.exported()
+}
+
+// Next returns the next record of the segment, or io.EOF once all records were read.
+func (r *SegmentReader[T]) Next() (Record[T], error) {
+	for {
+		scanned, err := r.scanner.next()
+		if err != nil {
+			return Record[T]{}, err
+		}
+
+		record := Record[T]{Offset: scanned.offset}
+		switch scanned.kind {
+		case scannedTombstone:
+			record.Type = RecordTombstone
+		case scannedItem:
+			record.Type = RecordItem
+			if record.Data, err = decompress(r.scanner.header.compression, scanned.data); err != nil {
+				return Record[T]{}, errors.Wrapf(err, "failed to decompress object at offset %d", scanned.offset)
+			}
+			if record.SchemaVersion, record.Data, err = splitSchemaVersion(r.scanner.header.flags, record.Data); err != nil {
+				return Record[T]{}, errors.Wrapf(err, "failed to read object at offset %d", scanned.offset)
+			}
+			record.TxnID = scanned.env.txnID
+			record.Sequence = scanned.sequence
+			record.EnqueuedAt = scanned.enqueuedAt
+			record.Headers = scanned.env.headers
+			record.DueAt = scanned.dueAt
+			if r.converter != nil {
+				if err = unmarshalVersion(r.converter, record.SchemaVersion, record.Data, &record.Item); err != nil {
+					return Record[T]{}, errors.Wrapf(err, "failed to unmarshal object at offset %d", scanned.offset)
+				}
+			}
+		case scannedControl:
+			if scanned.control == controlAck {
+				index, ok := decodeAckControl(scanned.data)
+				if !ok {
+					return Record[T]{}, errors.Errorf("malformed acknowledgement at offset %d", scanned.offset)
+				}
+				record.Type = RecordAck
+				record.ItemIndex = index
+				break
+			}
+			if scanned.control == controlDrop {
+				count, ok := decodeDropControl(scanned.data)
+				if !ok {
+					return Record[T]{}, errors.Errorf("malformed removal at offset %d", scanned.offset)
+				}
+				record.Type = RecordDrop
+				record.Count = count
+				break
+			}
+			if isReserveControl(scanned.control) {
+				index, deadline, consumer, ok := decodeReserveControl(scanned.control, scanned.data)
+				if !ok {
+					return Record[T]{}, errors.Errorf("malformed reservation at offset %d", scanned.offset)
+				}
+				record.Type = RecordReserve
+				record.ItemIndex = index
+				record.ReservedUntil = deadline
+				record.Consumer = consumer
+				break
+			}
+			if scanned.control == controlTxnAck {
+				txnID, index, _, ok := decodeTxnAckControl(scanned.data)
+				if !ok {
+					return Record[T]{}, errors.Errorf("malformed transactional acknowledgement at offset %d", scanned.offset)
+				}
+				record.Type = RecordTxnAck
+				record.TxnID = txnID
+				record.ItemIndex = index
+				break
+			}
+			if len(scanned.data) != 8 {
+				continue
+			}
+			record.TxnID = binary.LittleEndian.Uint64(scanned.data)
+			if scanned.control == controlTxnCommit {
+				record.Type = RecordTxnCommit
+			} else if scanned.control == controlTxnAbort {
+				record.Type = RecordTxnAbort
+			} else {
+				continue
+			}
+		}
+		return record, nil
+	}
+}
+
+func (r *SegmentReader[T]) Close() error {
+	return r.file.Close()
+}
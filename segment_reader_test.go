@@ -0,0 +1,72 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegmentReader(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		Name:                 "events",
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 5,
+	}
+
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, koyori.EnqueueFanout("c", queue))
+	assert.Nil(t, queue.Close())
+
+	reader, err := koyori.OpenSegment(filepath.Join(opts.FolderPath, "00001.queue.open"), koyori.Converter[string](StringConverter{}))
+	assert.Nil(t, err)
+	defer reader.Close()
+	assert.Equal(t, 5, reader.Header().Capacity)
+	assert.Equal(t, "events", reader.Header().QueueName)
+
+	types := []koyori.RecordType{}
+	items := []string{}
+	sequences := []uint64{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		types = append(types, record.Type)
+		if record.Type == koyori.RecordItem {
+			items = append(items, record.Item)
+			sequences = append(sequences, record.Sequence)
+		}
+	}
+	assert.Equal(t, []koyori.RecordType{
+		koyori.RecordItem, koyori.RecordItem, koyori.RecordTombstone, koyori.RecordItem, koyori.RecordTxnCommit,
+	}, types)
+	assert.Equal(t, []string{"a", "b", "c"}, items)
+	assert.Equal(t, []uint64{1, 2, 3}, sequences)
+}
+
+func TestOpenSegmentUnknownFormat(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	assert.Nil(t, os.MkdirAll(folder, os.ModePerm))
+
+	notSegment := filepath.Join(folder, "notes.txt")
+	assert.Nil(t, os.WriteFile(notSegment, []byte("hello, world"), os.ModePerm))
+	_, err := koyori.OpenSegment[string](notSegment, nil)
+	assert.ErrorIs(t, err, koyori.ErrNotSegment)
+
+	// Magic followed by version 99
+	future := filepath.Join(folder, "00001.queue")
+	assert.Nil(t, os.WriteFile(future, []byte{'K', 'Y', 'R', 'I', 99, 0, 0, 0, 0, 0}, os.ModePerm))
+	_, err = koyori.OpenSegment[string](future, nil)
+	assert.ErrorIs(t, err, koyori.ErrUnsupportedFormat)
+}
@@ -0,0 +1,19 @@
+package koyori
+
+// raiseSequenceLocked makes sure the items enqueued next are numbered from at least end on,
+// past those added with a sequence number of their own. The caller holds tailMutex.
+func (q *Queue[T]) raiseSequenceLocked(end uint64) {
+	if end > q.nextSequence {
+		q.nextSequence = end
+	}
+}
+
+// recoverSequenceLocked numbers the items enqueued next after all those the loaded queue ever
+// held. Segments are created with the sequence number of the next item at the time, so the
+// last one and the scheduled ones know the numbers taken before them.
+func (q *Queue[T]) recoverSequenceLocked() {
+	q.raiseSequenceLocked(q.lastSegment.sequenceEnd)
+	for _, seg := range q.schedule.segments {
+		q.raiseSequenceLocked(seg.sequenceEnd)
+	}
+}
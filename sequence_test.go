@@ -0,0 +1,144 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func assertSequence[T any](t *testing.T, queue *koyori.Queue[T], expected T, sequence uint64) {
+	msg, err := queue.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, msg.Item)
+	assert.Equal(t, sequence, msg.Sequence)
+}
+
+func TestQueueEnqueueSequence(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	sequence, err := queue.Enqueue("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	sequence, err = queue.EnqueueMany([]string{"b", "c", "d"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), sequence)
+	sequence, err = queue.EnqueueWithHeaders("e", map[string]string{"k": "v"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), sequence)
+	sequence, err = queue.Enqueue("f")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sequence)
+	assert.Nil(t, queue.Close())
+
+	// Sequence numbers are kept with the items, and carry on after a restart even once the
+	// queue was drained.
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	for i, item := range []string{"a", "b", "c", "d", "e", "f"} {
+		assertSequence(t, queue, item, uint64(i+1))
+	}
+	sequence, err = queue.Enqueue("g")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), sequence)
+	assertSequence(t, queue, "g", 7)
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	sequence, err = queue.Enqueue("h")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), sequence)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueSequenceRetry(t *testing.T) {
+	clock := koyori.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+		RetryPolicy:          koyori.RetryPolicy{InitialDelay: time.Minute},
+		Clock:                clock,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.Enqueue("a")))
+	sequence, err := queue.EnqueueAfter("b", 2*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), sequence)
+	sequence, err = queue.Enqueue("c")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), sequence)
+
+	// Retried items keep their sequence numbers, and scheduled ones are numbered when added.
+	delivery, err := queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), delivery.Sequence)
+	assert.Nil(t, delivery.Retry())
+	assertSequence(t, queue, "c", 3)
+	assert.Nil(t, queue.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	clock.Advance(2 * time.Minute)
+	delivery, err = queue.Reserve()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", delivery.Item)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, uint64(1), delivery.Sequence)
+	assert.Nil(t, delivery.Ack())
+	assertSequence(t, queue, "b", 2)
+	sequence, err = queue.Enqueue("d")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), sequence)
+	assert.Nil(t, queue.Close())
+}
+
+func TestQueueSequenceCompact(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 10,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e"})))
+	assertDequeue(t, queue, "a")
+	assertDequeue(t, queue, "b")
+	deliveries := make([]koyori.Delivery[string], 3)
+	for i := range deliveries {
+		deliveries[i], err = queue.Reserve()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint64(5), deliveries[2].Sequence)
+	assert.Nil(t, deliveries[2].Ack())
+	assert.Nil(t, deliveries[0].Nack())
+	assert.Nil(t, deliveries[1].Nack())
+	assert.Nil(t, queue.PushFront("z"))
+
+	// The number of the last item stays taken after it was compacted away.
+	assert.Nil(t, queue.Compact())
+	assert.Nil(t, queue.Close())
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	sequence, err := queue.Enqueue("f")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sequence)
+	assertSequence(t, queue, "z", 0)
+	assertSequence(t, queue, "c", 3)
+	assertSequence(t, queue, "d", 4)
+	assertSequence(t, queue, "f", 6)
+	assert.Nil(t, queue.Close())
+}
@@ -0,0 +1,123 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot writes a point-in-time copy of the queue folder to dir, which must not exist or be
+// empty. The copy can be opened as a queue of its own, for example after being moved to backup
+// storage, and holds exactly the items in the queue when Snapshot was called. Operations on the
+// queue wait until Snapshot returns.
+//
+// Segments other than the first and the last one aren't written to until they become the
+// first one, so they are hard-linked into dir where possible rather than copied. The queue
+// copies a linked segment file before it writes to it again, leaving the snapshot as it was.
+// dir must be on the same file system as the queue for links to be used. Segments offloaded to
+// ColdStorage are downloaded into dir.
+func (q *Queue[T]) Snapshot(dir string) error {
+	q.lock()
+	defer q.unlock()
+
+	if err := q.checkOpenLocked(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, q.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create folder")
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return errors.Wrap(err, "failed to read folder")
+	} else if len(entries) > 0 {
+		return errors.Errorf("folder %s is not empty", dir)
+	}
+
+	if err := q.firstSegment.writePending(); err != nil {
+		return errors.Wrap(err, "failed to write segment")
+	}
+	if err := q.lastSegment.writePending(); err != nil {
+		return errors.Wrap(err, "failed to write segment")
+	}
+	for _, number := range q.segments {
+		src := q.options.SegmentNaming.path(q.options.FolderPath, number)
+		dst := filepath.Join(dir, filepath.Base(src))
+		if q.isColdLocked(number) {
+			if err := q.fetchColdLocked(number, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		active := number == q.firstSegment.segmentNumber || number == q.lastSegment.segmentNumber
+		if !active && linkSnapshots && os.Link(src, dst) == nil {
+			continue
+		}
+		// Copied if it can't be linked, for example across file systems.
+		if err := copyFileSynced(src, dst, q.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to copy segment (#%d)", number)
+		}
+	}
+	if err := q.options.headFile.copyTo(dir); err != nil {
+		return errors.Wrap(err, "failed to copy head file")
+	}
+	if err := q.snapshotScheduleLocked(dir); err != nil {
+		return err
+	}
+	if err := q.snapshotGroupsLocked(dir); err != nil {
+		return err
+	}
+	return errors.Wrap(syncDir(dir), "failed to sync folder")
+}
+
+// snapshotScheduleLocked copies the segments of scheduled items, which may all be written to,
+// to the scheduled folder of dir.
+func (q *Queue[T]) snapshotScheduleLocked(dir string) error {
+	if len(q.schedule.segments) == 0 {
+		return nil
+	}
+	if q.schedule.last != nil {
+		if err := q.schedule.last.writePending(); err != nil {
+			return errors.Wrap(err, "failed to write scheduled segment")
+		}
+	}
+	scheduledDir := filepath.Join(dir, scheduledFolder)
+	if err := os.MkdirAll(scheduledDir, q.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create folder")
+	}
+	for number := range q.schedule.segments {
+		name := q.options.SegmentNaming.filename(number)
+		if err := copyFileSynced(filepath.Join(q.schedule.options.FolderPath, name), filepath.Join(scheduledDir, name), q.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to copy scheduled segment (#%d)", number)
+		}
+	}
+	return errors.Wrap(syncDir(scheduledDir), "failed to sync folder")
+}
+
+// snapshotGroupsLocked copies the cursors of the consumer groups to the groups folder of dir.
+func (q *Queue[T]) snapshotGroupsLocked(dir string) error {
+	if len(q.groups) == 0 {
+		return nil
+	}
+	groupsDir := filepath.Join(dir, groupsFolder)
+	if err := os.MkdirAll(groupsDir, q.options.dirMode()); err != nil {
+		return errors.Wrap(err, "failed to create folder")
+	}
+	for name, g := range q.groups {
+		if err := copyFileSynced(g.cursorPath(), filepath.Join(groupsDir, name+groupCursorExtension), q.options.FileMode); err != nil {
+			return errors.Wrapf(err, "failed to copy cursor of consumer group %q", name)
+		}
+	}
+	return errors.Wrap(syncDir(groupsDir), "failed to sync folder")
+}
+
+// unlinkSnapshot gives the segment file its own copy if it is hard-linked from a snapshot, so
+// that writing to it leaves the snapshot unchanged.
+func unlinkSnapshot(filePath string, mode os.FileMode) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if linkCount(info) <= 1 {
+		return nil
+	}
+	return copyFileSynced(filePath, filePath, mode)
+}
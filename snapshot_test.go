@@ -0,0 +1,56 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestQueueSnapshot(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assertDequeue(t, queue, "a")
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("later", time.Hour)))
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	assert.Nil(t, queue.Snapshot(dir))
+	assert.NotNil(t, queue.Snapshot(dir))
+	if runtime.GOOS != "windows" {
+		original, err := os.Stat(filepath.Join(opts.FolderPath, "00002.queue"))
+		assert.Nil(t, err)
+		linked, err := os.Stat(filepath.Join(dir, "00002.queue"))
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(original, linked))
+	}
+
+	// Consuming through the linked segments leaves the snapshot as it was.
+	assertDequeueMany(t, queue, 5, []string{"b", "c", "d", "e", "f"})
+	assert.Nil(t, enqueueErr(queue.Enqueue("h")))
+	assert.Nil(t, queue.Close())
+
+	snapshotOpts := opts
+	snapshotOpts.FolderPath = dir
+	snapshot, err := koyori.NewQueue(snapshotOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, snapshot.Len())
+	assert.Equal(t, 1, snapshot.ScheduledLen())
+	assertDequeueMany(t, snapshot, 10, []string{"b", "c", "d", "e", "f", "g"})
+	assert.Nil(t, snapshot.Close())
+
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queue, 10, []string{"g", "h"})
+	assert.Nil(t, queue.Close())
+}
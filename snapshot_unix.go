@@ -0,0 +1,19 @@
+//go:build !windows
+
+package koyori
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkSnapshots tells if Snapshot may hard-link segment files, which requires linkCount.
+const linkSnapshots = true
+
+// linkCount returns the number of hard links to a file.
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,11 @@
+package koyori
+
+import "os"
+
+// The number of links isn't available from os.FileInfo on Windows, so snapshots copy every
+// segment file.
+const linkSnapshots = false
+
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,500 @@
+package koyori
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Producer appends items to a queue folder that a Consumer in another process dequeues them
+// from, so that two processes can share a queue without anything else between them. Each side
+// takes a lock of its own in the folder, so there is at most one producer and one consumer at a
+// time, and both keep NewQueue from opening the folder meanwhile.
+//
+// The producer only holds the segment it appends to. The consumer reads segments from their
+// files, records its position in the head file of the folder, as HeadFile does, rather than in
+// the segments, and deletes a segment once it dequeued all of its items and the producer moved on
+// to the next one. Once both are closed, the folder can be opened with NewQueue again.
+type Producer[T any] struct {
+	queue       *Queue[T]
+	lockFile    *os.File
+	releaseOnce sync.Once
+}
+
+// OpenProducer opens the queue in options.FolderPath for appending, creating it if needed.
+// Options that remove items or need to know which items were dequeued can't be used: MaxItems,
+// MaxBytes, ItemTTL, MinAge, CompactInterval, ColdStorage, Replica and RenumberSegments.
+func OpenProducer[T any](options QueueOptions[T]) (*Producer[T], error) {
+	if err := options.prepare(); err != nil {
+		return nil, err
+	}
+	if err := options.checkShared(); err != nil {
+		return nil, err
+	}
+	queue := &Queue[T]{options: options, closed: make(chan struct{}), draining: make(chan struct{}), producer: true}
+	if err := queue.prepareFolder(); err != nil {
+		return nil, err
+	}
+	lockFile, err := acquireLockFile(context.Background(), options.FolderPath, producerLockFilename, options.FileMode, options.LockTimeout, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := queue.load(context.Background()); err != nil {
+		queue.abandonLoad()
+		releaseLock(lockFile)
+		return nil, errors.Wrap(err, "error while loading queue")
+	}
+	if policy := options.syncPolicy(); policy.Mode == SyncInterval && policy.Interval > 0 {
+		queue.background.Add(1)
+		go queue.runSync()
+	}
+	return &Producer[T]{queue: queue, lockFile: lockFile}, nil
+}
+
+// Enqueue adds an item to the queue and returns its sequence number, as Queue.Enqueue does.
+func (p *Producer[T]) Enqueue(item T) (uint64, error) {
+	return p.queue.Enqueue(item)
+}
+
+// EnqueueMany adds items to the queue and returns the sequence number of the first one, as
+// Queue.EnqueueMany does.
+func (p *Producer[T]) EnqueueMany(items []T) (uint64, error) {
+	return p.queue.EnqueueMany(items)
+}
+
+// Flush syncs the items enqueued so far to disk, as Queue.Flush does.
+func (p *Producer[T]) Flush() error {
+	return p.queue.Flush()
+}
+
+// Close closes the queue and releases the folder to another producer.
+func (p *Producer[T]) Close() error {
+	err := p.queue.Close()
+	p.releaseOnce.Do(func() {
+		if lockErr := releaseLock(p.lockFile); err == nil {
+			err = lockErr
+		}
+	})
+	return err
+}
+
+// Consumer dequeues the items a Producer in another process appends to a queue folder. See
+// Producer. A Consumer is safe for concurrent use.
+type Consumer[T any] struct {
+	options QueueOptions[T]
+	// lock guards the fields below.
+	lock sync.Mutex
+	// seg is the first segment, read from its file, or nil until the folder is scanned.
+	seg *segment[T]
+	// folderLock holds the lock on the queue folder shared with the producer, and lockFile the
+	// lock of the consumer.
+	folderLock *os.File
+	lockFile   *os.File
+	// unsynced counts the dequeues since the head file was last synced, and folderUnsynced is
+	// set when segment files were deleted since the folder was last synced.
+	unsynced       int
+	folderUnsynced bool
+	closed         chan struct{}
+	closeOnce      sync.Once
+	background     sync.WaitGroup
+	filesClosed    bool
+}
+
+// OpenConsumer opens the queue in options.FolderPath for dequeuing, creating the folder if
+// needed. The options are checked as by OpenProducer. Under RecoveryStrict, a record that can't
+// be read at the end of a segment is waited on, as the producer may be writing it.
+func OpenConsumer[T any](options QueueOptions[T]) (*Consumer[T], error) {
+	if err := options.prepare(); err != nil {
+		return nil, err
+	}
+	if err := options.checkShared(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(options.FolderPath, options.dirMode()); err != nil {
+		return nil, errors.Wrap(err, "failed to ensure folder exists")
+	}
+	lockFile, err := acquireLockFile(context.Background(), options.FolderPath, consumerLockFilename, options.FileMode, options.LockTimeout, false)
+	if err != nil {
+		return nil, err
+	}
+	folderLock, err := acquireLockFile(context.Background(), options.FolderPath, lockFilename, options.FileMode, options.LockTimeout, true)
+	if err != nil {
+		releaseLock(lockFile)
+		return nil, err
+	}
+	if options.headFile, err = loadHeadFile(options.FolderPath, options.FileMode, options.RecoveryMode, options.logger()); err != nil {
+		releaseLock(folderLock)
+		releaseLock(lockFile)
+		return nil, err
+	}
+	if options.RecoveryMode == RecoveryStrict {
+		// Segments are loaded read-only, so the file is left as it is.
+		options.RecoveryMode = RecoveryTruncate
+	}
+	c := &Consumer[T]{options: options, folderLock: folderLock, lockFile: lockFile, closed: make(chan struct{})}
+	if policy := options.syncPolicy(); policy.Mode == SyncInterval && policy.Interval > 0 {
+		c.background.Add(1)
+		go c.runSync()
+	}
+	return c, nil
+}
+
+// checkShared checks that the options can be used by a Producer or a Consumer, neither of which
+// knows what the other one did since it last looked at the folder.
+func (o *QueueOptions[T]) checkShared() error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{o.MaxItems > 0 || o.MaxBytes > 0, "MaxItems and MaxBytes"},
+		{o.ItemTTL > 0, "ItemTTL"},
+		{o.MinAge > 0, "MinAge"},
+		{o.CompactInterval > 0, "CompactInterval"},
+		{o.ColdStorage != nil, "ColdStorage"},
+		{o.Replica != nil, "Replica"},
+		{o.RenumberSegments, "RenumberSegments"},
+		{o.ArchivePolicy.Enabled, "ArchivePolicy"},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return errors.Errorf("%s can't be used by a producer or consumer", option.name)
+		}
+	}
+	return nil
+}
+
+// Dequeue removes the first item of the queue, or returns ErrEmpty if the producer didn't add
+// any since the last one was dequeued.
+func (c *Consumer[T]) Dequeue() (*T, error) {
+	items, err := c.DequeueMany(1)
+	if err != nil {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+// DequeueMany removes up to count items from the head of the queue, or returns ErrEmpty if there
+// are none. If an item fails to decode after others were removed, those are returned, and the
+// error is returned by the next call.
+func (c *Consumer[T]) DequeueMany(count int) ([]T, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.checkOpenLocked(); err != nil {
+		return nil, err
+	}
+	result := []T{}
+	for len(result) < count {
+		err := c.nextLocked()
+		if err == nil {
+			var items []T
+			items, err = c.takeLocked(count - len(result))
+			result = append(result, items...)
+		}
+		if err == ErrEmpty || (err != nil && len(result) > 0) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(result) == 0 && count > 0 {
+		return nil, ErrEmpty
+	}
+	return result, c.syncAfterDequeueLocked()
+}
+
+// DequeueWait removes the first item of the queue, waiting for the producer to add one while the
+// queue is empty. See Watch for how it learns about new items.
+func (c *Consumer[T]) DequeueWait(ctx context.Context) (*T, error) {
+	item, err := c.Dequeue()
+	if !errors.Is(err, ErrEmpty) {
+		return item, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changed := c.Watch(ctx)
+	for {
+		// Items may have been added before the folder was watched.
+		item, err := c.Dequeue()
+		if !errors.Is(err, ErrEmpty) {
+			return item, err
+		}
+		if _, ok := <-changed; !ok {
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrClosed
+}
+
+// Flush syncs the position of the consumer, and the deletion of the segments it dequeued, to
+// disk. Whatever the SyncPolicy, items dequeued before a successful Flush aren't delivered again
+// after a crash.
+func (c *Consumer[T]) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.checkOpenLocked(); err != nil {
+		return err
+	}
+	return c.syncLocked()
+}
+
+// Close stops the consumer and releases the folder to another consumer. Every other method
+// called afterwards returns ErrClosed, and calling it again does nothing.
+func (c *Consumer[T]) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.background.Wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.filesClosed {
+		return nil
+	}
+	c.filesClosed = true
+	err := c.closeSegmentLocked()
+	if err == nil && c.options.syncPolicy().Mode != SyncManual {
+		err = c.syncLocked()
+	}
+	if lockErr := releaseLock(c.folderLock); err == nil {
+		err = lockErr
+	}
+	if lockErr := releaseLock(c.lockFile); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func (c *Consumer[T]) checkOpenLocked() error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// nextLocked makes sure the first segment holds items, reading those the producer appended to
+// it since it was last read, or moving on to the next segment once the producer did and all of
+// its items were dequeued. It returns ErrEmpty if there are no items.
+func (c *Consumer[T]) nextLocked() error {
+	for c.seg == nil || c.seg.count() == 0 {
+		segments, err := listSegments(c.options.FolderPath, c.options.SegmentNaming, c.options.logger())
+		if err != nil {
+			return errors.Wrap(err, "error while reading queue directory")
+		}
+		if len(segments) == 0 {
+			return ErrEmpty
+		}
+		if c.seg != nil && c.seg.segmentNumber != segments[0] {
+			if err := c.closeSegmentLocked(); err != nil {
+				return err
+			}
+		}
+		// The producer finished writing a segment before it started the next one, so the
+		// segment read below has all of its items if there is one.
+		sealed := len(segments) > 1
+		if c.seg == nil {
+			if err := c.readSegmentLocked(segments[0]); err != nil {
+				return err
+			}
+		} else if found, err := readRenamed(c.seg.loadMore); err != nil {
+			return errors.Wrapf(err, "failed to read segment (#%d)", c.seg.segmentNumber)
+		} else if !found {
+			c.seg = nil
+		}
+		if c.seg == nil || c.seg.count() > 0 {
+			continue
+		}
+		if !sealed {
+			return ErrEmpty
+		}
+		if err := c.deleteSegmentLocked(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegmentLocked reads the segment with the given number as the first one, leaving it unset
+// if its file is gone.
+func (c *Consumer[T]) readSegmentLocked(number int) error {
+	seg := &segment[T]{folderPath: c.options.FolderPath, segmentNumber: number, converter: c.options.Converter, options: &c.options, readOnly: true}
+	found, err := readRenamed(seg.load)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read segment (#%d)", number)
+	} else if !found {
+		return nil
+	}
+	if seg.header.createdAt.IsZero() {
+		// The head file can't tell the segment apart from another one with the same number.
+		return errors.Errorf("segment (#%d) was written by an earlier version, and has to be dequeued from with NewQueue", number)
+	}
+	c.seg = seg
+	return nil
+}
+
+// takeLocked removes up to count items from the head of the first segment, recording the
+// position after them in the head file. Items that fail to decode are given up on as
+// PoisonPolicy decides.
+func (c *Consumer[T]) takeLocked(count int) ([]T, error) {
+	s := c.seg
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	items := []T{}
+	taken := 0
+	var err error
+	for len(items) < count && taken < len(s.entries) {
+		e := &s.entries[taken]
+		// Items skipped by RecoverySkip have nothing to decode.
+		if i := sort.SearchInts(s.lostIndexes, e.index); i < len(s.lostIndexes) && s.lostIndexes[i] == e.index {
+			taken++
+			continue
+		}
+		var item T
+		if err = s.decodeLocked(e, &item); err != nil {
+			var poison *UnmarshalError
+			if s.options.PoisonPolicy == PoisonFail || !errors.As(err, &poison) {
+				break
+			}
+			if err = s.giveUpPoisonLocked(e, poison); err != nil {
+				break
+			}
+			taken++
+			continue
+		}
+		items = append(items, item)
+		taken++
+	}
+	if taken == 0 {
+		return items, err
+	}
+	for i := 0; i < taken; i++ {
+		s.forgetEntryLocked(&s.entries[i])
+		s.entries[i] = entry[T]{}
+	}
+	s.entries = s.entries[taken:]
+	s.removeCount += taken
+	if headErr := s.recordHeadLocked(taken); headErr != nil {
+		return nil, errors.Wrap(headErr, "failed to record position")
+	}
+	return items, err
+}
+
+// deleteSegmentLocked deletes the file of the first segment once all of its items were dequeued.
+func (c *Consumer[T]) deleteSegmentLocked() error {
+	number := c.seg.segmentNumber
+	if err := c.closeSegmentLocked(); err != nil {
+		return err
+	}
+	naming, folderPath := c.options.SegmentNaming, c.options.FolderPath
+	if _, err := readRenamed(func() error { return os.Remove(naming.path(folderPath, number)) }); err != nil {
+		return errors.Wrapf(err, "failed to delete segment (#%d)", number)
+	}
+	// Like Queue.folderChangedLocked, a segment brought back by a crash delivers its items again.
+	c.folderUnsynced = true
+	switch c.options.syncPolicy().Mode {
+	case SyncEveryWrite, SyncEveryN:
+		c.folderUnsynced = false
+		return errors.Wrap(syncDir(folderPath), "failed to sync folder")
+	}
+	return nil
+}
+
+func (c *Consumer[T]) closeSegmentLocked() error {
+	if c.seg == nil {
+		return nil
+	}
+	c.seg.fileLock.Lock()
+	err := c.seg.closeReaderLocked()
+	c.seg.fileLock.Unlock()
+	c.seg = nil
+	return errors.Wrap(err, "failed to close segment file")
+}
+
+// syncAfterDequeueLocked syncs the head file after a dequeue if the sync policy asks for it.
+func (c *Consumer[T]) syncAfterDequeueLocked() error {
+	c.unsynced++
+	policy := c.options.syncPolicy()
+	switch policy.Mode {
+	case SyncEveryWrite:
+		return c.syncLocked()
+	case SyncEveryN:
+		if c.unsynced >= policy.Writes {
+			return c.syncLocked()
+		}
+	}
+	return nil
+}
+
+func (c *Consumer[T]) syncLocked() error {
+	if err := c.options.headFile.sync(); err != nil {
+		return err
+	}
+	c.unsynced = 0
+	if c.folderUnsynced {
+		if err := syncDir(c.options.FolderPath); err != nil {
+			return errors.Wrap(err, "failed to sync folder")
+		}
+		c.folderUnsynced = false
+	}
+	return nil
+}
+
+// runSync syncs the head file every SyncPolicy.Interval until the consumer is closed.
+func (c *Consumer[T]) runSync() {
+	defer c.background.Done()
+	ticker := time.NewTicker(c.options.SyncPolicy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.lock.Lock()
+			err := c.syncLocked()
+			c.lock.Unlock()
+			if err != nil {
+				c.options.logger().Warn("background sync failed", "folder", c.options.FolderPath, "err", err)
+			}
+		}
+	}
+}
+
+// loadMore reads the records appended to the file of a segment loaded read-only since it was
+// last read, as the producer of a Consumer appends to it.
+func (s *segment[T]) loadMore() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	// The producer renames the file once it moves on to the next segment.
+	s.open = s.options.SegmentNaming.isOpen(s.folderPath, s.segmentNumber)
+	file, err := os.Open(s.filePath())
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat file")
+	}
+	if info.Size() <= s.size {
+		return nil
+	}
+	if _, err := file.Seek(s.size, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to seek file")
+	}
+	scanner := resumeRecordScanner(bufio.NewReader(file), s.segmentNumber, s.header, s.size)
+	scanner.maxLength = s.options.maxRecordSize()
+	scanner.sequence, scanner.sequenceEnd = s.nextSequence, s.sequenceEnd
+	return s.scanRecordsLocked(scanner, info.Size())
+}
@@ -0,0 +1,102 @@
+package koyori_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProducerConsumer(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	producer, err := koyori.OpenProducer(opts)
+	assert.Nil(t, err)
+	consumer, err := koyori.OpenConsumer(opts)
+	assert.Nil(t, err)
+
+	// Each side excludes another one of its kind, and both exclude a queue.
+	_, err = koyori.OpenProducer(opts)
+	assert.ErrorIs(t, err, koyori.ErrQueueLocked)
+	_, err = koyori.OpenConsumer(opts)
+	assert.ErrorIs(t, err, koyori.ErrQueueLocked)
+	_, err = koyori.NewQueue(opts)
+	assert.ErrorIs(t, err, koyori.ErrQueueLocked)
+
+	_, err = consumer.Dequeue()
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, enqueueErr(producer.Enqueue("a")))
+	item, err := consumer.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", *item)
+
+	assert.Nil(t, enqueueErr(producer.EnqueueMany([]string{"b", "c", "d", "e", "f", "g", "h"})))
+	items, err := consumer.DequeueMany(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "c", "d", "e"}, items)
+	// Only the segment items are still read from is left of those the producer moved on from.
+	assert.Len(t, segmentFiles(t, opts.FolderPath), 2)
+
+	// A consumer opened again goes on where the last one stopped.
+	assert.Nil(t, consumer.Close())
+	consumer, err = koyori.OpenConsumer(opts)
+	assert.Nil(t, err)
+	items, err = consumer.DequeueMany(10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"f", "g", "h"}, items)
+	assert.Nil(t, enqueueErr(producer.Enqueue("i")))
+	assert.Nil(t, consumer.Close())
+	assert.Nil(t, producer.Close())
+
+	// The folder is a queue again once both are closed.
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.Len())
+	assertDequeue(t, queue, "i")
+	assert.Nil(t, queue.Close())
+
+	opts.MaxItems = 10
+	_, err = koyori.OpenProducer(opts)
+	assert.NotNil(t, err)
+}
+
+func TestConsumerDequeueWait(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		PollInterval:         10 * time.Millisecond,
+	}
+	consumer, err := koyori.OpenConsumer(opts)
+	assert.Nil(t, err)
+	defer consumer.Close()
+	producer, err := koyori.OpenProducer(opts)
+	assert.Nil(t, err)
+	defer producer.Close()
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(time.Millisecond)
+			assert.Nil(t, enqueueErr(producer.Enqueue(fmt.Sprintf("%02d", i))))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		item, err := consumer.DequeueWait(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%02d", i), *item)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = consumer.DequeueWait(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
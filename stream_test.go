@@ -0,0 +1,66 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// streamStringConverter only works through the streaming interface.
+type streamStringConverter struct {
+	marshaled, unmarshaled *int
+}
+
+func (streamStringConverter) Marshal(string) ([]byte, error) {
+	return nil, errors.New("Marshal should not be called")
+}
+
+func (streamStringConverter) Unmarshal([]byte) (string, error) {
+	return "", errors.New("Unmarshal should not be called")
+}
+
+func (c streamStringConverter) MarshalTo(w io.Writer, v string) error {
+	*c.marshaled++
+	_, err := io.WriteString(w, v)
+	return err
+}
+
+func (c streamStringConverter) UnmarshalFrom(r io.Reader) (string, error) {
+	*c.unmarshaled++
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestQueueStreamConverter(t *testing.T) {
+	for _, compression := range []koyori.Compression{koyori.CompressionNone, koyori.CompressionSnappy} {
+		for _, mmap := range []bool{false, true} {
+			converter := streamStringConverter{marshaled: new(int), unmarshaled: new(int)}
+			opts := koyori.QueueOptions[string]{
+				Converter:            converter,
+				FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+				FileMode:             os.ModePerm,
+				MaxObjectsPerSegment: 3,
+				Compression:          compression,
+				UseMmap:              mmap,
+			}
+			queue, err := koyori.NewQueue(opts)
+			assert.Nil(t, err)
+			assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "bb", "ccc", "dddd"})))
+			assert.Nil(t, enqueueErr(queue.Enqueue("eeeee")))
+			assert.Equal(t, 5, *converter.marshaled)
+			assert.Nil(t, queue.Close())
+
+			queue, err = koyori.NewQueue(opts)
+			assert.Nil(t, err)
+			assertDequeueMany(t, queue, 5, []string{"a", "bb", "ccc", "dddd", "eeeee"})
+			assert.Equal(t, 5, *converter.unmarshaled)
+			assert.Nil(t, queue.Close())
+		}
+	}
+}
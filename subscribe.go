@@ -0,0 +1,173 @@
+package koyori
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// SubOpt configures Subscribe.
+type SubOpt func(o *subOptions)
+
+type subOptions struct {
+	concurrency    int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// WithConcurrency sets how many items Subscribe handles at once. It defaults to 1.
+func WithConcurrency(n int) SubOpt {
+	return func(o *subOptions) { o.concurrency = n }
+}
+
+// WithMaxAttempts sets how many times Subscribe hands an item to the handler before giving up
+// on it. It defaults to 3; zero or less retries items forever.
+func WithMaxAttempts(n int) SubOpt {
+	return func(o *subOptions) { o.maxAttempts = n }
+}
+
+// WithBackoff sets how long Subscribe waits before retrying a failed item: initial after the
+// first failure, doubling with every further one up to max. It defaults to 100ms and 30s.
+func WithBackoff(initial, max time.Duration) SubOpt {
+	return func(o *subOptions) { o.initialBackoff, o.maxBackoff = initial, max }
+}
+
+func (o *subOptions) backoff(attempts int) time.Duration {
+	backoff := o.initialBackoff
+	for i := 1; i < attempts && backoff < o.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.maxBackoff {
+		return o.maxBackoff
+	}
+	return backoff
+}
+
+// Subscribe runs a pool of workers that take items from the queue and pass them to handler,
+// waiting for new items while the queue is empty, until ctx is done. It then waits for the
+// handlers that are running and returns ctx.Err().
+//
+// Items are reserved (see Reserve) while handler runs, and acked once it returns nil. An item
+// for which handler returns an error or panics is put back in its place after a backoff, and
+// retried. Once it failed as many times as set by WithMaxAttempts, it is moved to
+// QueueOptions.DeadLetterQueue, or dropped if that isn't set. Attempts are only remembered
+// across restarts with VisibilityTimeout set. With QueueOptions.RetryPolicy set, failed items
+// are handed to Delivery.Retry instead, and WithMaxAttempts and WithBackoff don't apply.
+//
+// Subscribe stops early, returning the error, if the queue is closed or fails.
+func (q *Queue[T]) Subscribe(ctx context.Context, handler func(T) error, opts ...SubOpt) error {
+	o := subOptions{concurrency: 1, maxAttempts: 3, initialBackoff: 100 * time.Millisecond, maxBackoff: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+
+	return runWorkers(ctx, o.concurrency, func(ctx context.Context) error {
+		return q.runSubscriber(ctx, handler, &o)
+	})
+}
+
+// runWorkers runs worker in n goroutines until ctx is done, and then returns ctx.Err(), or
+// until one of them fails, returning its error.
+func runWorkers(ctx context.Context, n int, worker func(ctx context.Context) error) error {
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(workerCtx); err != nil {
+				once.Do(func() { firstErr = err })
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// runSubscriber handles items until ctx is done, which returns nil, or the queue fails.
+func (q *Queue[T]) runSubscriber(ctx context.Context, handler func(T) error, o *subOptions) error {
+	for {
+		added := q.added.wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+		delivery, err := q.Reserve()
+		if errors.Is(err, ErrEmpty) {
+			q.waitAdded(ctx, added)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if handlerErr := callHandler(handler, delivery.Item); handlerErr == nil {
+			err = delivery.Ack()
+		} else {
+			err = q.handleFailure(ctx, delivery, handlerErr, o)
+		}
+		// The reservation expired under VisibilityTimeout, and the item was handed out again.
+		if err != nil && !errors.Is(err, ErrDeliveryDone) {
+			return err
+		}
+	}
+}
+
+// waitAdded waits for items to be added, or at most waitPollInterval, as items that become
+// available otherwise, such as scheduled items coming due, don't signal added.
+func (q *Queue[T]) waitAdded(ctx context.Context, added <-chan struct{}) {
+	timer := time.NewTimer(waitPollInterval)
+	defer timer.Stop()
+	select {
+	case <-added:
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-q.closed:
+	}
+}
+
+func callHandler[T any](handler func(T) error, item T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler(item)
+}
+
+// handleFailure retries an item after a backoff, or gives up on it after too many attempts.
+func (q *Queue[T]) handleFailure(ctx context.Context, delivery Delivery[T], handlerErr error, o *subOptions) error {
+	if q.options.RetryPolicy.enabled() {
+		return delivery.Retry()
+	}
+	if o.maxAttempts > 0 && delivery.Attempts >= o.maxAttempts {
+		if dlq := q.options.DeadLetterQueue; dlq != nil {
+			if _, err := dlq.Enqueue(delivery.Item); err != nil {
+				// Retried rather than lost.
+				q.options.logger().Warn("failed to move item to dead letter queue", "folder", q.options.FolderPath, "err", err)
+				return delivery.Nack()
+			}
+		}
+		q.options.logger().Warn("gave up on item", "folder", q.options.FolderPath, "attempts", delivery.Attempts, "err", handlerErr)
+		return delivery.Ack()
+	}
+	timer := time.NewTimer(o.backoff(delivery.Attempts))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-q.closed:
+	}
+	return delivery.Nack()
+}
@@ -0,0 +1,93 @@
+package koyori_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueSubscribe(t *testing.T) {
+	newOpts := func() koyori.QueueOptions[string] {
+		return koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 3,
+		}
+	}
+	dlq, err := koyori.NewQueue(newOpts())
+	assert.Nil(t, err)
+	opts := newOpts()
+	opts.DeadLetterQueue = dlq
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+
+	var mutex sync.Mutex
+	handled := []string{}
+	attempts := map[string]int{}
+	done := make(chan struct{})
+	handler := func(item string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[item]++
+		switch {
+		case item == "bad":
+			return errors.New("always fails")
+		case item == "panic":
+			panic("boom")
+		case item == "flaky" && attempts[item] == 1:
+			return errors.New("fails once")
+		}
+		handled = append(handled, item)
+		if len(handled) == 4 {
+			close(done)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- queue.Subscribe(ctx, handler, koyori.WithConcurrency(2), koyori.WithMaxAttempts(2), koyori.WithBackoff(time.Millisecond, 5*time.Millisecond))
+	}()
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "bad", "flaky", "panic", "b"})))
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, enqueueErr(queue.Enqueue("c")))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("items weren't handled")
+	}
+	assert.Eventually(t, func() bool { return dlq.Len() == 2 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-result)
+
+	mutex.Lock()
+	sort.Strings(handled)
+	assert.Equal(t, []string{"a", "b", "c", "flaky"}, handled)
+	assert.Equal(t, 2, attempts["bad"])
+	assert.Equal(t, 2, attempts["flaky"])
+	mutex.Unlock()
+	assert.Equal(t, 0, queue.Len())
+	dead, err := dlq.DequeueMany(10)
+	assert.Nil(t, err)
+	sort.Strings(dead)
+	assert.Equal(t, []string{"bad", "panic"}, dead)
+
+	// Subscribe stops once the queue is closed.
+	go func() {
+		result <- queue.Subscribe(context.Background(), handler)
+	}()
+	assert.Nil(t, queue.Close())
+	assert.True(t, errors.Is(<-result, koyori.ErrClosed))
+	assert.Nil(t, dlq.Close())
+}
@@ -0,0 +1,135 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// SyncMode decides when writes to segment files are synced to disk.
+type SyncMode int
+
+const (
+	// SyncManual only syncs segments on Flush. Writes that weren't flushed may be lost if the
+	// machine crashes, but not if only the process dies.
+	SyncManual SyncMode = iota
+	// SyncEveryWrite syncs after every write, the same as AlwaysFlush.
+	SyncEveryWrite
+	// SyncEveryN syncs a segment once SyncPolicy.Writes writes were made to it since it was
+	// last synced.
+	SyncEveryN
+	// SyncInterval syncs the open segments every SyncPolicy.Interval in the background.
+	SyncInterval
+)
+
+// SyncPolicy configures how often writes are synced to disk. Syncing in batches trades the
+// items written since the last sync for throughput. Except with SyncManual, segments are also
+// synced when they are closed. The queue folder, which records the creation and deletion of
+// segment files, is synced along with the segments.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Writes   int
+	Interval time.Duration
+}
+
+// syncPolicy returns the sync policy in effect, which AlwaysFlush overrides.
+func (o *QueueOptions[T]) syncPolicy() SyncPolicy {
+	if o.AlwaysFlush {
+		return SyncPolicy{Mode: SyncEveryWrite}
+	}
+	return o.SyncPolicy
+}
+
+// syncAfterWriteLocked syncs the segment after a write if the sync policy asks for it.
+func (s *segment[T]) syncAfterWriteLocked() error {
+	policy := s.options.syncPolicy()
+	switch policy.Mode {
+	case SyncEveryWrite:
+		return s.flushLocked()
+	case SyncEveryN:
+		if s.unsynced >= policy.Writes {
+			return s.flushLocked()
+		}
+	}
+	return nil
+}
+
+// closeUnsynced closes the segment, returning whether it was left with writes that only
+// a later Flush syncs.
+func (s *segment[T]) closeUnsynced() (bool, error) {
+	s.fileLock.Lock()
+	unsynced := (s.unsynced > 0 || s.unrecordedDrops > 0 || s.usesHeadFileLocked() && s.options.headFile.dirty()) && s.options.syncPolicy().Mode == SyncManual
+	s.fileLock.Unlock()
+	return unsynced, s.close()
+}
+
+// syncIfDirty syncs the segment if it was written to since it was last synced.
+func (s *segment[T]) syncIfDirty() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if s.unsynced == 0 && s.unrecordedDrops == 0 && !(s.usesHeadFileLocked() && s.options.headFile.dirty()) {
+		return nil
+	}
+	return s.flushLocked()
+}
+
+// runSync syncs the open segments every SyncPolicy.Interval until the queue is closed.
+func (q *Queue[T]) runSync() {
+	defer q.background.Done()
+	ticker := time.NewTicker(q.options.SyncPolicy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-ticker.C:
+			if err := q.syncDirty(); err != nil {
+				q.options.logger().Warn("background sync failed", "folder", q.options.FolderPath, "err", err)
+			}
+		}
+	}
+}
+
+// folderChangedLocked makes the creation or deletion of segment files durable as the sync policy
+// asks: right away when syncing after writes, and otherwise with the next sync of the queue.
+// Until the folder is synced, a crash may lose a new segment, or bring back a deleted one whose
+// items are then delivered again. The caller holds tailMutex.
+func (q *Queue[T]) folderChangedLocked() error {
+	switch q.options.syncPolicy().Mode {
+	case SyncEveryWrite, SyncEveryN:
+		q.folderUnsynced = false
+		return errors.Wrap(syncDir(q.options.FolderPath), "failed to sync folder")
+	}
+	q.folderUnsynced = true
+	return nil
+}
+
+func (q *Queue[T]) syncDirty() error {
+	q.headMutex.Lock()
+	err := q.checkOpenLocked()
+	if err == nil {
+		err = q.firstSegment.syncIfDirty()
+	}
+	q.headMutex.Unlock()
+	if err == ErrClosed {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to sync segment")
+	}
+
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+	if q.checkOpenLocked() != nil {
+		return nil
+	}
+	if err := q.lastSegment.syncIfDirty(); err != nil {
+		return errors.Wrap(err, "failed to sync segment")
+	}
+	if q.folderUnsynced {
+		if err := syncDir(q.options.FolderPath); err != nil {
+			return errors.Wrap(err, "failed to sync folder")
+		}
+		q.folderUnsynced = false
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueSyncPolicy(t *testing.T) {
+	policies := []koyori.SyncPolicy{
+		{Mode: koyori.SyncManual},
+		{Mode: koyori.SyncEveryWrite},
+		{Mode: koyori.SyncEveryN, Writes: 3},
+		{Mode: koyori.SyncInterval, Interval: 5 * time.Millisecond},
+	}
+	for _, policy := range policies {
+		opts := koyori.QueueOptions[string]{
+			Converter:            StringConverter{},
+			FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+			FileMode:             os.ModePerm,
+			MaxObjectsPerSegment: 3,
+			SyncPolicy:           policy,
+		}
+		queue, err := koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 8; i++ {
+			assert.Nil(t, enqueueErr(queue.Enqueue(fmt.Sprintf("%d", i))))
+		}
+		time.Sleep(20 * time.Millisecond)
+		assertDequeueMany(t, queue, 2, []string{"0", "1"})
+		assert.Nil(t, queue.Close())
+
+		queue, err = koyori.NewQueue(opts)
+		assert.Nil(t, err)
+		assertDequeueMany(t, queue, 6, []string{"2", "3", "4", "5", "6", "7"})
+		assert.Nil(t, queue.Close())
+	}
+}
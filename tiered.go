@@ -0,0 +1,339 @@
+package koyori
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ColdStorage holds the segment files offloaded under QueueOptions.ColdStorage, for example in
+// an S3-compatible bucket. Objects are named after the segment files, so a storage must not be
+// shared between queues without giving each its own prefix. Implementations must be safe for
+// concurrent use.
+type ColdStorage interface {
+	// Upload stores the size bytes read from r under name, replacing any object of that name.
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+	// Download writes the object stored under name to w.
+	Download(ctx context.Context, name string, w io.Writer) error
+	// Delete removes the object stored under name. Deleting a missing object isn't an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// coldManifestFilename is the file in the queue folder listing the offloaded segments. Each
+// line after the first holds the number of a segment, its size in bytes and its item count.
+const coldManifestFilename = "cold.manifest"
+
+const coldManifestVersion = "koyori-cold 1"
+
+// coldSegment is an offloaded segment. As segments between the first and the last one aren't
+// written to, its size and item count don't change while it is offloaded.
+type coldSegment struct {
+	size  int64
+	items int
+}
+
+func readColdManifest(folderPath string) (map[int]coldSegment, error) {
+	cold := map[int]coldSegment{}
+	file, err := os.Open(filepath.Join(folderPath, coldManifestFilename))
+	if os.IsNotExist(err) {
+		return cold, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open cold storage manifest")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != coldManifestVersion {
+		return nil, errors.Wrap(ErrCorrupt, "invalid cold storage manifest")
+	}
+	for scanner.Scan() {
+		var number int
+		var seg coldSegment
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &number, &seg.size, &seg.items); err != nil {
+			return nil, errors.Wrapf(ErrCorrupt, "invalid cold storage manifest line %q", scanner.Text())
+		}
+		cold[number] = seg
+	}
+	return cold, errors.Wrap(scanner.Err(), "failed to read cold storage manifest")
+}
+
+// writeColdManifestLocked replaces the manifest with one listing q.cold.
+func (q *Queue[T]) writeColdManifestLocked() error {
+	manifestPath := filepath.Join(q.options.FolderPath, coldManifestFilename)
+	if len(q.cold) == 0 {
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove cold storage manifest")
+		}
+		return errors.Wrap(syncDir(q.options.FolderPath), "failed to sync folder")
+	}
+	numbers := make([]int, 0, len(q.cold))
+	for number := range q.cold {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	lines := []string{coldManifestVersion}
+	for _, number := range numbers {
+		lines = append(lines, fmt.Sprintf("%d %d %d", number, q.cold[number].size, q.cold[number].items))
+	}
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), q.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to write cold storage manifest")
+	}
+	if err := syncFile(tmpPath, q.options.FileMode); err != nil {
+		return errors.Wrap(err, "failed to sync cold storage manifest")
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return errors.Wrap(err, "failed to replace cold storage manifest")
+	}
+	return errors.Wrap(syncDir(q.options.FolderPath), "failed to sync folder")
+}
+
+// loadColdLocked reads the manifest, adding the offloaded segments to local ones. A segment
+// that is also found locally, because the process died while it was offloaded or fetched back,
+// is kept local.
+func (q *Queue[T]) loadColdLocked(local []int) ([]int, error) {
+	cold, err := readColdManifest(q.options.FolderPath)
+	if err != nil {
+		return nil, err
+	}
+	if q.options.ColdStorage == nil {
+		if len(cold) > 0 {
+			return nil, errors.Errorf("%d segments were offloaded to cold storage, but ColdStorage isn't set", len(cold))
+		}
+		return local, nil
+	}
+	q.cold = cold
+	isLocal := map[int]bool{}
+	for _, number := range local {
+		isLocal[number] = true
+	}
+	segments := append([]int(nil), local...)
+	changed := false
+	for number := range cold {
+		if isLocal[number] {
+			delete(q.cold, number)
+			q.deleteColdObject(number)
+			changed = true
+		} else {
+			segments = append(segments, number)
+		}
+	}
+	sort.Ints(segments)
+	if changed {
+		if err := q.writeColdManifestLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// ensureLocalLocked fetches an offloaded segment back into the queue folder, as it is about to
+// be written to.
+func (q *Queue[T]) ensureLocalLocked(number int) error {
+	if _, ok := q.cold[number]; !ok {
+		return nil
+	}
+	filePath := filepath.Join(q.options.FolderPath, q.options.SegmentNaming.filename(number))
+	if err := q.fetchColdLocked(number, filePath); err != nil {
+		return err
+	}
+	delete(q.cold, number)
+	if err := q.writeColdManifestLocked(); err != nil {
+		return err
+	}
+	q.deleteColdObject(number)
+	q.options.logger().Debug("fetched segment from cold storage", "folder", q.options.FolderPath, "segment", number)
+	return nil
+}
+
+// fetchColdLocked downloads an offloaded segment to filePath, through a temporary file that is
+// synced before it is renamed into place.
+func (q *Queue[T]) fetchColdLocked(number int, filePath string) error {
+	tmpPath := filePath + ".download"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, q.options.FileMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to create segment file")
+	}
+	defer os.Remove(tmpPath)
+	err = q.options.ColdStorage.Download(context.Background(), q.options.SegmentNaming.filename(number), file)
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to download segment (#%d) from cold storage", number)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to sync segment file")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close segment file")
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return errors.Wrap(err, "failed to rename segment file")
+	}
+	return errors.Wrap(syncDir(filepath.Dir(filePath)), "failed to sync folder")
+}
+
+// fetchColdTemp downloads an offloaded segment to a new temporary folder, for reading it
+// without making it local. The caller removes the folder.
+func (q *Queue[T]) fetchColdTemp(number int) (string, error) {
+	if q.options.ColdStorage == nil {
+		return "", errors.Errorf("segment (#%d) was offloaded to cold storage, but ColdStorage isn't set", number)
+	}
+	dir, err := os.MkdirTemp("", "koyori-cold-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temporary folder")
+	}
+	if err := q.fetchColdLocked(number, filepath.Join(dir, q.options.SegmentNaming.filename(number))); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// deleteColdObject removes an object that is no longer needed. Failing to do so only leaves
+// it behind, so it is logged rather than returned.
+func (q *Queue[T]) deleteColdObject(number int) {
+	if err := q.options.ColdStorage.Delete(context.Background(), q.options.SegmentNaming.filename(number)); err != nil {
+		q.options.logger().Warn("failed to delete segment from cold storage", "folder", q.options.FolderPath, "segment", number, "err", err)
+	}
+}
+
+// clearColdLocked forgets every offloaded segment, deleting their objects.
+func (q *Queue[T]) clearColdLocked() error {
+	if len(q.cold) == 0 {
+		return nil
+	}
+	for number := range q.cold {
+		q.deleteColdObject(number)
+	}
+	q.cold = map[int]coldSegment{}
+	return q.writeColdManifestLocked()
+}
+
+// runOffload uploads the segments between the first and the last one to cold storage whenever
+// segments are added, until the queue is closed.
+func (q *Queue[T]) runOffload() {
+	defer q.background.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		sealed := q.sealed.wait()
+		for {
+			number, ok := q.nextOffloadCandidate()
+			if !ok {
+				break
+			}
+			if err := q.offload(ctx, number); err != nil {
+				if ctx.Err() == nil {
+					q.options.logger().Warn("failed to offload segment to cold storage", "folder", q.options.FolderPath, "segment", number, "err", err)
+				}
+				// Tried again once another segment is sealed.
+				break
+			}
+		}
+		select {
+		case <-q.closed:
+			return
+		case <-sealed:
+		}
+	}
+}
+
+// nextOffloadCandidate returns the oldest local segment between the first and the last one.
+func (q *Queue[T]) nextOffloadCandidate() (int, bool) {
+	q.lock()
+	defer q.unlock()
+
+	if q.checkOpenLocked() != nil {
+		return 0, false
+	}
+	for _, number := range q.segments {
+		if q.isMiddleLocked(number) && !q.isColdLocked(number) {
+			return number, true
+		}
+	}
+	return 0, false
+}
+
+func (q *Queue[T]) isMiddleLocked(number int) bool {
+	if number == q.firstSegment.segmentNumber || number == q.lastSegment.segmentNumber {
+		return false
+	}
+	for _, n := range q.segments {
+		if n == number {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue[T]) isColdLocked(number int) bool {
+	_, ok := q.cold[number]
+	return ok
+}
+
+// offload uploads a segment between the first and the last one, then removes its file if it is
+// still such a segment. The queue isn't locked during the upload, as the file doesn't change.
+func (q *Queue[T]) offload(ctx context.Context, number int) error {
+	q.tailMutex.Lock()
+	folderPath := q.options.FolderPath
+	q.tailMutex.Unlock()
+	filePath := q.options.SegmentNaming.path(folderPath, number)
+
+	items, err := countLiveItems(folderPath, q.options.SegmentNaming, number, q.options.RecoveryMode, q.options.headFile.get(), q.options.maxRecordSize())
+	if err != nil {
+		return errors.Wrap(err, "failed to count items")
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open segment file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to stat segment file")
+	}
+	err = q.options.ColdStorage.Upload(ctx, q.options.SegmentNaming.filename(number), file, info.Size())
+	file.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to upload segment")
+	}
+
+	q.lock()
+	defer q.unlock()
+	if q.checkOpenLocked() != nil || !q.isMiddleLocked(number) || folderPath != q.options.FolderPath {
+		// The head reached the segment, or it was removed, while it was uploaded.
+		q.deleteColdObject(number)
+		return nil
+	}
+	q.cold[number] = coldSegment{size: info.Size(), items: items}
+	if err := q.writeColdManifestLocked(); err != nil {
+		delete(q.cold, number)
+		return err
+	}
+	// The uploaded copy holds the writes that weren't synced yet.
+	for i, n := range q.unsyncedSegments {
+		if n == number {
+			q.unsyncedSegments = append(q.unsyncedSegments[:i], q.unsyncedSegments[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filePath); err != nil {
+		return errors.Wrap(err, "segment was offloaded, but failed to remove its file")
+	}
+	q.options.logger().Debug("offloaded segment to cold storage", "folder", q.options.FolderPath, "segment", number)
+	return nil
+}
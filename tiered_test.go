@@ -0,0 +1,115 @@
+package koyori_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryColdStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryColdStorage) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes, expected %d", len(data), size)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memoryColdStorage) Download(ctx context.Context, name string, w io.Writer) error {
+	m.mutex.Lock()
+	data, ok := m.objects[name]
+	m.mutex.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+func (m *memoryColdStorage) Delete(ctx context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *memoryColdStorage) len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.objects)
+}
+
+func TestQueueColdStorage(t *testing.T) {
+	storage := &memoryColdStorage{objects: map[string][]byte{}}
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		ColdStorage:          storage,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	items := []string{}
+	for i := 0; i < 9; i++ {
+		items = append(items, fmt.Sprintf("%d", i))
+	}
+	assert.Nil(t, enqueueErr(queue.EnqueueMany(items)))
+
+	// Only the first and the last segment stay local.
+	assert.Eventually(t, func() bool { return storage.len() == 3 }, 5*time.Second, 10*time.Millisecond)
+	infos, err := koyori.InspectSegments(opts.FolderPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, 9, queue.Len())
+
+	iterated := []string{}
+	assert.Nil(t, queue.Range(func(item string) bool {
+		iterated = append(iterated, item)
+		return true
+	}))
+	assert.Equal(t, items, iterated)
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	assert.Nil(t, queue.Snapshot(dir))
+	snapshotOpts := opts
+	snapshotOpts.FolderPath = dir
+	snapshotOpts.ColdStorage = nil
+	snapshot, err := koyori.NewQueue(snapshotOpts)
+	assert.Nil(t, err)
+	assertDequeueMany(t, snapshot, 20, items)
+	assert.Nil(t, snapshot.Close())
+	assert.Nil(t, queue.Close())
+
+	// The manifest keeps track of offloaded segments across restarts.
+	withoutStorage := opts
+	withoutStorage.ColdStorage = nil
+	_, err = koyori.NewQueue(withoutStorage)
+	assert.NotNil(t, err)
+	queue, err = koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, queue.Len())
+	assertDequeueMany(t, queue, 5, items[:5])
+	assert.Nil(t, enqueueErr(queue.Enqueue("9")))
+	assertDequeueMany(t, queue, 20, append(items[5:], "9"))
+	assert.Equal(t, 0, storage.len())
+	assert.Nil(t, queue.Close())
+}
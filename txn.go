@@ -0,0 +1,279 @@
+package koyori
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrTxnDone = errors.New("transaction was already committed or rolled back")
+
+// Txn moves items between queues as one atomic unit: even across crashes, either every item
+// taken by Dequeue is removed from its queue and every item given to Enqueue is added to its
+// queue, or none of it happens.
+//
+// Items taken by Dequeue are reserved as by Queue.Reserve until the transaction ends, and items
+// given to Enqueue are only written on Commit. A Txn is not safe for concurrent use.
+type Txn[T any] struct {
+	dequeued []Delivery[T]
+	enqueued []txnEnqueue[T]
+	done     bool
+}
+
+type txnEnqueue[T any] struct {
+	queue *Queue[T]
+	item  T
+	// headers and attempts are carried over by Move.
+	headers  map[string]string
+	attempts int
+}
+
+// NewTxn starts an empty transaction.
+func NewTxn[T any]() *Txn[T] {
+	return &Txn[T]{}
+}
+
+// Dequeue takes the first available item of q as part of the transaction.
+// It returns ErrEmpty if q has no item that isn't reserved.
+func (t *Txn[T]) Dequeue(q *Queue[T]) (T, error) {
+	if t.done {
+		var zero T
+		return zero, ErrTxnDone
+	}
+	delivery, err := q.Reserve()
+	if err != nil {
+		return delivery.Item, err
+	}
+	t.dequeued = append(t.dequeued, delivery)
+	return delivery.Item, nil
+}
+
+// Enqueue adds item to the end of q once the transaction commits.
+func (t *Txn[T]) Enqueue(q *Queue[T], item T) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.enqueued = append(t.enqueued, txnEnqueue[T]{queue: q, item: item})
+	return nil
+}
+
+// Move takes the first available item of from as part of the transaction, like Dequeue, and
+// adds it to the end of to once the transaction commits. The item keeps its headers and counts
+// this delivery among its attempts. It returns ErrEmpty if from has no item that isn't reserved.
+func (t *Txn[T]) Move(from, to *Queue[T]) (T, error) {
+	item, err := t.Dequeue(from)
+	if err != nil {
+		return item, err
+	}
+	delivery := t.dequeued[len(t.dequeued)-1]
+	t.enqueued = append(t.enqueued, txnEnqueue[T]{queue: to, item: item, headers: delivery.headers, attempts: delivery.Attempts})
+	return item, nil
+}
+
+// Commit applies the transaction. Like EnqueueFanout, the changes are first written to each
+// queue as pending records, and a commit marker in the folder of the first queue used decides
+// the outcome if the process dies before they are resolved.
+//
+// If Commit fails before the marker is written, the transaction is rolled back. If a dequeued
+// item's reservation expired in the meantime, ErrDeliveryDone is returned.
+func (t *Txn[T]) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	committed, err := t.commit()
+	if err != nil && !committed {
+		t.nackAll()
+	}
+	return err
+}
+
+// Rollback ends the transaction without applying it, putting the dequeued items back in their
+// places.
+func (t *Txn[T]) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	return t.nackAll()
+}
+
+func (t *Txn[T]) nackAll() error {
+	var firstErr error
+	for _, delivery := range t.dequeued {
+		if err := delivery.Nack(); err != nil && err != ErrDeliveryDone && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// commit returns whether the commit marker was written, after which the transaction is
+// committed even if resolving it failed.
+func (t *Txn[T]) commit() (bool, error) {
+	queues := []*Queue[T]{}
+	seen := map[*Queue[T]]bool{}
+	for _, delivery := range t.dequeued {
+		if !seen[delivery.queue] {
+			seen[delivery.queue] = true
+			queues = append(queues, delivery.queue)
+		}
+	}
+	for _, enqueue := range t.enqueued {
+		if !seen[enqueue.queue] {
+			seen[enqueue.queue] = true
+			queues = append(queues, enqueue.queue)
+		}
+	}
+	if len(queues) == 0 {
+		return true, nil
+	}
+	coordinator := queues[0].options.FolderPath
+
+	// Lock in folder order so concurrent transactions over the same queues can't deadlock
+	ordered := make([]*Queue[T], len(queues))
+	copy(ordered, queues)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].options.FolderPath < ordered[j].options.FolderPath
+	})
+	for i, q := range ordered {
+		if i > 0 && ordered[i-1].options.FolderPath == q.options.FolderPath {
+			return false, errors.Errorf("queue %s opened more than once", q.options.FolderPath)
+		}
+		q.lock()
+		defer q.unlock()
+		if err := q.checkOpenLocked(); err != nil {
+			return false, err
+		}
+	}
+
+	txnID, err := newTxnID()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to generate transaction ID")
+	}
+	env := envelope{txnID: txnID, txnCoordinator: coordinator}
+	written := []*segment[T]{}
+	// closed holds the segments that filled up and were closed after the transaction wrote to
+	// them, with their queues.
+	closed := map[*segment[T]]*Queue[T]{}
+	resolve := func(seg *segment[T], commit bool) error {
+		q, ok := closed[seg]
+		if !ok {
+			return seg.resolveTxn(txnID, commit)
+		}
+		// The queue counted the segment without the pending items when it was closed
+		countBefore, sizeBefore := seg.count(), seg.fileSize()
+		if err := seg.resolveClosedTxn(txnID, commit); err != nil {
+			return err
+		}
+		q.middleCount += seg.count() - countBefore
+		q.middleBytes += seg.fileSize() - sizeBefore
+		return nil
+	}
+	abort := func(cause error) (bool, error) {
+		// Best effort: pending records without a marker are aborted on the next load anyway
+		for _, seg := range written {
+			_ = resolve(seg, false)
+		}
+		return false, cause
+	}
+	addWritten := func(seg *segment[T]) {
+		for _, w := range written {
+			if w == seg {
+				return
+			}
+		}
+		written = append(written, seg)
+	}
+	addSegment := func(q *Queue[T]) error {
+		last := q.lastSegment
+		if err := q.addSegmentLocked(); err != nil {
+			return err
+		}
+		if last != q.firstSegment {
+			closed[last] = q
+		}
+		return nil
+	}
+
+	dequeued := map[*Queue[T]]int{}
+	for _, delivery := range t.dequeued {
+		q := delivery.queue
+		if q.firstSegment.segmentNumber != delivery.segmentNumber {
+			return abort(ErrDeliveryDone)
+		}
+		if err := q.firstSegment.addTxnAck(delivery.index, delivery.reservation, env); err != nil {
+			if err == errNotReserved {
+				return abort(ErrDeliveryDone)
+			}
+			return abort(errors.Wrapf(err, "failed to write pending acknowledgement to %s", q.options.FolderPath))
+		}
+		addWritten(q.firstSegment)
+		dequeued[q]++
+	}
+
+	items := map[*Queue[T]][]txnEnqueue[T]{}
+	for _, enqueue := range t.enqueued {
+		items[enqueue.queue] = append(items[enqueue.queue], enqueue)
+	}
+	for _, q := range queues {
+		if len(items[q]) == 0 {
+			continue
+		}
+		if err := q.checkAcceptingLocked(); err != nil {
+			return abort(err)
+		}
+		if err := q.checkCapacityLocked(len(items[q])); err != nil {
+			return abort(errors.Wrapf(err, "failed to write pending items to %s", q.options.FolderPath))
+		}
+		sequence := q.nextSequence
+		for _, enqueue := range items[q] {
+			if q.lastSegment.full() || q.lastSegment.header.version < segmentFormatV1 {
+				if err := addSegment(q); err != nil {
+					return abort(errors.Wrap(err, "failed to add new segment"))
+				}
+			}
+			addWritten(q.lastSegment)
+			env.sequence = sequence
+			env.headers, env.attempts = enqueue.headers, enqueue.attempts
+			env.enqueuedAt = time.Time{}
+			if q.options.recordsEnqueueTime() {
+				env.enqueuedAt = q.options.now()
+			}
+			if err := q.lastSegment.addTxn(enqueue.item, env); err != nil {
+				return abort(errors.Wrapf(err, "failed to write pending item to %s", q.options.FolderPath))
+			}
+			sequence++
+		}
+	}
+
+	markerPath := fanoutMarkerPath(coordinator, txnID)
+	if err := writeFanoutMarker(markerPath, queues[0].options.FileMode, segmentPaths(written)); err != nil {
+		return abort(errors.Wrap(err, "failed to write commit marker"))
+	}
+	// The items are committed from here on, even if writing the outcome below fails
+	for q, enqueued := range items {
+		q.nextSequence += uint64(len(enqueued))
+	}
+	for _, seg := range written {
+		if err := resolve(seg, true); err != nil {
+			// The marker stays in place, so the transaction is committed when the queue is reloaded
+			return true, errors.Wrap(err, "failed to commit transaction")
+		}
+	}
+	for _, q := range queues {
+		if count := dequeued[q]; count > 0 {
+			q.emit(Event{Type: EventDequeue, Count: count})
+			if err := q.closeDrainedSegmentsBothLocked(); err != nil {
+				return true, err
+			}
+		}
+		if count := len(items[q]); count > 0 {
+			q.emit(Event{Type: EventEnqueue, Count: count})
+		}
+		// Dequeued items may have hidden the ones after them, so wake up consumers either way
+		q.notifyAdded()
+	}
+	return true, errors.Wrap(os.Remove(markerPath), "failed to remove commit marker")
+}
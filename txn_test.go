@@ -0,0 +1,228 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func txnQueueOptions(maxItemsB int) (koyori.QueueOptions[string], koyori.QueueOptions[string]) {
+	root := filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano()))
+	optsA := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(root, "a"),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+	}
+	optsB := optsA
+	optsB.FolderPath = filepath.Join(root, "b")
+	optsB.MaxItems = maxItemsB
+	return optsA, optsB
+}
+
+func TestTxnMove(t *testing.T) {
+	optsA, optsB := txnQueueOptions(0)
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queueA.EnqueueMany([]string{"a", "b", "c"})))
+	assert.Nil(t, enqueueErr(queueB.Enqueue("x")))
+
+	txn := koyori.NewTxn[string]()
+	item, err := txn.Dequeue(queueA)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", item)
+	item, err = txn.Dequeue(queueA)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", item)
+	assert.Nil(t, txn.Enqueue(queueB, "a"))
+	assert.Nil(t, txn.Enqueue(queueB, "b"))
+	assert.Nil(t, txn.Enqueue(queueA, "again"))
+	assert.Nil(t, txn.Commit())
+	assert.ErrorIs(t, txn.Commit(), koyori.ErrTxnDone)
+
+	assert.Equal(t, 2, queueA.Len())
+	assert.Equal(t, 3, queueB.Len())
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queueA, 5, []string{"c", "again"})
+	assertDequeueMany(t, queueB, 5, []string{"x", "a", "b"})
+	files, err := os.ReadDir(optsA.FolderPath)
+	assert.Nil(t, err)
+	for _, file := range files {
+		assert.NotContains(t, file.Name(), ".commit")
+	}
+}
+
+func TestTxnMoveKeepsMetadata(t *testing.T) {
+	optsA, optsB := txnQueueOptions(0)
+	optsB.RecordEnqueueTime = true
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queueA.EnqueueWithHeaders("a", map[string]string{"k": "v"})))
+	delivery, err := queueA.Reserve()
+	assert.Nil(t, err)
+	assert.Nil(t, delivery.Nack())
+
+	txn := koyori.NewTxn[string]()
+	item, err := txn.Move(queueA, queueB)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", item)
+	_, err = txn.Move(queueA, queueB)
+	assert.ErrorIs(t, err, koyori.ErrEmpty)
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, 0, queueA.Len())
+	assert.Nil(t, queueB.Close())
+
+	// Moved items keep their headers and attempts, and get the enqueue time of their new queue.
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	msg, err := queueB.DequeueMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", msg.Item)
+	assert.Equal(t, map[string]string{"k": "v"}, msg.Headers)
+	assert.Equal(t, 3, msg.Attempts)
+	assert.False(t, msg.EnqueuedAt.IsZero())
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+}
+
+func TestTxnFillsSegments(t *testing.T) {
+	optsA, optsB := txnQueueOptions(0)
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queueB.Enqueue("x")))
+
+	// Items are spread over new segments as those fill up, like with EnqueueMany.
+	txn := koyori.NewTxn[string]()
+	for _, item := range []string{"a", "b", "c", "d", "e"} {
+		assert.Nil(t, txn.Enqueue(queueB, item))
+	}
+	assert.Nil(t, txn.Enqueue(queueA, "f"))
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, 6, queueB.Len())
+	assert.Len(t, segmentFiles(t, optsB.FolderPath), 3)
+	assert.Nil(t, queueB.Close())
+
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, queueB.Len())
+	assertDequeueMany(t, queueB, 10, []string{"x", "a", "b", "c", "d", "e"})
+	assertDequeue(t, queueA, "f")
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+}
+
+func TestTxnRollback(t *testing.T) {
+	optsA, optsB := txnQueueOptions(1)
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queueA.EnqueueMany([]string{"a", "b"})))
+
+	txn := koyori.NewTxn[string]()
+	_, err = txn.Dequeue(queueA)
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Enqueue(queueB, "a"))
+	assert.Nil(t, txn.Rollback())
+	assert.ErrorIs(t, txn.Rollback(), koyori.ErrTxnDone)
+	assert.Equal(t, 2, queueA.Len())
+
+	// Commit fails on the full queue after the acknowledgement was written, and rolls back
+	assert.Nil(t, enqueueErr(queueB.Enqueue("x")))
+	txn = koyori.NewTxn[string]()
+	_, err = txn.Dequeue(queueA)
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Enqueue(queueB, "a"))
+	assert.ErrorIs(t, txn.Commit(), koyori.ErrQueueFull)
+	assert.Equal(t, 2, queueA.Len())
+	assert.Equal(t, 1, queueB.Len())
+
+	// Items rolled back after they were written don't use up sequence numbers
+	txn = koyori.NewTxn[string]()
+	assert.Nil(t, txn.Enqueue(queueA, "rolled back"))
+	assert.Nil(t, txn.Enqueue(queueB, "a"))
+	assert.ErrorIs(t, txn.Commit(), koyori.ErrQueueFull)
+	sequence, err := queueA.Enqueue("c")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), sequence)
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err = koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assertDequeueMany(t, queueA, 5, []string{"a", "b", "c"})
+	assertDequeueMany(t, queueB, 5, []string{"x"})
+}
+
+func TestTxnExpiredReservation(t *testing.T) {
+	optsA, optsB := txnQueueOptions(0)
+	optsA.VisibilityTimeout = 10 * time.Millisecond
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queueA.Enqueue("a")))
+
+	txn := koyori.NewTxn[string]()
+	_, err = txn.Dequeue(queueA)
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Enqueue(queueB, "a"))
+	time.Sleep(20 * time.Millisecond)
+	assert.ErrorIs(t, txn.Commit(), koyori.ErrDeliveryDone)
+	assert.Equal(t, 1, queueA.Len())
+	assert.Equal(t, 0, queueB.Len())
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+}
+
+func TestTxnItemsInMemoryLimits(t *testing.T) {
+	unmarshaled := 0
+	optsA, optsB := txnQueueOptions(0)
+	optsA.MaxObjectsPerSegment = 10
+	optsA.Converter = countingConverter{unmarshaled: &unmarshaled}
+	optsA.MaxInMemoryItems = 1
+	queueA, err := koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	queueB, err := koyori.NewQueue(optsB)
+	assert.Nil(t, err)
+
+	// Committed items are kept in memory only while MaxInMemoryItems allows.
+	txn := koyori.NewTxn[string]()
+	for _, item := range []string{"a", "b", "c"} {
+		assert.Nil(t, txn.Enqueue(queueA, item))
+	}
+	assert.Nil(t, txn.Commit())
+	assert.Nil(t, koyori.EnqueueFanout("d", queueA, queueB))
+	assertDequeueMany(t, queueA, 4, []string{"a", "b", "c", "d"})
+	assert.Equal(t, 3, unmarshaled)
+
+	// Loading the segment doesn't decode them.
+	assert.Nil(t, koyori.EnqueueFanout("e", queueA, queueB))
+	assert.Nil(t, queueA.Close())
+	unmarshaled = 0
+	queueA, err = koyori.NewQueue(optsA)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, unmarshaled)
+	assertDequeue(t, queueA, "e")
+	assert.Equal(t, 1, unmarshaled)
+	assert.Nil(t, queueA.Close())
+	assert.Nil(t, queueB.Close())
+}
@@ -1,6 +1,43 @@
 package koyori
 
+import "io"
+
 type Converter[T any] interface {
 	Marshal(obj T) ([]byte, error)
 	Unmarshal(data []byte) (T, error)
 }
+
+// IntoUnmarshaler can be implemented by a Converter to decode into an existing value.
+// When available, items loaded from disk are kept encoded and decoded straight into the
+// destination on dequeue, so DequeueInto and DequeueManyInto can reuse caller-owned values.
+type IntoUnmarshaler[T any] interface {
+	UnmarshalInto(data []byte, dst *T) error
+}
+
+// ViewUnmarshaler can be implemented by a Converter that doesn't keep the data it decodes from
+// once Unmarshal or UnmarshalInto returns. With QueueOptions.UseMmap, such converters are passed
+// a view of the mapped segment file instead of a copy of each item, if AcceptsViews is true.
+type ViewUnmarshaler interface {
+	AcceptsViews() bool
+}
+
+// StreamConverter can be implemented by a Converter to encode and decode items through a
+// stream, so large items aren't buffered twice. When available, it is used instead of Marshal
+// and Unmarshal: items are encoded straight into the segment's write buffer and, unless the
+// queue is compressed, decoded straight from the segment file.
+type StreamConverter[T any] interface {
+	MarshalTo(w io.Writer, obj T) error
+	UnmarshalFrom(r io.Reader) (T, error)
+}
+
+// VersionedConverter can be implemented by a Converter whose encoding changes over time. Items
+// are then stored with the schema version they were encoded with, and those of an earlier
+// version are passed to UnmarshalVersion instead of Unmarshal, so they stay readable after the
+// encoding changed. Compact rewrites them in the current version.
+type VersionedConverter[T any] interface {
+	// SchemaVersion is the version of the items Marshal encodes.
+	SchemaVersion() byte
+	// UnmarshalVersion decodes an item encoded with an earlier version. Items written before
+	// the converter was versioned have version 0.
+	UnmarshalVersion(version byte, data []byte) (T, error)
+}
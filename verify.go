@@ -0,0 +1,266 @@
+package koyori
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// VerifyReport describes the segment files checked by Verify.
+type VerifyReport struct {
+	// Segments is the number of segment files checked, including those of scheduled items.
+	Segments int
+	// Records is the number of records read, counting the items of a block one by one.
+	Records int
+	// Items is the number of items left in the segments.
+	Items    int
+	Problems []VerifyProblem
+}
+
+// OK reports whether no problems were found, or all of them were repaired.
+func (r VerifyReport) OK() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyProblem is a record that couldn't be read, or that doesn't fit with the ones before it.
+type VerifyProblem struct {
+	Segment int
+	Path    string
+	// Offset is where the record starts in the file.
+	Offset int64
+	Err    error
+	// Torn is set if the problem is at the end of the file, as left by a process that died
+	// while writing. Repair cuts such records off, as RecoveryTruncate does.
+	Torn bool
+	// Repaired is set if Repair cut the record off.
+	Repaired bool
+}
+
+// Verify reads every segment file of the queue in options.FolderPath, checking their headers,
+// the framing and checksums of their records, and that removals refer to items the segment
+// holds. Items are also decoded if options has a Converter. Nothing is modified, and the queue
+// may be open meanwhile, though the report may be out of date by the time it returns.
+//
+// Reading stops at the first problem of a segment that leaves the rest of it unreadable, such as
+// a corrupt block. The error is only set if the folder can't be read; problems are reported in
+// VerifyReport.Problems.
+func Verify[T any](options QueueOptions[T]) (VerifyReport, error) {
+	report := VerifyReport{}
+	headFile, err := readHeadFile(options.FolderPath, options.FileMode)
+	if err != nil {
+		return report, err
+	}
+	for _, folderPath := range []string{options.FolderPath, filepath.Join(options.FolderPath, scheduledFolder)} {
+		if _, err := os.Stat(folderPath); os.IsNotExist(err) && folderPath != options.FolderPath {
+			continue
+		}
+		numbers, err := listSegments(folderPath, options.SegmentNaming, options.logger())
+		if err != nil {
+			return report, errors.Wrap(err, "error while reading queue directory")
+		}
+		head := headFile.get()
+		if folderPath != options.FolderPath {
+			head = headPosition{}
+		}
+		for _, number := range numbers {
+			if err := verifySegment(&options, options.SegmentNaming.path(folderPath, number), number, head, &report); err != nil {
+				return report, errors.Wrapf(err, "failed to read segment (#%d)", number)
+			}
+		}
+	}
+	return report, nil
+}
+
+// Repair runs Verify with the queue folder locked, and cuts off the torn records it finds, as
+// loading the queue with RecoveryTruncate would. Other problems are left for the caller to
+// deal with, for example by loading the queue with RecoverySkip.
+func Repair[T any](options QueueOptions[T]) (VerifyReport, error) {
+	lockFile, err := acquireLock(context.Background(), options.FolderPath, fileModeFor(options.FileMode), options.LockTimeout)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer releaseLock(lockFile)
+
+	report, err := Verify(options)
+	if err != nil {
+		return report, err
+	}
+	for i := range report.Problems {
+		p := &report.Problems[i]
+		if !p.Torn {
+			continue
+		}
+		if err := os.Truncate(p.Path, p.Offset); err != nil {
+			return report, errors.Wrapf(err, "failed to truncate segment (#%d)", p.Segment)
+		}
+		p.Repaired = true
+	}
+	return report, nil
+}
+
+// verifySegment reads the records of a segment file, adding them and the problems found to
+// report, and leaves out the items in front of head if it is about the segment. Only failing to
+// open the file is returned as an error.
+func verifySegment[T any](options *QueueOptions[T], filePath string, number int, head headPosition, report *VerifyReport) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat file")
+	}
+	report.Segments++
+	problem := func(offset int64, err error, torn bool) {
+		report.Problems = append(report.Problems, VerifyProblem{Segment: number, Path: filePath, Offset: offset, Err: err, Torn: torn})
+	}
+
+	scanner, err := newRecordScanner(bufio.NewReader(file), number)
+	if err != nil {
+		problem(0, err, false)
+		return nil
+	}
+	scanner.maxLength = options.maxRecordSize()
+	converter, _ := options.converterFor(scanner.header)
+	// live holds the indexes of the items left, in order, and pending the number of items of
+	// each open transaction. Skipped items keep their index, as later records refer to the
+	// items by it, and lost holds them.
+	live := []int{}
+	lost := []int{}
+	nextIndex := 0
+	pending := map[uint64]int{}
+	find := func(index int) int {
+		pos := sort.SearchInts(live, index)
+		if pos == len(live) || live[pos] != index {
+			return -1
+		}
+		return pos
+	}
+	for {
+		record, err := scanner.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			skippable := scanner.skippable(err)
+			atTail := torn(err) || (skippable && scanner.offset == info.Size())
+			problem(scanner.recordStart, err, atTail)
+			if skippable && !atTail {
+				if scanner.recordKind == recordKindItem {
+					live = append(live, nextIndex)
+					lost = append(lost, nextIndex)
+					nextIndex++
+				}
+				continue
+			}
+			break
+		}
+		report.Records++
+
+		switch record.kind {
+		case scannedTombstone:
+			if len(live) == 0 {
+				problem(record.offset, scanner.corrupt(record.offset, "found deletion marker, but no objects are left"), false)
+				continue
+			}
+			live = live[1:]
+		case scannedItem:
+			if record.env.txnID != 0 {
+				pending[record.env.txnID]++
+			} else {
+				live = append(live, nextIndex)
+				nextIndex++
+			}
+			if converter == nil {
+				continue
+			}
+			data, err := decompress(scanner.header.compression, record.data)
+			if err == nil {
+				var obj T
+				err = decodeItem(converter, scanner.header.flags, data, &obj)
+			}
+			if err != nil {
+				problem(record.offset, errors.Wrap(err, "failed to decode item"), false)
+			}
+		case scannedControl:
+			switch record.control {
+			case controlTxnCommit, controlTxnAbort:
+				if len(record.data) != 8 {
+					continue
+				}
+				txnID := binary.LittleEndian.Uint64(record.data)
+				if record.control == controlTxnCommit {
+					for i := 0; i < pending[txnID]; i++ {
+						live = append(live, nextIndex)
+						nextIndex++
+					}
+				}
+				delete(pending, txnID)
+			case controlAck:
+				index, ok := decodeAckControl(record.data)
+				pos := -1
+				if ok {
+					pos = find(index)
+				}
+				if pos < 0 {
+					problem(record.offset, scanner.corrupt(record.offset, "found acknowledgement of unknown item %d", index), false)
+					continue
+				}
+				live = append(live[:pos], live[pos+1:]...)
+			case controlDrop:
+				count, ok := decodeDropControl(record.data)
+				if !ok || count > len(live) {
+					problem(record.offset, scanner.corrupt(record.offset, "found removal of %d items, but %d objects are left", count, len(live)), false)
+					continue
+				}
+				live = live[count:]
+			case controlReserve, controlReserveAs:
+				index, _, _, ok := decodeReserveControl(record.control, record.data)
+				if !ok || find(index) < 0 {
+					problem(record.offset, scanner.corrupt(record.offset, "found reservation of unknown item %d", index), false)
+				}
+			case controlTxnAck:
+				_, index, _, ok := decodeTxnAckControl(record.data)
+				if !ok || find(index) < 0 {
+					problem(record.offset, scanner.corrupt(record.offset, "found transactional acknowledgement of unknown item %d", index), false)
+				}
+			}
+		}
+	}
+	// Items in front of the head position were removed since the records and the footer were
+	// written.
+	applies := head.matches(number, scanner.header)
+	footer, hasFooter := readFooter(file, scanner.header.version, info.Size(), scanner.headerSize)
+	footerItems := 0
+	for _, e := range footer.entries {
+		if !applies || e.index >= head.index {
+			footerItems++
+		}
+	}
+	if applies {
+		live = live[sort.SearchInts(live, head.index):]
+	}
+	items := len(live)
+	for _, index := range lost {
+		if find(index) >= 0 {
+			items--
+		}
+	}
+	report.Items += items
+
+	if hasFooter && footerItems != len(live) {
+		offset := info.Size() - footer.bodyLength - int64(recordOverhead(scanner.header.version))
+		problem(offset, scanner.corrupt(offset, "footer lists %d items, but the records leave %d", footerItems, len(live)), false)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package koyori_test
+
+import (
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 3,
+	}
+	queue, err := koyori.NewQueue(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, enqueueErr(queue.EnqueueMany([]string{"a", "b", "c", "d", "e", "f", "g"})))
+	assert.Nil(t, enqueueErr(queue.EnqueueAfter("later", time.Hour)))
+	assertDequeue(t, queue, "a")
+
+	// The folder of an open queue can be verified.
+	report, err := koyori.Verify(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, report.Segments)
+	assert.Equal(t, 7, report.Items)
+	assert.Nil(t, queue.Close())
+
+	// A torn write at the end of the last segment
+	lastPath := filepath.Join(opts.FolderPath, "00003.queue.open")
+	file, err := os.OpenFile(lastPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{5, 0})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	// A bad checksum in the middle of a segment
+	firstPath := filepath.Join(opts.FolderPath, "00001.queue")
+	reader, err := koyori.OpenSegment[string](firstPath, nil)
+	assert.Nil(t, err)
+	record, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	data, err := os.ReadFile(firstPath)
+	assert.Nil(t, err)
+	data[record.Offset+4] ^= 0xff
+	assert.Nil(t, os.WriteFile(firstPath, data, os.ModePerm))
+
+	report, err = koyori.Verify(opts)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 2, len(report.Problems))
+	assert.Equal(t, 1, report.Problems[0].Segment)
+	assert.Equal(t, record.Offset, report.Problems[0].Offset)
+	assert.ErrorIs(t, report.Problems[0].Err, koyori.ErrCorrupt)
+	assert.False(t, report.Problems[0].Torn)
+	assert.Equal(t, lastPath, report.Problems[1].Path)
+	assert.True(t, report.Problems[1].Torn)
+	info, err := os.Stat(lastPath)
+	assert.Nil(t, err)
+	size := info.Size()
+
+	// Only the torn write is repaired.
+	report, err = koyori.Repair(opts)
+	assert.Nil(t, err)
+	assert.False(t, report.Problems[0].Repaired)
+	assert.True(t, report.Problems[1].Repaired)
+	info, err = os.Stat(lastPath)
+	assert.Nil(t, err)
+	assert.Equal(t, size-2, info.Size())
+	report, err = koyori.Verify(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Problems))
+}
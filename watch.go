@@ -0,0 +1,86 @@
+package koyori
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch returns a channel that receives a value when the producer may have added items, so that
+// the consumer process can wait for them rather than scan the folder over and over. Changes that
+// come while a value is waiting to be received are folded into it. The channel is closed once ctx
+// is done or the consumer is closed.
+//
+// On Linux, the queue folder is watched with inotify. Elsewhere, or if it can't be watched, the
+// folder is looked at every PollInterval. A value is only a hint: Dequeue may still return
+// ErrEmpty after it, such as for an item that is still being written.
+func (c *Consumer[T]) Watch(ctx context.Context) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-c.closed:
+		}
+	}()
+	watchFolder(ctx, c.options.FolderPath, c.options.SegmentNaming, c.pollInterval(), out)
+	return out
+}
+
+func (c *Consumer[T]) pollInterval() time.Duration {
+	if c.options.PollInterval > 0 {
+		return c.options.PollInterval
+	}
+	return waitPollInterval
+}
+
+// notifyChanged sends a value to out unless one is already waiting there.
+func notifyChanged(out chan<- struct{}) {
+	select {
+	case out <- struct{}{}:
+	default:
+	}
+}
+
+// folderState sums up the segment files of a queue folder, as far as the items a consumer can
+// dequeue are concerned: which segments there are, and the size of the last one, which the
+// producer appends to.
+type folderState struct {
+	first, last, count int
+	size               int64
+}
+
+func readFolderState(folderPath string, naming SegmentNaming) folderState {
+	segments, err := listSegments(folderPath, naming, nopLogger{})
+	if err != nil || len(segments) == 0 {
+		return folderState{}
+	}
+	state := folderState{first: segments[0], last: segments[len(segments)-1], count: len(segments)}
+	if info, err := os.Stat(naming.path(folderPath, state.last)); err == nil {
+		state.size = info.Size()
+	}
+	return state
+}
+
+// pollFolder sends to out whenever the state of the folder changed, looking at it every
+// interval, and closes out once ctx is done. Changes made after it returns are caught.
+func pollFolder(ctx context.Context, folderPath string, naming SegmentNaming, interval time.Duration, out chan<- struct{}) {
+	last := readFolderState(folderPath, naming)
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if state := readFolderState(folderPath, naming); state != last {
+					last = state
+					notifyChanged(out)
+				}
+			}
+		}
+	}()
+}
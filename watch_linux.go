@@ -0,0 +1,75 @@
+//go:build linux
+
+package koyori
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// watchFolder sends to out whenever inotify reports a segment file of the folder as written,
+// created, renamed or deleted, and closes out once ctx is done. Changes made after it returns
+// are caught. It falls back to pollFolder if the folder can't be watched.
+func watchFolder(ctx context.Context, folderPath string, naming SegmentNaming, interval time.Duration, out chan<- struct{}) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		pollFolder(ctx, folderPath, naming, interval, out)
+		return
+	}
+	mask := uint32(unix.IN_MODIFY | unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_DELETE)
+	if _, err := unix.InotifyAddWatch(fd, folderPath, mask); err != nil {
+		unix.Close(fd)
+		pollFolder(ctx, folderPath, naming, interval, out)
+		return
+	}
+	// The descriptor is non-blocking, so reads wait in the runtime poller, and closing the file
+	// ends them.
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				break
+			}
+			if segmentEvents(buf[:n], naming) {
+				notifyChanged(out)
+			}
+		}
+		if ctx.Err() != nil {
+			close(out)
+			return
+		}
+		// Changes may have been missed since the read failed.
+		notifyChanged(out)
+		pollFolder(ctx, folderPath, naming, interval, out)
+	}()
+}
+
+// segmentEvents reports whether any of the inotify events in buf is about a segment file, or
+// tells that events were lost.
+func segmentEvents(buf []byte, naming SegmentNaming) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + unix.SizeofInotifyEvent
+		offset = start + int(event.Len)
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			return true
+		}
+		if offset > len(buf) {
+			break
+		}
+		if _, ok := naming.parse(strings.TrimRight(string(buf[start:offset]), "\x00")); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package koyori
+
+import (
+	"context"
+	"time"
+)
+
+// watchFolder falls back to pollFolder, as the folder can't be watched outside of Linux.
+func watchFolder(ctx context.Context, folderPath string, naming SegmentNaming, interval time.Duration, out chan<- struct{}) {
+	pollFolder(ctx, folderPath, naming, interval, out)
+}
@@ -0,0 +1,70 @@
+package koyori_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jungnoh/koyori"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsumerWatch(t *testing.T) {
+	opts := koyori.QueueOptions[string]{
+		Converter:            StringConverter{},
+		FolderPath:           filepath.Join(os.TempDir(), fmt.Sprintf("%d", time.Now().UnixNano())),
+		FileMode:             os.ModePerm,
+		MaxObjectsPerSegment: 2,
+		PollInterval:         10 * time.Millisecond,
+	}
+	consumer, err := koyori.OpenConsumer(opts)
+	assert.Nil(t, err)
+	defer consumer.Close()
+	producer, err := koyori.OpenProducer(opts)
+	assert.Nil(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := consumer.Watch(ctx)
+	for _, item := range []string{"a", "b", "c"} {
+		assert.Nil(t, enqueueErr(producer.Enqueue(item)))
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			t.Fatal("no change seen after enqueue")
+		}
+		assertConsumerDequeue(t, consumer, item)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-changed:
+		for ok {
+			_, ok = <-changed
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel left open after cancel")
+	}
+
+	// Closing the consumer ends the watch as well.
+	changed = consumer.Watch(context.Background())
+	assert.Nil(t, consumer.Close())
+	select {
+	case _, ok := <-changed:
+		for ok {
+			_, ok = <-changed
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel left open after close")
+	}
+}
+
+func assertConsumerDequeue(t *testing.T, consumer *koyori.Consumer[string], expected string) {
+	t.Helper()
+	item, err := consumer.Dequeue()
+	if assert.Nil(t, err) {
+		assert.Equal(t, expected, *item)
+	}
+}